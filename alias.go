@@ -0,0 +1,142 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"sync/atomic"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// AliasChooser is an optional interface for a FileSystem with hard
+// links, choosing the path used for an inode with several known
+// names. paths has the most recently looked up name first, which is
+// the default. The choice is kept until a name of the inode or of one
+// of its ancestors changes.
+type AliasChooser interface {
+	ChooseAlias(paths []string) string
+}
+
+// maxAliasDepth bounds the parent walk of allPaths.
+const maxAliasDepth = 1024
+
+// allPaths returns the known paths of n, the path through its most
+// recent parent first.
+func (b *rawBridge) allPaths(n *inode) []string {
+	return b.pathsOf(n, 0, nil)
+}
+
+// pathsOf is allPaths, also appending the inodes walked through to
+// chain if it is not nil.
+func (b *rawBridge) pathsOf(n *inode, depth int, chain *[]pathLink) []string {
+	if n == b.root {
+		return []string{""}
+	}
+	if depth > maxAliasDepth {
+		return nil
+	}
+
+	n.mu.Lock()
+	pes := n.parents.newestFirst()
+	if chain != nil {
+		*chain = append(*chain, pathLink{n, atomic.LoadUint64(&n.pathEpoch)})
+	}
+	n.mu.Unlock()
+
+	var paths []string
+	for _, pe := range pes {
+		for _, p := range b.pathsOf(pe.node, depth+1, chain) {
+			paths = append(paths, childPathOf(p, pe.name))
+		}
+	}
+	return paths
+}
+
+// hasAliases reports whether n has more than one name.
+func (b *rawBridge) hasAliases(n *inode) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.parents.count() > 1
+}
+
+// chooseAlias returns the path of n picked by the AliasChooser, if
+// there is a choice to make, with the inodes it depends on. path and
+// chain are the ones of walkChain.
+func (b *rawBridge) chooseAlias(n *inode, path string, chain []pathLink) (string, []pathLink) {
+	ac, ok := b.fs.(AliasChooser)
+	if !ok || !b.hasAliases(n) {
+		return path, chain
+	}
+	var links []pathLink
+	paths := b.pathsOf(n, 0, &links)
+	chosen := ac.ChooseAlias(paths)
+	for _, p := range paths {
+		if p == chosen {
+			return chosen, links
+		}
+	}
+	b.logf("warning: ChooseAlias returned %q, not a known path of n%d", chosen, n.ino)
+	return path, links
+}
+
+// tryPaths calls op with the path of n and, while it fails with
+// ENOENT, with the other known paths of n. The names found gone are
+// dropped from the tree once another one works. During op,
+// Context.Paths returns the paths of n.
+func (b *rawBridge) tryPaths(ctx *Context, n *inode, op func(path string) fuse.Status) fuse.Status {
+	return b.tryFilePaths(ctx, n, "", op)
+}
+
+// tryFilePaths is tryPaths for an open file of n, starting with fpath,
+// the path of the file returned by inodeAndFile, if it has one.
+func (b *rawBridge) tryFilePaths(ctx *Context, n *inode, fpath string, op func(path string) fuse.Status) fuse.Status {
+	node := ctx.node
+	ctx.bridge, ctx.node = b, n
+	defer func() { ctx.node = node }()
+
+	path, code := b.fpathOf(n, fpath)
+	if !code.Ok() {
+		return code
+	}
+	code = op(path)
+	if code != fuse.ENOENT || !b.hasAliases(n) {
+		return code
+	}
+
+	gone := []string{path}
+	for _, alt := range b.allPaths(n) {
+		if alt == path {
+			continue
+		}
+		code = op(alt)
+		if code == fuse.ENOENT {
+			gone = append(gone, alt)
+			continue
+		}
+		if code.Ok() {
+			for _, p := range gone {
+				b.dropAlias(n, p)
+			}
+		}
+		return code
+	}
+	return fuse.ENOENT
+}
+
+// dropAlias removes the name of n at path from the tree.
+func (b *rawBridge) dropAlias(n *inode, path string) {
+	n.mu.Lock()
+	pes := n.parents.all()
+	n.mu.Unlock()
+
+	for _, pe := range pes {
+		pp, code := b.pathOf(pe.node)
+		if code.Ok() && childPathOf(pp, pe.name) == path {
+			b.logf("warning: n%d: dropping %q, which the FileSystem doesn't know", n.ino, path)
+			b.rmChild(pe.node, pe.name)
+			return
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package pathfs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// linkFileSystem knows the names in known, all hard links of n100.
+type linkFileSystem struct {
+	mockFileSystem
+	known    map[string]bool
+	accessed []string
+	paths    []string
+}
+
+func newLinkFileSystem(names ...string) *linkFileSystem {
+	fs := &linkFileSystem{known: map[string]bool{}}
+	for _, name := range names {
+		fs.known[name] = true
+	}
+	fs.getAttrFunc = func(path string) (fuse.Attr, fuse.Status) {
+		if !fs.known[path] {
+			return fuse.Attr{}, fuse.ENOENT
+		}
+		return fuse.Attr{Ino: 100, Mode: fuse.S_IFREG | 0644, Nlink: 2}, fuse.OK
+	}
+	return fs
+}
+
+func (l *linkFileSystem) Access(ctx *Context, path string, mask uint32) fuse.Status {
+	return l.access(ctx, path)
+}
+
+func (l *linkFileSystem) access(ctx *Context, path string) fuse.Status {
+	l.accessed = append(l.accessed, path)
+	l.paths = ctx.Paths()
+	if !l.known[path] {
+		return fuse.ENOENT
+	}
+	return fuse.OK
+}
+
+func (l *linkFileSystem) Chmod(ctx *Context, path string, uFh uint32, perms uint32) fuse.Status {
+	return l.access(ctx, path)
+}
+
+func (l *linkFileSystem) SetXAttr(ctx *Context, path string, attr string, data []byte, flags uint32) fuse.Status {
+	return l.access(ctx, path)
+}
+
+func (l *linkFileSystem) StatFs(ctx *Context, path string, out *fuse.StatfsOut) fuse.Status {
+	return l.access(ctx, path)
+}
+
+func (l *linkFileSystem) Read(ctx *Context, path string, uFh uint32, dest []byte, off uint64) (fuse.ReadResult, fuse.Status) {
+	return fuse.ReadResultData(nil), l.access(ctx, path)
+}
+
+type choosingFileSystem struct {
+	linkFileSystem
+	chosen int
+}
+
+func (c *choosingFileSystem) ChooseAlias(paths []string) string {
+	c.chosen++
+	return paths[len(paths)-1]
+}
+
+func TestAliasRetry(t *testing.T) {
+	fs := newLinkFileSystem("a", "b")
+	b := newMockBridge(&fs.mockFileSystem)
+	b.fs = fs
+
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "a", &fuse.EntryOut{})
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "b", &fuse.EntryOut{})
+
+	if code := b.Access(nil, &fuse.AccessIn{InHeader: fuse.InHeader{NodeId: 100}}); !code.Ok() {
+		t.Fatal(code)
+	}
+	if fmt.Sprint(fs.paths) != "[b a]" {
+		t.Errorf("want known paths [b a], have %v", fs.paths)
+	}
+
+	// b is gone behind the bridge's back: a is used instead.
+	delete(fs.known, "b")
+	fs.accessed = nil
+	if code := b.Access(nil, &fuse.AccessIn{InHeader: fuse.InHeader{NodeId: 100}}); !code.Ok() {
+		t.Fatalf("want OK through the other link, have %v", code)
+	}
+	if fmt.Sprint(fs.accessed) != "[b a]" {
+		t.Errorf("want b then a tried, have %v", fs.accessed)
+	}
+	if b.root.children["b"] != nil {
+		t.Error("want the stale name dropped")
+	}
+	if p, _ := b.pathOf(b.inode(100)); p != "a" {
+		t.Errorf("want path a, have %s", p)
+	}
+
+	// a real ENOENT stays one.
+	delete(fs.known, "a")
+	if code := b.Access(nil, &fuse.AccessIn{InHeader: fuse.InHeader{NodeId: 100}}); code != fuse.ENOENT {
+		t.Errorf("want ENOENT, have %v", code)
+	}
+}
+
+func TestAliasRetryOps(t *testing.T) {
+	fs := newLinkFileSystem("a", "b")
+	b := newMockBridge(&fs.mockFileSystem)
+	b.fs = fs
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "a", &fuse.EntryOut{})
+	fh := b.registerFile(fuse.Owner{}, 100, "", 0, nil)
+	node := fuse.InHeader{NodeId: 100}
+
+	ops := map[string]func() fuse.Status{
+		"SetAttr": func() fuse.Status {
+			in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{InHeader: node, Valid: fuse.FATTR_MODE}}
+			return b.SetAttr(nil, in, &fuse.AttrOut{})
+		},
+		"SetXAttr": func() fuse.Status {
+			return b.SetXAttr(nil, &fuse.SetXAttrIn{InHeader: node}, "user.x", nil)
+		},
+		"StatFs": func() fuse.Status {
+			return b.StatFs(nil, &node, &fuse.StatfsOut{})
+		},
+		"Read": func() fuse.Status {
+			_, code := b.Read(nil, &fuse.ReadIn{InHeader: node, Fh: uint64(fh)}, nil)
+			return code
+		},
+	}
+	for name, op := range ops {
+		// b is looked up last, then goes away behind the bridge's
+		// back.
+		fs.known["b"] = true
+		b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "b", &fuse.EntryOut{})
+		delete(fs.known, "b")
+		fs.accessed = nil
+
+		if code := op(); !code.Ok() {
+			t.Errorf("%s: want OK through the other link, have %v", name, code)
+		}
+		if fmt.Sprint(fs.accessed) != "[b a]" || fmt.Sprint(fs.paths) != "[b a]" {
+			t.Errorf("%s: want b then a tried, with known paths [b a], have %v and %v", name, fs.accessed, fs.paths)
+		}
+	}
+}
+
+func TestAliasChooser(t *testing.T) {
+	fs := &choosingFileSystem{linkFileSystem: *newLinkFileSystem("a", "b", "c")}
+	b := newMockBridge(&fs.mockFileSystem)
+	b.fs = fs
+
+	for _, name := range []string{"a", "b", "c"} {
+		b.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &fuse.EntryOut{})
+	}
+	// the chooser picks the oldest name over the newest.
+	if p, _ := b.pathOf(b.inode(100)); p != "a" {
+		t.Errorf("want path a, have %s", p)
+	}
+
+	// the choice is kept until a name changes.
+	b.pathOf(b.inode(100))
+	if fs.chosen != 1 {
+		t.Errorf("want one choice, have %d", fs.chosen)
+	}
+	b.rmChild(b.root, "a")
+	if p, _ := b.pathOf(b.inode(100)); p != "b" || fs.chosen != 2 {
+		t.Errorf("want path b chosen again, have %s after %d choices", p, fs.chosen)
+	}
+}
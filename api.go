@@ -10,6 +10,7 @@
 package pathfs
 
 import (
+	"fmt"
 	"log"
 	"time"
 
@@ -72,6 +73,60 @@ type FileSystem interface {
 	StatFs(ctx *Context, path string, out *fuse.StatfsOut) fuse.Status
 }
 
+// FileHandle is the per-open state of a file, returned by the
+// HandleFileSystem methods. Its methods replace the FileSystem file
+// methods for that handle; the FileSystem methods that remain in use
+// (Chmod, Utimens, ...) are called with uFh 0.
+type FileHandle interface {
+	Read(ctx *Context, dest []byte, off uint64) (result fuse.ReadResult, code fuse.Status)
+	Write(ctx *Context, data []byte, off uint64) (written uint32, code fuse.Status)
+	Flush(ctx *Context, lockOwner uint64) fuse.Status
+	Release(ctx *Context)
+}
+
+// HandleFileSystem is an optional interface for a FileSystem that
+// keeps per-open state in Go values instead of uint32 handles. If
+// implemented, FileSystem.Create and FileSystem.Open are not called.
+// Servers other than the bridge open files through OpenFile and
+// CreateFile, which serve either kind of FileSystem.
+type HandleFileSystem interface {
+	CreateHandle(ctx *Context, path string, flags uint32, mode uint32) (fh FileHandle, forceDIO bool, code fuse.Status)
+	OpenHandle(ctx *Context, path string, flags uint32) (fh FileHandle, keepCache, forceDIO bool, code fuse.Status)
+}
+
+// FileGetAttrer is an optional interface for a FileHandle, used
+// instead of FileSystem.GetAttr.
+type FileGetAttrer interface {
+	GetAttr(ctx *Context, out *fuse.Attr) fuse.Status
+}
+
+// FileFsyncer is an optional interface for a FileHandle, used instead
+// of FileSystem.Fsync.
+type FileFsyncer interface {
+	Fsync(ctx *Context, flags uint32) fuse.Status
+}
+
+// FileTruncater is an optional interface for a FileHandle, used
+// instead of FileSystem.Truncate.
+type FileTruncater interface {
+	Truncate(ctx *Context, size uint64) fuse.Status
+}
+
+// FileFallocater is an optional interface for a FileHandle, used
+// instead of FileSystem.Fallocate.
+type FileFallocater interface {
+	Fallocate(ctx *Context, off uint64, size uint64, mode uint32) fuse.Status
+}
+
+// Generationer is an optional interface for a FileSystem that reuses
+// inode numbers, reporting the generation of the file at path, like
+// the i_generation of local filesystems. When a known inode number
+// shows up with another generation (or file type), the bridge
+// replaces its node and bumps the generation in fuse.EntryOut.
+type Generationer interface {
+	Generation(ctx *Context, path string) (gen uint64, ok bool)
+}
+
 // Options sets options for the entire filesystem
 type Options struct {
 	// If set to nonnil, this defines the overall entry timeout
@@ -94,15 +149,73 @@ type Options struct {
 	// directories.
 	NullPermissions bool
 
+	// ModePolicy, if set, masks, forces or overrides per path the
+	// permission bits of the returned attrs, and applies a umask to
+	// the modes of new entries.
+	ModePolicy *ModePolicy
+
 	// If nonzero, replace default (zero) UID with the given UID
 	UID uint32
 
 	// If nonzero, replace default (zero) GID with the given GID
 	GID uint32
 
+	// UIDMap and GIDMap, if set, translate the ids of the FileSystem
+	// to the ids seen by the kernel, like the id maps of a user
+	// namespace: they apply to the attrs returned by GetAttr and
+	// Lookup, and in reverse to Chown and to Context.Caller. Ids
+	// without a mapping show up as 65534; chown to them fails with
+	// EINVAL. See LoadSubIDMap. UID and GID apply after the mapping.
+	UIDMap IDMap
+	GIDMap IDMap
+
+	// DefaultPermissions, if set, makes the bridge check the POSIX
+	// mode, owner and group of the GetAttr results against the
+	// caller (including its supplementary groups) before calling
+	// the FileSystem, like the default_permissions mount option
+	// does in the kernel. Access is answered by the bridge alone.
+	DefaultPermissions bool
+
+	// LocalLocks, if set, makes the bridge serve POSIX and BSD flock
+	// locks from an in-memory lock manager keyed by inode and lock
+	// owner, instead of calling the FileSystem lock methods. Use it
+	// for filesystems that don't implement locking. Mount enables
+	// lock support in the mount options accordingly.
+	LocalLocks bool
+
+	// SillyRename, if set, makes Unlink, and Rename over an
+	// existing file, rename a file that is still open to a hidden
+	// name in the same directory instead of removing it, so its open
+	// handles keep working as POSIX requires. The hidden file is
+	// removed at the last Release. This is what NFS clients do.
+	SillyRename bool
+
+	// RepairRestore, if set, makes Restore drop or re-parent
+	// inodes that fail validation instead of failing the whole
+	// restore. See RestoreReport.
+	RepairRestore bool
+
+	// InoAllocator, if set, assigns stable inode numbers by path
+	// when the FileSystem returns Ino 0.
+	InoAllocator *InoAllocator
+
 	// Logger is a sink for diagnostic messages. Diagnostic
 	// messages are printed under conditions where we cannot
 	// return error, but want to signal something seems off
 	// anyway. If unset, no messages are printed.
 	Logger *log.Logger
 }
+
+// Validate checks the id maps and the mode policy of the options.
+func (o *Options) Validate() error {
+	if err := o.UIDMap.Validate(); err != nil {
+		return fmt.Errorf("uid map: %v", err)
+	}
+	if err := o.GIDMap.Validate(); err != nil {
+		return fmt.Errorf("gid map: %v", err)
+	}
+	if p := o.ModePolicy; p != nil {
+		return p.Validate()
+	}
+	return nil
+}
@@ -0,0 +1,354 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// archiveEntry is a file of an archive. Hard links share an entry.
+type archiveEntry struct {
+	attr   fuse.Attr
+	target string // of symlinks
+
+	// children are the sorted names of a directory.
+	children []string
+
+	// The content of a regular file is one of: the attr.Size bytes at
+	// off of the archive; the stream of open; or data.
+	off  int64
+	open func() (io.ReadCloser, error)
+	data []byte
+}
+
+// archiveIndex builds the entries of an archive, in archive order.
+type archiveIndex struct {
+	entries map[string]*archiveEntry
+	names   map[string]map[string]bool // of directories
+	nextIno uint64
+}
+
+func newArchiveIndex() *archiveIndex {
+	x := &archiveIndex{
+		entries: make(map[string]*archiveEntry),
+		names:   make(map[string]map[string]bool),
+		nextIno: 2,
+	}
+	root := &archiveEntry{}
+	root.attr.Ino = 1
+	root.attr.Mode = syscall.S_IFDIR | 0755
+	root.attr.Nlink = 2
+	x.entries[""] = root
+	x.names[""] = make(map[string]bool)
+	return x
+}
+
+// archivePath cleans the name of an archive member, reporting false
+// for names outside the archive.
+func archivePath(name string) (string, bool) {
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", false
+		}
+	}
+	return path.Clean("/" + name)[1:], true
+}
+
+// dir returns the directory at p, adding it and its parents if they
+// are not in the archive.
+func (x *archiveIndex) dir(p string) *archiveEntry {
+	if e, ok := x.entries[p]; ok && e.attr.IsDir() {
+		return e
+	}
+	e := &archiveEntry{}
+	e.attr.Mode = syscall.S_IFDIR | 0755
+	x.add(p, e)
+	return e
+}
+
+// add puts e at p, replacing the entry there, as a later member of an
+// archive replaces an earlier one.
+func (x *archiveIndex) add(p string, e *archiveEntry) {
+	if p == "" {
+		// Only the attrs of the root can change.
+		if e.attr.IsDir() {
+			root := x.entries[""]
+			ino := root.attr.Ino
+			root.attr = e.attr
+			root.attr.Ino = ino
+		}
+		return
+	}
+	old, ok := x.entries[p]
+	switch {
+	case ok && old.attr.IsDir() && e.attr.IsDir():
+		ino := old.attr.Ino
+		old.attr = e.attr
+		old.attr.Ino = ino
+		return
+	case e.attr.Ino == 0:
+		e.attr.Ino = x.nextIno
+		x.nextIno++
+	}
+	if e.attr.Nlink == 0 {
+		e.attr.Nlink = 1
+	}
+	if e.attr.IsDir() {
+		x.names[p] = make(map[string]bool)
+	} else {
+		delete(x.names, p)
+	}
+	x.entries[p] = e
+	dir, name := path.Split(p)
+	dir = strings.TrimSuffix(dir, "/")
+	x.dir(dir)
+	x.names[dir][name] = true
+}
+
+// link adds a hard link at p to the entry at target.
+func (x *archiveIndex) link(p, target string) bool {
+	e, ok := x.entries[target]
+	if !ok || e.attr.IsDir() || p == "" || p == target {
+		return false
+	}
+	x.add(p, e)
+	e.attr.Nlink++
+	return true
+}
+
+// fileSystem returns the FileSystem of the entries.
+func (x *archiveIndex) fileSystem(r io.ReaderAt, closer io.Closer) *archiveFileSystem {
+	for p, names := range x.names {
+		e := x.entries[p]
+		e.children = make([]string, 0, len(names))
+		for name := range names {
+			e.children = append(e.children, name)
+		}
+		sort.Strings(e.children)
+		e.attr.Nlink = 2
+	}
+	for p, e := range x.entries {
+		if p != "" && e.attr.IsDir() {
+			x.entries[parentOf(p)].attr.Nlink++
+		}
+	}
+	return &archiveFileSystem{
+		r:       r,
+		closer:  closer,
+		entries: x.entries,
+		files:   make(map[uint32]*archiveFile),
+		nextFh:  1,
+	}
+}
+
+func parentOf(p string) string {
+	if i := strings.LastIndexByte(p, '/'); i >= 0 {
+		return p[:i]
+	}
+	return ""
+}
+
+// archiveFile is an open file whose content is a stream, read forward
+// and reopened to go back.
+type archiveFile struct {
+	mu  sync.Mutex
+	rc  io.ReadCloser
+	pos int64
+}
+
+// archiveFileSystem serves the entries of an archive.
+type archiveFileSystem struct {
+	readOnlyFileSystem
+	r       io.ReaderAt
+	closer  io.Closer
+	entries map[string]*archiveEntry
+
+	mu     sync.Mutex
+	files  map[uint32]*archiveFile
+	nextFh uint32
+}
+
+// Close releases the files of the FileSystem, such as the spool of
+// NewTarGzFileSystem.
+func (fsys *archiveFileSystem) Close() error {
+	if fsys.closer != nil {
+		return fsys.closer.Close()
+	}
+	return nil
+}
+
+func (fsys *archiveFileSystem) GetAttr(ctx *Context, path string, uFh uint32, out *fuse.Attr) fuse.Status {
+	e, ok := fsys.entries[path]
+	if !ok {
+		return fuse.ENOENT
+	}
+	*out = e.attr
+	return fuse.OK
+}
+
+func (fsys *archiveFileSystem) Access(ctx *Context, path string, mask uint32) fuse.Status {
+	if mask&permWrite != 0 {
+		return fuse.EROFS
+	}
+	if _, ok := fsys.entries[path]; !ok {
+		return fuse.ENOENT
+	}
+	return fuse.OK
+}
+
+func (fsys *archiveFileSystem) Readlink(ctx *Context, path string) (string, fuse.Status) {
+	e, ok := fsys.entries[path]
+	if !ok {
+		return "", fuse.ENOENT
+	}
+	if e.attr.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		return "", fuse.EINVAL
+	}
+	return e.target, fuse.OK
+}
+
+func (fsys *archiveFileSystem) Lsdir(ctx *Context, path string) ([]fuse.DirEntry, fuse.Status) {
+	e, ok := fsys.entries[path]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	if !e.attr.IsDir() {
+		return nil, fuse.ENOTDIR
+	}
+	stream := make([]fuse.DirEntry, 0, len(e.children))
+	for _, name := range e.children {
+		c := fsys.entries[childPathOf(path, name)]
+		stream = append(stream, fuse.DirEntry{
+			Name: name,
+			Mode: c.attr.Mode,
+			Ino:  c.attr.Ino,
+		})
+	}
+	return stream, fuse.OK
+}
+
+func (fsys *archiveFileSystem) Open(ctx *Context, path string, flags uint32) (uFh uint32, keepCache, forceDIO bool, code fuse.Status) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0 {
+		return 0, false, false, fuse.EROFS
+	}
+	e, ok := fsys.entries[path]
+	if !ok {
+		return 0, false, false, fuse.ENOENT
+	}
+	if e.attr.IsDir() {
+		return 0, false, false, fuse.Status(syscall.EISDIR)
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	uFh = fsys.nextFh
+	fsys.nextFh++
+	fsys.files[uFh] = &archiveFile{}
+	// The content never changes.
+	return uFh, true, false, fuse.OK
+}
+
+func (fsys *archiveFileSystem) Read(ctx *Context, path string, uFh uint32, dest []byte, off uint64) (fuse.ReadResult, fuse.Status) {
+	e, ok := fsys.entries[path]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	if off >= e.attr.Size {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	if rest := e.attr.Size - off; uint64(len(dest)) > rest {
+		dest = dest[:rest]
+	}
+	switch {
+	case e.data != nil:
+		return fuse.ReadResultData(e.data[off : off+uint64(len(dest))]), fuse.OK
+	case e.open == nil:
+		n, err := fsys.r.ReadAt(dest, e.off+int64(off))
+		if err != nil && err != io.EOF {
+			return nil, ioStatus(err)
+		}
+		return fuse.ReadResultData(dest[:n]), fuse.OK
+	}
+
+	fsys.mu.Lock()
+	f := fsys.files[uFh]
+	fsys.mu.Unlock()
+	if f == nil {
+		return nil, fuse.EBADF
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rc == nil || int64(off) < f.pos {
+		if f.rc != nil {
+			f.rc.Close()
+		}
+		rc, err := e.open()
+		if err != nil {
+			return nil, ioStatus(err)
+		}
+		f.rc, f.pos = rc, 0
+	}
+	n, err := io.CopyN(io.Discard, f.rc, int64(off)-f.pos)
+	f.pos += n
+	m := 0
+	if err == nil {
+		m, err = io.ReadFull(f.rc, dest)
+		f.pos += int64(m)
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, ioStatus(err)
+	}
+	return fuse.ReadResultData(dest[:m]), fuse.OK
+}
+
+func (fsys *archiveFileSystem) Flush(ctx *Context, path string, uFh uint32, lockOwner uint64) fuse.Status {
+	return fuse.OK
+}
+
+func (fsys *archiveFileSystem) Fsync(ctx *Context, path string, uFh uint32, flags uint32) fuse.Status {
+	return fuse.OK
+}
+
+func (fsys *archiveFileSystem) Release(ctx *Context, path string, uFh uint32) {
+	fsys.mu.Lock()
+	f := fsys.files[uFh]
+	delete(fsys.files, uFh)
+	fsys.mu.Unlock()
+	if f != nil && f.rc != nil {
+		f.rc.Close()
+	}
+}
+
+func (fsys *archiveFileSystem) GetXAttr(ctx *Context, path string, attr string) ([]byte, fuse.Status) {
+	return nil, fuse.ENOATTR
+}
+
+func (fsys *archiveFileSystem) ListXAttr(ctx *Context, path string) ([]string, fuse.Status) {
+	return nil, fuse.OK
+}
+
+func (fsys *archiveFileSystem) StatFs(ctx *Context, path string, out *fuse.StatfsOut) fuse.Status {
+	*out = fuse.StatfsOut{NameLen: 255, Bsize: 4096, Files: uint64(len(fsys.entries))}
+	return fuse.OK
+}
+
+// setArchiveTimes sets the times of attr, defaulting to mtime.
+func setArchiveTimes(attr *fuse.Attr, mtime, atime, ctime time.Time) {
+	if atime.IsZero() {
+		atime = mtime
+	}
+	if ctime.IsZero() {
+		ctime = mtime
+	}
+	attr.SetTimes(&atime, &mtime, &ctime)
+}
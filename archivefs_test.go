@@ -0,0 +1,232 @@
+package pathfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+var archiveTime = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// countingReaderAt counts the bytes read from a ReaderAt.
+type countingReaderAt struct {
+	r io.ReaderAt
+	n int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func newTestTar(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "dir/", Mode: 0750, ModTime: archiveTime},
+		{Typeflag: tar.TypeReg, Name: "dir/a.txt", Mode: 0640, Uid: 1000, Gid: 100, Size: 11, ModTime: archiveTime},
+		{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "dir/a.txt", Mode: 0777, ModTime: archiveTime},
+		{Typeflag: tar.TypeLink, Name: "hard", Linkname: "dir/a.txt"},
+		{Typeflag: tar.TypeReg, Name: "implicit/b.txt", Mode: 0644, Size: 3, ModTime: archiveTime},
+		{Typeflag: tar.TypeFifo, Name: "fifo", Mode: 0600, ModTime: archiveTime},
+		{Typeflag: tar.TypeReg, Name: "../escape", Mode: 0644, ModTime: archiveTime},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		switch hdr.Name {
+		case "dir/a.txt":
+			tw.Write([]byte("hello world"))
+		case "implicit/b.txt":
+			tw.Write([]byte("bbb"))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newTestZip(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	add := func(name string, mode fs.FileMode, method uint16, data string) {
+		hdr := &zip.FileHeader{Name: name, Method: method, Modified: archiveTime}
+		hdr.SetMode(mode)
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+	}
+	add("dir/", fs.ModeDir|0750, zip.Store, "")
+	add("dir/a.txt", 0640, zip.Deflate, "hello world")
+	add("stored.txt", 0600, zip.Store, "stored data")
+	add("link", fs.ModeSymlink|0777, zip.Store, "dir/a.txt")
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readArchiveFile(t *testing.T, fsys FileSystem, path string, off uint64, n int) string {
+	t.Helper()
+	fh, _, _, code := fsys.Open(nil, path, syscall.O_RDONLY)
+	if !code.Ok() {
+		t.Fatalf("Open %s: %v", path, code)
+	}
+	defer fsys.Release(nil, path, fh)
+	res, code := fsys.Read(nil, path, fh, make([]byte, n), off)
+	if !code.Ok() {
+		t.Fatalf("Read %s: %v", path, code)
+	}
+	data, _ := res.Bytes(nil)
+	return string(data)
+}
+
+func TestTarFileSystem(t *testing.T) {
+	data := newTestTar(t)
+	r := &countingReaderAt{r: bytes.NewReader(data)}
+	fsys, err := NewTarFileSystem(r, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var a, hard, dir, link, fifo, implicit fuse.Attr
+	for _, c := range []struct {
+		path string
+		attr *fuse.Attr
+	}{{"dir/a.txt", &a}, {"hard", &hard}, {"dir", &dir}, {"link", &link}, {"fifo", &fifo}, {"implicit", &implicit}} {
+		if code := fsys.GetAttr(nil, c.path, 0, c.attr); !code.Ok() {
+			t.Fatalf("GetAttr %s: %v", c.path, code)
+		}
+	}
+	if !a.IsRegular() || a.Mode&07777 != 0640 || a.Size != 11 || a.Uid != 1000 || a.Gid != 100 || a.Mtime != uint64(archiveTime.Unix()) {
+		t.Errorf("a.txt: %v", a)
+	}
+	if hard.Ino != a.Ino || a.Nlink != 2 {
+		t.Errorf("hard link: ino %d, %d; nlink %d", hard.Ino, a.Ino, a.Nlink)
+	}
+	if !dir.IsDir() || dir.Mode&07777 != 0750 || !implicit.IsDir() || fifo.Mode&syscall.S_IFMT != syscall.S_IFIFO {
+		t.Errorf("dir %v, implicit %v, fifo %v", dir, implicit, fifo)
+	}
+	if target, code := fsys.Readlink(nil, "link"); !code.Ok() || target != "dir/a.txt" || link.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		t.Errorf("link: %q %v %v", target, code, link)
+	}
+	if code := fsys.GetAttr(nil, "escape", 0, &a); code != fuse.ENOENT {
+		t.Errorf("escaping member: %v", code)
+	}
+	if code := fsys.Unlink(nil, "hard"); code != fuse.EROFS {
+		t.Errorf("Unlink: %v", code)
+	}
+
+	stream, code := fsys.Lsdir(nil, "")
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	var names []string
+	for _, e := range stream {
+		names = append(names, e.Name)
+	}
+	if want := "dir fifo hard implicit link"; strings.Join(names, " ") != want {
+		t.Errorf("Lsdir: %v", names)
+	}
+
+	// Reads go straight to the content.
+	before := atomic.LoadInt64(&r.n)
+	if got := readArchiveFile(t, fsys, "hard", 6, 100); got != "world" {
+		t.Errorf("Read: %q", got)
+	}
+	if n := atomic.LoadInt64(&r.n) - before; n != 5 {
+		t.Errorf("Read of 5 bytes read %d from the archive", n)
+	}
+
+	// Inode numbers are stable.
+	again, err := NewTarFileSystem(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b fuse.Attr
+	again.GetAttr(nil, "implicit/b.txt", 0, &b)
+	fsys.GetAttr(nil, "implicit/b.txt", 0, &a)
+	if a.Ino != b.Ino || a.Ino == 0 {
+		t.Errorf("ino %d, then %d", a.Ino, b.Ino)
+	}
+}
+
+func TestTarGzFileSystem(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(newTestTar(t))
+	zw.Close()
+
+	fsys, err := NewTarGzFileSystem(&buf, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fsys.(io.Closer).Close()
+	if got := readArchiveFile(t, fsys, "implicit/b.txt", 0, 100); got != "bbb" {
+		t.Errorf("Read: %q", got)
+	}
+}
+
+func TestZipFileSystem(t *testing.T) {
+	data := newTestZip(t)
+	fsys, err := NewZipFileSystem(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var a, dir, link fuse.Attr
+	fsys.GetAttr(nil, "dir/a.txt", 0, &a)
+	fsys.GetAttr(nil, "dir", 0, &dir)
+	fsys.GetAttr(nil, "link", 0, &link)
+	if !a.IsRegular() || a.Mode&07777 != 0640 || a.Size != 11 || a.Mtime != uint64(archiveTime.Unix()) {
+		t.Errorf("a.txt: %v", a)
+	}
+	if !dir.IsDir() || dir.Mode&07777 != 0750 || dir.Ino >= a.Ino {
+		t.Errorf("dir: %v", dir)
+	}
+	if target, code := fsys.Readlink(nil, "link"); !code.Ok() || target != "dir/a.txt" || link.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		t.Errorf("link: %q %v", target, code)
+	}
+
+	if got := readArchiveFile(t, fsys, "stored.txt", 7, 100); got != "data" {
+		t.Errorf("Read of a stored member: %q", got)
+	}
+
+	// A compressed member is read forward and restarted to go back.
+	fh, _, _, code := fsys.Open(nil, "dir/a.txt", syscall.O_RDONLY)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer fsys.Release(nil, "dir/a.txt", fh)
+	for _, c := range []struct {
+		off  uint64
+		n    int
+		want string
+	}{{6, 5, "world"}, {0, 5, "hello"}, {4, 3, "o w"}, {20, 5, ""}} {
+		res, code := fsys.Read(nil, "dir/a.txt", fh, make([]byte, c.n), c.off)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		if got, _ := res.Bytes(nil); string(got) != c.want {
+			t.Errorf("Read at %d: %q, want %q", c.off, got, c.want)
+		}
+	}
+
+	if _, _, _, code := fsys.Open(nil, "stored.txt", syscall.O_WRONLY); code != fuse.EROFS {
+		t.Errorf("Open for writing: %v", code)
+	}
+}
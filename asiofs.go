@@ -0,0 +1,460 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// maxSymlinks bounds the symlinks followed by Open and Stat, like
+// the MAXSYMLINKS of the kernel.
+const maxSymlinks = 40
+
+// IOFS exposes a FileSystem as a read-only fs.FS, without mounting
+// it. It implements fs.ReadDirFS, fs.StatFS and fs.ReadFileFS; its
+// files implement io.ReaderAt and io.Seeker, so it can be served with
+// http.FS. Symlinks in the last element of a name are followed, within
+// the FileSystem.
+//
+// The FileSystem is called with a Context for Caller that is never
+// canceled. Errors are *fs.PathError wrapping the syscall.Errno of the
+// failed call, so errors.Is(err, fs.ErrNotExist) and the like work.
+type IOFS struct {
+	FileSystem FileSystem
+	Caller     fuse.Caller
+}
+
+// NewIOFS returns an IOFS for fs, called as root.
+func NewIOFS(fs FileSystem) *IOFS {
+	return &IOFS{FileSystem: fs}
+}
+
+var (
+	_ fs.ReadDirFS  = (*IOFS)(nil)
+	_ fs.StatFS     = (*IOFS)(nil)
+	_ fs.ReadFileFS = (*IOFS)(nil)
+)
+
+func (f *IOFS) newContext() *Context {
+	ctx := newContext(nil, f.Caller)
+	ctx.Opener = &f.Caller.Owner
+	return ctx
+}
+
+// statusError turns a failed status into an error for op on name.
+func statusError(op, name string, code fuse.Status) error {
+	return &fs.PathError{Op: op, Path: name, Err: syscall.Errno(code)}
+}
+
+// fsPath turns an fs.FS name into a FileSystem path.
+func fsPath(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return "", nil
+	}
+	return name, nil
+}
+
+// fsMode converts a mode with S_IF* type bits to an fs.FileMode.
+func fsMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0777)
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		m |= fs.ModeDir
+	case syscall.S_IFLNK:
+		m |= fs.ModeSymlink
+	case syscall.S_IFIFO:
+		m |= fs.ModeNamedPipe
+	case syscall.S_IFSOCK:
+		m |= fs.ModeSocket
+	case syscall.S_IFCHR:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case syscall.S_IFBLK:
+		m |= fs.ModeDevice
+	}
+	if mode&syscall.S_ISUID != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
+
+// fileInfo is the fs.FileInfo of an attr.
+type fileInfo struct {
+	name string
+	attr fuse.Attr
+}
+
+func (fi *fileInfo) Name() string      { return fi.name }
+func (fi *fileInfo) Size() int64       { return int64(fi.attr.Size) }
+func (fi *fileInfo) Mode() fs.FileMode { return fsMode(fi.attr.Mode) }
+func (fi *fileInfo) ModTime() time.Time {
+	return time.Unix(int64(fi.attr.Mtime), int64(fi.attr.Mtimensec))
+}
+func (fi *fileInfo) IsDir() bool { return fi.attr.IsDir() }
+
+// Sys returns the *fuse.Attr.
+func (fi *fileInfo) Sys() interface{} { return &fi.attr }
+
+func newFileInfo(p string, attr *fuse.Attr) *fileInfo {
+	return &fileInfo{name: path.Base("/" + p), attr: *attr}
+}
+
+// resolve follows the symlinks at the end of p, returning the final
+// path and its attr.
+func (f *IOFS) resolve(ctx *Context, op, name, p string, attr *fuse.Attr) (string, error) {
+	for i := 0; ; i++ {
+		if code := f.FileSystem.GetAttr(ctx, p, 0, attr); !code.Ok() {
+			return "", statusError(op, name, code)
+		}
+		if attr.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+			return p, nil
+		}
+		if i == maxSymlinks {
+			return "", statusError(op, name, fuse.Status(syscall.ELOOP))
+		}
+		target, code := f.FileSystem.Readlink(ctx, p)
+		if !code.Ok() {
+			return "", statusError(op, name, code)
+		}
+		if path.IsAbs(target) {
+			return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+		}
+		p = path.Join(path.Dir(p), target)
+		if p == "." {
+			p = ""
+		} else if !fs.ValidPath(p) {
+			// escapes the root.
+			return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+		}
+	}
+}
+
+// Open implements fs.FS.
+func (f *IOFS) Open(name string) (fs.File, error) {
+	p, err := fsPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+	ctx := f.newContext()
+	defer releaseContext(ctx)
+
+	var attr fuse.Attr
+	if p, err = f.resolve(ctx, "open", name, p, &attr); err != nil {
+		return nil, err
+	}
+	file := &ioFSFile{fsys: f, name: name, path: p, attr: attr}
+	if attr.IsDir() {
+		return file, nil
+	}
+
+	var code fuse.Status
+	if file.file, _, _, code = OpenFile(ctx, f.FileSystem, p, syscall.O_RDONLY); !code.Ok() {
+		return nil, statusError("open", name, code)
+	}
+	return file, nil
+}
+
+// Stat implements fs.StatFS.
+func (f *IOFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := fsPath("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	ctx := f.newContext()
+	defer releaseContext(ctx)
+
+	var attr fuse.Attr
+	if p, err = f.resolve(ctx, "stat", name, p, &attr); err != nil {
+		return nil, err
+	}
+	return newFileInfo(p, &attr), nil
+}
+
+// Lstat is Stat without following a final symlink.
+func (f *IOFS) Lstat(name string) (fs.FileInfo, error) {
+	p, err := fsPath("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	ctx := f.newContext()
+	defer releaseContext(ctx)
+
+	var attr fuse.Attr
+	if code := f.FileSystem.GetAttr(ctx, p, 0, &attr); !code.Ok() {
+		return nil, statusError("lstat", name, code)
+	}
+	return newFileInfo(p, &attr), nil
+}
+
+// ReadLink returns the target of the symlink name.
+func (f *IOFS) ReadLink(name string) (string, error) {
+	p, err := fsPath("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	ctx := f.newContext()
+	defer releaseContext(ctx)
+
+	target, code := f.FileSystem.Readlink(ctx, p)
+	if !code.Ok() {
+		return "", statusError("readlink", name, code)
+	}
+	return target, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (f *IOFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := fsPath("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	ctx := f.newContext()
+	defer releaseContext(ctx)
+
+	var attr fuse.Attr
+	if p, err = f.resolve(ctx, "readdir", name, p, &attr); err != nil {
+		return nil, err
+	}
+	return f.readDir(ctx, name, p)
+}
+
+func (f *IOFS) readDir(ctx *Context, name, p string) ([]fs.DirEntry, error) {
+	stream, code := f.FileSystem.Lsdir(ctx, p)
+	if !code.Ok() {
+		return nil, statusError("readdir", name, code)
+	}
+	entries := make([]fs.DirEntry, 0, len(stream))
+	for _, e := range stream {
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+		entries = append(entries, &dirEntry{fsys: f, path: childPathOf(p, e.Name), e: e})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (f *IOFS) ReadFile(name string) ([]byte, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := file.(*ioFSFile)
+	if r.attr.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: syscall.EISDIR}
+	}
+	data := make([]byte, 0, r.attr.Size+1)
+	for {
+		if len(data) == cap(data) {
+			data = append(data, 0)[:len(data)]
+		}
+		n, err := r.Read(data[len(data):cap(data)])
+		data = data[:len(data)+n]
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// dirEntry is the fs.DirEntry of a fuse.DirEntry.
+type dirEntry struct {
+	fsys *IOFS
+	path string
+	e    fuse.DirEntry
+}
+
+func (d *dirEntry) Name() string      { return d.e.Name }
+func (d *dirEntry) IsDir() bool       { return d.e.Mode&syscall.S_IFMT == syscall.S_IFDIR }
+func (d *dirEntry) Type() fs.FileMode { return fsMode(d.e.Mode).Type() }
+
+func (d *dirEntry) Info() (fs.FileInfo, error) {
+	ctx := d.fsys.newContext()
+	defer releaseContext(ctx)
+
+	var attr fuse.Attr
+	if code := d.fsys.FileSystem.GetAttr(ctx, d.path, 0, &attr); !code.Ok() {
+		return nil, statusError("stat", d.e.Name, code)
+	}
+	return newFileInfo(d.path, &attr), nil
+}
+
+// ioFSFile is an open file or directory of an IOFS. Like an os.File,
+// it is not safe for concurrent use, except for ReadAt.
+type ioFSFile struct {
+	fsys *IOFS
+	name string
+	path string
+	attr fuse.Attr
+
+	file   *File
+	off    int64
+	closed bool
+
+	// for directories
+	entries []fs.DirEntry
+	listed  bool
+}
+
+var (
+	_ fs.ReadDirFile = (*ioFSFile)(nil)
+	_ io.ReaderAt    = (*ioFSFile)(nil)
+	_ io.Seeker      = (*ioFSFile)(nil)
+)
+
+func (f *ioFSFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+	ctx := f.fsys.newContext()
+	defer releaseContext(ctx)
+
+	var attr fuse.Attr
+	var code fuse.Status
+	if f.file != nil {
+		code = f.file.GetAttr(ctx, f.path, &attr)
+	} else {
+		code = f.fsys.FileSystem.GetAttr(ctx, f.path, 0, &attr)
+	}
+	if !code.Ok() {
+		return nil, statusError("stat", f.name, code)
+	}
+	return newFileInfo(f.path, &attr), nil
+}
+
+func (f *ioFSFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *ioFSFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	if f.attr.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	ctx := f.fsys.newContext()
+	defer releaseContext(ctx)
+
+	n := 0
+	for n < len(p) {
+		res, code := f.file.Read(ctx, f.path, p[n:], uint64(off)+uint64(n))
+		if !code.Ok() {
+			return n, statusError("read", f.name, code)
+		}
+		data, code := res.Bytes(p[n:])
+		m := copy(p[n:], data)
+		res.Done()
+		if !code.Ok() {
+			return n, statusError("read", f.name, code)
+		}
+		if m == 0 {
+			return n, io.EOF
+		}
+		n += m
+	}
+	return n, nil
+}
+
+func (f *ioFSFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset += fi.Size()
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (f *ioFSFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fs.ErrClosed}
+	}
+	if !f.attr.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	if !f.listed {
+		ctx := f.fsys.newContext()
+		entries, err := f.fsys.readDir(ctx, f.name, f.path)
+		releaseContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		f.entries, f.listed = entries, true
+	}
+
+	if n <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.entries) {
+		n = len(f.entries)
+	}
+	entries := f.entries[:n:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+func (f *ioFSFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	if f.attr.IsDir() {
+		return nil
+	}
+
+	ctx := f.fsys.newContext()
+	defer releaseContext(ctx)
+
+	if code := f.file.Close(ctx, f.path); !code.Ok() {
+		return statusError("close", f.name, code)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package pathfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestIOFS(t *testing.T) {
+	fsys := NewIOFS(NewIOFileSystem(newTestMapFS()))
+	if err := fstest.TestFS(fsys, "a.txt", "dir/b.txt", "link"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := fs.ReadFile(fsys, "link")
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("read through link: %q %v", data, err)
+	}
+	fi, err := fsys.Lstat("link")
+	if err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("lstat: %v %v", fi, err)
+	}
+}
+
+func TestIOFSErrors(t *testing.T) {
+	mock := &mockFileSystem{
+		getAttrFunc: func(path string) (fuse.Attr, fuse.Status) {
+			switch path {
+			case "":
+				return fuse.Attr{Mode: fuse.S_IFDIR | 0755}, fuse.OK
+			case "secret":
+				return fuse.Attr{}, fuse.EACCES
+			}
+			return fuse.Attr{}, fuse.ENOENT
+		},
+	}
+	fsys := NewIOFS(mock)
+
+	if _, err := fsys.Open("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("want ErrNotExist, have %v", err)
+	}
+	if _, err := fsys.Stat("secret"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("want ErrPermission, have %v", err)
+	}
+	if _, err := fsys.Open("../x"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("want ErrInvalid, have %v", err)
+	}
+}
+
+func TestIOFSSeek(t *testing.T) {
+	fsys := NewIOFS(NewIOFileSystem(newTestMapFS()))
+	f, err := fsys.Open("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	s := f.(io.ReadSeeker)
+	if off, err := s.Seek(-5, io.SeekEnd); err != nil || off != 6 {
+		t.Fatalf("seek: %d %v", off, err)
+	}
+	data, err := io.ReadAll(s)
+	if err != nil || string(data) != "world" {
+		t.Errorf("have %q %v", data, err)
+	}
+}
@@ -5,9 +5,11 @@
 package pathfs
 
 import (
+	"fmt"
 	"log"
 	"runtime/debug"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -26,9 +28,18 @@ type rawBridge struct {
 
 	files     []*fileEntry
 	freeFiles []uint32
+
+	// locks is set if Options.LocalLocks is.
+	locks *lockManager
+
+	// sillies maps the inodes silly-renamed by Options.SillyRename to
+	// their hidden path. Protected by mu.
+	sillies    map[uint64]string
+	sillyCount uint64
 }
 
-// NewPathFS creates a path based filesystem.
+// NewPathFS creates a path based filesystem. It panics if the options
+// are invalid; see Options.Validate.
 func NewPathFS(fs FileSystem, options *Options) fuse.RawFileSystem {
 	if options == nil {
 		oneSec := time.Second
@@ -37,6 +48,9 @@ func NewPathFS(fs FileSystem, options *Options) fuse.RawFileSystem {
 			AttrTimeout:  &oneSec,
 		}
 	}
+	if err := options.Validate(); err != nil {
+		log.Panicf("invalid options: %v", err)
+	}
 
 	b := &rawBridge{
 		fs:      fs,
@@ -51,6 +65,10 @@ func NewPathFS(fs FileSystem, options *Options) fuse.RawFileSystem {
 	// Fh 0 means no file handle.
 	b.files = []*fileEntry{{}}
 
+	if options.LocalLocks {
+		b.locks = newLockManager()
+	}
+
 	return b
 }
 
@@ -77,20 +95,27 @@ func (b *rawBridge) inodeSafe(ino uint64) *inode {
 	return b.nodes[ino]
 }
 
-func (b *rawBridge) inodeAndFile(ino uint64, fh uint32, ctx *Context) (*inode, *fileEntry) {
+// inodeAndFile returns the node ino, its open file fh and the path of
+// the file, which the file table keeps up to date under b.mu. EBADF is
+// returned if fh is not open on the node.
+func (b *rawBridge) inodeAndFile(ino uint64, fh uint32, ctx *Context) (*inode, *fileEntry, string, fuse.Status) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	n, f := b.nodes[ino], b.files[fh]
+	n := b.nodes[ino]
 	if n == nil {
 		log.Panicf("unknown node %d", ino)
 	}
-	if f == nil {
-		log.Panicf("unknown file %d", fh)
+	if int(fh) >= len(b.files) {
+		return n, nil, "", fuse.EBADF
 	}
+	f := b.files[fh]
 	if fh != 0 {
+		if f.ino != ino {
+			return n, nil, "", fuse.EBADF
+		}
 		ctx.Opener = &f.opener
 	}
-	return n, f
+	return n, f, f.path, fuse.OK
 }
 
 func (b *rawBridge) Init(s *fuse.Server) {}
@@ -109,23 +134,36 @@ func (b *rawBridge) NodeCount() int {
 func (b *rawBridge) SetDebug(debug bool) {}
 
 func (b *rawBridge) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.Status {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
 	n := b.inode(input.NodeId)
-	path := b.pathOf(n)
 
-	return b.fs.Access(ctx, path, input.Mask)
+	if b.options.DefaultPermissions {
+		// Never forward: an ENOSYS would make the kernel stop
+		// asking.
+		return b.checkPerm(ctx, n, input.Mask)
+	}
+
+	return b.tryPaths(ctx, n, func(path string) fuse.Status {
+		return b.fs.Access(ctx, path, input.Mask)
+	})
 }
 
 func (b *rawBridge) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
-	ctx := newContext(cancel, header.Caller)
+	ctx := b.newContext(cancel, header.Caller)
 	defer releaseContext(ctx)
 
 	parent := b.inode(header.NodeId)
-	path := childPathOf(b.pathOf(parent), name)
+	if code := b.checkPerm(ctx, parent, permExec); !code.Ok() {
+		return code
+	}
+	path, code := b.entryPath(parent, name)
+	if !code.Ok() {
+		return code
+	}
 
-	code := b.lookup(ctx, path, parent, name, out)
+	code = b.lookup(ctx, path, parent, name, out)
 	if !code.Ok() {
 		b.rmChild(parent, name)
 		if b.options.NegativeTimeout != nil {
@@ -141,10 +179,20 @@ func (b *rawBridge) lookup(ctx *Context, path string, parent *inode, name string
 	if !code.Ok() {
 		return code
 	}
+	if out.Attr.Ino == 0 && b.options.InoAllocator != nil {
+		out.Attr.Ino = b.synthIno(ctx, path)
+	}
 
-	child := b.addChild(parent, name, out.Attr.Ino, out.Attr.IsDir())
+	id := nodeIdent{fileType: out.Attr.Mode & syscall.S_IFMT}
+	if g, ok := b.fs.(Generationer); ok {
+		id.gen, _ = g.Generation(ctx, path)
+	}
+	child := b.addChildIdent(parent, name, out.Attr.Ino, out.Attr.IsDir(), id)
+	if child == nil {
+		return fuse.Status(syscall.ESTALE)
+	}
 
-	b.setEntryOut(child, out)
+	b.setEntryOut(child, path, out)
 	b.setEntryOutTimeout(out)
 	return fuse.OK
 }
@@ -183,46 +231,74 @@ func (b *rawBridge) compactMemory() {
 }
 
 func (b *rawBridge) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
-	n, f := b.inodeAndFile(input.NodeId, uint32(input.Fh()), ctx)
-	path := b.fpathOf(n, f)
-
-	return b.getAttr(ctx, path, f.uFh, out)
+	n, f, fpath, code := b.inodeAndFile(input.NodeId, uint32(input.Fh()), ctx)
+	if !code.Ok() {
+		return code
+	}
+	return b.tryFilePaths(ctx, n, fpath, func(path string) fuse.Status {
+		return b.getAttr(ctx, path, f, out)
+	})
 }
 
-func (b *rawBridge) getAttr(ctx *Context, path string, uFh uint32, out *fuse.AttrOut) fuse.Status {
-	code := b.fs.GetAttr(ctx, path, uFh, &out.Attr)
+func (b *rawBridge) getAttr(ctx *Context, path string, f *fileEntry, out *fuse.AttrOut) (code fuse.Status) {
+	if fga, ok := f.handle.(FileGetAttrer); ok {
+		code = fga.GetAttr(ctx, &out.Attr)
+	} else {
+		code = b.fs.GetAttr(ctx, path, f.uFh, &out.Attr)
+	}
 	if !code.Ok() {
 		return code
 	}
+	if out.Attr.Ino == 0 && b.options.InoAllocator != nil {
+		out.Attr.Ino = b.synthIno(ctx, path)
+	}
 
-	b.setAttr(out)
+	b.setAttr(path, out)
 	b.setAttrTimeout(out)
 	return fuse.OK
 }
 
 func (b *rawBridge) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) (code fuse.Status) {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
 	fh, _ := input.GetFh()
-	n, f := b.inodeAndFile(input.NodeId, uint32(fh), ctx)
-	path := b.fpathOf(n, f)
+	n, f, fpath, code := b.inodeAndFile(input.NodeId, uint32(fh), ctx)
+	if !code.Ok() {
+		return code
+	}
+	if code := b.checkSetAttr(ctx, n, input); !code.Ok() {
+		return code
+	}
 
+	return b.tryFilePaths(ctx, n, fpath, func(path string) fuse.Status {
+		return b.setAttrPath(ctx, path, f, input, out)
+	})
+}
+
+func (b *rawBridge) setAttrPath(ctx *Context, path string, f *fileEntry, input *fuse.SetAttrIn, out *fuse.AttrOut) (code fuse.Status) {
 	if perms, ok := input.GetMode(); ok {
 		code = b.fs.Chmod(ctx, path, f.uFh, perms)
 	}
 
 	uid, uok := input.GetUID()
 	gid, gok := input.GetGID()
+	if code.Ok() && (uok || gok) {
+		uid, gid, code = b.backendOwner(uid, gid, uok, gok)
+	}
 	if code.Ok() && (uok || gok) {
 		code = b.fs.Chown(ctx, path, f.uFh, uid, gid)
 	}
 
 	if sz, ok := input.GetSize(); code.Ok() && ok {
-		code = b.fs.Truncate(ctx, path, f.uFh, sz)
+		if ft, ok := f.handle.(FileTruncater); ok {
+			code = ft.Truncate(ctx, sz)
+		} else {
+			code = b.fs.Truncate(ctx, path, f.uFh, sz)
+		}
 	}
 
 	atime, aok := input.GetATime()
@@ -242,17 +318,23 @@ func (b *rawBridge) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *
 		return code
 	}
 
-	return b.getAttr(ctx, path, f.uFh, out)
+	return b.getAttr(ctx, path, f, out)
 }
 
 func (b *rawBridge) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
 	parent := b.inode(input.NodeId)
-	path := childPathOf(b.pathOf(parent), name)
+	if code := b.checkPerm(ctx, parent, permWrite|permExec); !code.Ok() {
+		return code
+	}
+	path, code := b.entryPath(parent, name)
+	if !code.Ok() {
+		return code
+	}
 
-	code := b.fs.Mknod(ctx, path, input.Mode, input.Rdev)
+	code = b.fs.Mknod(ctx, path, b.createMode(input.Mode), input.Rdev)
 	if !code.Ok() {
 		return code
 	}
@@ -261,13 +343,19 @@ func (b *rawBridge) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name stri
 }
 
 func (b *rawBridge) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
 	parent := b.inode(input.NodeId)
-	path := childPathOf(b.pathOf(parent), name)
+	if code := b.checkPerm(ctx, parent, permWrite|permExec); !code.Ok() {
+		return code
+	}
+	path, code := b.entryPath(parent, name)
+	if !code.Ok() {
+		return code
+	}
 
-	code := b.fs.Mkdir(ctx, path, input.Mode)
+	code = b.fs.Mkdir(ctx, path, b.createMode(input.Mode))
 	if !code.Ok() {
 		return code
 	}
@@ -276,32 +364,66 @@ func (b *rawBridge) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name stri
 }
 
 func (b *rawBridge) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
-	ctx := newContext(cancel, header.Caller)
+	ctx := b.newContext(cancel, header.Caller)
 	defer releaseContext(ctx)
 
 	parent := b.inode(header.NodeId)
-	path := childPathOf(b.pathOf(parent), name)
+	if code := b.checkPerm(ctx, parent, permWrite|permExec); !code.Ok() {
+		return code
+	}
+	if code := b.checkSticky(ctx, parent, name); !code.Ok() {
+		return code
+	}
+	path, code := b.entryPath(parent, name)
+	if !code.Ok() {
+		return code
+	}
 
-	code := b.fs.Unlink(ctx, path)
+	child := b.child(parent, name)
+	if b.needsSilly(child) {
+		if code := b.sillyRename(ctx, parent, child, path); !code.Ok() {
+			return code
+		}
+		b.rmChild(parent, name)
+		return fuse.OK
+	}
+
+	code = b.fs.Unlink(ctx, path)
 	if !code.Ok() {
 		return code
 	}
+	if a := b.options.InoAllocator; a != nil {
+		a.Remove(path)
+	}
 
 	b.rmChild(parent, name)
+	b.orphaned(ctx, child, path)
 	return fuse.OK
 }
 
 func (b *rawBridge) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
-	ctx := newContext(cancel, header.Caller)
+	ctx := b.newContext(cancel, header.Caller)
 	defer releaseContext(ctx)
 
 	parent := b.inode(header.NodeId)
-	path := childPathOf(b.pathOf(parent), name)
+	if code := b.checkPerm(ctx, parent, permWrite|permExec); !code.Ok() {
+		return code
+	}
+	if code := b.checkSticky(ctx, parent, name); !code.Ok() {
+		return code
+	}
+	path, code := b.entryPath(parent, name)
+	if !code.Ok() {
+		return code
+	}
 
-	code := b.fs.Rmdir(ctx, path)
+	code = b.fs.Rmdir(ctx, path)
 	if !code.Ok() {
 		return code
 	}
+	if a := b.options.InoAllocator; a != nil {
+		a.Remove(path)
+	}
 
 	b.rmChild(parent, name)
 	return fuse.OK
@@ -312,35 +434,82 @@ func (b *rawBridge) Rename(cancel <-chan struct{}, input *fuse.RenameIn, name st
 		return fuse.ENOSYS
 	}
 
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
 	parent := b.inode(input.NodeId)
-	path := childPathOf(b.pathOf(parent), name)
-
 	newParent := b.inode(input.Newdir)
-	newPath := childPathOf(b.pathOf(newParent), newName)
+	if code := b.checkRename(ctx, parent, name, newParent, newName); !code.Ok() {
+		return code
+	}
 
-	code := b.fs.Rename(ctx, path, newPath)
+	path, code := b.entryPath(parent, name)
+	if !code.Ok() {
+		return code
+	}
+	newPath, code := b.entryPath(newParent, newName)
 	if !code.Ok() {
 		return code
 	}
 
+	// an open target is hidden first, and put back if the rename
+	// fails.
+	var hidden string
+	dest := b.child(newParent, newName)
+	if dest != nil && dest != b.child(parent, name) && b.needsSilly(dest) {
+		if hidden, code = b.hideFile(ctx, newParent, dest, newPath); !code.Ok() {
+			return code
+		}
+	}
+
+	code = b.fs.Rename(ctx, path, newPath)
+	if !code.Ok() && hidden != "" {
+		if code := b.fs.Rename(ctx, hidden, newPath); !code.Ok() {
+			b.logf("warning: restoring %q from %q: %v", newPath, hidden, code)
+			b.hidden(ctx, dest, newPath, hidden)
+			b.rmChild(newParent, newName)
+		}
+	}
+	if !code.Ok() {
+		return code
+	}
+	if hidden != "" {
+		b.hidden(ctx, dest, newPath, hidden)
+		dest = nil
+	}
+	if a := b.options.InoAllocator; a != nil {
+		a.Rename(path, newPath)
+	}
+
 	b.mvChild(parent, name, newParent, newName, true)
+	b.renameFiles(path, newPath)
+	b.orphaned(ctx, dest, newPath)
 	return fuse.OK
 }
 
 func (b *rawBridge) Link(cancel <-chan struct{}, input *fuse.LinkIn, name string, out *fuse.EntryOut) fuse.Status {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
 	old := b.inode(input.Oldnodeid)
-	oldPath := b.pathOf(old)
-
 	parent := b.inode(input.NodeId)
-	path := childPathOf(b.pathOf(parent), name)
+	if code := b.checkPerm(ctx, parent, permWrite|permExec); !code.Ok() {
+		return code
+	}
+	path, code := b.entryPath(parent, name)
+	if !code.Ok() {
+		return code
+	}
 
-	code := b.fs.Link(ctx, oldPath, path)
+	code = b.tryPaths(ctx, old, func(oldPath string) fuse.Status {
+		code := b.fs.Link(ctx, oldPath, path)
+		if code.Ok() {
+			if a := b.options.InoAllocator; a != nil {
+				a.Link(oldPath, path)
+			}
+		}
+		return code
+	})
 	if !code.Ok() {
 		return code
 	}
@@ -349,13 +518,19 @@ func (b *rawBridge) Link(cancel <-chan struct{}, input *fuse.LinkIn, name string
 }
 
 func (b *rawBridge) Symlink(cancel <-chan struct{}, header *fuse.InHeader, target string, name string, out *fuse.EntryOut) fuse.Status {
-	ctx := newContext(cancel, header.Caller)
+	ctx := b.newContext(cancel, header.Caller)
 	defer releaseContext(ctx)
 
 	parent := b.inode(header.NodeId)
-	path := childPathOf(b.pathOf(parent), name)
+	if code := b.checkPerm(ctx, parent, permWrite|permExec); !code.Ok() {
+		return code
+	}
+	path, code := b.entryPath(parent, name)
+	if !code.Ok() {
+		return code
+	}
 
-	code := b.fs.Symlink(ctx, path, target)
+	code = b.fs.Symlink(ctx, path, target)
 	if !code.Ok() {
 		return code
 	}
@@ -364,24 +539,31 @@ func (b *rawBridge) Symlink(cancel <-chan struct{}, header *fuse.InHeader, targe
 }
 
 func (b *rawBridge) Readlink(cancel <-chan struct{}, header *fuse.InHeader) ([]byte, fuse.Status) {
-	ctx := newContext(cancel, header.Caller)
+	ctx := b.newContext(cancel, header.Caller)
 	defer releaseContext(ctx)
 
 	n := b.inode(header.NodeId)
-	path := b.pathOf(n)
-
-	target, code := b.fs.Readlink(ctx, path)
+	var target string
+	code := b.tryPaths(ctx, n, func(path string) (code fuse.Status) {
+		target, code = b.fs.Readlink(ctx, path)
+		return code
+	})
 	return []byte(target), code
 }
 
 func (b *rawBridge) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (uint32, fuse.Status) {
-	ctx := newContext(cancel, header.Caller)
+	ctx := b.newContext(cancel, header.Caller)
 	defer releaseContext(ctx)
 
 	n := b.inode(header.NodeId)
-	path := b.pathOf(n)
-
-	data, code := b.fs.GetXAttr(ctx, path, attr)
+	if code := b.checkPerm(ctx, n, permRead); !code.Ok() {
+		return 0, code
+	}
+	var data []byte
+	code := b.tryPaths(ctx, n, func(path string) (code fuse.Status) {
+		data, code = b.fs.GetXAttr(ctx, path, attr)
+		return code
+	})
 	if !code.Ok() {
 		return 0, code
 	}
@@ -396,13 +578,18 @@ func (b *rawBridge) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr
 }
 
 func (b *rawBridge) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
-	ctx := newContext(cancel, header.Caller)
+	ctx := b.newContext(cancel, header.Caller)
 	defer releaseContext(ctx)
 
 	n := b.inode(header.NodeId)
-	path := b.pathOf(n)
-
-	attrs, code := b.fs.ListXAttr(ctx, path)
+	if code := b.checkPerm(ctx, n, permRead); !code.Ok() {
+		return 0, code
+	}
+	var attrs []string
+	code := b.tryPaths(ctx, n, func(path string) (code fuse.Status) {
+		attrs, code = b.fs.ListXAttr(ctx, path)
+		return code
+	})
 	if !code.Ok() {
 		return 0, code
 	}
@@ -424,33 +611,62 @@ func (b *rawBridge) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, des
 }
 
 func (b *rawBridge) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
 	n := b.inode(input.NodeId)
-	path := b.pathOf(n)
-
-	return b.fs.SetXAttr(ctx, path, attr, data, input.Flags)
+	if code := b.checkPerm(ctx, n, permWrite); !code.Ok() {
+		return code
+	}
+	return b.tryPaths(ctx, n, func(path string) fuse.Status {
+		return b.fs.SetXAttr(ctx, path, attr, data, input.Flags)
+	})
 }
 
 func (b *rawBridge) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
-	ctx := newContext(cancel, header.Caller)
+	ctx := b.newContext(cancel, header.Caller)
 	defer releaseContext(ctx)
 
 	n := b.inode(header.NodeId)
-	path := b.pathOf(n)
-
-	return b.fs.RemoveXAttr(ctx, path, attr)
+	if code := b.checkPerm(ctx, n, permWrite); !code.Ok() {
+		return code
+	}
+	return b.tryPaths(ctx, n, func(path string) fuse.Status {
+		return b.fs.RemoveXAttr(ctx, path, attr)
+	})
 }
 
 func (b *rawBridge) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
 	parent := b.inode(input.NodeId)
-	path := childPathOf(b.pathOf(parent), name)
+	if code := b.checkPerm(ctx, parent, permWrite|permExec); !code.Ok() {
+		return code
+	}
+	path, code := b.entryPath(parent, name)
+	if !code.Ok() {
+		return code
+	}
+
+	if hfs, ok := b.fs.(HandleFileSystem); ok {
+		handle, forceDIO, code := hfs.CreateHandle(ctx, path, input.Flags, b.createMode(input.Mode))
+		if !code.Ok() {
+			return code
+		}
+		code = b.lookup(ctx, path, parent, name, &out.EntryOut)
+		if !code.Ok() {
+			handle.Release(ctx)
+			return code
+		}
+		if forceDIO {
+			out.OpenFlags |= fuse.FOPEN_DIRECT_IO
+		}
+		out.Fh = uint64(b.registerHandle(ctx.Caller.Owner, out.NodeId, path, handle))
+		return fuse.OK
+	}
 
-	uFh, forceDIO, code := b.fs.Create(ctx, path, input.Flags, input.Mode)
+	uFh, forceDIO, code := b.fs.Create(ctx, path, input.Flags, b.createMode(input.Mode))
 	if !code.Ok() {
 		return code
 	}
@@ -461,23 +677,39 @@ func (b *rawBridge) Create(cancel <-chan struct{}, input *fuse.CreateIn, name st
 	if forceDIO {
 		out.OpenFlags |= fuse.FOPEN_DIRECT_IO
 	}
-	out.Fh = uint64(b.registerFile(input.Caller.Owner, path, uFh, nil))
+	out.Fh = uint64(b.registerFile(ctx.Caller.Owner, out.NodeId, path, uFh, nil))
 	return fuse.OK
 }
 
 func (b *rawBridge) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
 	n := b.inode(input.NodeId)
-	path := b.pathOf(n)
-
-	uFh, keepCache, forceDIO, code := b.fs.Open(ctx, path, input.Flags)
+	if code := b.checkPerm(ctx, n, openMask(input.Flags)); !code.Ok() {
+		return code
+	}
+	var keepCache, forceDIO bool
+	code := b.tryPaths(ctx, n, func(path string) (code fuse.Status) {
+		if hfs, ok := b.fs.(HandleFileSystem); ok {
+			var handle FileHandle
+			handle, keepCache, forceDIO, code = hfs.OpenHandle(ctx, path, input.Flags)
+			if code.Ok() {
+				out.Fh = uint64(b.registerHandle(ctx.Caller.Owner, n.ino, path, handle))
+			}
+		} else {
+			var uFh uint32
+			uFh, keepCache, forceDIO, code = b.fs.Open(ctx, path, input.Flags)
+			if code.Ok() {
+				out.Fh = uint64(b.registerFile(ctx.Caller.Owner, n.ino, path, uFh, nil))
+			}
+		}
+		return code
+	})
 	if !code.Ok() {
 		return code
 	}
 
-	out.Fh = uint64(b.registerFile(input.Caller.Owner, path, uFh, nil))
 	if forceDIO {
 		out.OpenFlags |= fuse.FOPEN_DIRECT_IO
 	} else if keepCache {
@@ -487,124 +719,209 @@ func (b *rawBridge) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.O
 }
 
 func (b *rawBridge) Read(cancel <-chan struct{}, input *fuse.ReadIn, dest []byte) (fuse.ReadResult, fuse.Status) {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
-	n, f := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
-	path := b.fpathOf(n, f)
+	n, f, fpath, code := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
+	if !code.Ok() {
+		return nil, code
+	}
 
-	return b.fs.Read(ctx, path, f.uFh, dest, input.Offset)
+	var res fuse.ReadResult
+	code = b.tryFilePaths(ctx, n, fpath, func(path string) (code fuse.Status) {
+		if f.handle != nil {
+			res, code = f.handle.Read(ctx, dest, input.Offset)
+		} else {
+			res, code = b.fs.Read(ctx, path, f.uFh, dest, input.Offset)
+		}
+		return code
+	})
+	return res, code
 }
 
 func (b *rawBridge) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (written uint32, status fuse.Status) {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
-	n, f := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
-	path := b.fpathOf(n, f)
+	n, f, fpath, code := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
+	if !code.Ok() {
+		return 0, code
+	}
 
-	return b.fs.Write(ctx, path, f.uFh, data, input.Offset)
+	code = b.tryFilePaths(ctx, n, fpath, func(path string) (code fuse.Status) {
+		if f.handle != nil {
+			written, code = f.handle.Write(ctx, data, input.Offset)
+		} else {
+			written, code = b.fs.Write(ctx, path, f.uFh, data, input.Offset)
+		}
+		return code
+	})
+	return written, code
 }
 
 func (b *rawBridge) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) fuse.Status {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
-	n, f := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
-	path := b.fpathOf(n, f)
+	n, f, fpath, code := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
+	if !code.Ok() {
+		return code
+	}
 
-	return b.fs.Fallocate(ctx, path, f.uFh, input.Offset, input.Length, input.Mode)
+	return b.tryFilePaths(ctx, n, fpath, func(path string) fuse.Status {
+		if ffa, ok := f.handle.(FileFallocater); ok {
+			return ffa.Fallocate(ctx, input.Offset, input.Length, input.Mode)
+		}
+		return b.fs.Fallocate(ctx, path, f.uFh, input.Offset, input.Length, input.Mode)
+	})
 }
 
 func (b *rawBridge) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
-	n, f := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
-	path := b.fpathOf(n, f)
+	n, f, fpath, code := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
+	if !code.Ok() {
+		return code
+	}
 
-	return b.fs.Fsync(ctx, path, f.uFh, input.FsyncFlags)
+	return b.tryFilePaths(ctx, n, fpath, func(path string) fuse.Status {
+		if ffs, ok := f.handle.(FileFsyncer); ok {
+			return ffs.Fsync(ctx, input.FsyncFlags)
+		}
+		return b.fs.Fsync(ctx, path, f.uFh, input.FsyncFlags)
+	})
 }
 
 func (b *rawBridge) Flush(cancel <-chan struct{}, input *fuse.FlushIn) fuse.Status {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
-	n, f := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
-	path := b.fpathOf(n, f)
+	n, f, fpath, code := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
+	if !code.Ok() {
+		return code
+	}
 
-	return b.fs.Flush(ctx, path, f.uFh, input.LockOwner)
+	if b.locks != nil {
+		// close() drops the POSIX locks of the owner.
+		b.locks.ReleaseOwner(n.ino, input.LockOwner, false)
+	}
+
+	return b.tryFilePaths(ctx, n, fpath, func(path string) fuse.Status {
+		if f.handle != nil {
+			return f.handle.Flush(ctx, input.LockOwner)
+		}
+		return b.fs.Flush(ctx, path, f.uFh, input.LockOwner)
+	})
 }
 
 func (b *rawBridge) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
-	n, f := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
-	path := b.fpathOf(n, f)
+	n, f, fpath, code := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
+	if !code.Ok() {
+		b.logf("warning: release of fh%d on n%d: %v", input.Fh, input.NodeId, code)
+		return
+	}
+	// the file is released once, even if its path is gone.
+	path, _ := b.fpathOf(n, fpath)
+	ctx.bridge, ctx.node = b, n
+
+	if b.locks != nil && input.ReleaseFlags&releaseFlockUnlock != 0 {
+		b.locks.ReleaseOwner(n.ino, input.LockOwner, true)
+	}
 
-	b.fs.Release(ctx, path, f.uFh)
+	if f.handle != nil {
+		f.handle.Release(ctx)
+	} else {
+		b.fs.Release(ctx, path, f.uFh)
+	}
 
 	b.unregisterFile(uint32(input.Fh))
+	b.releaseSilly(ctx, n.ino)
 }
 
 func (b *rawBridge) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.LkOut) fuse.Status {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
-	n, f := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
-	path := b.fpathOf(n, f)
+	n, f, fpath, code := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
+	if !code.Ok() {
+		return code
+	}
 
-	return b.fs.GetLk(ctx, path, f.uFh, input.Owner, &input.Lk, input.LkFlags, &out.Lk)
+	if b.locks != nil {
+		return b.locks.GetLk(n.ino, input.Owner, &input.Lk, input.LkFlags, &out.Lk)
+	}
+	return b.tryFilePaths(ctx, n, fpath, func(path string) fuse.Status {
+		return b.fs.GetLk(ctx, path, f.uFh, input.Owner, &input.Lk, input.LkFlags, &out.Lk)
+	})
 }
 
 func (b *rawBridge) SetLk(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
-	n, f := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
-	path := b.fpathOf(n, f)
+	n, f, fpath, code := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
+	if !code.Ok() {
+		return code
+	}
 
-	return b.fs.SetLk(ctx, path, f.uFh, input.Owner, &input.Lk, input.LkFlags)
+	if b.locks != nil {
+		return b.locks.SetLk(n.ino, input.Owner, &input.Lk, input.LkFlags)
+	}
+	return b.tryFilePaths(ctx, n, fpath, func(path string) fuse.Status {
+		return b.fs.SetLk(ctx, path, f.uFh, input.Owner, &input.Lk, input.LkFlags)
+	})
 }
 
 func (b *rawBridge) SetLkw(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
-	n, f := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
-	path := b.fpathOf(n, f)
+	n, f, fpath, code := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
+	if !code.Ok() {
+		return code
+	}
 
-	return b.fs.SetLkw(ctx, path, f.uFh, input.Owner, &input.Lk, input.LkFlags)
+	if b.locks != nil {
+		return b.locks.SetLkw(ctx, n.ino, input.Owner, &input.Lk, input.LkFlags)
+	}
+	return b.tryFilePaths(ctx, n, fpath, func(path string) fuse.Status {
+		return b.fs.SetLkw(ctx, path, f.uFh, input.Owner, &input.Lk, input.LkFlags)
+	})
 }
 
 func (b *rawBridge) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
-	n := b.inode(input.NodeId)
-	path := b.pathOf(n)
+	ctx := b.newContext(cancel, input.Caller)
+	defer releaseContext(ctx)
 
-	out.Fh = uint64(b.registerFile(input.Caller.Owner, path, 0, nil))
-	return fuse.OK
+	n := b.inode(input.NodeId)
+	if code := b.checkPerm(ctx, n, permRead); !code.Ok() {
+		return code
+	}
+	return b.tryPaths(ctx, n, func(path string) fuse.Status {
+		out.Fh = uint64(b.registerFile(ctx.Caller.Owner, n.ino, path, 0, nil))
+		return fuse.OK
+	})
 }
 
 func (b *rawBridge) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
-	n, d := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
-	path := b.fpathOf(n, d)
+	n, d, fpath, code := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
+	if !code.Ok() {
+		return code
+	}
 
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	// rewinddir() should be as if reopening directory.
-	if d.stream == nil || input.Offset == 0 {
-		stream, code := b.fs.Lsdir(ctx, path)
-		if !code.Ok() {
-			return code
-		}
-		d.stream = append(stream,
-			fuse.DirEntry{Mode: fuse.S_IFDIR, Name: "."},
-			fuse.DirEntry{Mode: fuse.S_IFDIR, Name: ".."})
+	path, code := b.fillStream(ctx, n, d, fpath, input.Offset)
+	if !code.Ok() {
+		return code
 	}
 
 	if input.Offset > uint64(len(d.stream)) {
@@ -621,6 +938,9 @@ func (b *rawBridge) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fus
 			b.logf("warning: got empty directory entry, mode %o.", e.Mode)
 			continue
 		}
+		if e.Ino == 0 && b.options.InoAllocator != nil && e.Name != "." && e.Name != ".." {
+			e.Ino = b.synthIno(ctx, childPathOf(path, e.Name))
+		}
 
 		ok := out.AddDirEntry(e)
 		if !ok {
@@ -631,23 +951,20 @@ func (b *rawBridge) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fus
 }
 
 func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
-	n, d := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
-	path := b.fpathOf(n, d)
+	n, d, fpath, code := b.inodeAndFile(input.NodeId, uint32(input.Fh), ctx)
+	if !code.Ok() {
+		return code
+	}
 
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	if d.stream == nil || input.Offset == 0 {
-		stream, code := b.fs.Lsdir(ctx, path)
-		if !code.Ok() {
-			return code
-		}
-		d.stream = append(stream,
-			fuse.DirEntry{Mode: fuse.S_IFDIR, Name: "."},
-			fuse.DirEntry{Mode: fuse.S_IFDIR, Name: ".."})
+	path, code := b.fillStream(ctx, n, d, fpath, input.Offset)
+	if !code.Ok() {
+		return code
 	}
 
 	if input.Offset > uint64(len(d.stream)) {
@@ -659,6 +976,9 @@ func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out
 			b.logf("warning: got empty directory entry, mode %o.", e.Mode)
 			continue
 		}
+		if e.Ino == 0 && b.options.InoAllocator != nil && e.Name != "." && e.Name != ".." {
+			e.Ino = b.synthIno(ctx, childPathOf(path, e.Name))
+		}
 
 		// we have to be sure entry will fit if we try to add
 		// it, or we'll mess up the lookup counts.
@@ -676,6 +996,28 @@ func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out
 	return fuse.OK
 }
 
+// fillStream lists the directory n into the stream of its open file d
+// at offset 0, or if it has none yet. It returns the path of n. Call it
+// with d.mu held.
+func (b *rawBridge) fillStream(ctx *Context, n *inode, d *fileEntry, fpath string, off uint64) (path string, code fuse.Status) {
+	code = b.tryFilePaths(ctx, n, fpath, func(p string) fuse.Status {
+		path = p
+		// rewinddir() should be as if reopening directory.
+		if d.stream != nil && off != 0 {
+			return fuse.OK
+		}
+		stream, code := b.fs.Lsdir(ctx, p)
+		if !code.Ok() {
+			return code
+		}
+		d.stream = append(stream,
+			fuse.DirEntry{Mode: fuse.S_IFDIR, Name: "."},
+			fuse.DirEntry{Mode: fuse.S_IFDIR, Name: ".."})
+		return fuse.OK
+	})
+	return path, code
+}
+
 func (b *rawBridge) ReleaseDir(input *fuse.ReleaseIn) {
 	b.unregisterFile(uint32(input.Fh))
 }
@@ -693,30 +1035,69 @@ func (b *rawBridge) CopyFileRange(cancel <-chan struct{}, input *fuse.CopyFileRa
 }
 
 func (b *rawBridge) StatFs(cancel <-chan struct{}, input *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
-	ctx := newContext(cancel, input.Caller)
+	ctx := b.newContext(cancel, input.Caller)
 	defer releaseContext(ctx)
 
 	n := b.inode(input.NodeId)
-	path := b.pathOf(n)
-
-	return b.fs.StatFs(ctx, path, out)
+	return b.tryPaths(ctx, n, func(path string) fuse.Status {
+		return b.fs.StatFs(ctx, path, out)
+	})
 }
 
 func (b *rawBridge) Dump() (data *DumpRawBridge, iterator InodeIterator, err error) {
+	b.mu.Lock()
 	files := make([]*DumpFileEntry, len(b.files))
+	handles := make([]FileHandle, len(b.files))
 	for i, f := range b.files {
 		files[i] = &DumpFileEntry{
 			Opener: f.opener,
+			Ino:    f.ino,
 			Path:   f.path,
 			UFh:    f.uFh,
 			Stream: f.stream,
 		}
+		handles[i] = f.handle
+	}
+	freeFiles := append([]uint32(nil), b.freeFiles...)
+	var sillies map[uint64]string
+	if b.sillies != nil {
+		sillies = make(map[uint64]string, len(b.sillies))
+		for ino, path := range b.sillies {
+			sillies[ino] = path
+		}
+	}
+	b.mu.Unlock()
+
+	for i, h := range handles {
+		if h == nil {
+			continue
+		}
+		hd, ok := h.(FileHandleDumper)
+		if !ok {
+			return nil, nil, fmt.Errorf("file handle %d is not a FileHandleDumper", i)
+		}
+		if files[i].Handle, err = hd.DumpHandle(); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	data = &DumpRawBridge{
 		NodeCount: b.NodeCount(),
 		Files:     files,
-		FreeFiles: b.freeFiles,
+		FreeFiles: freeFiles,
+		Sillies:   sillies,
+	}
+
+	if d, ok := b.fs.(StateDumper); ok {
+		data.FSState, err = d.DumpState()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if a := b.options.InoAllocator; a != nil {
+		if data.InoTable, err = a.MarshalBinary(); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	inodeIterator := NewInodeDumper(b.nodes)
@@ -726,18 +1107,50 @@ func (b *rawBridge) Dump() (data *DumpRawBridge, iterator InodeIterator, err err
 }
 
 func (b *rawBridge) Restore(data *DumpRawBridge) (filler InodeFiller, err error) {
+	if data.FSState != nil {
+		d, ok := b.fs.(StateDumper)
+		if !ok {
+			return nil, errStateNotRestorable
+		}
+		if err = d.RestoreState(data.FSState); err != nil {
+			return nil, err
+		}
+	}
+
+	if data.InoTable != nil {
+		if a := b.options.InoAllocator; a != nil {
+			if err = a.UnmarshalBinary(data.InoTable); err != nil {
+				return nil, err
+			}
+		} else {
+			b.logf("restore: dump has an inode table but no InoAllocator is set")
+		}
+	}
+
 	b.nodes = map[uint64]*inode{}
 	files := make([]*fileEntry, len(data.Files))
 	for i, v := range data.Files {
 		files[i] = &fileEntry{
 			opener: v.Opener,
+			ino:    v.Ino,
 			path:   v.Path,
 			uFh:    v.UFh,
 			stream: v.Stream,
 		}
+		if v.Handle == nil {
+			continue
+		}
+		hr, ok := b.fs.(HandleRestorer)
+		if !ok {
+			return nil, errHandleNotRestorable
+		}
+		if files[i].handle, err = hr.RestoreHandle(v.Path, v.Handle); err != nil {
+			return nil, err
+		}
 	}
 	b.files = files
 	b.freeFiles = data.FreeFiles
+	b.sillies = data.Sillies
 
 	return &InodeRestorer{
 		bridge:    b,
@@ -0,0 +1,51 @@
+package pathfs
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// GetAttrIn carries the file handle on linux only.
+func TestGetAttrFh(t *testing.T) {
+	mock := &mockHandleFileSystem{
+		mockFileSystem: mockFileSystem{
+			getAttrFunc: func(path string) (fuse.Attr, fuse.Status) {
+				if path == "g" {
+					return fuse.Attr{Ino: 101, Mode: fuse.S_IFREG | 0644}, fuse.OK
+				}
+				return fuse.Attr{Ino: 100, Mode: fuse.S_IFREG | 0644}, fuse.OK
+			},
+		},
+	}
+	b := newMockBridge(&mock.mockFileSystem)
+	b.fs = mock
+
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "f", &fuse.EntryOut{})
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "g", &fuse.EntryOut{})
+	openOut := &fuse.OpenOut{}
+	if code := b.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 100}}, openOut); !code.Ok() {
+		t.Fatal(code)
+	}
+	b.Write(nil, &fuse.WriteIn{InHeader: fuse.InHeader{NodeId: 100}, Fh: openOut.Fh, Offset: 5}, []byte(" world"))
+
+	getAttrIn := &fuse.GetAttrIn{
+		InHeader: fuse.InHeader{NodeId: 100},
+		Fh_:      openOut.Fh,
+		Flags_:   fuse.FUSE_GETATTR_FH,
+	}
+	attrOut := &fuse.AttrOut{}
+	if code := b.GetAttr(nil, getAttrIn, attrOut); !code.Ok() {
+		t.Fatal(code)
+	}
+	if attrOut.Size != 11 || attrOut.Mode != fuse.S_IFREG|0600 {
+		t.Errorf("want attributes from the handle, have %v", &attrOut.Attr)
+	}
+
+	// the handle is not open on another node.
+	getAttrIn.NodeId = 101
+	if code := b.GetAttr(nil, getAttrIn, &fuse.AttrOut{}); code != fuse.Status(syscall.EBADF) {
+		t.Errorf("want EBADF for the handle of another node, have %v", code)
+	}
+}
@@ -1,6 +1,7 @@
 package pathfs
 
 import (
+	"fmt"
 	"sync"
 	"testing"
 	"time"
@@ -513,3 +514,168 @@ func TestConcurrentLookup(t *testing.T) {
 		t.Errorf("expected lookupCount 10, got %d", node.lookupCount)
 	}
 }
+
+// mockHandle is a FileHandle recording the calls it gets.
+type mockHandle struct {
+	data     []byte
+	calls    []string
+	released bool
+}
+
+func (h *mockHandle) Read(ctx *Context, dest []byte, off uint64) (fuse.ReadResult, fuse.Status) {
+	h.calls = append(h.calls, "read")
+	return fuse.ReadResultData(h.data[off:]), fuse.OK
+}
+
+func (h *mockHandle) Write(ctx *Context, data []byte, off uint64) (uint32, fuse.Status) {
+	h.calls = append(h.calls, "write")
+	h.data = append(h.data[:off], data...)
+	return uint32(len(data)), fuse.OK
+}
+
+func (h *mockHandle) Flush(ctx *Context, lockOwner uint64) fuse.Status {
+	h.calls = append(h.calls, "flush")
+	return fuse.OK
+}
+
+func (h *mockHandle) Release(ctx *Context) {
+	h.released = true
+}
+
+func (h *mockHandle) GetAttr(ctx *Context, out *fuse.Attr) fuse.Status {
+	out.Ino = 100
+	out.Mode = fuse.S_IFREG | 0600
+	out.Size = uint64(len(h.data))
+	return fuse.OK
+}
+
+func (h *mockHandle) DumpHandle() ([]byte, error) {
+	return h.data, nil
+}
+
+// mockHandleFileSystem hands out mockHandles.
+type mockHandleFileSystem struct {
+	mockFileSystem
+	handles []*mockHandle
+}
+
+func (m *mockHandleFileSystem) CreateHandle(ctx *Context, path string, flags uint32, mode uint32) (FileHandle, bool, fuse.Status) {
+	h := &mockHandle{}
+	m.handles = append(m.handles, h)
+	return h, false, fuse.OK
+}
+
+func (m *mockHandleFileSystem) OpenHandle(ctx *Context, path string, flags uint32) (FileHandle, bool, bool, fuse.Status) {
+	h := &mockHandle{data: []byte("hello")}
+	m.handles = append(m.handles, h)
+	return h, true, false, fuse.OK
+}
+
+func (m *mockHandleFileSystem) RestoreHandle(path string, data []byte) (FileHandle, error) {
+	h := &mockHandle{data: data}
+	m.handles = append(m.handles, h)
+	return h, nil
+}
+
+func TestFileHandle(t *testing.T) {
+	mock := &mockHandleFileSystem{
+		mockFileSystem: mockFileSystem{
+			getAttrFunc: func(path string) (fuse.Attr, fuse.Status) {
+				return fuse.Attr{Ino: 100, Mode: fuse.S_IFREG | 0644}, fuse.OK
+			},
+			openFunc: func(path string) (uint32, bool, bool, fuse.Status) {
+				t.Error("FileSystem.Open should not be called")
+				return 0, false, false, fuse.EIO
+			},
+		},
+	}
+	b := newMockBridge(&mock.mockFileSystem)
+	b.fs = mock
+
+	header := fuse.InHeader{NodeId: 1}
+	b.Lookup(nil, &header, "f", &fuse.EntryOut{})
+
+	openOut := &fuse.OpenOut{}
+	if code := b.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 100}}, openOut); !code.Ok() {
+		t.Fatal(code)
+	}
+	if openOut.OpenFlags&fuse.FOPEN_KEEP_CACHE == 0 {
+		t.Error("FOPEN_KEEP_CACHE should be set")
+	}
+	h := mock.handles[0]
+
+	dest := make([]byte, 16)
+	res, code := b.Read(nil, &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: 100}, Fh: openOut.Fh}, dest)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if data, _ := res.Bytes(dest); string(data) != "hello" {
+		t.Errorf("want %q, have %q", "hello", data)
+	}
+	b.Write(nil, &fuse.WriteIn{InHeader: fuse.InHeader{NodeId: 100}, Fh: openOut.Fh, Offset: 5}, []byte(" world"))
+	b.Flush(nil, &fuse.FlushIn{InHeader: fuse.InHeader{NodeId: 100}, Fh: openOut.Fh})
+	if _, code := b.Read(nil, &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: 1}, Fh: openOut.Fh}, dest); code != fuse.EBADF {
+		t.Errorf("want EBADF reading the handle through another node, have %v", code)
+	}
+
+	// GetAttrIn carries no file handle on darwin.
+	attrOut := &fuse.AttrOut{}
+	if code := b.getAttr(&Context{}, "f", b.files[openOut.Fh], attrOut); !code.Ok() {
+		t.Fatal(code)
+	}
+	if attrOut.Size != 11 {
+		t.Errorf("want size from the handle 11, have %d", attrOut.Size)
+	}
+
+	want := []string{"read", "write", "flush"}
+	if fmt.Sprint(h.calls) != fmt.Sprint(want) {
+		t.Errorf("want calls %v, have %v", want, h.calls)
+	}
+
+	// handles survive Dump/Restore.
+	dumpB, _, err := b.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := newMockBridge(&mock.mockFileSystem)
+	receiver.fs = mock
+	if _, err := receiver.Restore(dumpB); err != nil {
+		t.Fatal(err)
+	}
+	restored := receiver.files[openOut.Fh].handle.(*mockHandle)
+	if string(restored.data) != "hello world" {
+		t.Errorf("want restored handle %q, have %q", "hello world", restored.data)
+	}
+
+	b.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: 100}, Fh: openOut.Fh})
+	if !h.released {
+		t.Error("handle should be released")
+	}
+	if b.files[openOut.Fh].handle != nil {
+		t.Error("file entry should drop the handle")
+	}
+}
+
+func TestCreateFileHandle(t *testing.T) {
+	mock := &mockHandleFileSystem{
+		mockFileSystem: mockFileSystem{
+			getAttrFunc: func(path string) (fuse.Attr, fuse.Status) {
+				return fuse.Attr{Ino: 200, Mode: fuse.S_IFREG | 0644}, fuse.OK
+			},
+			createFunc: func(path string) (uint32, bool, fuse.Status) {
+				t.Error("FileSystem.Create should not be called")
+				return 0, false, fuse.EIO
+			},
+		},
+	}
+	b := newMockBridge(&mock.mockFileSystem)
+	b.fs = mock
+
+	out := &fuse.CreateOut{}
+	if code := b.Create(nil, &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: 1}}, "f", out); !code.Ok() {
+		t.Fatal(code)
+	}
+	if b.files[out.Fh].handle != mock.handles[0] {
+		t.Error("file entry should hold the created handle")
+	}
+}
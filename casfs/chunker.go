@@ -0,0 +1,94 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package casfs
+
+import (
+	"io"
+	"math/bits"
+)
+
+// gear is the table of the gear hash, fixed so that stores cut the
+// same content at the same places.
+var gear [256]uint64
+
+func init() {
+	// splitmix64
+	x := uint64(0x6361736673) // "casfs"
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		gear[i] = z ^ z>>31
+	}
+}
+
+// chunker splits a stream into content-defined chunks: a chunk ends
+// where the gear hash of the 64 bytes before has its top bits clear,
+// so an edit only changes the chunks around it.
+type chunker struct {
+	r        io.Reader
+	min, max int
+	shift    uint // a cut is where hash>>shift is 0
+
+	buf        []byte
+	start, end int
+	eof        bool
+}
+
+// newChunker returns a chunker of chunks of at least avg/4 and at most
+// avg*8 bytes, cut past avg/4 with a probability of 1/avg per byte.
+// avg is a power of two.
+func newChunker(r io.Reader, avg int) *chunker {
+	return &chunker{
+		r:     r,
+		min:   avg / 4,
+		max:   avg * 8,
+		shift: uint(64 - bits.TrailingZeros(uint(avg))),
+		buf:   make([]byte, avg*8),
+	}
+}
+
+// cut returns the length of the chunk at the start of data.
+func (c *chunker) cut(data []byte) int {
+	if len(data) <= c.min {
+		return len(data)
+	}
+	if len(data) > c.max {
+		data = data[:c.max]
+	}
+	var h uint64
+	for i, b := range data {
+		h = h<<1 + gear[b]
+		if i+1 >= c.min && h>>c.shift == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+// next returns the next chunk, valid until the next call, or io.EOF.
+func (c *chunker) next() ([]byte, error) {
+	if c.end-c.start < c.max && !c.eof {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+		for c.end < len(c.buf) && !c.eof {
+			n, err := c.r.Read(c.buf[c.end:])
+			c.end += n
+			if err == io.EOF {
+				c.eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
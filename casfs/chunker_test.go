@@ -0,0 +1,64 @@
+package casfs
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunks(t *testing.T, data []byte, avg int) [][]byte {
+	t.Helper()
+	c := newChunker(bytes.NewReader(data), avg)
+	var out [][]byte
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunker(t *testing.T) {
+	const avg = 1 << 10
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	a := chunks(t, data, avg)
+	if got := bytes.Join(a, nil); !bytes.Equal(got, data) {
+		t.Fatal("chunks do not add up to the data")
+	}
+	for i, chunk := range a {
+		if len(chunk) > avg*8 || len(chunk) < avg/4 && i != len(a)-1 {
+			t.Fatalf("chunk %d of %d bytes", i, len(chunk))
+		}
+	}
+	if n := len(data) / len(a); n < avg || n > avg*2 {
+		t.Errorf("%d chunks of %d bytes on average", len(a), n)
+	}
+
+	// An insertion changes only the chunks around it.
+	edited := append(append(append([]byte(nil), data[:1000]...), "inserted"...), data[1000:]...)
+	b := chunks(t, edited, avg)
+	seen := make(map[string]bool)
+	for _, chunk := range a {
+		seen[string(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range b {
+		if !seen[string(chunk)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("%d of %d chunks changed", changed, len(b))
+	}
+
+	if got := chunks(t, nil, avg); len(got) != 0 {
+		t.Errorf("chunks of no data: %d", len(got))
+	}
+}
@@ -0,0 +1,458 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package casfs
+
+import (
+	"io"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+)
+
+// pageSize is the unit of the buffered writes.
+const pageSize = 64 << 10
+
+// dirtyData is the content of a file being written: pages of writes
+// over the committed chunks.
+type dirtyData struct {
+	size  uint64
+	pages map[uint64][]byte // by offset / pageSize
+
+	// limit bounds the committed content that shows through; past it
+	// the file was truncated, and reads zeros where there is no page.
+	limit uint64
+}
+
+// committedReader reads the committed content of a file.
+type committedReader struct {
+	s      *store
+	chunks []chunkRef
+	offs   []uint64 // of chunks
+	size   uint64
+}
+
+func newCommittedReader(s *store, chunks []chunkRef) *committedReader {
+	r := &committedReader{s: s, chunks: chunks, offs: make([]uint64, len(chunks))}
+	for i, c := range chunks {
+		r.offs[i] = r.size
+		r.size += uint64(c.Size)
+	}
+	return r
+}
+
+// ReadAt reads from the chunks, and zeros past them.
+func (r *committedReader) ReadAt(dest []byte, off int64) (int, error) {
+	pos := uint64(off)
+	i := sort.Search(len(r.offs), func(i int) bool { return r.offs[i] > pos }) - 1
+	n := 0
+	for n < len(dest) && pos < r.size {
+		c := r.chunks[i]
+		seg := dest[n:spanEnd(len(dest), n, r.offs[i]+uint64(c.Size)-pos)]
+		m, err := r.s.readAt(c.ID, seg, int64(pos-r.offs[i]))
+		if m < len(seg) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n + m, err
+		}
+		n += m
+		pos += uint64(m)
+		i++
+	}
+	for ; n < len(dest); n++ {
+		dest[n] = 0
+	}
+	return n, nil
+}
+
+// spanEnd returns the end of the span from n of at most rest bytes
+// before end.
+func spanEnd(end, n int, rest uint64) int {
+	if uint64(end-n) > rest {
+		return n + int(rest)
+	}
+	return end
+}
+
+func newDirtyData(size uint64) *dirtyData {
+	return &dirtyData{size: size, pages: make(map[uint64][]byte), limit: size}
+}
+
+// page returns the page of index i, filled from r if it is new.
+func (d *dirtyData) page(r *committedReader, i uint64) ([]byte, error) {
+	if p := d.pages[i]; p != nil {
+		return p, nil
+	}
+	p := make([]byte, pageSize)
+	if off := i * pageSize; off < d.limit {
+		n := pageSize
+		if d.limit-off < pageSize {
+			n = int(d.limit - off)
+		}
+		if _, err := r.ReadAt(p[:n], int64(off)); err != nil {
+			return nil, err
+		}
+	}
+	d.pages[i] = p
+	return p, nil
+}
+
+func (d *dirtyData) write(r *committedReader, data []byte, off uint64) error {
+	for len(data) > 0 {
+		p, err := d.page(r, off/pageSize)
+		if err != nil {
+			return err
+		}
+		n := copy(p[off%pageSize:], data)
+		data = data[n:]
+		off += uint64(n)
+		if off > d.size {
+			d.size = off
+		}
+	}
+	return nil
+}
+
+func (d *dirtyData) truncate(size uint64) {
+	if size < d.size {
+		for i := range d.pages {
+			if i*pageSize >= size {
+				delete(d.pages, i)
+			}
+		}
+		if p := d.pages[size/pageSize]; p != nil {
+			tail := p[size%pageSize:]
+			for i := range tail {
+				tail[i] = 0
+			}
+		}
+		if size < d.limit {
+			d.limit = size
+		}
+	}
+	d.size = size
+}
+
+// dirtyReader reads the content of a file being written.
+type dirtyReader struct {
+	d *dirtyData
+	r *committedReader
+}
+
+// ReadAt reads up to the size of the file.
+func (dr dirtyReader) ReadAt(dest []byte, off int64) (int, error) {
+	d := dr.d
+	pos := uint64(off)
+	if pos >= d.size {
+		return 0, io.EOF
+	}
+	var err error
+	if uint64(len(dest)) > d.size-pos {
+		dest = dest[:d.size-pos]
+		err = io.EOF
+	}
+	for n := 0; n < len(dest); {
+		seg := dest[n:spanEnd(len(dest), n, pageSize-pos%pageSize)]
+		if p := d.pages[pos/pageSize]; p != nil {
+			copy(seg, p[pos%pageSize:])
+		} else {
+			m := 0
+			if pos < d.limit {
+				m = spanEnd(len(seg), 0, d.limit-pos)
+				if _, err := dr.r.ReadAt(seg[:m], int64(pos)); err != nil {
+					return n, err
+				}
+			}
+			for i := m; i < len(seg); i++ {
+				seg[i] = 0
+			}
+		}
+		n += len(seg)
+		pos += uint64(len(seg))
+	}
+	return len(dest), err
+}
+
+// commit stores the buffered writes of n as chunks.
+func (fs *FileSystem) commit(n *node) fuse.Status {
+	fs.gcMu.RLock()
+	defer fs.gcMu.RUnlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	d := n.dirty
+	if d == nil || n.gone {
+		return fuse.OK
+	}
+	r := dirtyReader{d: d, r: newCommittedReader(fs.store, n.Chunks)}
+	c := newChunker(io.NewSectionReader(r, 0, int64(d.size)), fs.chunkSize)
+	var chunks []chunkRef
+	for {
+		data, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		var ref chunkRef
+		if err == nil {
+			ref, err = fs.store.put(data)
+		}
+		if err != nil {
+			// The chunks put so far are left to GC.
+			fs.logf("casfs: commit of inode %d: %v", n.Ino, err)
+			return fuse.EIO
+		}
+		chunks = append(chunks, ref)
+	}
+	fs.store.ref(chunks)
+	fs.store.unref(n.Chunks)
+	n.Chunks, n.Size, n.dirty = chunks, d.size, nil
+	return fuse.OK
+}
+
+// reader returns the reader of the content of n, and its size. n.mu
+// is held.
+func (fs *FileSystem) reader(n *node) (io.ReaderAt, uint64) {
+	r := newCommittedReader(fs.store, n.Chunks)
+	if n.dirty != nil {
+		return dirtyReader{d: n.dirty, r: r}, n.dirty.size
+	}
+	return r, r.size
+}
+
+// open adds a handle of n. fs.mu is held.
+func (fs *FileSystem) open(n *node, flags uint32) uint32 {
+	uFh := fs.nextFh
+	fs.nextFh++
+	fs.files[uFh] = &handle{n: n, flags: flags}
+	n.opens++
+	return uFh
+}
+
+func (fs *FileSystem) Create(ctx *pathfs.Context, path string, flags uint32, mode uint32) (uFh uint32, forceDIO bool, code fuse.Status) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	parent, name, code := fs.lookupParent(path)
+	if !code.Ok() {
+		return 0, false, code
+	}
+	var n *node
+	if ino, ok := parent.Children[name]; ok {
+		if flags&syscall.O_EXCL != 0 {
+			return 0, false, fuse.Status(syscall.EEXIST)
+		}
+		n = fs.nodes[ino]
+		if n.isDir() {
+			return 0, false, fuse.Status(syscall.EISDIR)
+		}
+		if flags&syscall.O_TRUNC != 0 {
+			n.mu.Lock()
+			truncate(n, 0)
+			n.mu.Unlock()
+		}
+	} else {
+		n, code = fs.newNode(ctx, parent, name, syscall.S_IFREG|mode&07777)
+		if !code.Ok() {
+			return 0, false, code
+		}
+	}
+	return fs.open(n, flags), false, fuse.OK
+}
+
+func (fs *FileSystem) Open(ctx *pathfs.Context, path string, flags uint32) (uFh uint32, keepCache, forceDIO bool, code fuse.Status) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, code := fs.lookup(path)
+	if !code.Ok() {
+		return 0, false, false, code
+	}
+	if n.isDir() && flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		return 0, false, false, fuse.Status(syscall.EISDIR)
+	}
+	if flags&syscall.O_TRUNC != 0 && flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		n.mu.Lock()
+		truncate(n, 0)
+		n.mu.Unlock()
+	}
+	return fs.open(n, flags), false, false, fuse.OK
+}
+
+// handle returns an open file.
+func (fs *FileSystem) handle(uFh uint32) (*handle, fuse.Status) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	h := fs.files[uFh]
+	if h == nil {
+		return nil, fuse.EBADF
+	}
+	return h, fuse.OK
+}
+
+func (fs *FileSystem) Read(ctx *pathfs.Context, path string, uFh uint32, dest []byte, off uint64) (fuse.ReadResult, fuse.Status) {
+	n, _, code := fs.node(path, uFh)
+	if !code.Ok() {
+		return nil, code
+	}
+	if !n.isRegular() {
+		return nil, fuse.EINVAL
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	r, size := fs.reader(n)
+	if off >= size {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	if uint64(len(dest)) > size-off {
+		dest = dest[:size-off]
+	}
+	m, err := r.ReadAt(dest, int64(off))
+	if err != nil && err != io.EOF {
+		fs.logf("casfs: read of inode %d: %v", n.Ino, err)
+		return nil, fuse.EIO
+	}
+	return fuse.ReadResultData(dest[:m]), fuse.OK
+}
+
+func (fs *FileSystem) Write(ctx *pathfs.Context, path string, uFh uint32, data []byte, off uint64) (uint32, fuse.Status) {
+	h, code := fs.handle(uFh)
+	if !code.Ok() {
+		return 0, code
+	}
+	if h.flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+		return 0, fuse.EBADF
+	}
+	n := h.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.dirty == nil {
+		n.dirty = newDirtyData(n.Size)
+	}
+	if err := n.dirty.write(newCommittedReader(fs.store, n.Chunks), data, off); err != nil {
+		fs.logf("casfs: write of inode %d: %v", n.Ino, err)
+		return 0, fuse.EIO
+	}
+	now := time.Now()
+	n.Mtime, n.Ctime = now, now
+	return uint32(len(data)), fuse.OK
+}
+
+// truncate sets the size of n. n.mu is held.
+func truncate(n *node, size uint64) {
+	if n.dirty == nil {
+		if size == n.Size {
+			return
+		}
+		n.dirty = newDirtyData(n.Size)
+	}
+	n.dirty.truncate(size)
+	now := time.Now()
+	n.Mtime, n.Ctime = now, now
+}
+
+// Truncate changes the size of a file. Unless the file is open, the
+// change is committed at once.
+func (fs *FileSystem) Truncate(ctx *pathfs.Context, path string, uFh uint32, size uint64) fuse.Status {
+	fs.mu.Lock()
+	var n *node
+	code := fuse.OK
+	if uFh != 0 {
+		if h := fs.files[uFh]; h != nil {
+			n = h.n
+		} else {
+			code = fuse.EBADF
+		}
+	} else {
+		n, code = fs.lookup(path)
+	}
+	if code.Ok() && !n.isRegular() {
+		code = fuse.EINVAL
+		if n.isDir() {
+			code = fuse.Status(syscall.EISDIR)
+		}
+	}
+	if !code.Ok() {
+		fs.mu.Unlock()
+		return code
+	}
+	open := n.opens > 0
+	fs.mu.Unlock()
+
+	n.mu.Lock()
+	truncate(n, size)
+	n.mu.Unlock()
+	if open {
+		return fuse.OK
+	}
+	return fs.commit(n)
+}
+
+// Fallocate only extends files, as mode 0.
+func (fs *FileSystem) Fallocate(ctx *pathfs.Context, path string, uFh uint32, off uint64, size uint64, mode uint32) fuse.Status {
+	if mode != 0 {
+		return fuse.ENOSYS
+	}
+	h, code := fs.handle(uFh)
+	if !code.Ok() {
+		return code
+	}
+	n := h.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, cur := fs.reader(n); off+size > cur {
+		truncate(n, off+size)
+	}
+	return fuse.OK
+}
+
+func (fs *FileSystem) Flush(ctx *pathfs.Context, path string, uFh uint32, lockOwner uint64) fuse.Status {
+	h, code := fs.handle(uFh)
+	if !code.Ok() {
+		return code
+	}
+	return fs.commit(h.n)
+}
+
+// Fsync commits the writes to a file, and saves the metadata tree.
+func (fs *FileSystem) Fsync(ctx *pathfs.Context, path string, uFh uint32, flags uint32) fuse.Status {
+	h, code := fs.handle(uFh)
+	if !code.Ok() {
+		return code
+	}
+	if code := fs.commit(h.n); !code.Ok() {
+		return code
+	}
+	fs.gcMu.Lock()
+	defer fs.gcMu.Unlock()
+	if err := fs.save(); err != nil {
+		fs.logf("casfs: save: %v", err)
+		return fuse.EIO
+	}
+	return fuse.OK
+}
+
+func (fs *FileSystem) Release(ctx *pathfs.Context, path string, uFh uint32) {
+	fs.mu.Lock()
+	h := fs.files[uFh]
+	if h == nil {
+		fs.mu.Unlock()
+		return
+	}
+	n := h.n
+	unlinked := n.Nlink == 0 && n.opens == 1
+	fs.mu.Unlock()
+	if !unlinked {
+		// A failure is logged, and the writes stay buffered for the
+		// next commit.
+		fs.commit(n)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.files, uFh)
+	if n.opens--; n.opens == 0 && n.Nlink == 0 {
+		fs.drop(n)
+	}
+}
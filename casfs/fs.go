@@ -0,0 +1,731 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package casfs is a pathfs.FileSystem that stores the content of
+// files in a local content-addressed chunk store, so that the many
+// copies of a file, or of most of one, take the space of one.
+//
+// The content of a file is cut into chunks at content-defined
+// boundaries, so an edit changes only the chunks around it, and each
+// chunk is stored once under its SHA-256. Writes are buffered in
+// memory and committed to chunks by Flush, Fsync and Release; reads
+// reassemble the content from the chunks and the buffered writes.
+// Chunks are reference counted by the files that use them, and those
+// left without references are removed by GC.
+//
+// The metadata tree (names, attrs, xattrs and the chunks of each file)
+// is kept in memory and saved to the store by Sync, Fsync, GC and
+// Close; changes since the last save are lost on a crash, as on an
+// unsynced file system. Permissions are not checked, see
+// pathfs.Options.DefaultPermissions.
+package casfs
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+)
+
+// DefaultChunkSize is the average size of chunks when
+// Options.ChunkSize is not set.
+const DefaultChunkSize = 8 << 10
+
+// Options sets options for a FileSystem.
+type Options struct {
+	// ChunkSize is the average size of the chunks of new content,
+	// rounded down to a power of two of at least 256. Chunks are
+	// between a quarter and 8 times that.
+	ChunkSize int
+
+	// Logger is a sink for diagnostic messages, such as failed
+	// commits. If unset, no messages are printed.
+	Logger *log.Logger
+}
+
+// GCStats reports what GC removed.
+type GCStats struct {
+	Chunks int
+	Bytes  int64
+}
+
+// Stats reports the chunks in use.
+type Stats struct {
+	Chunks int
+	Bytes  int64
+}
+
+// handle is an open file.
+type handle struct {
+	n     *node
+	flags uint32
+}
+
+// FileSystem is a FileSystem backed by a chunk store.
+type FileSystem struct {
+	dir       string
+	chunkSize int
+	options   Options
+	store     *store
+
+	// gcMu is held for reading by commits and for writing by saves,
+	// so that a save sees no commit halfway, and GC sweeps no chunk
+	// between its put and its ref.
+	gcMu sync.RWMutex
+
+	mu      sync.Mutex
+	nodes   map[uint64]*node
+	nextIno uint64
+	files   map[uint32]*handle
+	nextFh  uint32
+}
+
+var _ pathfs.FileSystem = (*FileSystem)(nil)
+
+// Open opens the store in dir, creating it if it does not exist.
+// options may be nil.
+func Open(dir string, options *Options) (*FileSystem, error) {
+	fs := &FileSystem{
+		dir:    dir,
+		nodes:  make(map[uint64]*node),
+		files:  make(map[uint32]*handle),
+		nextFh: 1,
+	}
+	if options != nil {
+		fs.options = *options
+	}
+	fs.chunkSize = DefaultChunkSize
+	if size := fs.options.ChunkSize; size > 0 {
+		fs.chunkSize = 256
+		for fs.chunkSize*2 <= size {
+			fs.chunkSize *= 2
+		}
+	}
+
+	chunks := filepath.Join(dir, "chunks")
+	if err := os.MkdirAll(chunks, 0755); err != nil {
+		return nil, err
+	}
+	fs.store = newStore(chunks)
+
+	t, err := loadTree(fs.treePath())
+	if os.IsNotExist(err) {
+		now := time.Now()
+		root := &node{
+			Ino:      rootIno,
+			Mode:     syscall.S_IFDIR | 0755,
+			Nlink:    2,
+			Uid:      uint32(os.Getuid()),
+			Gid:      uint32(os.Getgid()),
+			Atime:    now,
+			Mtime:    now,
+			Ctime:    now,
+			Children: make(map[string]uint64),
+			kind:     syscall.S_IFDIR,
+		}
+		t = &treeFile{Version: treeVersion, NextIno: rootIno + 1, Nodes: []*node{root}}
+		err = saveTree(fs.treePath(), t)
+	} else if err == nil {
+		err = checkTree(t)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fs.nextIno = t.NextIno
+	for _, n := range t.Nodes {
+		fs.nodes[n.Ino] = n
+		fs.store.ref(n.Chunks)
+	}
+	return fs, nil
+}
+
+func (fs *FileSystem) treePath() string {
+	return filepath.Join(fs.dir, "tree")
+}
+
+func (fs *FileSystem) logf(format string, args ...interface{}) {
+	if fs.options.Logger != nil {
+		fs.options.Logger.Printf(format, args...)
+	}
+}
+
+// Sync commits the buffered writes and saves the metadata tree.
+func (fs *FileSystem) Sync() error {
+	if code := fs.commitAll(); !code.Ok() {
+		return syscall.Errno(code)
+	}
+	fs.gcMu.Lock()
+	defer fs.gcMu.Unlock()
+	return fs.save()
+}
+
+// save saves the metadata tree. gcMu is held.
+func (fs *FileSystem) save() error {
+	if err := fs.store.sync(); err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	t := &treeFile{Version: treeVersion, NextIno: fs.nextIno}
+	for _, n := range fs.nodes {
+		if n.Nlink == 0 {
+			continue
+		}
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		t.Nodes = append(t.Nodes, n)
+	}
+	return saveTree(fs.treePath(), t)
+}
+
+// commitAll commits the buffered writes of every file.
+func (fs *FileSystem) commitAll() fuse.Status {
+	fs.mu.Lock()
+	var dirty []*node
+	for _, n := range fs.nodes {
+		if n.isRegular() {
+			dirty = append(dirty, n)
+		}
+	}
+	fs.mu.Unlock()
+	for _, n := range dirty {
+		if code := fs.commit(n); !code.Ok() {
+			return code
+		}
+	}
+	return fuse.OK
+}
+
+// Close is Sync. The FileSystem must not be used afterwards.
+func (fs *FileSystem) Close() error {
+	return fs.Sync()
+}
+
+// GC saves the metadata tree, then removes the chunks that no file
+// uses, including those of the writes lost by a crash.
+func (fs *FileSystem) GC() (GCStats, error) {
+	if code := fs.commitAll(); !code.Ok() {
+		return GCStats{}, syscall.Errno(code)
+	}
+	fs.gcMu.Lock()
+	defer fs.gcMu.Unlock()
+	// The saved tree must not refer to the chunks swept.
+	if err := fs.save(); err != nil {
+		return GCStats{}, err
+	}
+	return fs.store.sweep()
+}
+
+// Stats returns the chunks in use, each counted once.
+func (fs *FileSystem) Stats() Stats {
+	fs.store.mu.Lock()
+	defer fs.store.mu.Unlock()
+	var st Stats
+	for _, c := range fs.store.chunks {
+		st.Chunks++
+		st.Bytes += int64(c.size)
+	}
+	return st
+}
+
+// lookup returns the node at path. fs.mu is held.
+func (fs *FileSystem) lookup(path string) (*node, fuse.Status) {
+	n := fs.nodes[rootIno]
+	if path == "" {
+		return n, fuse.OK
+	}
+	for _, name := range strings.Split(path, "/") {
+		if !n.isDir() {
+			return nil, fuse.ENOTDIR
+		}
+		ino, ok := n.Children[name]
+		if !ok {
+			return nil, fuse.ENOENT
+		}
+		n = fs.nodes[ino]
+	}
+	return n, fuse.OK
+}
+
+// lookupParent returns the directory of path, and the name of path in
+// it. fs.mu is held.
+func (fs *FileSystem) lookupParent(path string) (*node, string, fuse.Status) {
+	if path == "" {
+		return nil, "", fuse.EINVAL
+	}
+	dir, name := "", path
+	if i := strings.LastIndexByte(path, '/'); i >= 0 {
+		dir, name = path[:i], path[i+1:]
+	}
+	parent, code := fs.lookup(dir)
+	if !code.Ok() {
+		return nil, "", code
+	}
+	if !parent.isDir() {
+		return nil, "", fuse.ENOTDIR
+	}
+	return parent, name, fuse.OK
+}
+
+// node returns the node of an open file, or else the node at path,
+// with its Nlink.
+func (fs *FileSystem) node(path string, uFh uint32) (*node, uint32, fuse.Status) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if uFh != 0 {
+		h := fs.files[uFh]
+		if h == nil {
+			return nil, 0, fuse.EBADF
+		}
+		return h.n, h.n.Nlink, fuse.OK
+	}
+	n, code := fs.lookup(path)
+	if !code.Ok() {
+		return nil, 0, code
+	}
+	return n, n.Nlink, fuse.OK
+}
+
+// newNode adds a node of mode in parent. Its owner is the caller, and
+// the group that of a setgid parent. fs.mu is held.
+func (fs *FileSystem) newNode(ctx *pathfs.Context, parent *node, name string, mode uint32) (*node, fuse.Status) {
+	if _, ok := parent.Children[name]; ok {
+		return nil, fuse.Status(syscall.EEXIST)
+	}
+	now := time.Now()
+	n := &node{
+		Ino:   fs.nextIno,
+		Mode:  mode,
+		Nlink: 1,
+		Uid:   uint32(os.Getuid()),
+		Gid:   uint32(os.Getgid()),
+		Atime: now,
+		Mtime: now,
+		Ctime: now,
+		kind:  mode & syscall.S_IFMT,
+	}
+	if ctx != nil {
+		n.Uid, n.Gid = ctx.Uid, ctx.Gid
+	}
+	parent.mu.Lock()
+	if parent.Mode&syscall.S_ISGID != 0 {
+		n.Gid = parent.Gid
+		if n.isDir() {
+			n.Mode |= syscall.S_ISGID
+		}
+	}
+	parent.Mtime, parent.Ctime = now, now
+	parent.mu.Unlock()
+	if n.isDir() {
+		n.Nlink = 2
+		n.Children = make(map[string]uint64)
+		parent.Nlink++
+	}
+	fs.nextIno++
+	fs.nodes[n.Ino] = n
+	parent.Children[name] = n.Ino
+	return n, fuse.OK
+}
+
+// unlink removes name from parent, dropping its node when it has no
+// links and is not open. fs.mu is held.
+func (fs *FileSystem) unlink(parent *node, name string, now time.Time) {
+	n := fs.nodes[parent.Children[name]]
+	delete(parent.Children, name)
+	if n.isDir() {
+		parent.Nlink--
+		n.Nlink = 0
+	} else {
+		n.Nlink--
+	}
+	touch(parent, now)
+	touch(n, now)
+	if n.Nlink == 0 && n.opens == 0 {
+		fs.drop(n)
+	}
+}
+
+// touch sets the ctime of n, and the mtime of a directory, whose
+// content is its entries.
+func touch(n *node, now time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.kind == syscall.S_IFDIR {
+		n.Mtime = now
+	}
+	n.Ctime = now
+}
+
+// drop removes a node without links nor opens. fs.mu is held.
+func (fs *FileSystem) drop(n *node) {
+	delete(fs.nodes, n.Ino)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	fs.store.unref(n.Chunks)
+	n.Chunks, n.dirty, n.gone = nil, nil, true
+}
+
+func (fs *FileSystem) GetAttr(ctx *pathfs.Context, path string, uFh uint32, out *fuse.Attr) fuse.Status {
+	n, nlink, code := fs.node(path, uFh)
+	if !code.Ok() {
+		return code
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.fillAttr(out)
+	out.Nlink = nlink
+	return fuse.OK
+}
+
+func (fs *FileSystem) Access(ctx *pathfs.Context, path string, mask uint32) fuse.Status {
+	_, _, code := fs.node(path, 0)
+	return code
+}
+
+func (fs *FileSystem) Mknod(ctx *pathfs.Context, path string, mode uint32, dev uint32) fuse.Status {
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFREG, syscall.S_IFIFO, syscall.S_IFSOCK, syscall.S_IFCHR, syscall.S_IFBLK:
+	default:
+		return fuse.EINVAL
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	parent, name, code := fs.lookupParent(path)
+	if !code.Ok() {
+		return code
+	}
+	n, code := fs.newNode(ctx, parent, name, mode)
+	if code.Ok() {
+		n.Rdev = dev
+	}
+	return code
+}
+
+func (fs *FileSystem) Mkdir(ctx *pathfs.Context, path string, mode uint32) fuse.Status {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	parent, name, code := fs.lookupParent(path)
+	if !code.Ok() {
+		return code
+	}
+	_, code = fs.newNode(ctx, parent, name, syscall.S_IFDIR|mode&07777)
+	return code
+}
+
+func (fs *FileSystem) Unlink(ctx *pathfs.Context, path string) fuse.Status {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	parent, name, code := fs.lookupParent(path)
+	if !code.Ok() {
+		return code
+	}
+	ino, ok := parent.Children[name]
+	if !ok {
+		return fuse.ENOENT
+	}
+	if fs.nodes[ino].isDir() {
+		return fuse.Status(syscall.EISDIR)
+	}
+	fs.unlink(parent, name, time.Now())
+	return fuse.OK
+}
+
+func (fs *FileSystem) Rmdir(ctx *pathfs.Context, path string) fuse.Status {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if path == "" {
+		return fuse.EBUSY
+	}
+	parent, name, code := fs.lookupParent(path)
+	if !code.Ok() {
+		return code
+	}
+	ino, ok := parent.Children[name]
+	if !ok {
+		return fuse.ENOENT
+	}
+	n := fs.nodes[ino]
+	if !n.isDir() {
+		return fuse.ENOTDIR
+	}
+	if len(n.Children) != 0 {
+		return fuse.Status(syscall.ENOTEMPTY)
+	}
+	fs.unlink(parent, name, time.Now())
+	return fuse.OK
+}
+
+func (fs *FileSystem) Rename(ctx *pathfs.Context, path string, newPath string) fuse.Status {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	parent, name, code := fs.lookupParent(path)
+	if !code.Ok() {
+		return code
+	}
+	newParent, newName, code := fs.lookupParent(newPath)
+	if !code.Ok() {
+		return code
+	}
+	ino, ok := parent.Children[name]
+	if !ok {
+		return fuse.ENOENT
+	}
+	n := fs.nodes[ino]
+	if n.isDir() && (newPath == path || strings.HasPrefix(newPath, path+"/")) {
+		if newPath == path {
+			return fuse.OK
+		}
+		return fuse.EINVAL
+	}
+	now := time.Now()
+	if oldIno, ok := newParent.Children[newName]; ok {
+		if oldIno == ino {
+			return fuse.OK
+		}
+		old := fs.nodes[oldIno]
+		switch {
+		case n.isDir() && !old.isDir():
+			return fuse.ENOTDIR
+		case !n.isDir() && old.isDir():
+			return fuse.Status(syscall.EISDIR)
+		case old.isDir() && len(old.Children) != 0:
+			return fuse.Status(syscall.ENOTEMPTY)
+		}
+		fs.unlink(newParent, newName, now)
+	}
+	delete(parent.Children, name)
+	newParent.Children[newName] = ino
+	if n.isDir() && parent != newParent {
+		parent.Nlink--
+		newParent.Nlink++
+	}
+	touch(parent, now)
+	touch(newParent, now)
+	touch(n, now)
+	return fuse.OK
+}
+
+func (fs *FileSystem) Link(ctx *pathfs.Context, path string, newPath string) fuse.Status {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, code := fs.lookup(path)
+	if !code.Ok() {
+		return code
+	}
+	if n.isDir() {
+		return fuse.EPERM
+	}
+	parent, name, code := fs.lookupParent(newPath)
+	if !code.Ok() {
+		return code
+	}
+	if _, ok := parent.Children[name]; ok {
+		return fuse.Status(syscall.EEXIST)
+	}
+	now := time.Now()
+	parent.Children[name] = n.Ino
+	n.Nlink++
+	touch(parent, now)
+	touch(n, now)
+	return fuse.OK
+}
+
+func (fs *FileSystem) Symlink(ctx *pathfs.Context, path string, target string) fuse.Status {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	parent, name, code := fs.lookupParent(path)
+	if !code.Ok() {
+		return code
+	}
+	n, code := fs.newNode(ctx, parent, name, syscall.S_IFLNK|0777)
+	if code.Ok() {
+		n.Target = target
+	}
+	return code
+}
+
+func (fs *FileSystem) Readlink(ctx *pathfs.Context, path string) (string, fuse.Status) {
+	n, _, code := fs.node(path, 0)
+	if !code.Ok() {
+		return "", code
+	}
+	if n.kind != syscall.S_IFLNK {
+		return "", fuse.EINVAL
+	}
+	return n.Target, fuse.OK
+}
+
+func (fs *FileSystem) GetXAttr(ctx *pathfs.Context, path string, attr string) ([]byte, fuse.Status) {
+	n, _, code := fs.node(path, 0)
+	if !code.Ok() {
+		return nil, code
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	data, ok := n.XAttrs[attr]
+	if !ok {
+		return nil, fuse.ENOATTR
+	}
+	return append([]byte(nil), data...), fuse.OK
+}
+
+func (fs *FileSystem) ListXAttr(ctx *pathfs.Context, path string) ([]string, fuse.Status) {
+	n, _, code := fs.node(path, 0)
+	if !code.Ok() {
+		return nil, code
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	attrs := make([]string, 0, len(n.XAttrs))
+	for attr := range n.XAttrs {
+		attrs = append(attrs, attr)
+	}
+	sort.Strings(attrs)
+	return attrs, fuse.OK
+}
+
+// The flags of setxattr(2).
+const (
+	xattrCreate  = 1
+	xattrReplace = 2
+)
+
+func (fs *FileSystem) SetXAttr(ctx *pathfs.Context, path string, attr string, data []byte, flags uint32) fuse.Status {
+	n, _, code := fs.node(path, 0)
+	if !code.Ok() {
+		return code
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, ok := n.XAttrs[attr]
+	switch {
+	case ok && flags&xattrCreate != 0:
+		return fuse.Status(syscall.EEXIST)
+	case !ok && flags&xattrReplace != 0:
+		return fuse.ENOATTR
+	}
+	if n.XAttrs == nil {
+		n.XAttrs = make(map[string][]byte)
+	}
+	n.XAttrs[attr] = append([]byte(nil), data...)
+	n.Ctime = time.Now()
+	return fuse.OK
+}
+
+func (fs *FileSystem) RemoveXAttr(ctx *pathfs.Context, path string, attr string) fuse.Status {
+	n, _, code := fs.node(path, 0)
+	if !code.Ok() {
+		return code
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.XAttrs[attr]; !ok {
+		return fuse.ENOATTR
+	}
+	delete(n.XAttrs, attr)
+	n.Ctime = time.Now()
+	return fuse.OK
+}
+
+func (fs *FileSystem) GetLk(ctx *pathfs.Context, path string, uFh uint32, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (fs *FileSystem) SetLk(ctx *pathfs.Context, path string, uFh uint32, owner uint64, lk *fuse.FileLock, flags uint32) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (fs *FileSystem) SetLkw(ctx *pathfs.Context, path string, uFh uint32, owner uint64, lk *fuse.FileLock, flags uint32) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (fs *FileSystem) Chmod(ctx *pathfs.Context, path string, uFh uint32, mode uint32) fuse.Status {
+	n, _, code := fs.node(path, uFh)
+	if !code.Ok() {
+		return code
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.Mode = n.Mode&syscall.S_IFMT | mode&07777
+	n.Ctime = time.Now()
+	return fuse.OK
+}
+
+// Chown changes the owner of a file; an id of ^uint32(0) is left
+// unchanged, as in chown(2).
+func (fs *FileSystem) Chown(ctx *pathfs.Context, path string, uFh uint32, uid uint32, gid uint32) fuse.Status {
+	n, _, code := fs.node(path, uFh)
+	if !code.Ok() {
+		return code
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if uid != ^uint32(0) {
+		n.Uid = uid
+	}
+	if gid != ^uint32(0) {
+		n.Gid = gid
+	}
+	n.Ctime = time.Now()
+	return fuse.OK
+}
+
+func (fs *FileSystem) Utimens(ctx *pathfs.Context, path string, uFh uint32, atime *time.Time, mtime *time.Time) fuse.Status {
+	n, _, code := fs.node(path, uFh)
+	if !code.Ok() {
+		return code
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if atime != nil {
+		n.Atime = *atime
+	}
+	if mtime != nil {
+		n.Mtime = *mtime
+	}
+	n.Ctime = time.Now()
+	return fuse.OK
+}
+
+func (fs *FileSystem) Lsdir(ctx *pathfs.Context, path string) ([]fuse.DirEntry, fuse.Status) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, code := fs.lookup(path)
+	if !code.Ok() {
+		return nil, code
+	}
+	if !n.isDir() {
+		return nil, fuse.ENOTDIR
+	}
+	stream := make([]fuse.DirEntry, 0, len(n.Children))
+	for name, ino := range n.Children {
+		stream = append(stream, fuse.DirEntry{
+			Name: name,
+			Mode: fs.nodes[ino].kind,
+			Ino:  ino,
+		})
+	}
+	sort.Slice(stream, func(i, j int) bool { return stream[i].Name < stream[j].Name })
+	return stream, fuse.OK
+}
+
+func (fs *FileSystem) StatFs(ctx *pathfs.Context, path string, out *fuse.StatfsOut) fuse.Status {
+	s := syscall.Statfs_t{}
+	if err := syscall.Statfs(fs.dir, &s); err != nil {
+		return fuse.ToStatus(err)
+	}
+	out.FromStatfsT(&s)
+	fs.mu.Lock()
+	out.Files = uint64(len(fs.nodes))
+	fs.mu.Unlock()
+	out.Ffree = 1 << 20
+	return fuse.OK
+}
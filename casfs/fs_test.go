@@ -0,0 +1,258 @@
+package casfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// writeFile writes data to path, failing t without stopping it, so
+// that it can be called by other goroutines.
+func writeFile(t *testing.T, fs *FileSystem, path string, data []byte) {
+	t.Helper()
+	fh, _, code := fs.Create(nil, path, syscall.O_WRONLY|syscall.O_TRUNC, 0644)
+	if !code.Ok() {
+		t.Errorf("Create %s: %v", path, code)
+		return
+	}
+	// Odd sizes and offsets, out of order.
+	for off := 0; off < len(data); off += 10000 {
+		end := off + 10000
+		if end > len(data) {
+			end = len(data)
+		}
+		if n, code := fs.Write(nil, path, fh, data[off:end], uint64(off)); !code.Ok() || int(n) != end-off {
+			t.Errorf("Write %s: %d %v", path, n, code)
+		}
+	}
+	if code := fs.Flush(nil, path, fh, 0); !code.Ok() {
+		t.Errorf("Flush %s: %v", path, code)
+	}
+	fs.Release(nil, path, fh)
+}
+
+func readFile(t *testing.T, fs *FileSystem, path string, off uint64, n int) []byte {
+	t.Helper()
+	fh, _, _, code := fs.Open(nil, path, syscall.O_RDONLY)
+	if !code.Ok() {
+		t.Fatalf("Open %s: %v", path, code)
+	}
+	defer fs.Release(nil, path, fh)
+	res, code := fs.Read(nil, path, fh, make([]byte, n), off)
+	if !code.Ok() {
+		t.Fatalf("Read %s: %v", path, code)
+	}
+	data, _ := res.Bytes(nil)
+	return data
+}
+
+func TestFileSystem(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := Open(dir, &Options{ChunkSize: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 300<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	if code := fs.Mkdir(nil, "a", 0755); !code.Ok() {
+		t.Fatal(code)
+	}
+	writeFile(t, fs, "a/f", data)
+	one := fs.Stats()
+	if one.Bytes != int64(len(data)) || one.Chunks < 100 {
+		t.Fatalf("stats of one file: %+v", one)
+	}
+	for _, off := range []int{0, 1, 1023, 5000, len(data) - 10} {
+		if got := readFile(t, fs, "a/f", uint64(off), 4000); !bytes.Equal(got, data[off:off+len(got)]) || len(got) == 0 {
+			t.Fatalf("Read at %d: %d bytes differ", off, len(got))
+		}
+	}
+
+	// Copies take no space, and near-copies little.
+	writeFile(t, fs, "copy", data)
+	if st := fs.Stats(); st != one {
+		t.Errorf("stats with a copy: %+v, want %+v", st, one)
+	}
+	edited := append(append(append([]byte(nil), data[:100000]...), "edit"...), data[100000:]...)
+	writeFile(t, fs, "edited", edited)
+	if st := fs.Stats(); st.Chunks-one.Chunks > 3 {
+		t.Errorf("stats with an edited copy: %+v, had %+v", st, one)
+	}
+
+	// Writes are read back before they are committed.
+	fh, _, _, code := fs.Open(nil, "copy", syscall.O_RDWR)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	fs.Write(nil, "copy", fh, []byte("xyz"), 70000)
+	if got := readFile(t, fs, "copy", 69999, 5); string(got) != string(data[69999:70000])+"xyz"+string(data[70003:70004]) {
+		t.Errorf("Read of a buffered write: %q", got)
+	}
+	// Truncated content reads as zeros when the file grows again.
+	fs.Truncate(nil, "copy", fh, 1000)
+	fs.Truncate(nil, "copy", fh, 200000)
+	if got := readFile(t, fs, "copy", 998, 4); !bytes.Equal(got, []byte{data[998], data[999], 0, 0}) {
+		t.Errorf("Read across a truncation: %v", got)
+	}
+	var attr fuse.Attr
+	if fs.GetAttr(nil, "copy", fh, &attr); attr.Size != 200000 {
+		t.Errorf("size before Release: %d", attr.Size)
+	}
+	fs.Release(nil, "copy", fh)
+	if got := readFile(t, fs, "copy", 199990, 100); len(got) != 10 || !bytes.Equal(got, make([]byte, 10)) {
+		t.Errorf("Read after Release: %v", got)
+	}
+
+	// The tree.
+	if code := fs.Symlink(nil, "link", "a/f"); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Link(nil, "a/f", "hard"); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.SetXAttr(nil, "a/f", "user.x", []byte("v"), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Chmod(nil, "a/f", 0, 0600); !code.Ok() {
+		t.Fatal(code)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	fs.Utimens(nil, "a/f", 0, nil, &mtime)
+	if code := fs.Rmdir(nil, "a"); code != fuse.Status(syscall.ENOTEMPTY) {
+		t.Errorf("Rmdir of a non-empty directory: %v", code)
+	}
+	if code := fs.Rename(nil, "a", "a/b"); code != fuse.EINVAL {
+		t.Errorf("Rename into itself: %v", code)
+	}
+	if code := fs.Rename(nil, "edited", "copy"); !code.Ok() {
+		t.Fatal(code)
+	}
+
+	// All of it survives a reopen.
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs, err = Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f, hard, a fuse.Attr
+	fs.GetAttr(nil, "a/f", 0, &f)
+	fs.GetAttr(nil, "hard", 0, &hard)
+	fs.GetAttr(nil, "a", 0, &a)
+	if f.Mode != syscall.S_IFREG|0600 || f.Nlink != 2 || f.Ino != hard.Ino || f.Size != uint64(len(data)) || f.Mtime != uint64(mtime.Unix()) || f.Mtimensec != 6 {
+		t.Errorf("attr of a/f: %v", &f)
+	}
+	if !a.IsDir() || a.Nlink != 2 {
+		t.Errorf("attr of a: %v", &a)
+	}
+	if target, _ := fs.Readlink(nil, "link"); target != "a/f" {
+		t.Errorf("Readlink: %q", target)
+	}
+	if v, _ := fs.GetXAttr(nil, "hard", "user.x"); string(v) != "v" {
+		t.Errorf("GetXAttr: %q", v)
+	}
+	if got := readFile(t, fs, "copy", 99998, 8); string(got) != string(edited[99998:100006]) {
+		t.Errorf("Read of the renamed file: %q", got)
+	}
+	stream, _ := fs.Lsdir(nil, "")
+	var names []string
+	for _, e := range stream {
+		names = append(names, e.Name)
+	}
+	if got := len(names); got != 4 || names[0] != "a" || names[1] != "copy" || names[2] != "hard" || names[3] != "link" {
+		t.Errorf("Lsdir: %v", names)
+	}
+
+	// GC removes the chunks of the replaced copy.
+	if st, err := fs.GC(); err != nil || st.Chunks == 0 {
+		t.Errorf("GC after replacing a file: %+v %v", st, err)
+	}
+
+	// An unlinked file stays readable while open.
+	fh, _, _, _ = fs.Open(nil, "copy", syscall.O_RDONLY)
+	fs.Unlink(nil, "copy")
+	if res, code := fs.Read(nil, "copy", fh, make([]byte, 4), 100000); !code.Ok() {
+		t.Errorf("Read of an unlinked file: %v", code)
+	} else if got, _ := res.Bytes(nil); string(got) != "edit" {
+		t.Errorf("Read of an unlinked file: %q", got)
+	}
+	if st, _ := fs.GC(); st.Chunks != 0 {
+		t.Errorf("GC removed %d chunks of an open file", st.Chunks)
+	}
+	fs.Release(nil, "copy", fh)
+
+	// GC removes the chunks of the edit only, and the chunks of
+	// crashed writes.
+	orphan := fs.store.path(sha256.Sum256([]byte("orphan")))
+	os.MkdirAll(filepath.Dir(orphan), 0755)
+	os.WriteFile(orphan, []byte("orphan"), 0644)
+	st, err := fs.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Chunks < 2 || st.Chunks > 4 {
+		t.Errorf("GC after removing the edited copy: %+v", st)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphan chunk: %v", err)
+	}
+	fs.Unlink(nil, "a/f")
+	fs.Unlink(nil, "hard")
+	if st, _ := fs.GC(); st.Bytes != int64(len(data)) {
+		t.Errorf("GC after removing all: %+v", st)
+	}
+	if st := fs.Stats(); st.Chunks != 0 {
+		t.Errorf("stats after removing all: %+v", st)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSystemConcurrent(t *testing.T) {
+	fs, err := Open(t.TempDir(), &Options{ChunkSize: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 64<<10)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				writeFile(t, fs, name, data)
+				fs.Rename(nil, name, name+".old")
+				fs.Unlink(nil, name+".old")
+			}
+			writeFile(t, fs, name, data)
+		}(string(rune('a' + i)))
+	}
+	for j := 0; j < 10; j++ {
+		if _, err := fs.GC(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	fs.GC()
+	for i := 0; i < 4; i++ {
+		if got := readFile(t, fs, string(rune('a'+i)), 0, len(data)); !bytes.Equal(got, data) {
+			t.Errorf("content of %c differs", 'a'+i)
+		}
+	}
+	if st := fs.Stats(); st.Bytes != int64(len(data)) {
+		t.Errorf("stats: %+v", st)
+	}
+}
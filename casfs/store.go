@@ -0,0 +1,191 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package casfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ChunkID is the SHA-256 of the content of a chunk.
+type ChunkID [sha256.Size]byte
+
+func (id ChunkID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// chunkRef is a chunk of the content of a file.
+type chunkRef struct {
+	ID   ChunkID
+	Size uint32
+}
+
+type chunkInfo struct {
+	refs int
+	size uint32
+}
+
+// store is a directory of chunks, each in a file named by its ID, with
+// the count of the references to them from files. Chunks are only
+// removed by sweep.
+type store struct {
+	dir string
+
+	mu     sync.Mutex
+	chunks map[ChunkID]*chunkInfo
+	// unsynced are the files of the chunks put since the last sync.
+	unsynced []string
+}
+
+func newStore(dir string) *store {
+	return &store{dir: dir, chunks: make(map[ChunkID]*chunkInfo)}
+}
+
+func (s *store) path(id ChunkID) string {
+	h := id.String()
+	return filepath.Join(s.dir, h[:2], h[2:])
+}
+
+// put stores a chunk, unless it is already there.
+func (s *store) put(data []byte) (chunkRef, error) {
+	ref := chunkRef{ID: sha256.Sum256(data), Size: uint32(len(data))}
+	p := s.path(ref.ID)
+	if _, err := os.Stat(p); err == nil {
+		return ref, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return ref, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return ref, err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return ref, err
+	}
+	s.mu.Lock()
+	s.unsynced = append(s.unsynced, p)
+	s.mu.Unlock()
+	return ref, nil
+}
+
+// readAt reads the content of a chunk at off.
+func (s *store) readAt(id ChunkID, dest []byte, off int64) (int, error) {
+	f, err := os.Open(s.path(id))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.ReadAt(dest, off)
+}
+
+// ref adds a reference to each of refs.
+func (s *store) ref(refs []chunkRef) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range refs {
+		c := s.chunks[r.ID]
+		if c == nil {
+			c = &chunkInfo{size: r.Size}
+			s.chunks[r.ID] = c
+		}
+		c.refs++
+	}
+}
+
+// unref drops a reference to each of refs. Chunks left without
+// references stay in the directory until the next sweep.
+func (s *store) unref(refs []chunkRef) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range refs {
+		if c := s.chunks[r.ID]; c != nil {
+			if c.refs--; c.refs <= 0 {
+				delete(s.chunks, r.ID)
+			}
+		}
+	}
+}
+
+// sync makes the chunks put since the last sync durable.
+func (s *store) sync() error {
+	s.mu.Lock()
+	unsynced := s.unsynced
+	s.unsynced = nil
+	s.mu.Unlock()
+	for i, p := range unsynced {
+		f, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			err = f.Sync()
+			f.Close()
+		}
+		if err != nil {
+			s.mu.Lock()
+			s.unsynced = append(s.unsynced, unsynced[i:]...)
+			s.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// sweep removes the chunks without references, and the temporary
+// files of puts that did not finish. No put may run meanwhile.
+func (s *store) sweep() (stats GCStats, err error) {
+	dirs, err := os.ReadDir(s.dir)
+	if err != nil {
+		return stats, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range dirs {
+		if !d.IsDir() || len(d.Name()) != 2 {
+			continue
+		}
+		dir := filepath.Join(s.dir, d.Name())
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return stats, err
+		}
+		for _, e := range entries {
+			var id ChunkID
+			if !strings.HasPrefix(e.Name(), ".tmp-") {
+				b, err := hex.DecodeString(d.Name() + e.Name())
+				if err != nil || len(b) != len(id) {
+					continue
+				}
+				copy(id[:], b)
+				if s.chunks[id] != nil {
+					continue
+				}
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil && !os.IsNotExist(err) {
+				return stats, err
+			}
+			stats.Chunks++
+			stats.Bytes += info.Size()
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package casfs
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+const rootIno = 1
+
+// node is a file of the metadata tree.
+//
+// FileSystem.mu guards Nlink, Children and opens; mu guards the rest,
+// but for Ino and kind, which do not change.
+type node struct {
+	mu sync.Mutex
+
+	Ino    uint64
+	Mode   uint32
+	Nlink  uint32
+	Uid    uint32
+	Gid    uint32
+	Rdev   uint32
+	Size   uint64
+	Atime  time.Time
+	Mtime  time.Time
+	Ctime  time.Time
+	XAttrs map[string][]byte
+
+	Target   string            // of symlinks
+	Chunks   []chunkRef        // of regular files
+	Children map[string]uint64 // of directories
+
+	// dirty holds the writes not committed to Chunks yet.
+	dirty *dirtyData
+	// opens counts the open handles.
+	opens int
+	// kind is the file type of Mode.
+	kind uint32
+	// gone is set when the node is dropped.
+	gone bool
+}
+
+func (n *node) isDir() bool {
+	return n.kind == syscall.S_IFDIR
+}
+
+func (n *node) isRegular() bool {
+	return n.kind == syscall.S_IFREG
+}
+
+func (n *node) fillAttr(out *fuse.Attr) {
+	*out = fuse.Attr{
+		Ino:   n.Ino,
+		Mode:  n.Mode,
+		Nlink: n.Nlink,
+		Rdev:  n.Rdev,
+		Size:  n.Size,
+	}
+	out.Uid = n.Uid
+	out.Gid = n.Gid
+	switch {
+	case n.dirty != nil:
+		out.Size = n.dirty.size
+	case n.Mode&syscall.S_IFMT == syscall.S_IFLNK:
+		out.Size = uint64(len(n.Target))
+	}
+	out.Blocks = (out.Size + 511) / 512
+	out.SetTimes(&n.Atime, &n.Mtime, &n.Ctime)
+}
+
+// treeFile is the encoding of the metadata tree.
+type treeFile struct {
+	Version int
+	NextIno uint64
+	Nodes   []*node
+}
+
+const treeVersion = 1
+
+// loadTree reads the tree at p.
+func loadTree(p string) (*treeFile, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var t treeFile
+	if err := gob.NewDecoder(f).Decode(&t); err != nil {
+		return nil, fmt.Errorf("casfs: %s: %v", p, err)
+	}
+	if t.Version != treeVersion {
+		return nil, fmt.Errorf("casfs: %s: version %d", p, t.Version)
+	}
+	for _, n := range t.Nodes {
+		n.kind = n.Mode & syscall.S_IFMT
+	}
+	return &t, nil
+}
+
+// saveTree replaces the tree at p, durably.
+func saveTree(p string, t *treeFile) error {
+	f, err := os.CreateTemp(filepath.Dir(p), ".tree-")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(t)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if d, err := os.Open(filepath.Dir(p)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// checkTree checks that the nodes of t make a tree rooted at rootIno.
+func checkTree(t *treeFile) error {
+	nodes := make(map[uint64]*node, len(t.Nodes))
+	for _, n := range t.Nodes {
+		if n.Ino == 0 || n.Ino >= t.NextIno || nodes[n.Ino] != nil {
+			return fmt.Errorf("casfs: bad inode %d", n.Ino)
+		}
+		nodes[n.Ino] = n
+	}
+	if root := nodes[rootIno]; root == nil || !root.isDir() {
+		return errors.New("casfs: no root")
+	}
+	for _, n := range t.Nodes {
+		for name, ino := range n.Children {
+			if nodes[ino] == nil {
+				return fmt.Errorf("casfs: %q of inode %d is missing", name, n.Ino)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,436 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command pathfs-dump inspects bridge dumps written by pathfs.WriteDump.
+//
+// Usage:
+//
+//	pathfs-dump [summary|tree|files|orphans] DUMP
+//	pathfs-dump diff OLD NEW
+//
+// Without a command, all reports of a single dump are printed.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/someonegg/pathfs"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [summary|tree|files|orphans] DUMP\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s diff OLD NEW\n", os.Args[0])
+	}
+	flag.Parse()
+
+	if err := run(flag.Args(), os.Stdout); err != nil {
+		if err == errUsage {
+			flag.Usage()
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "pathfs-dump: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("usage")
+
+func run(args []string, w io.Writer) error {
+	if len(args) == 1 {
+		d, err := loadFile(args[0])
+		if err != nil {
+			return err
+		}
+		printSummary(w, d)
+		fmt.Fprintln(w)
+		printTree(w, d)
+		fmt.Fprintln(w)
+		printFiles(w, d)
+		fmt.Fprintln(w)
+		printOrphans(w, d)
+		return nil
+	}
+
+	if len(args) == 3 && args[0] == "diff" {
+		old, err := loadFile(args[1])
+		if err != nil {
+			return err
+		}
+		cur, err := loadFile(args[2])
+		if err != nil {
+			return err
+		}
+		printDiff(w, old, cur)
+		return nil
+	}
+
+	if len(args) != 2 {
+		return errUsage
+	}
+	var report func(io.Writer, *dump)
+	switch args[0] {
+	case "summary":
+		report = printSummary
+	case "tree":
+		report = printTree
+	case "files":
+		report = printFiles
+	case "orphans":
+		report = printOrphans
+	default:
+		return errUsage
+	}
+	d, err := loadFile(args[1])
+	if err != nil {
+		return err
+	}
+	report(w, d)
+	return nil
+}
+
+// dump is a bridge dump loaded in memory.
+type dump struct {
+	data   *pathfs.DumpRawBridge
+	inodes map[uint64]*pathfs.DumpInode
+	// children by parent ino, then name.
+	children map[uint64]map[string]uint64
+	report   *pathfs.RestoreReport
+}
+
+func loadFile(name string) (*dump, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d, err := load(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return d, nil
+}
+
+func load(r io.Reader) (*dump, error) {
+	data, iterator, err := pathfs.ReadDump(r)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &dump{
+		data:     data,
+		inodes:   make(map[uint64]*pathfs.DumpInode),
+		children: make(map[uint64]map[string]uint64),
+	}
+	for {
+		n, err := iterator.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		d.inodes[n.Ino] = n
+		for _, p := range n.Parents {
+			m := d.children[p.Node]
+			if m == nil {
+				m = make(map[string]uint64)
+				d.children[p.Node] = m
+			}
+			m[p.Name] = n.Ino
+		}
+	}
+
+	d.report = d.validate()
+	return d, nil
+}
+
+// validate runs the restore validation of the library on a scratch
+// bridge.
+func (d *dump) validate() *pathfs.RestoreReport {
+	data := *d.data
+	// the state belongs to the FileSystem and is opaque here.
+	data.FSState = nil
+
+	files := make([]*pathfs.DumpFileEntry, len(data.Files))
+	for i, f := range data.Files {
+		c := *f
+		files[i] = &c
+	}
+	data.Files = files
+
+	b := pathfs.NewPathFS(pathfs.DefaultFileSystem(), nil).(pathfs.Copier)
+	filler, err := b.Restore(&data)
+	if err != nil {
+		return nil
+	}
+	for _, n := range d.inodes {
+		c := *n
+		filler.AddInode(&c)
+	}
+	filler.Finished()
+	return filler.(*pathfs.InodeRestorer).Report()
+}
+
+func (d *dump) isFree(fh int) bool {
+	for _, v := range d.data.FreeFiles {
+		if int(v) == fh {
+			return true
+		}
+	}
+	return false
+}
+
+// path returns the path of an inode through its newest parents, and
+// false if the inode does not reach the root.
+func (d *dump) path(ino uint64) (string, bool) {
+	var segments []string
+	seen := map[uint64]bool{}
+	for ino != 1 {
+		n := d.inodes[ino]
+		if n == nil || len(n.Parents) == 0 || seen[ino] {
+			return "", false
+		}
+		seen[ino] = true
+		p := n.Parents[len(n.Parents)-1]
+		segments = append(segments, p.Name)
+		ino = p.Node
+	}
+	for i, j := 0, len(segments)-1; i < j; i, j = i+1, j-1 {
+		segments[i], segments[j] = segments[j], segments[i]
+	}
+	return strings.Join(segments, "/"), true
+}
+
+// resolve returns the inode at path.
+func (d *dump) resolve(path string) (uint64, bool) {
+	ino := uint64(1)
+	if path == "" {
+		return ino, true
+	}
+	for _, name := range strings.Split(path, "/") {
+		child, ok := d.children[ino][name]
+		if !ok {
+			return 0, false
+		}
+		ino = child
+	}
+	return ino, true
+}
+
+// reachable returns the inodes reachable from the root.
+func (d *dump) reachable() map[uint64]bool {
+	seen := map[uint64]bool{1: true}
+	queue := []uint64{1}
+	for len(queue) > 0 {
+		ino := queue[0]
+		queue = queue[1:]
+		for _, child := range d.children[ino] {
+			if !seen[child] {
+				seen[child] = true
+				queue = append(queue, child)
+			}
+		}
+	}
+	return seen
+}
+
+func sortedInos(m map[uint64]*pathfs.DumpInode) []uint64 {
+	inos := make([]uint64, 0, len(m))
+	for ino := range m {
+		inos = append(inos, ino)
+	}
+	sort.Slice(inos, func(i, j int) bool { return inos[i] < inos[j] })
+	return inos
+}
+
+func sortedNames(m map[string]uint64) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func printSummary(w io.Writer, d *dump) {
+	dirs, links := 0, 0
+	for _, n := range d.inodes {
+		if n.IsDir {
+			dirs++
+		}
+		if len(n.Parents) > 1 {
+			links++
+		}
+	}
+	open := 0
+	for i := range d.data.Files {
+		if i != 0 && !d.isFree(i) {
+			open++
+		}
+	}
+	orphans := len(d.inodes) - len(d.reachable())
+	if _, ok := d.inodes[1]; !ok {
+		orphans++
+	}
+
+	fmt.Fprintf(w, "inodes:       %d (%d declared)\n", len(d.inodes), d.data.NodeCount)
+	fmt.Fprintf(w, "directories:  %d\n", dirs)
+	fmt.Fprintf(w, "hard links:   %d\n", links)
+	fmt.Fprintf(w, "orphans:      %d\n", orphans)
+	fmt.Fprintf(w, "file handles: %d open, %d free\n", open, len(d.data.FreeFiles))
+	fmt.Fprintf(w, "fs state:     %d bytes\n", len(d.data.FSState))
+	if d.report == nil {
+		return
+	}
+	fmt.Fprintf(w, "validation:   %d problems\n", len(d.report.Problems))
+	for _, p := range d.report.Problems {
+		fmt.Fprintf(w, "  %v\n", p)
+	}
+}
+
+func printTree(w io.Writer, d *dump) {
+	root := d.inodes[1]
+	if root == nil {
+		fmt.Fprintln(w, "root inode not found")
+		return
+	}
+	fmt.Fprintf(w, ". (n1, lookups %d)\n", root.LookupCount)
+
+	onPath := map[uint64]bool{1: true}
+	var walk func(ino uint64, prefix string)
+	walk = func(ino uint64, prefix string) {
+		names := sortedNames(d.children[ino])
+		for i, name := range names {
+			child := d.children[ino][name]
+			branch, indent := "├─ ", "│  "
+			if i == len(names)-1 {
+				branch, indent = "└─ ", "   "
+			}
+			n := d.inodes[child]
+			if n.IsDir {
+				name += "/"
+			}
+			fmt.Fprintf(w, "%s%s%s (n%d, lookups %d)", prefix, branch, name, child, n.LookupCount)
+			if len(n.Parents) > 1 {
+				fmt.Fprintf(w, " [%d links]", len(n.Parents))
+			}
+			if onPath[child] {
+				fmt.Fprintln(w, " [cycle]")
+				continue
+			}
+			fmt.Fprintln(w)
+			onPath[child] = true
+			walk(child, prefix+indent)
+			delete(onPath, child)
+		}
+	}
+	walk(1, "")
+}
+
+func printFiles(w io.Writer, d *dump) {
+	fmt.Fprintln(w, "open file handles:")
+	for i, f := range d.data.Files {
+		if i == 0 || d.isFree(i) {
+			continue
+		}
+		kind := "file"
+		if f.Stream != nil {
+			kind = fmt.Sprintf("dir, %d entries", len(f.Stream))
+		}
+		if f.Handle != nil {
+			kind += fmt.Sprintf(", %d bytes handle state", len(f.Handle))
+		}
+		target := "unknown path"
+		if ino, ok := d.resolve(f.Path); ok {
+			target = fmt.Sprintf("n%d", ino)
+		} else if f.Path == "" {
+			target = "inode path"
+		}
+		fmt.Fprintf(w, "  fh%d uFh=%d opener=%d:%d %q (%s) -> %s\n",
+			i, f.UFh, f.Opener.Uid, f.Opener.Gid, f.Path, kind, target)
+	}
+}
+
+func printOrphans(w io.Writer, d *dump) {
+	fmt.Fprintln(w, "orphaned inodes:")
+	reachable := d.reachable()
+	for _, ino := range sortedInos(d.inodes) {
+		if reachable[ino] {
+			continue
+		}
+		n := d.inodes[ino]
+		parents := make([]string, len(n.Parents))
+		for i, p := range n.Parents {
+			parents[i] = fmt.Sprintf("n%d/%s", p.Node, p.Name)
+		}
+		fmt.Fprintf(w, "  n%d lookups %d dir %v parents [%s]\n",
+			ino, n.LookupCount, n.IsDir, strings.Join(parents, " "))
+	}
+}
+
+func printDiff(w io.Writer, old, cur *dump) {
+	describe := func(d *dump, ino uint64) string {
+		if p, ok := d.path(ino); ok {
+			return fmt.Sprintf("n%d %q", ino, p)
+		}
+		return fmt.Sprintf("n%d (orphaned)", ino)
+	}
+
+	for _, ino := range sortedInos(old.inodes) {
+		if _, ok := cur.inodes[ino]; !ok {
+			fmt.Fprintf(w, "- %s\n", describe(old, ino))
+		}
+	}
+	for _, ino := range sortedInos(cur.inodes) {
+		n := cur.inodes[ino]
+		o, ok := old.inodes[ino]
+		if !ok {
+			fmt.Fprintf(w, "+ %s\n", describe(cur, ino))
+			continue
+		}
+		if o.LookupCount != n.LookupCount {
+			fmt.Fprintf(w, "~ n%d lookups %d -> %d\n", ino, o.LookupCount, n.LookupCount)
+		}
+		if o.IsDir != n.IsDir {
+			fmt.Fprintf(w, "~ n%d dir %v -> %v\n", ino, o.IsDir, n.IsDir)
+		}
+		if o.Generation != n.Generation {
+			fmt.Fprintf(w, "~ n%d generation %d -> %d\n", ino, o.Generation, n.Generation)
+		}
+		op, _ := old.path(ino)
+		np, _ := cur.path(ino)
+		if op != np || len(o.Parents) != len(n.Parents) {
+			fmt.Fprintf(w, "~ %s -> %s\n", describe(old, ino), describe(cur, ino))
+		}
+	}
+
+	count := len(old.data.Files)
+	if len(cur.data.Files) > count {
+		count = len(cur.data.Files)
+	}
+	for i := 1; i < count; i++ {
+		var o, n *pathfs.DumpFileEntry
+		if i < len(old.data.Files) && !old.isFree(i) {
+			o = old.data.Files[i]
+		}
+		if i < len(cur.data.Files) && !cur.isFree(i) {
+			n = cur.data.Files[i]
+		}
+		switch {
+		case o == nil && n != nil:
+			fmt.Fprintf(w, "+ fh%d uFh=%d %q\n", i, n.UFh, n.Path)
+		case o != nil && n == nil:
+			fmt.Fprintf(w, "- fh%d uFh=%d %q\n", i, o.UFh, o.Path)
+		case o != nil && (o.Path != n.Path || o.UFh != n.UFh || o.Opener != n.Opener):
+			fmt.Fprintf(w, "~ fh%d uFh=%d %q -> uFh=%d %q\n", i, o.UFh, o.Path, n.UFh, n.Path)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+)
+
+type sliceIterator []*pathfs.DumpInode
+
+func (s *sliceIterator) Next() (*pathfs.DumpInode, error) {
+	if len(*s) == 0 {
+		return nil, io.EOF
+	}
+	n := (*s)[0]
+	*s = (*s)[1:]
+	return n, nil
+}
+
+func writeDump(t *testing.T, name string, files []*pathfs.DumpFileEntry, inodes ...*pathfs.DumpInode) string {
+	path := filepath.Join(t.TempDir(), name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	data := &pathfs.DumpRawBridge{NodeCount: len(inodes), Files: files}
+	it := sliceIterator(inodes)
+	if err := pathfs.WriteDump(f, data, &it); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func sampleDump(t *testing.T) string {
+	return writeDump(t, "a", []*pathfs.DumpFileEntry{
+		{},
+		{Opener: fuse.Owner{Uid: 1000, Gid: 100}, Path: "d/f", UFh: 7},
+	},
+		&pathfs.DumpInode{Ino: 1, LookupCount: 1, IsDir: true},
+		&pathfs.DumpInode{Ino: 2, LookupCount: 1, IsDir: true, Parents: []pathfs.DumpParentEntry{{Name: "d", Node: 1}}},
+		&pathfs.DumpInode{Ino: 3, LookupCount: 2, Parents: []pathfs.DumpParentEntry{{Name: "g", Node: 1}, {Name: "f", Node: 2}}},
+		&pathfs.DumpInode{Ino: 4, LookupCount: 1},
+	)
+}
+
+func runOutput(t *testing.T, args ...string) string {
+	var buf bytes.Buffer
+	if err := run(args, &buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func assertContains(t *testing.T, out string, want ...string) {
+	for _, w := range want {
+		if !strings.Contains(out, w) {
+			t.Errorf("want %q in output:\n%s", w, out)
+		}
+	}
+}
+
+func TestReports(t *testing.T) {
+	path := sampleDump(t)
+
+	assertContains(t, runOutput(t, "summary", path),
+		"inodes:       4 (4 declared)",
+		"hard links:   1",
+		"orphans:      1",
+		"file handles: 1 open, 0 free",
+		"validation:   0 problems")
+	assertContains(t, runOutput(t, "tree", path),
+		"├─ d/ (n2, lookups 1)",
+		"│  └─ f (n3, lookups 2) [2 links]",
+		"└─ g (n3, lookups 2) [2 links]")
+	assertContains(t, runOutput(t, "files", path),
+		`fh1 uFh=7 opener=1000:100 "d/f" (file) -> n3`)
+	assertContains(t, runOutput(t, "orphans", path),
+		"n4 lookups 1 dir false parents []")
+}
+
+func TestDiff(t *testing.T) {
+	old := sampleDump(t)
+	cur := writeDump(t, "b", []*pathfs.DumpFileEntry{{}, {Path: "e/f", UFh: 7}},
+		&pathfs.DumpInode{Ino: 1, LookupCount: 1, IsDir: true},
+		&pathfs.DumpInode{Ino: 2, LookupCount: 3, IsDir: true, Parents: []pathfs.DumpParentEntry{{Name: "e", Node: 1}}},
+		&pathfs.DumpInode{Ino: 3, LookupCount: 2, Parents: []pathfs.DumpParentEntry{{Name: "g", Node: 1}, {Name: "f", Node: 2}}},
+		&pathfs.DumpInode{Ino: 5, LookupCount: 1, Parents: []pathfs.DumpParentEntry{{Name: "h", Node: 1}}},
+	)
+
+	assertContains(t, runOutput(t, "diff", old, cur),
+		"- n4 (orphaned)",
+		"~ n2 lookups 1 -> 3",
+		`~ n2 "d" -> n2 "e"`,
+		`~ n3 "d/f" -> n3 "e/f"`,
+		`+ n5 "h"`,
+		`~ fh1 uFh=7 "d/f" -> uFh=7 "e/f"`)
+}
+
+func TestUsage(t *testing.T) {
+	if err := run(nil, io.Discard); err != errUsage {
+		t.Errorf("want usage error, have %v", err)
+	}
+	if err := run([]string{"bogus", "x"}, io.Discard); err != errUsage {
+		t.Errorf("want usage error, have %v", err)
+	}
+}
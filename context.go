@@ -19,6 +19,28 @@ import (
 type Context struct {
 	fuse.Context
 	Opener *fuse.Owner // set when manipulating file handle.
+
+	// kernel is the caller as seen by the kernel, before the
+	// Options.UIDMap and Options.GIDMap translation.
+	kernel fuse.Caller
+
+	// bridge and node are set for requests about an inode, see
+	// Paths.
+	bridge *rawBridge
+	node   *inode
+}
+
+// Paths returns the known paths of the inode of the request, the
+// most recently looked up first, for FileSystems that handle hard
+// links. It is set in the calls about an inode, including Link for
+// its source, and nil in the calls about a name in a directory:
+// Mknod, Mkdir, Unlink, Rmdir, Rename, Symlink, Create and the
+// GetAttr of a lookup.
+func (c *Context) Paths() []string {
+	if c.node == nil {
+		return nil
+	}
+	return c.bridge.allPaths(c.node)
 }
 
 func (c *Context) Deadline() (time.Time, bool) {
@@ -71,6 +93,9 @@ func newContext(cancel <-chan struct{}, caller fuse.Caller) *Context {
 	ctx.Cancel = cancel
 	ctx.Caller = caller
 	ctx.Opener = nil
+	ctx.kernel = caller
+	ctx.bridge = nil
+	ctx.node = nil
 	return ctx
 }
 
@@ -78,5 +103,8 @@ func releaseContext(ctx *Context) {
 	ctx.Cancel = nil
 	ctx.Caller = fuse.Caller{}
 	ctx.Opener = nil
+	ctx.kernel = fuse.Caller{}
+	ctx.bridge = nil
+	ctx.node = nil
 	contextPool.Put(ctx)
 }
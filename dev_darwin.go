@@ -0,0 +1,16 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+// SplitDev returns the major and minor numbers of a dev_t.
+func SplitDev(dev uint32) (major, minor uint32) {
+	return dev >> 24, dev & 0xffffff
+}
+
+// MakeDev returns the dev_t of a major and minor number, encoded as
+// on the host like fuse.Attr.Rdev.
+func MakeDev(major, minor uint32) uint32 {
+	return major<<24 | minor&0xffffff
+}
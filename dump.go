@@ -9,10 +9,13 @@ import (
 
 type DumpFileEntry struct {
 	Opener fuse.Owner
+	Ino    uint64
 	Path   string
 
 	// file
 	UFh uint32
+	// Handle is the state of a FileHandle, see FileHandleDumper.
+	Handle []byte
 
 	// dir
 	Stream []fuse.DirEntry
@@ -22,6 +25,16 @@ type DumpRawBridge struct {
 	NodeCount int
 	Files     []*DumpFileEntry
 	FreeFiles []uint32
+
+	// FSState is the FileSystem's own state, see StateDumper.
+	FSState []byte
+
+	// InoTable is the state of Options.InoAllocator.
+	InoTable []byte
+
+	// Sillies are the hidden paths of the files silly-renamed by
+	// Options.SillyRename, by inode.
+	Sillies map[uint64]string
 }
 
 type DumpInode struct {
@@ -30,6 +43,9 @@ type DumpInode struct {
 	LookupCount uint32
 	Parents     []DumpParentEntry
 	IsDir       bool
+	Generation  uint64
+	FileType    uint32
+	BackendGen  uint64
 }
 
 type DumpParentEntry struct {
@@ -42,6 +58,34 @@ type InodeIterator interface {
 	Next() (data *DumpInode, err error)
 }
 
+// StateDumper is an optional interface for a FileSystem to carry its
+// own state (open handle table, caches) across a Dump/Restore handoff,
+// so the uFh values in DumpFileEntry stay meaningful. The encoding of
+// the state is up to the FileSystem.
+type StateDumper interface {
+	DumpState() ([]byte, error)
+	// RestoreState is called by Restore, before any inode is added.
+	RestoreState(data []byte) error
+}
+
+// FileHandleDumper is an optional interface for a FileHandle that can
+// be carried across a Dump/Restore handoff. Dump fails if an open
+// FileHandle does not implement it.
+type FileHandleDumper interface {
+	DumpHandle() ([]byte, error)
+}
+
+// HandleRestorer is an optional interface for a HandleFileSystem to
+// revive the handles saved by FileHandleDumper.
+type HandleRestorer interface {
+	RestoreHandle(path string, data []byte) (FileHandle, error)
+}
+
+var (
+	errStateNotRestorable  = errors.New("dump carries FileSystem state, but the FileSystem is not a StateDumper")
+	errHandleNotRestorable = errors.New("dump carries file handles, but the FileSystem is not a HandleRestorer")
+)
+
 type Copier interface {
 	Dump() (data *DumpRawBridge, iterator InodeIterator, err error)
 	Restore(data *DumpRawBridge) (filler InodeFiller, err error)
@@ -78,6 +122,9 @@ func (s *InodeDumper) Next() (data *DumpInode, err error) {
 		node.lookupCount,
 		node.parents.Dump(),
 		node.isDir(),
+		node.generation,
+		node.fileType,
+		node.backendGen,
 	}
 	s.off++
 	return data, nil
@@ -93,75 +140,74 @@ type InodeRestorer struct {
 	nodeCount    int
 	addNodeCount int
 	bridge       *rawBridge
-}
 
-// if not found in bridge's inodes, insert a new one and return it
-// otherwise just return the existed one
-func (s *InodeRestorer) getDirInode(ino uint64) *inode {
-	inodes := s.bridge.nodes
-	var ret *inode
-	var found bool
-	if ret, found = inodes[ino]; !found {
-		ret = &inode{
-			ino:      ino,
-			children: make(map[string]*inode),
-		}
-		inodes[ino] = ret
-	}
-	return ret
+	// dumped collects the inodes until Finished validates and
+	// links them.
+	dumped map[uint64]*DumpInode
+	report *RestoreReport
 }
 
 func (s *InodeRestorer) AddInode(dumpInode *DumpInode) error {
-
-	inodes := s.bridge.nodes
-	var curInode *inode
-	var found bool
-	if curInode, found = inodes[dumpInode.Ino]; !found {
-		curInode = &inode{
-			ino: dumpInode.Ino,
-		}
-		inodes[dumpInode.Ino] = curInode
-	}
-
-	// restore other fields
-	curInode.revision = dumpInode.Revision
-	curInode.lookupCount = dumpInode.LookupCount
-	if dumpInode.IsDir && curInode.children == nil {
-		curInode.children = make(map[string]*inode)
+	if s.dumped == nil {
+		s.dumped = make(map[uint64]*DumpInode)
 	}
-
-	var parInode *inode
-	for _, p := range dumpInode.Parents {
-		parInode = s.getDirInode(p.Node)
-		parInode.children[p.Name] = curInode
-		curInode.parents.add(parentEntry{name: p.Name, node: parInode})
-	}
-
+	s.dumped[dumpInode.Ino] = dumpInode
 	s.addNodeCount++
 
 	return nil
 }
 
-// Finished restore root inode and verify inode's count
+// Finished validates the dumped inode graph, links it into the bridge
+// and restores the bridge's root. Problems fail the restore unless
+// Options.RepairRestore is set, in which case they are repaired.
 func (s *InodeRestorer) Finished() error {
 	bridge := s.bridge
 
-	if root, found := s.bridge.nodes[1]; !found {
-		return errors.New("root inode not found")
-	} else {
-		bridge.root = root
+	report, parents := s.validate(bridge.options.RepairRestore)
+	s.report = report
+	for _, p := range report.Problems {
+		bridge.logf("warning: restore: %v", p)
+	}
+	if !report.OK() && !report.Repaired {
+		return fmt.Errorf("restore: %v", report)
 	}
 
-	if s.addNodeCount < s.nodeCount {
-		for _, n := range s.bridge.nodes {
-			if n.revision == 0 {
-				bridge.logf("warning: inode %d is lost.\n", n.ino)
-			}
+	inodes := make(map[uint64]*inode, len(s.dumped))
+	for ino, d := range s.dumped {
+		n := &inode{
+			ino:         ino,
+			revision:    d.Revision,
+			lookupCount: d.LookupCount,
+			generation:  d.Generation,
+			fileType:    d.FileType,
+			backendGen:  d.BackendGen,
+		}
+		if n.generation == 0 {
+			// dumped before generations were kept.
+			n.generation = 1
+		}
+		if d.IsDir {
+			n.children = make(map[string]*inode)
+		}
+		inodes[ino] = n
+	}
+	for ino, ps := range parents {
+		n := inodes[ino]
+		for _, p := range ps {
+			parent := inodes[p.Node]
+			parent.children[p.Name] = n
+			n.parents.add(parentEntry{name: p.Name, node: parent})
 		}
-		return fmt.Errorf("expected %d inodes, but only got %d inodes", s.nodeCount, s.addNodeCount)
 	}
 
-	s.bridge.nodeCountHigh = len(s.bridge.nodes)
+	bridge.nodes = inodes
+	bridge.root = inodes[1]
+	bridge.nodeCountHigh = len(inodes)
 
 	return nil
 }
+
+// Report returns the outcome of the validation done by Finished.
+func (s *InodeRestorer) Report() *RestoreReport {
+	return s.report
+}
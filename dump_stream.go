@@ -0,0 +1,69 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// dumpStreamVersion is written at the start of every dump stream.
+const dumpStreamVersion = 1
+
+// WriteDump serializes the result of Copier.Dump to w: the
+// DumpRawBridge followed by every inode of the iterator, gob encoded.
+func WriteDump(w io.Writer, data *DumpRawBridge, iterator InodeIterator) error {
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(dumpStreamVersion); err != nil {
+		return err
+	}
+	if err := enc.Encode(data); err != nil {
+		return err
+	}
+	for {
+		n, err := iterator.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(n); err != nil {
+			return err
+		}
+	}
+}
+
+// ReadDump reads a stream written by WriteDump. The inodes are decoded
+// lazily by the returned iterator, which can be fed to the InodeFiller
+// of Copier.Restore.
+func ReadDump(r io.Reader) (data *DumpRawBridge, iterator InodeIterator, err error) {
+	dec := gob.NewDecoder(r)
+	var version int
+	if err := dec.Decode(&version); err != nil {
+		return nil, nil, err
+	}
+	if version != dumpStreamVersion {
+		return nil, nil, fmt.Errorf("unsupported dump stream version %d", version)
+	}
+	data = &DumpRawBridge{}
+	if err := dec.Decode(data); err != nil {
+		return nil, nil, err
+	}
+	return data, &inodeDecoder{dec}, nil
+}
+
+type inodeDecoder struct {
+	dec *gob.Decoder
+}
+
+func (d *inodeDecoder) Next() (*DumpInode, error) {
+	n := &DumpInode{}
+	if err := d.dec.Decode(n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
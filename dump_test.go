@@ -1,7 +1,12 @@
 package pathfs
 
 import (
+	"bytes"
+	"io"
+	"syscall"
 	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 type simpleFileInfo struct {
@@ -130,3 +135,164 @@ func TestDump(t *testing.T) {
 		printDirTree(receiverBridge.root)
 	}
 }
+
+func TestDumpFileSystemState(t *testing.T) {
+	dir := t.TempDir()
+	ctx := &Context{}
+
+	senderFS := NewTestFileSystem(dir)
+	uFh, _, code := senderFS.Create(ctx, "f", syscall.O_RDWR, 0644)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code := senderFS.Write(ctx, "f", uFh, []byte("hello"), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+
+	senderBridge := NewPathFS(senderFS, nil).(*rawBridge)
+	senderBridge.registerFile(fuse.Owner{}, 0, "f", uFh, nil)
+
+	// the file is reopened at its new name.
+	if code := senderFS.Rename(ctx, "f", "g"); !code.Ok() {
+		t.Fatal(code)
+	}
+	senderBridge.renameFiles("f", "g")
+	dumpB, _, err := senderBridge.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dumpB.FSState == nil {
+		t.Fatal("want FileSystem state in dump")
+	}
+
+	receiverFS := NewTestFileSystem(dir)
+	receiverBridge := NewPathFS(receiverFS, nil).(*rawBridge)
+	if _, err := receiverBridge.Restore(dumpB); err != nil {
+		t.Fatal(err)
+	}
+
+	f := receiverBridge.files[1]
+	dest := make([]byte, 16)
+	res, code := receiverFS.Read(ctx, f.path, f.uFh, dest, 0)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	data, _ := res.Bytes(dest)
+	if string(data) != "hello" {
+		t.Errorf("want %q, have %q", "hello", data)
+	}
+	senderFS.Release(ctx, "g", uFh)
+	receiverFS.Release(ctx, "g", f.uFh)
+
+	// a FileSystem without state cannot take it back.
+	if _, err := newTestBridge().Restore(dumpB); err == nil {
+		t.Error("want error restoring state into a FileSystem that is not a StateDumper")
+	}
+}
+
+func TestDumpCopiesTables(t *testing.T) {
+	b := newTestBridge()
+	constructDirTree(b)
+	fh1 := b.registerFile(fuse.Owner{}, 1, "", 0, nil)
+	fh2 := b.registerFile(fuse.Owner{}, 1, "", 0, nil)
+	b.unregisterFile(fh1)
+	b.sillies = map[uint64]string{1: sillyPrefix}
+
+	dumpB, _, err := b.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the bridge goes on after the dump.
+	b.registerFile(fuse.Owner{}, 1, "", 0, nil)
+	b.unregisterFile(fh2)
+	delete(b.sillies, 1)
+	if len(dumpB.FreeFiles) != 1 || dumpB.FreeFiles[0] != fh1 {
+		t.Errorf("want free files [%d], have %v", fh1, dumpB.FreeFiles)
+	}
+	if len(dumpB.Sillies) != 1 {
+		t.Errorf("want the silly-renamed file kept, have %v", dumpB.Sillies)
+	}
+}
+
+func TestTestFileSystemRename(t *testing.T) {
+	dir := t.TempDir()
+	ctx := &Context{}
+	fs := NewTestFileSystem(dir)
+
+	fs.Mkdir(ctx, "d", 0755)
+	for _, path := range []string{"d/f", "g"} {
+		uFh, _, code := fs.Create(ctx, path, syscall.O_RDWR, 0644)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		fs.Release(ctx, path, uFh)
+		fs.SetXAttr(ctx, path, "user.x", []byte(path), 0)
+	}
+
+	// the extended attributes go with the files, and the target's
+	// are dropped.
+	fs.Unlink(ctx, "g")
+	if code := fs.Rename(ctx, "d", "g"); !code.Ok() {
+		t.Fatal(code)
+	}
+	if v, code := fs.GetXAttr(ctx, "g/f", "user.x"); !code.Ok() || string(v) != "d/f" {
+		t.Errorf("want %q, have %q, %v", "d/f", v, code)
+	}
+	if _, code := fs.GetXAttr(ctx, "d/f", "user.x"); code.Ok() {
+		t.Error("want no attribute left at the old path")
+	}
+	if _, code := fs.GetXAttr(ctx, "g", "user.x"); code.Ok() {
+		t.Error("want the attribute of the replaced target dropped")
+	}
+}
+
+func TestWriteReadDump(t *testing.T) {
+	senderBridge := newTestBridge()
+	constructDirTree(senderBridge)
+
+	dumpB, iter, err := senderBridge.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteDump(&buf, dumpB, iter); err != nil {
+		t.Fatal(err)
+	}
+
+	data, iter, err := ReadDump(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiverBridge := &rawBridge{}
+	filler, err := receiverBridge.Restore(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		n, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := filler.AddInode(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := filler.Finished(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(senderBridge.nodes) != len(receiverBridge.nodes) {
+		t.Errorf("want: %d inodes, have: %d", len(senderBridge.nodes), len(receiverBridge.nodes))
+	}
+	for ino, old := range senderBridge.nodes {
+		assertSameInode(t, old, receiverBridge.nodes[ino])
+	}
+
+	if _, _, err := ReadDump(bytes.NewReader(buf.Bytes()[:0])); err == nil {
+		t.Error("want error reading an empty stream")
+	}
+}
@@ -0,0 +1,393 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// RestoreProblemKind classifies an inconsistency found in a dumped
+// inode graph.
+type RestoreProblemKind int
+
+const (
+	// MissingInode means fewer inodes than DumpRawBridge.NodeCount
+	// were added, or the root inode is absent.
+	MissingInode RestoreProblemKind = iota
+	// DanglingParent means a parent entry refers to an inode that
+	// was not dumped.
+	DanglingParent
+	// NotADirectory means a parent entry refers to an inode that
+	// is not a directory, so it cannot hold children.
+	NotADirectory
+	// ParentCycle means following parent entries leads back to the
+	// inode itself.
+	ParentCycle
+	// LookupCountAnomaly means an inode is neither referenced by
+	// the kernel nor kept alive by children, or the root has a zero
+	// lookup count.
+	LookupCountAnomaly
+	// DuplicateName means two inodes claim the same name under one
+	// parent.
+	DuplicateName
+	// UnknownFilePath means a file table entry refers to an inode
+	// that was not dumped, or to a path that does not resolve in the
+	// restored tree although its inode still has a name.
+	UnknownFilePath
+)
+
+var restoreProblemNames = [...]string{
+	MissingInode:       "missing inode",
+	DanglingParent:     "dangling parent",
+	NotADirectory:      "not a directory",
+	ParentCycle:        "parent cycle",
+	LookupCountAnomaly: "lookup count anomaly",
+	DuplicateName:      "duplicate name",
+	UnknownFilePath:    "unknown file path",
+}
+
+func (k RestoreProblemKind) String() string {
+	if k >= 0 && int(k) < len(restoreProblemNames) {
+		return restoreProblemNames[k]
+	}
+	return fmt.Sprintf("RestoreProblemKind(%d)", int(k))
+}
+
+// RestoreProblem describes one inconsistency.
+type RestoreProblem struct {
+	Kind RestoreProblemKind
+	// Ino is the inode concerned, 0 for file table entries of no
+	// known inode.
+	Ino uint64
+	// Fh is the file table slot concerned, 0 for inodes.
+	Fh     uint32
+	Detail string
+}
+
+func (p RestoreProblem) String() string {
+	if p.Fh != 0 {
+		return fmt.Sprintf("%v: fh%d: %s", p.Kind, p.Fh, p.Detail)
+	}
+	return fmt.Sprintf("%v: n%d: %s", p.Kind, p.Ino, p.Detail)
+}
+
+// RestoreReport is the result of validating a dumped inode graph.
+type RestoreReport struct {
+	Problems []RestoreProblem
+	// Repaired is set when the problems were fixed instead of
+	// failing the restore.
+	Repaired bool
+	// Dropped lists the inodes removed by the repair.
+	Dropped []uint64
+	// Orphaned lists the inodes the repair cut off from the root,
+	// because it dropped the entries leading to them. They are kept
+	// without names, like unlinked files, as the kernel or open
+	// files still refer to them.
+	Orphaned []uint64
+}
+
+// OK returns true if no problem was found.
+func (r *RestoreReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *RestoreReport) String() string {
+	if r.OK() {
+		return "no problems"
+	}
+	lines := make([]string, len(r.Problems))
+	for i, p := range r.Problems {
+		lines[i] = p.String()
+	}
+	return fmt.Sprintf("%d problems: %s", len(r.Problems), strings.Join(lines, "; "))
+}
+
+func (r *RestoreReport) add(kind RestoreProblemKind, ino uint64, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, RestoreProblem{
+		Kind:   kind,
+		Ino:    ino,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+type childKey struct {
+	parent uint64
+	name   string
+}
+
+// validate checks the dumped inodes and the bridge's file table. It
+// returns the parent entries that survived the checks, keyed by
+// child ino. If repair is set, broken entries and nodes are dropped
+// from s.dumped and the file table is fixed up; inodes losing their
+// newest parent are re-parented onto the next valid one, and inodes
+// no longer reachable from the root become orphans, or are dropped if
+// nothing refers to them.
+func (s *InodeRestorer) validate(repair bool) (*RestoreReport, map[uint64][]DumpParentEntry) {
+	r := &RestoreReport{}
+	if s.dumped == nil {
+		s.dumped = make(map[uint64]*DumpInode)
+	}
+
+	if s.addNodeCount < s.nodeCount {
+		r.add(MissingInode, 0, "expected %d inodes, but only got %d inodes", s.nodeCount, s.addNodeCount)
+	}
+
+	root := s.dumped[1]
+	if root == nil {
+		r.add(MissingInode, 1, "root inode not found")
+		root = &DumpInode{Ino: 1, LookupCount: 1, IsDir: true}
+		if repair {
+			s.dumped[1] = root
+		}
+	}
+	if !root.IsDir {
+		r.add(NotADirectory, 1, "root inode is not a directory")
+		if repair {
+			root.IsDir = true
+		}
+	}
+	if root.LookupCount == 0 {
+		r.add(LookupCountAnomaly, 1, "root inode has zero lookup count")
+		if repair {
+			root.LookupCount = 1
+		}
+	}
+
+	inos := make([]uint64, 0, len(s.dumped))
+	for ino := range s.dumped {
+		inos = append(inos, ino)
+	}
+	sort.Slice(inos, func(i, j int) bool { return inos[i] < inos[j] })
+
+	// Check each parent entry on its own.
+	names := make(map[childKey]uint64)
+	parents := make(map[uint64][]DumpParentEntry, len(inos))
+	for _, ino := range inos {
+		d := s.dumped[ino]
+		var kept []DumpParentEntry
+		for _, p := range d.Parents {
+			key := childKey{p.Node, p.Name}
+			par := s.dumped[p.Node]
+			switch {
+			case ino == 1:
+				r.add(ParentCycle, ino, "root inode has parent n%d %q", p.Node, p.Name)
+			case par == nil:
+				r.add(DanglingParent, ino, "parent n%d of %q was not dumped", p.Node, p.Name)
+			case !par.IsDir:
+				r.add(NotADirectory, ino, "parent n%d of %q is not a directory", p.Node, p.Name)
+			case names[key] == ino:
+				// the same entry twice, harmless.
+			case names[key] != 0:
+				r.add(DuplicateName, ino, "%q under n%d already belongs to n%d", p.Name, p.Node, names[key])
+			default:
+				names[key] = ino
+				kept = append(kept, p)
+			}
+		}
+		parents[ino] = kept
+	}
+
+	// Break cycles, walking from child to parent.
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[uint64]int, len(inos))
+	var visit func(ino uint64)
+	visit = func(ino uint64) {
+		state[ino] = visiting
+		var kept []DumpParentEntry
+		for _, p := range parents[ino] {
+			switch state[p.Node] {
+			case visiting:
+				r.add(ParentCycle, ino, "parent n%d of %q is its own descendant", p.Node, p.Name)
+				continue
+			case unvisited:
+				visit(p.Node)
+			}
+			kept = append(kept, p)
+		}
+		parents[ino] = kept
+		state[ino] = visited
+	}
+	for _, ino := range inos {
+		if state[ino] == unvisited {
+			visit(ino)
+		}
+	}
+
+	// Look for nodes the live bridge would have released already.
+	childCount := make(map[uint64]int, len(inos))
+	for _, ps := range parents {
+		for _, p := range ps {
+			childCount[p.Node]++
+		}
+	}
+	dead := make(map[uint64]bool)
+	for changed := true; changed; {
+		changed = false
+		for _, ino := range inos {
+			if ino == 1 || dead[ino] {
+				continue
+			}
+			if s.dumped[ino].LookupCount > 0 || childCount[ino] > 0 {
+				continue
+			}
+			dead[ino] = true
+			r.add(LookupCountAnomaly, ino, "zero lookup count and no children")
+			if !repair {
+				continue
+			}
+			for _, p := range parents[ino] {
+				childCount[p.Node]--
+			}
+			changed = true
+		}
+	}
+	if repair {
+		for _, ino := range inos {
+			if !dead[ino] {
+				continue
+			}
+			delete(s.dumped, ino)
+			delete(parents, ino)
+			r.Dropped = append(r.Dropped, ino)
+		}
+		s.detachUnreachable(r, inos, parents)
+	}
+
+	// Every open file must still be reachable by its path, unless its
+	// inode lost all names: then the file keeps the path it was last
+	// reachable at, which may be a silly-renamed one.
+	names = make(map[childKey]uint64)
+	for ino, ps := range parents {
+		for _, p := range ps {
+			names[childKey{p.Node, p.Name}] = ino
+		}
+	}
+	free := make(map[uint32]bool, len(s.bridge.freeFiles))
+	for _, fh := range s.bridge.freeFiles {
+		free[fh] = true
+	}
+	hidden := make(map[string]bool, len(s.bridge.sillies))
+	for _, path := range s.bridge.sillies {
+		hidden[path] = true
+	}
+	for i, f := range s.bridge.files {
+		fh := uint32(i)
+		if fh == 0 || free[fh] {
+			continue
+		}
+		if f.ino != 0 {
+			if s.dumped[f.ino] == nil {
+				r.Problems = append(r.Problems, RestoreProblem{
+					Kind:   UnknownFilePath,
+					Ino:    f.ino,
+					Fh:     fh,
+					Detail: fmt.Sprintf("inode n%d of %q not found", f.ino, f.path),
+				})
+				continue
+			}
+			if f.ino != 1 && len(parents[f.ino]) == 0 {
+				continue
+			}
+		}
+		if f.path == "" || hidden[f.path] || resolveDumpedPath(names, f.path) {
+			continue
+		}
+		r.Problems = append(r.Problems, RestoreProblem{
+			Kind:   UnknownFilePath,
+			Ino:    f.ino,
+			Fh:     fh,
+			Detail: fmt.Sprintf("path %q not found", f.path),
+		})
+		if repair {
+			// fall back to the path of the inode, which has one.
+			f.path = ""
+		}
+	}
+
+	r.Repaired = repair && !r.OK()
+	return r, parents
+}
+
+// detachUnreachable turns the named inodes that can't be reached from
+// the root through parents into orphans, or drops them if neither the
+// kernel nor an open file refers to them. Inodes dumped without names
+// are orphans already.
+func (s *InodeRestorer) detachUnreachable(r *RestoreReport, inos []uint64, parents map[uint64][]DumpParentEntry) {
+	children := make(map[uint64][]uint64, len(parents))
+	for ino, ps := range parents {
+		for _, p := range ps {
+			children[p.Node] = append(children[p.Node], ino)
+		}
+	}
+	reachable := map[uint64]bool{1: true}
+	queue := []uint64{1}
+	for len(queue) > 0 {
+		ino := queue[0]
+		queue = queue[1:]
+		for _, child := range children[ino] {
+			if !reachable[child] {
+				reachable[child] = true
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	free := make(map[uint32]bool, len(s.bridge.freeFiles))
+	for _, fh := range s.bridge.freeFiles {
+		free[fh] = true
+	}
+	open := make(map[uint64]bool)
+	for i, f := range s.bridge.files {
+		if i != 0 && !free[uint32(i)] {
+			open[f.ino] = true
+		}
+	}
+
+	for _, ino := range inos {
+		d := s.dumped[ino]
+		if d == nil {
+			continue
+		}
+		if !reachable[ino] {
+			if len(d.Parents) == 0 {
+				continue
+			}
+			parents[ino] = nil
+			if d.LookupCount == 0 && !open[ino] {
+				delete(s.dumped, ino)
+				delete(parents, ino)
+				r.Dropped = append(r.Dropped, ino)
+			} else {
+				r.Orphaned = append(r.Orphaned, ino)
+			}
+			continue
+		}
+		// hard links may lead to an unreachable parent too.
+		var kept []DumpParentEntry
+		for _, p := range parents[ino] {
+			if reachable[p.Node] {
+				kept = append(kept, p)
+			}
+		}
+		parents[ino] = kept
+	}
+}
+
+func resolveDumpedPath(names map[childKey]uint64, path string) bool {
+	ino := uint64(1)
+	for _, name := range strings.Split(path, "/") {
+		ino = names[childKey{ino, name}]
+		if ino == 0 {
+			return false
+		}
+	}
+	return true
+}
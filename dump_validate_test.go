@@ -0,0 +1,222 @@
+package pathfs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func restoreInodes(b *rawBridge, files []*DumpFileEntry, inodes ...*DumpInode) (*InodeRestorer, error) {
+	if files == nil {
+		files = []*DumpFileEntry{{}}
+	}
+	filler, err := b.Restore(&DumpRawBridge{
+		NodeCount: len(inodes),
+		Files:     files,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range inodes {
+		if err := filler.AddInode(d); err != nil {
+			return nil, err
+		}
+	}
+	restorer := filler.(*InodeRestorer)
+	return restorer, restorer.Finished()
+}
+
+func assertProblems(t *testing.T, report *RestoreReport, kinds ...RestoreProblemKind) {
+	if len(report.Problems) != len(kinds) {
+		t.Fatalf("want %d problems, have %v", len(kinds), report)
+	}
+	for i, k := range kinds {
+		if report.Problems[i].Kind != k {
+			t.Errorf("problem %d: want %v, have %v", i, k, report.Problems[i])
+		}
+	}
+}
+
+func dumpedRoot() *DumpInode {
+	return &DumpInode{Ino: 1, LookupCount: 1, IsDir: true}
+}
+
+func TestRestoreValidateClean(t *testing.T) {
+	b := &rawBridge{}
+	r, err := restoreInodes(b, nil,
+		dumpedRoot(),
+		&DumpInode{Ino: 2, LookupCount: 1, IsDir: true, Parents: []DumpParentEntry{{"d", 1}}},
+		&DumpInode{Ino: 3, LookupCount: 1, Parents: []DumpParentEntry{{"f", 2}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Report().OK() {
+		t.Errorf("want no problems, have %v", r.Report())
+	}
+	if p, _ := b.pathOf(b.nodes[3]); p != "d/f" {
+		t.Errorf("want path d/f, have %q", p)
+	}
+}
+
+func TestRestoreValidateDetect(t *testing.T) {
+	b := &rawBridge{}
+	r, err := restoreInodes(b, nil,
+		dumpedRoot(),
+		// dangling parent
+		&DumpInode{Ino: 2, LookupCount: 1, Parents: []DumpParentEntry{{"a", 99}}},
+		// parent is a file
+		&DumpInode{Ino: 3, LookupCount: 1, Parents: []DumpParentEntry{{"b", 2}}},
+		// duplicate name
+		&DumpInode{Ino: 4, LookupCount: 1, Parents: []DumpParentEntry{{"c", 1}}},
+		&DumpInode{Ino: 5, LookupCount: 1, Parents: []DumpParentEntry{{"c", 1}}},
+		// cycle
+		&DumpInode{Ino: 6, LookupCount: 1, IsDir: true, Parents: []DumpParentEntry{{"x", 7}}},
+		&DumpInode{Ino: 7, LookupCount: 1, IsDir: true, Parents: []DumpParentEntry{{"y", 6}}},
+		// dead
+		&DumpInode{Ino: 8, Parents: []DumpParentEntry{{"z", 1}}},
+	)
+	if err == nil {
+		t.Fatal("want error")
+	}
+	assertProblems(t, r.Report(),
+		DanglingParent, NotADirectory, DuplicateName, ParentCycle, LookupCountAnomaly)
+	if r.Report().Repaired {
+		t.Error("report should not be repaired")
+	}
+}
+
+func TestRestoreRepair(t *testing.T) {
+	b := &rawBridge{options: Options{RepairRestore: true}}
+	files := []*DumpFileEntry{
+		{},
+		{Path: "d/f"},
+		{Path: "gone"},
+	}
+	r, err := restoreInodes(b, files,
+		dumpedRoot(),
+		&DumpInode{Ino: 2, IsDir: true, Parents: []DumpParentEntry{{"d", 1}}},
+		// hard link whose newest parent is dangling
+		&DumpInode{Ino: 3, LookupCount: 1, Parents: []DumpParentEntry{{"f", 2}, {"f", 99}}},
+		// dead directory, and a dead file keeping it alive
+		&DumpInode{Ino: 4, IsDir: true, Parents: []DumpParentEntry{{"e", 1}}},
+		&DumpInode{Ino: 5, Parents: []DumpParentEntry{{"g", 4}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := r.Report()
+	assertProblems(t, report,
+		DanglingParent, LookupCountAnomaly, LookupCountAnomaly, UnknownFilePath)
+	if !report.Repaired {
+		t.Error("report should be repaired")
+	}
+	if len(report.Dropped) != 2 || b.nodes[4] != nil || b.nodes[5] != nil {
+		t.Errorf("want n4 and n5 dropped, have %v", report.Dropped)
+	}
+	if p, _ := b.pathOf(b.nodes[3]); p != "d/f" {
+		t.Errorf("want n3 re-parented to d/f, have %q", p)
+	}
+	if b.files[1].path != "d/f" {
+		t.Errorf("want fh1 path kept, have %q", b.files[1].path)
+	}
+	if b.files[2].path != "" {
+		t.Errorf("want fh2 path cleared, have %q", b.files[2].path)
+	}
+	if b.root == nil || len(b.root.children) != 1 {
+		t.Errorf("want root with 1 child")
+	}
+}
+
+func TestRestoreRepairUnreachable(t *testing.T) {
+	b := &rawBridge{options: Options{RepairRestore: true}}
+	files := []*DumpFileEntry{
+		{},
+		{Ino: 3, Path: "d/f"},
+	}
+	r, err := restoreInodes(b, files,
+		dumpedRoot(),
+		// a directory under a dangling parent, and its files
+		&DumpInode{Ino: 2, LookupCount: 1, IsDir: true, Parents: []DumpParentEntry{{"d", 99}}},
+		&DumpInode{Ino: 3, LookupCount: 1, Parents: []DumpParentEntry{{"f", 2}}},
+		&DumpInode{Ino: 4, IsDir: true, Parents: []DumpParentEntry{{"e", 2}}},
+		&DumpInode{Ino: 5, LookupCount: 1, Parents: []DumpParentEntry{{"g", 4}}},
+		// a hard link whose newest name is under n2
+		&DumpInode{Ino: 6, LookupCount: 1, Parents: []DumpParentEntry{{"h", 1}, {"i", 2}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := r.Report()
+	assertProblems(t, report, DanglingParent)
+	if fmt.Sprint(report.Orphaned) != "[2 3 5]" || fmt.Sprint(report.Dropped) != "[4]" {
+		t.Errorf("want n2, n3 and n5 orphaned and n4 dropped, have %v and %v", report.Orphaned, report.Dropped)
+	}
+	for _, ino := range []uint64{2, 3, 5} {
+		if n := b.nodes[ino]; n == nil || n.parents.count() != 0 || len(n.children) != 0 {
+			t.Errorf("want n%d kept without names or children", ino)
+		}
+	}
+	if b.nodes[4] != nil {
+		t.Error("want n4 dropped")
+	}
+	if p, _ := b.pathOf(b.nodes[6]); p != "h" {
+		t.Errorf("want n6 at h, have %q", p)
+	}
+	if b.files[1].path != "d/f" {
+		t.Errorf("want fh1 path kept, have %q", b.files[1].path)
+	}
+}
+
+func TestRestoreRepairMissingRoot(t *testing.T) {
+	b := &rawBridge{options: Options{RepairRestore: true}}
+	r, err := restoreInodes(b, []*DumpFileEntry{{}, {Opener: fuse.Owner{Uid: 1}}},
+		&DumpInode{Ino: 2, LookupCount: 1, Parents: []DumpParentEntry{{"a", 1}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertProblems(t, r.Report(), MissingInode)
+	if b.root == nil || b.root.children["a"] != b.nodes[2] {
+		t.Error("want root recreated with child a")
+	}
+}
+
+func TestRestoreOpenUnlinkedFile(t *testing.T) {
+	for _, silly := range []bool{false, true} {
+		fs := &sillyFileSystem{}
+		sender, fh := newUnlinkBridge(fs, &fs.mockFileSystem)
+		sender.options.SillyRename = silly
+		if code := sender.Unlink(nil, &fuse.InHeader{NodeId: 1}, "f"); !code.Ok() {
+			t.Fatal(code)
+		}
+		want := sender.files[fh].path
+
+		dumpB, iter, err := sender.Dump()
+		if err != nil {
+			t.Fatal(err)
+		}
+		receiver := newMockBridge(&fs.mockFileSystem)
+		receiver.fs = fs
+		filler, err := receiver.Restore(dumpB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for d, err := iter.Next(); err == nil; d, err = iter.Next() {
+			filler.AddInode(d)
+		}
+		if err := filler.Finished(); err != nil {
+			t.Fatalf("silly %v: %v", silly, err)
+		}
+
+		fs.readPaths = nil
+		readIn := &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: 100}, Fh: fh, Size: 1}
+		if _, code := receiver.Read(nil, readIn, make([]byte, 1)); !code.Ok() {
+			t.Fatalf("silly %v: %v", silly, code)
+		}
+		if len(fs.readPaths) != 1 || fs.readPaths[0] != want {
+			t.Errorf("silly %v: want read of %s, have %v", silly, want, fs.readPaths)
+		}
+	}
+}
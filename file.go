@@ -5,37 +5,95 @@
 package pathfs
 
 import (
-	"fmt"
-	"math/rand"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 type fileEntry struct {
 	opener fuse.Owner
+	ino    uint64
 	path   string
 
 	// file
-	uFh uint32
+	uFh    uint32
+	handle FileHandle
 
 	// dir
 	mu     sync.Mutex
 	stream []fuse.DirEntry
 }
 
-// path returns a path string to the inode relative to `bridge.root`.
-func (b *rawBridge) pathOf(n *inode) string {
+// cachedPath is a path computed by walkPath, valid while the path
+// epochs of the inodes on the way to the root are unchanged.
+type cachedPath struct {
+	path  string
+	chain []pathLink
+}
+
+// pathLink is an inode on the path, with its path epoch at the time.
+type pathLink struct {
+	node  *inode
+	epoch uint64
+}
+
+// pathChanged invalidates the paths cached on n and below it. Call it
+// with n.mu held, after changing the parents of n.
+func (n *inode) pathChanged() {
+	atomic.AddUint64(&n.pathEpoch, 1)
+}
+
+func (c *cachedPath) valid() bool {
+	for _, l := range c.chain {
+		if atomic.LoadUint64(&l.node.pathEpoch) != l.epoch {
+			return false
+		}
+	}
+	return true
+}
+
+// pathOf returns a path string to the inode relative to `bridge.root`.
+// The path is cached on the inode until it or an ancestor moves, or,
+// for a choice of an AliasChooser, until any of its names changes, so
+// repeated calls take no lock. Orphans, which can't reach the root any
+// more, have no path: ESTALE is returned.
+func (b *rawBridge) pathOf(n *inode) (string, fuse.Status) {
+	if c, ok := n.path.Load().(*cachedPath); ok && c.valid() {
+		return c.path, fuse.OK
+	}
+
+	path, chain, ok := b.walkChain(n)
+	if !ok {
+		return "", fuse.Status(syscall.ESTALE)
+	}
+	path, chain = b.chooseAlias(n, path, chain)
+	n.path.Store(&cachedPath{path, chain})
+	return path, fuse.OK
+}
+
+// walkPath computes the path of n by walking the parents up to the
+// root. It reports false for orphans.
+func (b *rawBridge) walkPath(n *inode) (string, bool) {
+	path, _, ok := b.walkChain(n)
+	return path, ok
+}
+
+// walkChain is walkPath, also returning the inodes walked through.
+func (b *rawBridge) walkChain(n *inode) (string, []pathLink, bool) {
 	it, root := n, b.root
 	if it == root {
-		return ""
+		return "", nil, true
 	}
 
 	var segments []string
+	var chain []pathLink
 	for it != nil && it != root {
 		it.mu.Lock()
 		pe := it.parents.get()
+		chain = append(chain, pathLink{it, atomic.LoadUint64(&it.pathEpoch)})
 		it.mu.Unlock()
 		if pe.node != nil {
 			segments = append(segments, pe.name)
@@ -44,10 +102,7 @@ func (b *rawBridge) pathOf(n *inode) string {
 	}
 
 	if it != root {
-		placeholder := fmt.Sprintf(".pathfs.orphaned/%d.%d", n.ino, rand.Uint64())
-		b.logf("warning: inode.path: n%d is orphaned, replacing with %q",
-			n.ino, placeholder)
-		return placeholder
+		return "", nil, false
 	}
 
 	i := 0
@@ -59,16 +114,28 @@ func (b *rawBridge) pathOf(n *inode) string {
 	}
 
 	path := strings.Join(segments, "/")
-	return path
+	return path, chain, true
 }
 
-func (b *rawBridge) fpathOf(n *inode, f *fileEntry) string {
-	if len(f.path) > 0 {
-		return f.path
+// fpathOf returns fpath, the path of an open file returned by
+// inodeAndFile, which outlives the names of its inode, or else the
+// path of n.
+func (b *rawBridge) fpathOf(n *inode, fpath string) (string, fuse.Status) {
+	if len(fpath) > 0 {
+		return fpath, fuse.OK
 	}
 	return b.pathOf(n)
 }
 
+// entryPath returns the path of the entry name in parent.
+func (b *rawBridge) entryPath(parent *inode, name string) (string, fuse.Status) {
+	path, code := b.pathOf(parent)
+	if !code.Ok() {
+		return "", code
+	}
+	return childPathOf(path, name), fuse.OK
+}
+
 func childPathOf(parent, child string) string {
 	if parent == "" {
 		return child
@@ -76,7 +143,15 @@ func childPathOf(parent, child string) string {
 	return parent + "/" + child
 }
 
-func (b *rawBridge) registerFile(opener fuse.Owner, path string, uFh uint32, stream []fuse.DirEntry) (fh uint32) {
+func (b *rawBridge) registerFile(opener fuse.Owner, ino uint64, path string, uFh uint32, stream []fuse.DirEntry) (fh uint32) {
+	return b.registerEntry(opener, ino, path, uFh, nil, stream)
+}
+
+func (b *rawBridge) registerHandle(opener fuse.Owner, ino uint64, path string, handle FileHandle) (fh uint32) {
+	return b.registerEntry(opener, ino, path, 0, handle, nil)
+}
+
+func (b *rawBridge) registerEntry(opener fuse.Owner, ino uint64, path string, uFh uint32, handle FileHandle, stream []fuse.DirEntry) (fh uint32) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -91,12 +166,27 @@ func (b *rawBridge) registerFile(opener fuse.Owner, path string, uFh uint32, str
 
 	entry := b.files[fh]
 	entry.opener = opener
+	entry.ino = ino
 	entry.path = path
 	entry.uFh = uFh
+	entry.handle = handle
 	entry.stream = stream
 	return
 }
 
+// renameFiles moves the paths of the open files at or below path to
+// newPath, after a rename.
+func (b *rawBridge) renameFiles(path string, newPath string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, f := range b.files[1:] {
+		if rest, ok := underPath(f.path, path); ok {
+			f.path = newPath + rest
+		}
+	}
+}
+
 func (b *rawBridge) unregisterFile(fh uint32) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
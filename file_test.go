@@ -1,8 +1,13 @@
 package pathfs
 
 import (
-	"github.com/hanwen/go-fuse/v2/fuse"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"syscall"
 	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 func TestPath(t *testing.T) {
@@ -11,21 +16,20 @@ func TestPath(t *testing.T) {
 	b.addChild(b.inode(2), "d2", 3, true)
 	b.addChild(b.inode(3), "f1", 4, false)
 
-	path := b.pathOf(b.inode(4))
+	path, _ := b.pathOf(b.inode(4))
 	if path != "d1/d2/f1" {
 		t.Errorf("want path: %s, have: %s", "d1/d2/f1", path)
 	}
 
-	rootPath := b.pathOf(b.root)
+	rootPath, _ := b.pathOf(b.root)
 	if rootPath != "" {
 		t.Errorf("want empty path, have: %s", rootPath)
 	}
 
 	// make inode 4 be orphan
 	b.rmChild(b.inode(3), "f1")
-	placeholder := b.pathOf(b.inode(4))
-	if placeholder[:18] != ".pathfs.orphaned/4" {
-		t.Errorf("want placeholder: %s, have: %s", ".pathfs.orphaned/4", placeholder[:18])
+	if _, code := b.pathOf(b.inode(4)); code != fuse.Status(syscall.ESTALE) {
+		t.Errorf("want ESTALE for an orphan, have: %v", code)
 	}
 
 }
@@ -36,11 +40,11 @@ func TestRegister(t *testing.T) {
 	b.addChild(b.inode(2), "d2", 3, true)
 	b.addChild(b.inode(3), "f1", 4, false)
 
-	path := b.pathOf(b.inode(4))
-	fh := b.registerFile(fuse.Owner{}, path, 4, nil)
+	path, _ := b.pathOf(b.inode(4))
+	fh := b.registerFile(fuse.Owner{}, 4, path, 4, nil)
 
-	node, file := b.inodeAndFile(4, fh, &Context{})
-	path = b.fpathOf(node, file)
+	node, _, fpath, _ := b.inodeAndFile(4, fh, &Context{})
+	path, _ = b.fpathOf(node, fpath)
 	if path != "d1/d2/f1" {
 		t.Errorf("want path: %s, have: %s", "d1/d2/f1", path)
 	}
@@ -50,16 +54,237 @@ func TestRegister(t *testing.T) {
 		t.Errorf("want freeFiles count: %d, have: %d", 1, len(b.freeFiles))
 	}
 
-	path = b.pathOf(b.inode(3))
-	fh = b.registerFile(fuse.Owner{}, path, 3, nil)
+	path, _ = b.pathOf(b.inode(3))
+	fh = b.registerFile(fuse.Owner{}, 3, path, 3, nil)
 	if len(b.freeFiles) != 0 {
 		t.Errorf("want freeFiles count: %d, have: %d", 0, len(b.freeFiles))
 	}
 
-	node, file = b.inodeAndFile(3, fh, &Context{})
-	path = b.fpathOf(node, file)
+	node, _, fpath, _ = b.inodeAndFile(3, fh, &Context{})
+	path, _ = b.fpathOf(node, fpath)
 	if path != "d1/d2" {
 		t.Errorf("want path: %s, have: %s", "d1/d2", path)
 	}
 
 }
+
+// renamingFileSystem serves d/f, and counts the I/O on other paths.
+// It yields in I/O, to let renames in.
+type renamingFileSystem struct {
+	noInoFileSystem
+	bad int32
+}
+
+func (r *renamingFileSystem) Read(ctx *Context, path string, uFh uint32, dest []byte, off uint64) (fuse.ReadResult, fuse.Status) {
+	if path != "d/f" && path != "e/f" {
+		atomic.AddInt32(&r.bad, 1)
+	}
+	runtime.Gosched()
+	return fuse.ReadResultData(nil), fuse.OK
+}
+
+func (r *renamingFileSystem) Write(ctx *Context, path string, uFh uint32, data []byte, off uint64) (uint32, fuse.Status) {
+	if path != "d/f" && path != "e/f" {
+		atomic.AddInt32(&r.bad, 1)
+	}
+	runtime.Gosched()
+	return uint32(len(data)), fuse.OK
+}
+
+func TestFilePathRenameRace(t *testing.T) {
+	fs := &renamingFileSystem{}
+	fs.getAttrFunc = func(path string) (fuse.Attr, fuse.Status) {
+		if path == "d" {
+			return fuse.Attr{Ino: 100, Mode: fuse.S_IFDIR | 0755}, fuse.OK
+		}
+		return fuse.Attr{Ino: 101, Mode: fuse.S_IFREG | 0644}, fuse.OK
+	}
+	b := newMockBridge(&fs.mockFileSystem)
+	b.fs = fs
+
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "d", &fuse.EntryOut{})
+	b.Lookup(nil, &fuse.InHeader{NodeId: 100}, "f", &fuse.EntryOut{})
+	openOut := &fuse.OpenOut{}
+	if code := b.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 101}}, openOut); !code.Ok() {
+		t.Fatal(code)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		names := []string{"d", "e"}
+		for i := 0; i < 200; i++ {
+			in := &fuse.RenameIn{InHeader: fuse.InHeader{NodeId: 1}, Newdir: 1}
+			b.Rename(nil, in, names[i%2], names[(i+1)%2])
+		}
+	}()
+	header := fuse.InHeader{NodeId: 101}
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		b.Read(nil, &fuse.ReadIn{InHeader: header, Fh: openOut.Fh}, nil)
+		b.Write(nil, &fuse.WriteIn{InHeader: header, Fh: openOut.Fh}, []byte("x"))
+		b.GetAttr(nil, &fuse.GetAttrIn{InHeader: header}, &fuse.AttrOut{})
+	}
+	if fs.bad != 0 {
+		t.Errorf("want I/O on d/f or e/f only, have %d others", fs.bad)
+	}
+}
+
+func TestPathCache(t *testing.T) {
+	b := newTestBridge()
+	b.addChild(b.root, "d1", 2, true)
+	b.addChild(b.inode(2), "d2", 3, true)
+	b.addChild(b.inode(3), "f1", 4, false)
+
+	if path, _ := b.pathOf(b.inode(4)); path != "d1/d2/f1" {
+		t.Fatalf("want path: %s, have: %s", "d1/d2/f1", path)
+	}
+
+	// a lookup elsewhere keeps it.
+	cached := b.inode(4).path.Load()
+	b.addChild(b.inode(3), "f2", 5, false)
+	b.addChild(b.root, "f3", 6, false)
+	b.pathOf(b.inode(4))
+	if b.inode(4).path.Load() != cached {
+		t.Error("want the cached path kept by lookups of new children")
+	}
+
+	// renaming an ancestor invalidates the cached path.
+	b.mvChild(b.root, "d1", b.root, "x", true)
+	if path, _ := b.pathOf(b.inode(4)); path != "x/d2/f1" {
+		t.Errorf("want path: %s, have: %s", "x/d2/f1", path)
+	}
+
+	// so does a new hard link, which becomes the preferred parent.
+	b.addChild(b.root, "link", 4, false)
+	if path, _ := b.pathOf(b.inode(4)); path != "link" {
+		t.Errorf("want path: %s, have: %s", "link", path)
+	}
+	b.rmChild(b.root, "link")
+	if path, _ := b.pathOf(b.inode(4)); path != "x/d2/f1" {
+		t.Errorf("want path: %s, have: %s", "x/d2/f1", path)
+	}
+}
+
+func newDeepBridge(depth int) (*rawBridge, *inode) {
+	b := newTestBridge()
+	n := b.root
+	for i := 0; i < depth; i++ {
+		n = b.addChild(n, fmt.Sprintf("dir%d", i), uint64(i+2), true)
+	}
+	return b, n
+}
+
+func BenchmarkPathOfCached(b *testing.B) {
+	br, n := newDeepBridge(16)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		br.pathOf(n)
+	}
+}
+
+func BenchmarkPathOfWalk(b *testing.B) {
+	br, n := newDeepBridge(16)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		br.walkPath(n)
+	}
+}
+
+func BenchmarkPathOfLookup(b *testing.B) {
+	br, n := newDeepBridge(16)
+	parent := br.inode(uint64(16))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		br.addChild(parent, fmt.Sprintf("f%d", i%1024), uint64(100+i%1024), false)
+		br.pathOf(n)
+	}
+}
+
+func BenchmarkPathOfCachedParallel(b *testing.B) {
+	br, n := newDeepBridge(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			br.pathOf(n)
+		}
+	})
+}
+
+func BenchmarkPathOfWalkParallel(b *testing.B) {
+	br, n := newDeepBridge(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			br.walkPath(n)
+		}
+	})
+}
+
+// renameFileSystem accepts creates and renames, and records the paths
+// of the file operations.
+type renameFileSystem struct {
+	mockFileSystem
+	ops []string
+}
+
+func (r *renameFileSystem) Rename(ctx *Context, path string, newPath string) fuse.Status {
+	return fuse.OK
+}
+
+func (r *renameFileSystem) Write(ctx *Context, path string, uFh uint32, data []byte, off uint64) (uint32, fuse.Status) {
+	r.ops = append(r.ops, "write "+path)
+	return uint32(len(data)), fuse.OK
+}
+
+func (r *renameFileSystem) Fsync(ctx *Context, path string, uFh uint32, flags uint32) fuse.Status {
+	r.ops = append(r.ops, "fsync "+path)
+	return fuse.OK
+}
+
+func (r *renameFileSystem) Release(ctx *Context, path string, uFh uint32) {
+	r.ops = append(r.ops, "release "+path)
+}
+
+func TestRenameOpenFile(t *testing.T) {
+	fs := &renameFileSystem{}
+	fs.getAttrFunc = func(path string) (fuse.Attr, fuse.Status) {
+		switch path {
+		case "d":
+			return fuse.Attr{Ino: 2, Mode: fuse.S_IFDIR | 0755}, fuse.OK
+		case "d/f.tmp", "d/f", "e/f":
+			return fuse.Attr{Ino: 3, Mode: fuse.S_IFREG | 0644}, fuse.OK
+		}
+		return fuse.Attr{}, fuse.ENOENT
+	}
+	b := newMockBridge(&fs.mockFileSystem)
+	b.fs = fs
+
+	// an editor writes a temporary file and renames it into place.
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "d", &fuse.EntryOut{})
+	createOut := &fuse.CreateOut{}
+	if code := b.Create(nil, &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: 2}}, "f.tmp", createOut); !code.Ok() {
+		t.Fatal(code)
+	}
+	fh := createOut.Fh
+	b.Write(nil, &fuse.WriteIn{InHeader: fuse.InHeader{NodeId: 3}, Fh: fh}, []byte("x"))
+	if code := b.Rename(nil, &fuse.RenameIn{InHeader: fuse.InHeader{NodeId: 2}, Newdir: 2}, "f.tmp", "f"); !code.Ok() {
+		t.Fatal(code)
+	}
+	b.Fsync(nil, &fuse.FsyncIn{InHeader: fuse.InHeader{NodeId: 3}, Fh: fh})
+
+	// renaming the directory moves the open file along.
+	if code := b.Rename(nil, &fuse.RenameIn{InHeader: fuse.InHeader{NodeId: 1}, Newdir: 1}, "d", "e"); !code.Ok() {
+		t.Fatal(code)
+	}
+	b.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: 3}, Fh: fh})
+
+	want := []string{"write d/f.tmp", "fsync d/f", "release e/f"}
+	if fmt.Sprint(fs.ops) != fmt.Sprint(want) {
+		t.Errorf("want %v, have %v", want, fs.ops)
+	}
+}
@@ -0,0 +1,339 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fileserver serves a pathfs.FileSystem read-only over HTTP,
+// without mounting it.
+//
+// GET and HEAD of a file are served by http.ServeContent, which
+// handles Range and conditional requests: ranges become Reads at their
+// offsets, and HEAD does not open the file. The ETag of a file is
+// derived from its ino, mtime and size. A directory is listed as HTML,
+// or as JSON when the request accepts "application/json" or has the
+// query "format=json". Symlinks and special files are not served.
+package fileserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+)
+
+// Options sets options for a Handler.
+type Options struct {
+	// Prefix is the URL path the FileSystem is served at, such as
+	// "/files". It is stripped from request paths.
+	Prefix string
+
+	// Caller is the caller of the FileSystem requests.
+	Caller fuse.Caller
+
+	// NoListing makes directories forbidden instead of listed.
+	NoListing bool
+
+	// Logger is a sink for diagnostic messages, such as failed
+	// requests. If unset, no messages are printed.
+	Logger *log.Logger
+}
+
+// Handler serves a FileSystem read-only over HTTP.
+type Handler struct {
+	fs      pathfs.FileSystem
+	options Options
+}
+
+// NewHandler returns a Handler for fs. options may be nil.
+func NewHandler(fs pathfs.FileSystem, options *Options) *Handler {
+	h := &Handler{fs: fs}
+	if options != nil {
+		h.options = *options
+	}
+	h.options.Prefix = strings.TrimRight(h.options.Prefix, "/")
+	return h
+}
+
+func (h *Handler) logf(format string, args ...interface{}) {
+	if h.options.Logger != nil {
+		h.options.Logger.Printf(format, args...)
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := h.fsPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx := &pathfs.Context{}
+	ctx.Caller = h.options.Caller
+	ctx.Cancel = r.Context().Done()
+
+	var attr fuse.Attr
+	if code := h.fs.GetAttr(ctx, p, 0, &attr); !code.Ok() {
+		h.error(w, r, code)
+		return
+	}
+	if attr.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			u := *r.URL
+			u.Path += "/"
+			http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+			return
+		}
+		if h.options.NoListing {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h.serveDir(ctx, w, r, p)
+		return
+	}
+	if attr.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	f := &file{h: h, ctx: ctx, path: p, size: int64(attr.Size)}
+	defer f.close()
+	w.Header().Set("ETag", etag(&attr))
+	if ct := mime.TypeByExtension(path.Ext(p)); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	http.ServeContent(w, r, path.Base(p), modTime(&attr), f)
+	if f.err != nil {
+		h.logf("fileserver: GET %s: %v", r.URL.Path, f.err)
+	}
+}
+
+// fsPath returns the FileSystem path of a URL path.
+func (h *Handler) fsPath(urlPath string) (string, bool) {
+	if !strings.HasPrefix(urlPath, h.options.Prefix) {
+		return "", false
+	}
+	rest := urlPath[len(h.options.Prefix):]
+	if rest != "" && rest[0] != '/' {
+		return "", false
+	}
+	return strings.TrimPrefix(path.Clean("/"+rest), "/"), true
+}
+
+// error writes the HTTP status of a failed GetAttr or Lsdir.
+func (h *Handler) error(w http.ResponseWriter, r *http.Request, code fuse.Status) {
+	status := http.StatusInternalServerError
+	switch syscall.Errno(code) {
+	case syscall.ENOENT, syscall.ENOTDIR:
+		status = http.StatusNotFound
+	case syscall.EACCES, syscall.EPERM:
+		status = http.StatusForbidden
+	default:
+		h.logf("fileserver: %s %s: %v", r.Method, r.URL.Path, syscall.Errno(code))
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// etag returns the ETag of a file with attr.
+func etag(attr *fuse.Attr) string {
+	return fmt.Sprintf(`"%x-%x-%x"`, attr.Ino, attr.Mtime*1e9+uint64(attr.Mtimensec), attr.Size)
+}
+
+func modTime(attr *fuse.Attr) time.Time {
+	return time.Unix(int64(attr.Mtime), int64(attr.Mtimensec))
+}
+
+// file is an io.ReadSeeker of a FileSystem file for http.ServeContent.
+// The file is opened by the first Read, so that HEAD, 304 and 412 do
+// not open it.
+type file struct {
+	h    *Handler
+	ctx  *pathfs.Context
+	path string
+	size int64
+	off  int64
+
+	// file is opened by the first Read.
+	file *pathfs.File
+
+	// err is the first failure of Read.
+	err error
+}
+
+func (f *file) open() fuse.Status {
+	f.ctx.Opener = &f.ctx.Caller.Owner
+	var code fuse.Status
+	f.file, _, _, code = pathfs.OpenFile(f.ctx, f.h.fs, f.path, syscall.O_RDONLY)
+	return code
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	if f.off >= f.size {
+		return 0, io.EOF
+	}
+	if f.file == nil {
+		if code := f.open(); !code.Ok() {
+			f.err = syscall.Errno(code)
+			return 0, f.err
+		}
+	}
+	res, code := f.file.Read(f.ctx, f.path, b, uint64(f.off))
+	if code.Ok() {
+		var data []byte
+		data, code = res.Bytes(b)
+		res.Done()
+		if code.Ok() {
+			if len(data) == 0 {
+				return 0, io.EOF
+			}
+			n := copy(b, data)
+			f.off += int64(n)
+			return n, nil
+		}
+	}
+	f.err = syscall.Errno(code)
+	return 0, f.err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, syscall.EINVAL
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *file) close() {
+	if f.file != nil {
+		f.file.Close(f.ctx, f.path)
+	}
+}
+
+// entry is an entry of a JSON listing.
+type entry struct {
+	Name    string    `json:"name"`
+	Dir     bool      `json:"dir,omitempty"`
+	Size    uint64    `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// fileMode converts a mode to an os.FileMode.
+func fileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		m |= os.ModeDir
+	case syscall.S_IFLNK:
+		m |= os.ModeSymlink
+	case syscall.S_IFIFO:
+		m |= os.ModeNamedPipe
+	case syscall.S_IFSOCK:
+		m |= os.ModeSocket
+	case syscall.S_IFCHR:
+		m |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFBLK:
+		m |= os.ModeDevice
+	}
+	if mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// wantJSON reports whether a listing is asked for as JSON.
+func wantJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && mt == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handler) serveDir(ctx *pathfs.Context, w http.ResponseWriter, r *http.Request, p string) {
+	dirents, code := h.fs.Lsdir(ctx, p)
+	if !code.Ok() {
+		h.error(w, r, code)
+		return
+	}
+	entries := make([]entry, 0, len(dirents))
+	for _, de := range dirents {
+		if de.Name == "." || de.Name == ".." {
+			continue
+		}
+		e := entry{Name: de.Name}
+		var attr fuse.Attr
+		if h.fs.GetAttr(ctx, path.Join(p, de.Name), 0, &attr).Ok() {
+			e.Size = attr.Size
+			e.ModTime = modTime(&attr).UTC()
+		} else {
+			attr.Mode = de.Mode
+		}
+		e.Dir = attr.IsDir()
+		e.Mode = fileMode(attr.Mode).String()
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	w.Header().Set("Vary", "Accept")
+	if wantJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != "HEAD" {
+			json.NewEncoder(w).Encode(entries)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == "HEAD" {
+		return
+	}
+	title := html.EscapeString("/" + p)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<title>%s</title>\n<h1>%s</h1>\n<ul>\n", title, title)
+	if p != "" {
+		fmt.Fprintf(w, "<li><a href=\"../\">../</a></li>\n")
+	}
+	for _, e := range entries {
+		name := e.Name
+		if e.Dir {
+			name += "/"
+		}
+		href := (&url.URL{Path: name}).String()
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	fmt.Fprintf(w, "</ul>\n")
+}
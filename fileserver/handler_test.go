@@ -0,0 +1,122 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+)
+
+// openCounter counts the calls of Open.
+type openCounter struct {
+	pathfs.FileSystem
+	opens int32
+}
+
+func (fs *openCounter) Open(ctx *pathfs.Context, path string, flags uint32) (uint32, bool, bool, fuse.Status) {
+	atomic.AddInt32(&fs.opens, 1)
+	return fs.FileSystem.Open(ctx, path, flags)
+}
+
+func serve(h http.Handler, method, target string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestHandler(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "a.txt"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := &openCounter{FileSystem: pathfs.NewTestFileSystem(dir)}
+	h := NewHandler(fs, &Options{Prefix: "/files/"})
+
+	w := serve(h, "GET", "/files/sub/a.txt")
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("GET: %d %q %v", w.Code, w.Body, w.Header())
+	}
+	tag := w.Header().Get("ETag")
+	if tag == "" {
+		t.Fatal("no ETag")
+	}
+
+	w = serve(h, "GET", "/files/sub/a.txt", "Range", "bytes=2-4")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" || w.Header().Get("Content-Range") != "bytes 2-4/10" {
+		t.Fatalf("GET range: %d %q %v", w.Code, w.Body, w.Header())
+	}
+	w = serve(h, "GET", "/files/sub/a.txt", "Range", "bytes=20-")
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("GET of an unsatisfiable range: %d", w.Code)
+	}
+
+	// HEAD and conditional requests do not open the file.
+	opens := atomic.LoadInt32(&fs.opens)
+	w = serve(h, "HEAD", "/files/sub/a.txt")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != "10" || w.Header().Get("ETag") != tag || w.Body.Len() != 0 {
+		t.Fatalf("HEAD: %d %v", w.Code, w.Header())
+	}
+	if w = serve(h, "GET", "/files/sub/a.txt", "If-None-Match", tag); w.Code != http.StatusNotModified {
+		t.Fatalf("If-None-Match: %d", w.Code)
+	}
+	if w = serve(h, "GET", "/files/sub/a.txt", "If-Match", `"other"`); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("If-Match: %d", w.Code)
+	}
+	if w = serve(h, "GET", "/files/sub/a.txt", "If-Modified-Since", "Fri, 01 Jan 2100 00:00:00 GMT"); w.Code != http.StatusNotModified {
+		t.Fatalf("If-Modified-Since: %d", w.Code)
+	}
+	if n := atomic.LoadInt32(&fs.opens); n != opens {
+		t.Fatalf("%d opens for HEAD and conditional requests", n-opens)
+	}
+	if w = serve(h, "GET", "/files/sub/a.txt", "Range", "bytes=0-0", "If-Range", `"other"`); w.Code != http.StatusOK || w.Body.Len() != 10 {
+		t.Fatalf("If-Range mismatch: %d %q", w.Code, w.Body)
+	}
+
+	// Listings.
+	if w = serve(h, "GET", "/files/sub"); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/files/sub/" {
+		t.Fatalf("GET of a directory without a slash: %d %v", w.Code, w.Header())
+	}
+	w = serve(h, "GET", "/files/")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<a href="sub/">sub/</a>`) {
+		t.Fatalf("HTML listing: %d %s", w.Code, w.Body)
+	}
+	for _, w := range []*httptest.ResponseRecorder{
+		serve(h, "GET", "/files/sub/?format=json"),
+		serve(h, "GET", "/files/sub/", "Accept", "application/json"),
+	} {
+		var entries []entry
+		if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Name != "a.txt" || entries[0].Size != 10 || entries[0].Dir || entries[0].Mode != "-rw-r--r--" {
+			t.Fatalf("JSON listing: %+v", entries)
+		}
+	}
+
+	if w = serve(h, "GET", "/files/missing"); w.Code != http.StatusNotFound {
+		t.Fatalf("GET of a missing file: %d", w.Code)
+	}
+	if w = serve(h, "GET", "/other/sub/a.txt"); w.Code != http.StatusNotFound {
+		t.Fatalf("GET outside the prefix: %d", w.Code)
+	}
+	if w = serve(h, "PUT", "/files/sub/a.txt"); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+		t.Fatalf("PUT: %d", w.Code)
+	}
+	if w = serve(NewHandler(fs, &Options{NoListing: true}), "GET", "/sub/"); w.Code != http.StatusForbidden {
+		t.Fatalf("NoListing: %d", w.Code)
+	}
+}
@@ -1,5 +1,8 @@
 module github.com/someonegg/pathfs
 
-go 1.15
+go 1.16
 
-require github.com/hanwen/go-fuse/v2 v2.1.0
+require (
+	github.com/hanwen/go-fuse/v2 v2.1.0
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
+)
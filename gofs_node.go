@@ -0,0 +1,624 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	gofs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// NewNodeRoot returns a go-fuse fs node serving fs, so that a
+// FileSystem can be mounted as a subtree of a go-fuse fs.Inode tree,
+// for example with fs.Inode.NewPersistentInode and AddChild. The
+// FileSystem sees paths relative to the returned node. See
+// NewNodeFileSystem for the reverse.
+//
+// The node tree is managed by go-fuse, so the bridge Options don't
+// apply; HandleFileSystem and the optional FileHandle interfaces are
+// supported.
+func NewNodeRoot(fs FileSystem) gofs.InodeEmbedder {
+	n := &pathNode{fs: fs}
+	n.top = n
+	return n
+}
+
+// pathNode is a node of a FileSystem in a go-fuse fs tree.
+type pathNode struct {
+	gofs.Inode
+	fs  FileSystem
+	top *pathNode
+}
+
+var (
+	_ gofs.NodeLookuper      = (*pathNode)(nil)
+	_ gofs.NodeGetattrer     = (*pathNode)(nil)
+	_ gofs.NodeSetattrer     = (*pathNode)(nil)
+	_ gofs.NodeAccesser      = (*pathNode)(nil)
+	_ gofs.NodeReaddirer     = (*pathNode)(nil)
+	_ gofs.NodeMkdirer       = (*pathNode)(nil)
+	_ gofs.NodeMknoder       = (*pathNode)(nil)
+	_ gofs.NodeCreater       = (*pathNode)(nil)
+	_ gofs.NodeOpener        = (*pathNode)(nil)
+	_ gofs.NodeUnlinker      = (*pathNode)(nil)
+	_ gofs.NodeRmdirer       = (*pathNode)(nil)
+	_ gofs.NodeRenamer       = (*pathNode)(nil)
+	_ gofs.NodeLinker        = (*pathNode)(nil)
+	_ gofs.NodeSymlinker     = (*pathNode)(nil)
+	_ gofs.NodeReadlinker    = (*pathNode)(nil)
+	_ gofs.NodeGetxattrer    = (*pathNode)(nil)
+	_ gofs.NodeSetxattrer    = (*pathNode)(nil)
+	_ gofs.NodeListxattrer   = (*pathNode)(nil)
+	_ gofs.NodeRemovexattrer = (*pathNode)(nil)
+	_ gofs.NodeStatfser      = (*pathNode)(nil)
+)
+
+// nodeContext converts the context of a go-fuse call.
+func nodeContext(ctx context.Context) *Context {
+	var caller fuse.Caller
+	if c, ok := fuse.FromContext(ctx); ok {
+		caller = *c
+	}
+	return newContext(ctx.Done(), caller)
+}
+
+// path returns the path of n below the top node, or ESTALE if n is
+// no longer linked to it.
+func (n *pathNode) path() (string, syscall.Errno) {
+	top := n.top.EmbeddedInode()
+	var names []string
+	for p := n.EmbeddedInode(); p != top; {
+		name, parent := p.Parent()
+		if parent == nil {
+			return "", syscall.ESTALE
+		}
+		names = append(names, name)
+		p = parent
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return strings.Join(names, "/"), 0
+}
+
+func (n *pathNode) childPath(name string) (string, syscall.Errno) {
+	path, errno := n.path()
+	if errno != 0 {
+		return "", errno
+	}
+	return childPathOf(path, name), 0
+}
+
+// newChild looks up the new entry at path and makes its node.
+func (n *pathNode) newChild(ctx context.Context, pctx *Context, path string, out *fuse.EntryOut) (*gofs.Inode, syscall.Errno) {
+	if code := n.fs.GetAttr(pctx, path, 0, &out.Attr); !code.Ok() {
+		return nil, syscall.Errno(code)
+	}
+	id := gofs.StableAttr{
+		Mode: out.Attr.Mode & syscall.S_IFMT,
+		Ino:  out.Attr.Ino,
+	}
+	if g, ok := n.fs.(Generationer); ok {
+		id.Gen, _ = g.Generation(pctx, path)
+	}
+	child := &pathNode{fs: n.fs, top: n.top}
+	return n.NewInode(ctx, child, id), 0
+}
+
+func (n *pathNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*gofs.Inode, syscall.Errno) {
+	path, errno := n.childPath(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+	return n.newChild(ctx, pctx, path, out)
+}
+
+func (n *pathNode) Getattr(ctx context.Context, f gofs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if pf, ok := f.(*pathFile); ok {
+		return pf.Getattr(ctx, out)
+	}
+	path, errno := n.path()
+	if errno != 0 {
+		return errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+	return syscall.Errno(n.fs.GetAttr(pctx, path, 0, &out.Attr))
+}
+
+func (n *pathNode) Setattr(ctx context.Context, f gofs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	pf, _ := f.(*pathFile)
+	path, errno := n.path()
+	if pf != nil {
+		path, errno = pf.currentPath()
+	}
+	if errno != 0 {
+		return errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+
+	var uFh uint32
+	if pf != nil {
+		uFh = pf.file.UFh()
+		pctx.Opener = &pf.opener
+	}
+
+	code := fuse.OK
+	if perms, ok := in.GetMode(); ok {
+		code = n.fs.Chmod(pctx, path, uFh, perms)
+	}
+	uid, uok := in.GetUID()
+	gid, gok := in.GetGID()
+	if code.Ok() && (uok || gok) {
+		code = n.fs.Chown(pctx, path, uFh, uid, gid)
+	}
+	if sz, ok := in.GetSize(); code.Ok() && ok {
+		if pf != nil {
+			code = pf.file.Truncate(pctx, path, sz)
+		} else {
+			code = n.fs.Truncate(pctx, path, uFh, sz)
+		}
+	}
+	atime, aok := in.GetATime()
+	mtime, mok := in.GetMTime()
+	if code.Ok() && (aok || mok) {
+		var a, m *time.Time
+		if aok {
+			a = &atime
+		}
+		if mok {
+			m = &mtime
+		}
+		code = n.fs.Utimens(pctx, path, uFh, a, m)
+	}
+	if !code.Ok() {
+		return syscall.Errno(code)
+	}
+
+	if pf != nil {
+		code = pf.file.GetAttr(pctx, path, &out.Attr)
+	} else {
+		code = n.fs.GetAttr(pctx, path, 0, &out.Attr)
+	}
+	return syscall.Errno(code)
+}
+
+func (n *pathNode) Access(ctx context.Context, mask uint32) syscall.Errno {
+	path, errno := n.path()
+	if errno != 0 {
+		return errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+	return syscall.Errno(n.fs.Access(pctx, path, mask))
+}
+
+func (n *pathNode) Readdir(ctx context.Context) (gofs.DirStream, syscall.Errno) {
+	path, errno := n.path()
+	if errno != 0 {
+		return nil, errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+
+	stream, code := n.fs.Lsdir(pctx, path)
+	if !code.Ok() {
+		return nil, syscall.Errno(code)
+	}
+	return gofs.NewListDirStream(stream), 0
+}
+
+func (n *pathNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*gofs.Inode, syscall.Errno) {
+	path, errno := n.childPath(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+
+	if code := n.fs.Mkdir(pctx, path, mode); !code.Ok() {
+		return nil, syscall.Errno(code)
+	}
+	return n.newChild(ctx, pctx, path, out)
+}
+
+func (n *pathNode) Mknod(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*gofs.Inode, syscall.Errno) {
+	path, errno := n.childPath(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+
+	if code := n.fs.Mknod(pctx, path, mode, dev); !code.Ok() {
+		return nil, syscall.Errno(code)
+	}
+	return n.newChild(ctx, pctx, path, out)
+}
+
+func (n *pathNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*gofs.Inode, syscall.Errno) {
+	path, errno := n.childPath(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+
+	if code := n.fs.Symlink(pctx, path, target); !code.Ok() {
+		return nil, syscall.Errno(code)
+	}
+	return n.newChild(ctx, pctx, path, out)
+}
+
+func (n *pathNode) Link(ctx context.Context, target gofs.InodeEmbedder, name string, out *fuse.EntryOut) (*gofs.Inode, syscall.Errno) {
+	t, ok := target.(*pathNode)
+	if !ok || t.top != n.top {
+		return nil, syscall.EXDEV
+	}
+	oldPath, errno := t.path()
+	if errno != 0 {
+		return nil, errno
+	}
+	path, errno := n.childPath(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+
+	if code := n.fs.Link(pctx, oldPath, path); !code.Ok() {
+		return nil, syscall.Errno(code)
+	}
+	return n.newChild(ctx, pctx, path, out)
+}
+
+func (n *pathNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	path, errno := n.childPath(name)
+	if errno != 0 {
+		return errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+	return syscall.Errno(n.fs.Unlink(pctx, path))
+}
+
+func (n *pathNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	path, errno := n.childPath(name)
+	if errno != 0 {
+		return errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+	return syscall.Errno(n.fs.Rmdir(pctx, path))
+}
+
+func (n *pathNode) Rename(ctx context.Context, name string, newParent gofs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if flags != 0 {
+		return syscall.ENOSYS
+	}
+	np, ok := newParent.(*pathNode)
+	if !ok || np.top != n.top {
+		return syscall.EXDEV
+	}
+	path, errno := n.childPath(name)
+	if errno != 0 {
+		return errno
+	}
+	newPath, errno := np.childPath(newName)
+	if errno != 0 {
+		return errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+	return syscall.Errno(n.fs.Rename(pctx, path, newPath))
+}
+
+func (n *pathNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	path, errno := n.path()
+	if errno != 0 {
+		return nil, errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+
+	target, code := n.fs.Readlink(pctx, path)
+	if !code.Ok() {
+		return nil, syscall.Errno(code)
+	}
+	return []byte(target), 0
+}
+
+func (n *pathNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	path, errno := n.path()
+	if errno != 0 {
+		return 0, errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+
+	data, code := n.fs.GetXAttr(pctx, path, attr)
+	if !code.Ok() {
+		return 0, syscall.Errno(code)
+	}
+	if len(dest) < len(data) {
+		return uint32(len(data)), syscall.ERANGE
+	}
+	return uint32(copy(dest, data)), 0
+}
+
+func (n *pathNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	path, errno := n.path()
+	if errno != 0 {
+		return 0, errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+
+	attrs, code := n.fs.ListXAttr(pctx, path)
+	if !code.Ok() {
+		return 0, syscall.Errno(code)
+	}
+	var data []byte
+	for _, a := range attrs {
+		data = append(data, a...)
+		data = append(data, 0)
+	}
+	if len(dest) < len(data) {
+		return uint32(len(data)), syscall.ERANGE
+	}
+	return uint32(copy(dest, data)), 0
+}
+
+func (n *pathNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	path, errno := n.path()
+	if errno != 0 {
+		return errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+	return syscall.Errno(n.fs.SetXAttr(pctx, path, attr, data, flags))
+}
+
+func (n *pathNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	path, errno := n.path()
+	if errno != 0 {
+		return errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+	return syscall.Errno(n.fs.RemoveXAttr(pctx, path, attr))
+}
+
+func (n *pathNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	path, errno := n.path()
+	if errno != 0 {
+		return errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+	return syscall.Errno(n.fs.StatFs(pctx, path, out))
+}
+
+// openFlags converts the keepCache and forceDIO results of a
+// FileSystem.
+func openFlags(keepCache, forceDIO bool) (flags uint32) {
+	if keepCache {
+		flags |= fuse.FOPEN_KEEP_CACHE
+	}
+	if forceDIO {
+		flags |= fuse.FOPEN_DIRECT_IO
+	}
+	return flags
+}
+
+func (n *pathNode) Open(ctx context.Context, flags uint32) (gofs.FileHandle, uint32, syscall.Errno) {
+	path, errno := n.path()
+	if errno != 0 {
+		return nil, 0, errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+	pctx.Opener = &pctx.Caller.Owner
+
+	file, keepCache, forceDIO, code := OpenFile(pctx, n.fs, path, flags)
+	if !code.Ok() {
+		return nil, 0, syscall.Errno(code)
+	}
+	f := &pathFile{node: n, opener: pctx.Caller.Owner, file: file, path: path}
+	return f, openFlags(keepCache, forceDIO), 0
+}
+
+func (n *pathNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*gofs.Inode, gofs.FileHandle, uint32, syscall.Errno) {
+	path, errno := n.childPath(name)
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+	pctx.Opener = &pctx.Caller.Owner
+
+	file, forceDIO, code := CreateFile(pctx, n.fs, path, flags, mode)
+	if !code.Ok() {
+		return nil, nil, 0, syscall.Errno(code)
+	}
+
+	var node *pathNode
+	child, errno := n.newChild(ctx, pctx, path, out)
+	if errno == 0 {
+		var ok bool
+		if node, ok = child.Operations().(*pathNode); !ok {
+			// the inode number is taken by another kind of node.
+			errno = syscall.EIO
+		}
+	}
+	if errno != 0 {
+		file.Release(pctx, path)
+		return nil, nil, 0, errno
+	}
+	f := &pathFile{
+		node:   node,
+		opener: pctx.Caller.Owner,
+		file:   file,
+		path:   path,
+	}
+	return child, f, openFlags(false, forceDIO), 0
+}
+
+// pathFile is an open file of a pathNode.
+type pathFile struct {
+	node   *pathNode
+	opener fuse.Owner
+	file   *File
+
+	// path is the last known path of node, kept for when the node
+	// has no name left.
+	mu   sync.Mutex
+	path string
+}
+
+var (
+	_ gofs.FileReader    = (*pathFile)(nil)
+	_ gofs.FileWriter    = (*pathFile)(nil)
+	_ gofs.FileFlusher   = (*pathFile)(nil)
+	_ gofs.FileFsyncer   = (*pathFile)(nil)
+	_ gofs.FileReleaser  = (*pathFile)(nil)
+	_ gofs.FileGetattrer = (*pathFile)(nil)
+	_ gofs.FileAllocater = (*pathFile)(nil)
+	_ gofs.FileGetlker   = (*pathFile)(nil)
+	_ gofs.FileSetlker   = (*pathFile)(nil)
+	_ gofs.FileSetlkwer  = (*pathFile)(nil)
+)
+
+// currentPath returns the path of the node of f or, once it was
+// unlinked, the path it was last known by.
+func (f *pathFile) currentPath() (string, syscall.Errno) {
+	path, errno := f.node.path()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if errno == 0 {
+		f.path = path
+	} else if f.path != "" {
+		return f.path, 0
+	}
+	return path, errno
+}
+
+// context returns the Context and the current path of f.
+func (f *pathFile) context(ctx context.Context) (*Context, string, syscall.Errno) {
+	path, errno := f.currentPath()
+	if errno != 0 {
+		return nil, "", errno
+	}
+	pctx := nodeContext(ctx)
+	pctx.Opener = &f.opener
+	return pctx, path, 0
+}
+
+func (f *pathFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	pctx, path, errno := f.context(ctx)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer releaseContext(pctx)
+
+	res, code := f.file.Read(pctx, path, dest, uint64(off))
+	return res, syscall.Errno(code)
+}
+
+func (f *pathFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	pctx, path, errno := f.context(ctx)
+	if errno != 0 {
+		return 0, errno
+	}
+	defer releaseContext(pctx)
+
+	written, code := f.file.Write(pctx, path, data, uint64(off))
+	return written, syscall.Errno(code)
+}
+
+func (f *pathFile) Flush(ctx context.Context) syscall.Errno {
+	pctx, path, errno := f.context(ctx)
+	if errno != 0 {
+		return errno
+	}
+	defer releaseContext(pctx)
+
+	return syscall.Errno(f.file.Flush(pctx, path, 0))
+}
+
+func (f *pathFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	pctx, path, errno := f.context(ctx)
+	if errno != 0 {
+		return errno
+	}
+	defer releaseContext(pctx)
+
+	return syscall.Errno(f.file.Fsync(pctx, path, flags))
+}
+
+func (f *pathFile) Release(ctx context.Context) syscall.Errno {
+	path, _ := f.currentPath()
+	pctx := nodeContext(ctx)
+	defer releaseContext(pctx)
+	pctx.Opener = &f.opener
+
+	f.file.Release(pctx, path)
+	return 0
+}
+
+func (f *pathFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	pctx, path, errno := f.context(ctx)
+	if errno != 0 {
+		return errno
+	}
+	defer releaseContext(pctx)
+
+	return syscall.Errno(f.file.GetAttr(pctx, path, &out.Attr))
+}
+
+func (f *pathFile) Allocate(ctx context.Context, off uint64, size uint64, mode uint32) syscall.Errno {
+	pctx, path, errno := f.context(ctx)
+	if errno != 0 {
+		return errno
+	}
+	defer releaseContext(pctx)
+
+	return syscall.Errno(f.file.Fallocate(pctx, path, off, size, mode))
+}
+
+func (f *pathFile) Getlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno {
+	pctx, path, errno := f.context(ctx)
+	if errno != 0 {
+		return errno
+	}
+	defer releaseContext(pctx)
+	return syscall.Errno(f.node.fs.GetLk(pctx, path, f.file.UFh(), owner, lk, flags, out))
+}
+
+func (f *pathFile) Setlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	pctx, path, errno := f.context(ctx)
+	if errno != 0 {
+		return errno
+	}
+	defer releaseContext(pctx)
+	return syscall.Errno(f.node.fs.SetLk(pctx, path, f.file.UFh(), owner, lk, flags))
+}
+
+func (f *pathFile) Setlkw(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	pctx, path, errno := f.context(ctx)
+	if errno != 0 {
+		return errno
+	}
+	defer releaseContext(pctx)
+	return syscall.Errno(f.node.fs.SetLkw(pctx, path, f.file.UFh(), owner, lk, flags))
+}
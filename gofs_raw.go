@@ -0,0 +1,616 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	gofs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// NewNodeFileSystem returns a FileSystem serving the go-fuse fs node
+// tree of root, so that it can be mounted with pathfs, or be part of
+// a FileSystem that delegates a subtree to it. See NewNodeRoot for the
+// reverse.
+//
+// The tree is driven through the fuse.RawFileSystem of fs.NewNodeFS,
+// looking up the elements of each path. There is no kernel to notify:
+// the notifications of its nodes fail with ENOSYS, unless
+// opts.ServerCallbacks is set. opts may be nil.
+func NewNodeFileSystem(root gofs.InodeEmbedder, opts *gofs.Options) FileSystem {
+	var o gofs.Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.ServerCallbacks == nil {
+		o.ServerCallbacks = noServer{}
+	}
+	return &nodeFileSystem{
+		raw:    gofs.NewNodeFS(root, &o),
+		root:   root.EmbeddedInode(),
+		files:  make(map[uint32]*nodeFile),
+		nextFh: 1,
+	}
+}
+
+// noServer stands in for the fuse.Server of the node tree.
+type noServer struct{}
+
+func (noServer) DeleteNotify(parent uint64, child uint64, name string) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (noServer) EntryNotify(parent uint64, name string) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (noServer) InodeNotify(node uint64, off int64, length int64) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (noServer) InodeRetrieveCache(node uint64, offset int64, dest []byte) (int, fuse.Status) {
+	return 0, fuse.ENOSYS
+}
+
+func (noServer) InodeNotifyStoreCache(node uint64, offset int64, data []byte) fuse.Status {
+	return fuse.ENOSYS
+}
+
+type nodeFile struct {
+	nodeId uint64
+	fh     uint64
+	// looked are the lookups that keep nodeId alive.
+	looked []uint64
+}
+
+type nodeFileSystem struct {
+	raw  fuse.RawFileSystem
+	root *gofs.Inode
+
+	mu     sync.Mutex
+	files  map[uint32]*nodeFile
+	nextFh uint32
+}
+
+func (n *nodeFileSystem) header(ctx *Context, nodeId uint64) fuse.InHeader {
+	return fuse.InHeader{NodeId: nodeId, Caller: ctx.Caller}
+}
+
+// walk looks up the elements of path, returning its node id and the
+// node ids to forget when done with it.
+func (n *nodeFileSystem) walk(ctx *Context, path string) (uint64, []uint64, fuse.Status) {
+	nodeId := uint64(fuse.FUSE_ROOT_ID)
+	if path == "" {
+		return nodeId, nil, fuse.OK
+	}
+	var looked []uint64
+	for _, name := range strings.Split(path, "/") {
+		var out fuse.EntryOut
+		h := n.header(ctx, nodeId)
+		if code := n.raw.Lookup(ctx.Cancel, &h, name, &out); !code.Ok() {
+			n.forget(looked)
+			return 0, nil, code
+		}
+		nodeId = out.NodeId
+		looked = append(looked, nodeId)
+	}
+	return nodeId, looked, fuse.OK
+}
+
+// walkParent walks to the parent directory of path, returning the
+// last element too.
+func (n *nodeFileSystem) walkParent(ctx *Context, path string) (uint64, string, []uint64, fuse.Status) {
+	dir, name := "", path
+	if i := strings.LastIndexByte(path, '/'); i >= 0 {
+		dir, name = path[:i], path[i+1:]
+	}
+	nodeId, looked, code := n.walk(ctx, dir)
+	return nodeId, name, looked, code
+}
+
+func (n *nodeFileSystem) forget(looked []uint64) {
+	for _, nodeId := range looked {
+		n.raw.Forget(nodeId, 1)
+	}
+}
+
+func (n *nodeFileSystem) file(uFh uint32) *nodeFile {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.files[uFh]
+}
+
+func (n *nodeFileSystem) addFile(f *nodeFile) uint32 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	uFh := n.nextFh
+	n.nextFh++
+	n.files[uFh] = f
+	return uFh
+}
+
+// node returns the node id of the open file uFh or of path.
+func (n *nodeFileSystem) node(ctx *Context, path string, uFh uint32) (uint64, []uint64, fuse.Status) {
+	if f := n.file(uFh); f != nil {
+		return f.nodeId, nil, fuse.OK
+	}
+	return n.walk(ctx, path)
+}
+
+func (n *nodeFileSystem) GetAttr(ctx *Context, path string, uFh uint32, out *fuse.Attr) fuse.Status {
+	nodeId, looked, code := n.node(ctx, path, uFh)
+	if !code.Ok() {
+		return code
+	}
+	defer n.forget(looked)
+
+	in := fuse.GetAttrIn{InHeader: n.header(ctx, nodeId)}
+	var attrOut fuse.AttrOut
+	code = n.raw.GetAttr(ctx.Cancel, &in, &attrOut)
+	*out = attrOut.Attr
+	return code
+}
+
+func (n *nodeFileSystem) Access(ctx *Context, path string, mask uint32) fuse.Status {
+	nodeId, looked, code := n.walk(ctx, path)
+	if !code.Ok() {
+		return code
+	}
+	defer n.forget(looked)
+
+	return n.raw.Access(ctx.Cancel, &fuse.AccessIn{InHeader: n.header(ctx, nodeId), Mask: mask})
+}
+
+// newEntry forgets the entry returned by a successful create.
+func (n *nodeFileSystem) newEntry(code fuse.Status, out *fuse.EntryOut) fuse.Status {
+	if code.Ok() {
+		n.raw.Forget(out.NodeId, 1)
+	}
+	return code
+}
+
+func (n *nodeFileSystem) Mknod(ctx *Context, path string, mode uint32, dev uint32) fuse.Status {
+	parent, name, looked, code := n.walkParent(ctx, path)
+	if !code.Ok() {
+		return code
+	}
+	defer n.forget(looked)
+
+	var in fuse.MknodIn
+	in.InHeader = n.header(ctx, parent)
+	in.Mode, in.Rdev = mode, dev
+	var out fuse.EntryOut
+	return n.newEntry(n.raw.Mknod(ctx.Cancel, &in, name, &out), &out)
+}
+
+func (n *nodeFileSystem) Mkdir(ctx *Context, path string, mode uint32) fuse.Status {
+	parent, name, looked, code := n.walkParent(ctx, path)
+	if !code.Ok() {
+		return code
+	}
+	defer n.forget(looked)
+
+	in := fuse.MkdirIn{InHeader: n.header(ctx, parent), Mode: mode}
+	var out fuse.EntryOut
+	return n.newEntry(n.raw.Mkdir(ctx.Cancel, &in, name, &out), &out)
+}
+
+func (n *nodeFileSystem) Unlink(ctx *Context, path string) fuse.Status {
+	parent, name, looked, code := n.walkParent(ctx, path)
+	if !code.Ok() {
+		return code
+	}
+	defer n.forget(looked)
+
+	h := n.header(ctx, parent)
+	return n.raw.Unlink(ctx.Cancel, &h, name)
+}
+
+func (n *nodeFileSystem) Rmdir(ctx *Context, path string) fuse.Status {
+	parent, name, looked, code := n.walkParent(ctx, path)
+	if !code.Ok() {
+		return code
+	}
+	defer n.forget(looked)
+
+	h := n.header(ctx, parent)
+	return n.raw.Rmdir(ctx.Cancel, &h, name)
+}
+
+func (n *nodeFileSystem) Rename(ctx *Context, path string, newPath string) fuse.Status {
+	parent, name, looked, code := n.walkParent(ctx, path)
+	if !code.Ok() {
+		return code
+	}
+	defer n.forget(looked)
+	newParent, newName, newLooked, code := n.walkParent(ctx, newPath)
+	if !code.Ok() {
+		return code
+	}
+	defer n.forget(newLooked)
+
+	in := fuse.RenameIn{InHeader: n.header(ctx, parent), Newdir: newParent}
+	return n.raw.Rename(ctx.Cancel, &in, name, newName)
+}
+
+func (n *nodeFileSystem) Link(ctx *Context, path string, newPath string) fuse.Status {
+	nodeId, looked, code := n.walk(ctx, path)
+	if !code.Ok() {
+		return code
+	}
+	defer n.forget(looked)
+	newParent, newName, newLooked, code := n.walkParent(ctx, newPath)
+	if !code.Ok() {
+		return code
+	}
+	defer n.forget(newLooked)
+
+	in := fuse.LinkIn{InHeader: n.header(ctx, newParent), Oldnodeid: nodeId}
+	var out fuse.EntryOut
+	return n.newEntry(n.raw.Link(ctx.Cancel, &in, newName, &out), &out)
+}
+
+func (n *nodeFileSystem) Symlink(ctx *Context, path string, target string) fuse.Status {
+	parent, name, looked, code := n.walkParent(ctx, path)
+	if !code.Ok() {
+		return code
+	}
+	defer n.forget(looked)
+
+	h := n.header(ctx, parent)
+	var out fuse.EntryOut
+	return n.newEntry(n.raw.Symlink(ctx.Cancel, &h, target, name, &out), &out)
+}
+
+func (n *nodeFileSystem) Readlink(ctx *Context, path string) (string, fuse.Status) {
+	nodeId, looked, code := n.walk(ctx, path)
+	if !code.Ok() {
+		return "", code
+	}
+	defer n.forget(looked)
+
+	h := n.header(ctx, nodeId)
+	target, code := n.raw.Readlink(ctx.Cancel, &h)
+	return string(target), code
+}
+
+// xattrData calls get with a buffer large enough for its result.
+func xattrData(get func(dest []byte) (uint32, fuse.Status)) ([]byte, fuse.Status) {
+	dest := make([]byte, 1024)
+	for {
+		sz, code := get(dest)
+		if code == fuse.ERANGE && int(sz) > len(dest) {
+			dest = make([]byte, sz)
+			continue
+		}
+		if !code.Ok() {
+			return nil, code
+		}
+		return dest[:sz], fuse.OK
+	}
+}
+
+func (n *nodeFileSystem) GetXAttr(ctx *Context, path string, attr string) ([]byte, fuse.Status) {
+	nodeId, looked, code := n.walk(ctx, path)
+	if !code.Ok() {
+		return nil, code
+	}
+	defer n.forget(looked)
+
+	h := n.header(ctx, nodeId)
+	return xattrData(func(dest []byte) (uint32, fuse.Status) {
+		return n.raw.GetXAttr(ctx.Cancel, &h, attr, dest)
+	})
+}
+
+func (n *nodeFileSystem) ListXAttr(ctx *Context, path string) ([]string, fuse.Status) {
+	nodeId, looked, code := n.walk(ctx, path)
+	if !code.Ok() {
+		return nil, code
+	}
+	defer n.forget(looked)
+
+	h := n.header(ctx, nodeId)
+	data, code := xattrData(func(dest []byte) (uint32, fuse.Status) {
+		return n.raw.ListXAttr(ctx.Cancel, &h, dest)
+	})
+	if !code.Ok() {
+		return nil, code
+	}
+	var attrs []string
+	for _, a := range strings.Split(string(data), "\x00") {
+		if a != "" {
+			attrs = append(attrs, a)
+		}
+	}
+	return attrs, fuse.OK
+}
+
+func (n *nodeFileSystem) SetXAttr(ctx *Context, path string, attr string, data []byte, flags uint32) fuse.Status {
+	nodeId, looked, code := n.walk(ctx, path)
+	if !code.Ok() {
+		return code
+	}
+	defer n.forget(looked)
+
+	var in fuse.SetXAttrIn
+	in.InHeader = n.header(ctx, nodeId)
+	in.Size, in.Flags = uint32(len(data)), flags
+	return n.raw.SetXAttr(ctx.Cancel, &in, attr, data)
+}
+
+func (n *nodeFileSystem) RemoveXAttr(ctx *Context, path string, attr string) fuse.Status {
+	nodeId, looked, code := n.walk(ctx, path)
+	if !code.Ok() {
+		return code
+	}
+	defer n.forget(looked)
+
+	h := n.header(ctx, nodeId)
+	return n.raw.RemoveXAttr(ctx.Cancel, &h, attr)
+}
+
+func (n *nodeFileSystem) Create(ctx *Context, path string, flags uint32, mode uint32) (uFh uint32, forceDIO bool, code fuse.Status) {
+	parent, name, looked, code := n.walkParent(ctx, path)
+	if !code.Ok() {
+		return 0, false, code
+	}
+	defer n.forget(looked)
+
+	var in fuse.CreateIn
+	in.InHeader = n.header(ctx, parent)
+	in.Flags, in.Mode = flags, mode
+	var out fuse.CreateOut
+	if code := n.raw.Create(ctx.Cancel, &in, name, &out); !code.Ok() {
+		return 0, false, code
+	}
+	// the lookup of the create is kept until Release.
+	uFh = n.addFile(&nodeFile{nodeId: out.NodeId, fh: out.Fh, looked: []uint64{out.NodeId}})
+	return uFh, out.OpenFlags&fuse.FOPEN_DIRECT_IO != 0, fuse.OK
+}
+
+func (n *nodeFileSystem) Open(ctx *Context, path string, flags uint32) (uFh uint32, keepCache, forceDIO bool, code fuse.Status) {
+	nodeId, looked, code := n.walk(ctx, path)
+	if !code.Ok() {
+		return 0, false, false, code
+	}
+
+	in := fuse.OpenIn{InHeader: n.header(ctx, nodeId), Flags: flags}
+	var out fuse.OpenOut
+	if code := n.raw.Open(ctx.Cancel, &in, &out); !code.Ok() {
+		n.forget(looked)
+		return 0, false, false, code
+	}
+	uFh = n.addFile(&nodeFile{nodeId: nodeId, fh: out.Fh, looked: looked})
+	return uFh, out.OpenFlags&fuse.FOPEN_KEEP_CACHE != 0, out.OpenFlags&fuse.FOPEN_DIRECT_IO != 0, fuse.OK
+}
+
+func (n *nodeFileSystem) Read(ctx *Context, path string, uFh uint32, dest []byte, off uint64) (fuse.ReadResult, fuse.Status) {
+	f := n.file(uFh)
+	if f == nil {
+		return nil, fuse.EBADF
+	}
+	var in fuse.ReadIn
+	in.InHeader = n.header(ctx, f.nodeId)
+	in.Fh, in.Offset, in.Size = f.fh, off, uint32(len(dest))
+	return n.raw.Read(ctx.Cancel, &in, dest)
+}
+
+func (n *nodeFileSystem) Write(ctx *Context, path string, uFh uint32, data []byte, off uint64) (written uint32, code fuse.Status) {
+	f := n.file(uFh)
+	if f == nil {
+		return 0, fuse.EBADF
+	}
+	var in fuse.WriteIn
+	in.InHeader = n.header(ctx, f.nodeId)
+	in.Fh, in.Offset, in.Size = f.fh, off, uint32(len(data))
+	return n.raw.Write(ctx.Cancel, &in, data)
+}
+
+func (n *nodeFileSystem) Fallocate(ctx *Context, path string, uFh uint32, off uint64, size uint64, mode uint32) fuse.Status {
+	f := n.file(uFh)
+	if f == nil {
+		return fuse.EBADF
+	}
+	in := fuse.FallocateIn{InHeader: n.header(ctx, f.nodeId), Fh: f.fh, Offset: off, Length: size, Mode: mode}
+	return n.raw.Fallocate(ctx.Cancel, &in)
+}
+
+func (n *nodeFileSystem) Fsync(ctx *Context, path string, uFh uint32, flags uint32) fuse.Status {
+	f := n.file(uFh)
+	if f == nil {
+		return fuse.EBADF
+	}
+	in := fuse.FsyncIn{InHeader: n.header(ctx, f.nodeId), Fh: f.fh, FsyncFlags: flags}
+	return n.raw.Fsync(ctx.Cancel, &in)
+}
+
+func (n *nodeFileSystem) Flush(ctx *Context, path string, uFh uint32, lockOwner uint64) fuse.Status {
+	f := n.file(uFh)
+	if f == nil {
+		return fuse.EBADF
+	}
+	in := fuse.FlushIn{InHeader: n.header(ctx, f.nodeId), Fh: f.fh, LockOwner: lockOwner}
+	return n.raw.Flush(ctx.Cancel, &in)
+}
+
+func (n *nodeFileSystem) Release(ctx *Context, path string, uFh uint32) {
+	n.mu.Lock()
+	f := n.files[uFh]
+	delete(n.files, uFh)
+	n.mu.Unlock()
+	if f == nil {
+		return
+	}
+
+	n.raw.Release(ctx.Cancel, &fuse.ReleaseIn{InHeader: n.header(ctx, f.nodeId), Fh: f.fh})
+	n.forget(f.looked)
+}
+
+func (n *nodeFileSystem) lk(ctx *Context, uFh uint32, owner uint64, lk *fuse.FileLock, flags uint32) (*fuse.LkIn, fuse.Status) {
+	f := n.file(uFh)
+	if f == nil {
+		return nil, fuse.EBADF
+	}
+	return &fuse.LkIn{InHeader: n.header(ctx, f.nodeId), Fh: f.fh, Owner: owner, Lk: *lk, LkFlags: flags}, fuse.OK
+}
+
+func (n *nodeFileSystem) GetLk(ctx *Context, path string, uFh uint32, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) fuse.Status {
+	in, code := n.lk(ctx, uFh, owner, lk, flags)
+	if !code.Ok() {
+		return code
+	}
+	var lkOut fuse.LkOut
+	code = n.raw.GetLk(ctx.Cancel, in, &lkOut)
+	*out = lkOut.Lk
+	return code
+}
+
+func (n *nodeFileSystem) SetLk(ctx *Context, path string, uFh uint32, owner uint64, lk *fuse.FileLock, flags uint32) fuse.Status {
+	in, code := n.lk(ctx, uFh, owner, lk, flags)
+	if !code.Ok() {
+		return code
+	}
+	return n.raw.SetLk(ctx.Cancel, in)
+}
+
+func (n *nodeFileSystem) SetLkw(ctx *Context, path string, uFh uint32, owner uint64, lk *fuse.FileLock, flags uint32) fuse.Status {
+	in, code := n.lk(ctx, uFh, owner, lk, flags)
+	if !code.Ok() {
+		return code
+	}
+	return n.raw.SetLkw(ctx.Cancel, in)
+}
+
+// setAttr calls SetAttr with the fields of valid set by set.
+func (n *nodeFileSystem) setAttr(ctx *Context, path string, uFh uint32, valid uint32, set func(in *fuse.SetAttrIn)) fuse.Status {
+	nodeId, looked, code := n.node(ctx, path, uFh)
+	if !code.Ok() {
+		return code
+	}
+	defer n.forget(looked)
+
+	var in fuse.SetAttrIn
+	in.InHeader = n.header(ctx, nodeId)
+	in.Valid = valid
+	if f := n.file(uFh); f != nil {
+		in.Valid |= fuse.FATTR_FH
+		in.Fh = f.fh
+	}
+	set(&in)
+	var out fuse.AttrOut
+	return n.raw.SetAttr(ctx.Cancel, &in, &out)
+}
+
+func (n *nodeFileSystem) Chmod(ctx *Context, path string, uFh uint32, mode uint32) fuse.Status {
+	return n.setAttr(ctx, path, uFh, fuse.FATTR_MODE, func(in *fuse.SetAttrIn) {
+		in.Mode = mode
+	})
+}
+
+func (n *nodeFileSystem) Chown(ctx *Context, path string, uFh uint32, uid uint32, gid uint32) fuse.Status {
+	return n.setAttr(ctx, path, uFh, fuse.FATTR_UID|fuse.FATTR_GID, func(in *fuse.SetAttrIn) {
+		in.Owner = fuse.Owner{Uid: uid, Gid: gid}
+	})
+}
+
+func (n *nodeFileSystem) Truncate(ctx *Context, path string, uFh uint32, size uint64) fuse.Status {
+	return n.setAttr(ctx, path, uFh, fuse.FATTR_SIZE, func(in *fuse.SetAttrIn) {
+		in.Size = size
+	})
+}
+
+func (n *nodeFileSystem) Utimens(ctx *Context, path string, uFh uint32, atime *time.Time, mtime *time.Time) fuse.Status {
+	var valid uint32
+	if atime != nil {
+		valid |= fuse.FATTR_ATIME
+	}
+	if mtime != nil {
+		valid |= fuse.FATTR_MTIME
+	}
+	return n.setAttr(ctx, path, uFh, valid, func(in *fuse.SetAttrIn) {
+		if atime != nil {
+			in.Atime, in.Atimensec = uint64(atime.Unix()), uint32(atime.Nanosecond())
+		}
+		if mtime != nil {
+			in.Mtime, in.Mtimensec = uint64(mtime.Unix()), uint32(mtime.Nanosecond())
+		}
+	})
+}
+
+// inode returns the node of path, which walk looked up.
+func (n *nodeFileSystem) inode(path string) *gofs.Inode {
+	node := n.root
+	if path == "" {
+		return node
+	}
+	for _, name := range strings.Split(path, "/") {
+		if node = node.GetChild(name); node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// Lsdir lists the directory the way the node bridge does for ReadDir,
+// through fs.NodeReaddirer or else the children of the node.
+func (n *nodeFileSystem) Lsdir(ctx *Context, path string) ([]fuse.DirEntry, fuse.Status) {
+	nodeId, looked, code := n.walk(ctx, path)
+	if !code.Ok() {
+		return nil, code
+	}
+	defer n.forget(looked)
+
+	in := fuse.OpenIn{InHeader: n.header(ctx, nodeId)}
+	var out fuse.OpenOut
+	if code := n.raw.OpenDir(ctx.Cancel, &in, &out); !code.Ok() {
+		return nil, code
+	}
+	defer n.raw.ReleaseDir(&fuse.ReleaseIn{InHeader: in.InHeader, Fh: out.Fh})
+
+	node := n.inode(path)
+	if node == nil {
+		return nil, fuse.ENOENT
+	}
+	rd, ok := node.Operations().(gofs.NodeReaddirer)
+	if !ok {
+		var stream []fuse.DirEntry
+		for name, child := range node.Children() {
+			stream = append(stream, fuse.DirEntry{Name: name, Ino: child.StableAttr().Ino, Mode: child.Mode()})
+		}
+		return stream, fuse.OK
+	}
+
+	ds, errno := rd.Readdir(&fuse.Context{Caller: ctx.Caller, Cancel: ctx.Cancel})
+	if errno != 0 {
+		return nil, fuse.Status(errno)
+	}
+	defer ds.Close()
+	var stream []fuse.DirEntry
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			return nil, fuse.Status(errno)
+		}
+		if e.Name != "." && e.Name != ".." {
+			stream = append(stream, e)
+		}
+	}
+	return stream, fuse.OK
+}
+
+func (n *nodeFileSystem) StatFs(ctx *Context, path string, out *fuse.StatfsOut) fuse.Status {
+	nodeId, looked, code := n.walk(ctx, path)
+	if !code.Ok() {
+		return code
+	}
+	defer n.forget(looked)
+
+	h := n.header(ctx, nodeId)
+	return n.raw.StatFs(ctx.Cancel, &h, out)
+}
@@ -0,0 +1,149 @@
+package pathfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+	"testing/fstest"
+
+	gofs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestNodeRoundTrip(t *testing.T) {
+	// FileSystem -> node tree -> FileSystem -> io/fs.
+	fsys := NewIOFS(NewNodeFileSystem(NewNodeRoot(NewIOFileSystem(newTestMapFS())), nil))
+	if err := fstest.TestFS(fsys, "a.txt", "dir/b.txt", "link"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNodeFileSystem(t *testing.T) {
+	for name, newRoot := range map[string]func(dir string) gofs.InodeEmbedder{
+		"loopback": func(dir string) gofs.InodeEmbedder {
+			root, err := gofs.NewLoopbackRoot(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return root
+		},
+		"pathfs": func(dir string) gofs.InodeEmbedder {
+			return NewNodeRoot(NewTestFileSystem(dir))
+		},
+	} {
+		dir := t.TempDir()
+		fsys := NewNodeFileSystem(newRoot(dir), nil)
+		ctx := newContext(nil, fuse.Caller{})
+
+		if code := fsys.Mkdir(ctx, "d", 0755); !code.Ok() {
+			t.Fatalf("%s: mkdir: %v", name, code)
+		}
+		fh, _, code := fsys.Create(ctx, "d/f", syscall.O_RDWR, 0644)
+		if !code.Ok() {
+			t.Fatalf("%s: create: %v", name, code)
+		}
+		if n, code := fsys.Write(ctx, "d/f", fh, []byte("hello"), 0); !code.Ok() || n != 5 {
+			t.Fatalf("%s: write: %d %v", name, n, code)
+		}
+		res, code := fsys.Read(ctx, "d/f", fh, make([]byte, 16), 1)
+		if data, _ := res.Bytes(make([]byte, 16)); !code.Ok() || string(data) != "ello" {
+			t.Errorf("%s: read: %q %v", name, data, code)
+		}
+		fsys.Release(ctx, "d/f", fh)
+
+		if code := fsys.Rename(ctx, "d/f", "g"); !code.Ok() {
+			t.Fatalf("%s: rename: %v", name, code)
+		}
+		if code := fsys.Chmod(ctx, "g", 0, 0600); !code.Ok() {
+			t.Errorf("%s: chmod: %v", name, code)
+		}
+		var attr fuse.Attr
+		if code := fsys.GetAttr(ctx, "g", 0, &attr); !code.Ok() || attr.Size != 5 || attr.Mode&07777 != 0600 {
+			t.Errorf("%s: getattr: %v %v", name, code, attr)
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, "g")); err != nil || string(data) != "hello" {
+			t.Errorf("%s: on disk: %q %v", name, data, err)
+		}
+
+		stream, code := fsys.Lsdir(ctx, "")
+		if !code.Ok() {
+			t.Fatalf("%s: lsdir: %v", name, code)
+		}
+		var names []string
+		for _, e := range stream {
+			names = append(names, e.Name)
+		}
+		sort.Strings(names)
+		if len(names) != 2 || names[0] != "d" || names[1] != "g" {
+			t.Errorf("%s: lsdir: %v", name, names)
+		}
+
+		if code := fsys.Unlink(ctx, "g"); !code.Ok() {
+			t.Errorf("%s: unlink: %v", name, code)
+		}
+		if code := fsys.GetAttr(ctx, "g", 0, &attr); code != fuse.ENOENT {
+			t.Errorf("%s: want ENOENT, have %v", name, code)
+		}
+		releaseContext(ctx)
+	}
+}
+
+func TestNodeOpenUnlinked(t *testing.T) {
+	dir := t.TempDir()
+	fsys := NewNodeFileSystem(NewNodeRoot(NewTestFileSystem(dir)), nil)
+	ctx := newContext(nil, fuse.Caller{})
+	defer releaseContext(ctx)
+
+	fh, _, code := fsys.Create(ctx, "f", syscall.O_RDWR, 0644)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fsys.Unlink(ctx, "f"); !code.Ok() {
+		t.Fatal(code)
+	}
+	if n, code := fsys.Write(ctx, "f", fh, []byte("hello"), 0); !code.Ok() || n != 5 {
+		t.Fatalf("write after unlink: %d %v", n, code)
+	}
+	res, code := fsys.Read(ctx, "f", fh, make([]byte, 16), 0)
+	if data, _ := res.Bytes(make([]byte, 16)); !code.Ok() || string(data) != "hello" {
+		t.Errorf("read after unlink: %q %v", data, code)
+	}
+	fsys.Release(ctx, "f", fh)
+}
+
+// memRoot is a node tree without Readdir, listed by its children.
+type memRoot struct {
+	gofs.Inode
+}
+
+func (r *memRoot) OnAdd(ctx context.Context) {
+	file := r.NewPersistentInode(ctx, &gofs.MemRegularFile{Data: []byte("hi")}, gofs.StableAttr{Ino: 5})
+	r.AddChild("f", file, false)
+	dir := r.NewPersistentInode(ctx, &gofs.Inode{}, gofs.StableAttr{Mode: fuse.S_IFDIR})
+	r.AddChild("d", dir, false)
+}
+
+func TestNodeFileSystemChildren(t *testing.T) {
+	root := &memRoot{}
+	fsys := NewNodeFileSystem(root, nil)
+	ctx := newContext(nil, fuse.Caller{})
+	defer releaseContext(ctx)
+
+	stream, code := fsys.Lsdir(ctx, "")
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	sort.Slice(stream, func(i, j int) bool { return stream[i].Name < stream[j].Name })
+	if len(stream) != 2 || stream[0].Name != "d" || stream[0].Mode != fuse.S_IFDIR ||
+		stream[1].Name != "f" || stream[1].Ino != 5 || stream[1].Mode != fuse.S_IFREG {
+		t.Errorf("lsdir: %v", stream)
+	}
+
+	// there is no kernel to notify.
+	if errno := root.GetChild("f").NotifyContent(0, 0); errno != syscall.ENOSYS {
+		t.Errorf("want ENOSYS, have %v", errno)
+	}
+}
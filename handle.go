@@ -0,0 +1,128 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// File is an open file of a FileSystem, for servers other than the
+// FUSE bridge. It holds the FileHandle of a HandleFileSystem or the
+// uFh of any other FileSystem, and calls the FileHandle (and the
+// optional interfaces it implements) or the FileSystem file methods
+// as the bridge does.
+//
+// The methods take the current path of the file, which the
+// FileSystem methods are called with.
+type File struct {
+	fs     FileSystem
+	uFh    uint32
+	handle FileHandle
+}
+
+// OpenFile opens path like FileSystem.Open, through OpenHandle if fs
+// is a HandleFileSystem.
+func OpenFile(ctx *Context, fs FileSystem, path string, flags uint32) (f *File, keepCache, forceDIO bool, code fuse.Status) {
+	f = &File{fs: fs}
+	if hfs, ok := fs.(HandleFileSystem); ok {
+		f.handle, keepCache, forceDIO, code = hfs.OpenHandle(ctx, path, flags)
+	} else {
+		f.uFh, keepCache, forceDIO, code = fs.Open(ctx, path, flags)
+	}
+	if !code.Ok() {
+		return nil, false, false, code
+	}
+	return f, keepCache, forceDIO, fuse.OK
+}
+
+// CreateFile creates and opens path like FileSystem.Create, through
+// CreateHandle if fs is a HandleFileSystem.
+func CreateFile(ctx *Context, fs FileSystem, path string, flags uint32, mode uint32) (f *File, forceDIO bool, code fuse.Status) {
+	f = &File{fs: fs}
+	if hfs, ok := fs.(HandleFileSystem); ok {
+		f.handle, forceDIO, code = hfs.CreateHandle(ctx, path, flags, mode)
+	} else {
+		f.uFh, forceDIO, code = fs.Create(ctx, path, flags, mode)
+	}
+	if !code.Ok() {
+		return nil, false, code
+	}
+	return f, forceDIO, fuse.OK
+}
+
+// UFh returns the uFh for the FileSystem methods that take one, such
+// as Chmod; it is 0 for a FileHandle.
+func (f *File) UFh() uint32 {
+	return f.uFh
+}
+
+func (f *File) Read(ctx *Context, path string, dest []byte, off uint64) (result fuse.ReadResult, code fuse.Status) {
+	if f.handle != nil {
+		return f.handle.Read(ctx, dest, off)
+	}
+	return f.fs.Read(ctx, path, f.uFh, dest, off)
+}
+
+func (f *File) Write(ctx *Context, path string, data []byte, off uint64) (written uint32, code fuse.Status) {
+	if f.handle != nil {
+		return f.handle.Write(ctx, data, off)
+	}
+	return f.fs.Write(ctx, path, f.uFh, data, off)
+}
+
+func (f *File) GetAttr(ctx *Context, path string, out *fuse.Attr) fuse.Status {
+	if fga, ok := f.handle.(FileGetAttrer); ok {
+		return fga.GetAttr(ctx, out)
+	}
+	return f.fs.GetAttr(ctx, path, f.uFh, out)
+}
+
+func (f *File) Truncate(ctx *Context, path string, size uint64) fuse.Status {
+	if ft, ok := f.handle.(FileTruncater); ok {
+		return ft.Truncate(ctx, size)
+	}
+	return f.fs.Truncate(ctx, path, f.uFh, size)
+}
+
+func (f *File) Fallocate(ctx *Context, path string, off uint64, size uint64, mode uint32) fuse.Status {
+	if ffa, ok := f.handle.(FileFallocater); ok {
+		return ffa.Fallocate(ctx, off, size, mode)
+	}
+	return f.fs.Fallocate(ctx, path, f.uFh, off, size, mode)
+}
+
+func (f *File) Fsync(ctx *Context, path string, flags uint32) fuse.Status {
+	if ffs, ok := f.handle.(FileFsyncer); ok {
+		return ffs.Fsync(ctx, flags)
+	}
+	return f.fs.Fsync(ctx, path, f.uFh, flags)
+}
+
+func (f *File) Flush(ctx *Context, path string, lockOwner uint64) fuse.Status {
+	if f.handle != nil {
+		return f.handle.Flush(ctx, lockOwner)
+	}
+	return f.fs.Flush(ctx, path, f.uFh, lockOwner)
+}
+
+func (f *File) Release(ctx *Context, path string) {
+	if f.handle != nil {
+		f.handle.Release(ctx)
+	} else {
+		f.fs.Release(ctx, path, f.uFh)
+	}
+}
+
+// Close flushes and releases the file, returning the status of Flush.
+// A FileSystem without Flush has nothing to flush: ENOSYS counts as
+// success.
+func (f *File) Close(ctx *Context, path string) fuse.Status {
+	code := f.Flush(ctx, path, 0)
+	f.Release(ctx, path)
+	if code == fuse.ENOSYS {
+		return fuse.OK
+	}
+	return code
+}
@@ -0,0 +1,67 @@
+package pathfs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestFileOfHandle(t *testing.T) {
+	mock := &mockHandleFileSystem{}
+	ctx := &Context{}
+	f, keepCache, _, code := OpenFile(ctx, mock, "f", 0)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if !keepCache || f.UFh() != 0 {
+		t.Errorf("want keepCache and uFh 0, have %v %d", keepCache, f.UFh())
+	}
+	h := mock.handles[0]
+
+	dest := make([]byte, 16)
+	res, code := f.Read(ctx, "f", dest, 0)
+	if data, _ := res.Bytes(dest); !code.Ok() || string(data) != "hello" {
+		t.Errorf("read: %q %v", data, code)
+	}
+	f.Write(ctx, "f", []byte(" world"), 5)
+	var attr fuse.Attr
+	if code := f.GetAttr(ctx, "f", &attr); !code.Ok() || attr.Size != 11 {
+		t.Errorf("want size from the handle 11, have %d %v", attr.Size, code)
+	}
+	if code := f.Close(ctx, "f"); !code.Ok() {
+		t.Error(code)
+	}
+	want := []string{"read", "write", "flush"}
+	if fmt.Sprint(h.calls) != fmt.Sprint(want) || !h.released {
+		t.Errorf("want calls %v and a release, have %v %v", want, h.calls, h.released)
+	}
+
+	if _, _, code := CreateFile(ctx, mock, "g", 0, fuse.S_IFREG|0644); !code.Ok() || len(mock.handles) != 2 {
+		t.Errorf("want a created handle, have %d %v", len(mock.handles), code)
+	}
+}
+
+func TestFileOfUFh(t *testing.T) {
+	mock := &mockFileSystem{
+		openFunc: func(path string) (uint32, bool, bool, fuse.Status) {
+			return 7, false, true, fuse.OK
+		},
+	}
+	ctx := &Context{}
+	f, _, forceDIO, code := OpenFile(ctx, mock, "f", 0)
+	if !code.Ok() || !forceDIO || f.UFh() != 7 {
+		t.Fatalf("want uFh 7 with forceDIO, have %v %v", forceDIO, code)
+	}
+	// the FileSystem has no Flush.
+	if code := f.Close(ctx, "f"); !code.Ok() {
+		t.Errorf("want ENOSYS of Flush ignored, have %v", code)
+	}
+
+	mock.openFunc = func(path string) (uint32, bool, bool, fuse.Status) {
+		return 0, false, false, fuse.EACCES
+	}
+	if f, _, _, code := OpenFile(ctx, mock, "f", 0); code != fuse.EACCES || f != nil {
+		t.Errorf("want EACCES, have %v %v", f, code)
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// overflowID is reported for ids that have no mapping, like the
+// overflow uid and gid of user namespaces.
+const overflowID = 65534
+
+// IDMapRange maps Count consecutive ids starting at Backend, as seen
+// by the FileSystem, to ids starting at Local, as seen by the kernel.
+type IDMapRange struct {
+	Backend uint32
+	Local   uint32
+	Count   uint32
+}
+
+// IDMap translates uids or gids between the FileSystem and the kernel,
+// like the uid_map and gid_map of a user namespace. Ids outside of all
+// ranges are unmapped.
+type IDMap []IDMapRange
+
+// ToLocal maps a FileSystem id to a kernel id.
+func (m IDMap) ToLocal(id uint32) (uint32, bool) {
+	for _, r := range m {
+		if id >= r.Backend && id-r.Backend < r.Count {
+			return r.Local + (id - r.Backend), true
+		}
+	}
+	return 0, false
+}
+
+// ToBackend maps a kernel id to a FileSystem id.
+func (m IDMap) ToBackend(id uint32) (uint32, bool) {
+	for _, r := range m {
+		if id >= r.Local && id-r.Local < r.Count {
+			return r.Backend + (id - r.Local), true
+		}
+	}
+	return 0, false
+}
+
+// Validate checks that the ranges are not empty, don't wrap around and
+// don't overlap on either side.
+func (m IDMap) Validate() error {
+	for i, r := range m {
+		if r.Count == 0 {
+			return fmt.Errorf("idmap: range %d is empty", i)
+		}
+		if r.Backend+r.Count-1 < r.Backend || r.Local+r.Count-1 < r.Local {
+			return fmt.Errorf("idmap: range %d overflows", i)
+		}
+		for j := 0; j < i; j++ {
+			o := m[j]
+			if rangesOverlap(r.Backend, r.Count, o.Backend, o.Count) {
+				return fmt.Errorf("idmap: backend ids of ranges %d and %d overlap", j, i)
+			}
+			if rangesOverlap(r.Local, r.Count, o.Local, o.Count) {
+				return fmt.Errorf("idmap: local ids of ranges %d and %d overlap", j, i)
+			}
+		}
+	}
+	return nil
+}
+
+func rangesOverlap(a, an, b, bn uint32) bool {
+	return a <= b+(bn-1) && b <= a+(an-1)
+}
+
+// ReadIDMap parses a map in the format of /proc/<pid>/uid_map: one
+// range per line, as "backend local count".
+func ReadIDMap(r io.Reader) (IDMap, error) {
+	var m IDMap
+	err := scanIDLines(r, func(fields []string) error {
+		if len(fields) != 3 {
+			return fmt.Errorf("want 3 fields, have %d", len(fields))
+		}
+		var v [3]uint32
+		for i, f := range fields {
+			n, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return err
+			}
+			v[i] = uint32(n)
+		}
+		m = append(m, IDMapRange{Backend: v[0], Local: v[1], Count: v[2]})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, m.Validate()
+}
+
+// ReadSubIDMap parses a file in the format of /etc/subuid and
+// /etc/subgid, "name:start:count", keeping the entries of name. As
+// with newuidmap, the local ranges are mapped in file order to
+// consecutive backend ids starting at 0.
+func ReadSubIDMap(r io.Reader, name string) (IDMap, error) {
+	var m IDMap
+	var next uint32
+	err := scanIDLines(r, func(fields []string) error {
+		fields = strings.Split(fields[0], ":")
+		if len(fields) != 3 {
+			return fmt.Errorf("want name:start:count")
+		}
+		if fields[0] != name {
+			return nil
+		}
+		start, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return err
+		}
+		count, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return err
+		}
+		m = append(m, IDMapRange{Backend: next, Local: uint32(start), Count: uint32(count)})
+		next += uint32(count)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, m.Validate()
+}
+
+// LoadSubIDMap reads the entries of name from a subuid or subgid file.
+func LoadSubIDMap(path string, name string) (IDMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadSubIDMap(f, name)
+}
+
+// scanIDLines calls fn with the fields of each line, skipping blank
+// lines and comments.
+func scanIDLines(r io.Reader, fn func(fields []string) error) error {
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if err := fn(fields); err != nil {
+			return fmt.Errorf("idmap: line %d: %v", line, err)
+		}
+	}
+	return s.Err()
+}
+
+// mapAttrIDs maps the owner of an attr returned by the FileSystem to
+// kernel ids.
+func (b *rawBridge) mapAttrIDs(out *fuse.Attr) {
+	if b.options.UIDMap != nil {
+		out.Uid = toLocalOrOverflow(b.options.UIDMap, out.Uid)
+	}
+	if b.options.GIDMap != nil {
+		out.Gid = toLocalOrOverflow(b.options.GIDMap, out.Gid)
+	}
+}
+
+func toLocalOrOverflow(m IDMap, id uint32) uint32 {
+	if l, ok := m.ToLocal(id); ok {
+		return l
+	}
+	return overflowID
+}
+
+// backendCaller maps a kernel caller to FileSystem ids. Unmapped ids
+// become the overflow id.
+func (b *rawBridge) backendCaller(caller fuse.Caller) fuse.Caller {
+	if b.options.UIDMap != nil {
+		caller.Uid = toBackendOrOverflow(b.options.UIDMap, caller.Uid)
+	}
+	if b.options.GIDMap != nil {
+		caller.Gid = toBackendOrOverflow(b.options.GIDMap, caller.Gid)
+	}
+	return caller
+}
+
+func toBackendOrOverflow(m IDMap, id uint32) uint32 {
+	if l, ok := m.ToBackend(id); ok {
+		return l
+	}
+	return overflowID
+}
+
+// backendOwner maps the ids of a chown to FileSystem ids. An id with
+// no mapping can't be represented, and fails with EINVAL as chown(2)
+// does in a user namespace.
+func (b *rawBridge) backendOwner(uid, gid uint32, uok, gok bool) (uint32, uint32, fuse.Status) {
+	var ok bool
+	if uok && b.options.UIDMap != nil {
+		if uid, ok = b.options.UIDMap.ToBackend(uid); !ok {
+			return 0, 0, fuse.EINVAL
+		}
+	}
+	if gok && b.options.GIDMap != nil {
+		if gid, ok = b.options.GIDMap.ToBackend(gid); !ok {
+			return 0, 0, fuse.EINVAL
+		}
+	}
+	return uid, gid, fuse.OK
+}
+
+// newContext is newContext with the caller mapped to FileSystem ids.
+// The kernel caller is kept for the permission checks, which compare
+// it with the mapped attrs.
+func (b *rawBridge) newContext(cancel <-chan struct{}, caller fuse.Caller) *Context {
+	ctx := newContext(cancel, caller)
+	if b.options.UIDMap != nil || b.options.GIDMap != nil {
+		ctx.Caller = b.backendCaller(caller)
+	}
+	return ctx
+}
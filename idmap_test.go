@@ -0,0 +1,142 @@
+package pathfs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestIDMap(t *testing.T) {
+	m := IDMap{{Backend: 0, Local: 100000, Count: 65536}, {Backend: 70000, Local: 1000, Count: 1}}
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		backend, local uint32
+	}{
+		{0, 100000},
+		{65535, 165535},
+		{70000, 1000},
+	}
+	for _, tt := range tests {
+		if l, ok := m.ToLocal(tt.backend); !ok || l != tt.local {
+			t.Errorf("ToLocal(%d): want %d, have %d %v", tt.backend, tt.local, l, ok)
+		}
+		if b, ok := m.ToBackend(tt.local); !ok || b != tt.backend {
+			t.Errorf("ToBackend(%d): want %d, have %d %v", tt.local, tt.backend, b, ok)
+		}
+	}
+	if _, ok := m.ToLocal(65536); ok {
+		t.Error("ToLocal(65536): want unmapped")
+	}
+	if _, ok := m.ToBackend(999); ok {
+		t.Error("ToBackend(999): want unmapped")
+	}
+
+	bad := IDMap{{0, 100, 10}, {5, 200, 10}}
+	if err := bad.Validate(); err == nil {
+		t.Error("want overlapping backend ranges rejected")
+	}
+}
+
+func TestInvalidIDMapOptions(t *testing.T) {
+	options := &Options{GIDMap: IDMap{{0, 100, 10}, {5, 200, 10}}}
+	if _, err := Mount(t.TempDir(), DefaultFileSystem(), options, nil); err == nil {
+		t.Error("want Mount to fail with an invalid gid map")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("want NewPathFS to panic with an invalid gid map")
+		}
+	}()
+	NewPathFS(DefaultFileSystem(), options)
+}
+
+func TestReadIDMap(t *testing.T) {
+	m, err := ReadIDMap(strings.NewReader("# comment\n0 100000 1000\n\n1000 1000 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := IDMap{{0, 100000, 1000}, {1000, 1000, 1}}
+	if len(m) != len(want) || m[0] != want[0] || m[1] != want[1] {
+		t.Errorf("want %v, have %v", want, m)
+	}
+	if _, err := ReadIDMap(strings.NewReader("0 1\n")); err == nil {
+		t.Error("want error for a short line")
+	}
+}
+
+func TestReadSubIDMap(t *testing.T) {
+	const subuid = "alice:100000:65536\nbob:165536:65536\nalice:300000:10\n"
+	m, err := ReadSubIDMap(strings.NewReader(subuid), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := IDMap{{0, 100000, 65536}, {65536, 300000, 10}}
+	if len(m) != len(want) || m[0] != want[0] || m[1] != want[1] {
+		t.Errorf("want %v, have %v", want, m)
+	}
+	if m, _ := ReadSubIDMap(strings.NewReader(subuid), "carol"); len(m) != 0 {
+		t.Errorf("want no ranges for carol, have %v", m)
+	}
+}
+
+type chownFileSystem struct {
+	mockFileSystem
+	caller     fuse.Caller
+	uid, gid   uint32
+	chownCalls int
+}
+
+func (c *chownFileSystem) Chown(ctx *Context, path string, uFh uint32, uid uint32, gid uint32) fuse.Status {
+	c.caller = ctx.Caller
+	c.uid, c.gid = uid, gid
+	c.chownCalls++
+	return fuse.OK
+}
+
+func TestBridgeIDMap(t *testing.T) {
+	fs := &chownFileSystem{}
+	fs.getAttrFunc = func(path string) (fuse.Attr, fuse.Status) {
+		return fuse.Attr{Ino: 100, Mode: fuse.S_IFREG | 0644, Owner: fuse.Owner{Uid: 10, Gid: 99999}}, fuse.OK
+	}
+	b := newMockBridge(&fs.mockFileSystem)
+	b.fs = fs
+	b.options.UIDMap = IDMap{{Backend: 0, Local: 100000, Count: 65536}}
+	b.options.GIDMap = IDMap{{Backend: 0, Local: 200000, Count: 65536}}
+
+	caller := fuse.Caller{Owner: fuse.Owner{Uid: 100010, Gid: 200000}}
+	var entryOut fuse.EntryOut
+	if code := b.Lookup(nil, &fuse.InHeader{NodeId: 1, Caller: caller}, "f", &entryOut); !code.Ok() {
+		t.Fatal(code)
+	}
+	if entryOut.Uid != 100010 || entryOut.Gid != overflowID {
+		t.Errorf("want mapped owner 100010:%d, have %d:%d", overflowID, entryOut.Uid, entryOut.Gid)
+	}
+
+	setIn := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+		InHeader: fuse.InHeader{NodeId: 100, Caller: caller},
+		Valid:    fuse.FATTR_UID | fuse.FATTR_GID,
+	}}
+	setIn.Uid, setIn.Gid = 100020, 200030
+	if code := b.SetAttr(nil, setIn, &fuse.AttrOut{}); !code.Ok() {
+		t.Fatal(code)
+	}
+	if fs.uid != 20 || fs.gid != 30 {
+		t.Errorf("want chown to 20:30, have %d:%d", fs.uid, fs.gid)
+	}
+	if fs.caller.Uid != 10 || fs.caller.Gid != 0 {
+		t.Errorf("want caller mapped to 10:0, have %d:%d", fs.caller.Uid, fs.caller.Gid)
+	}
+
+	// ids outside of the map can't be stored.
+	setIn.Uid = 5
+	if code := b.SetAttr(nil, setIn, &fuse.AttrOut{}); code != fuse.EINVAL {
+		t.Errorf("chown to unmapped uid: want EINVAL, have %v", code)
+	}
+	if fs.chownCalls != 1 {
+		t.Errorf("want 1 chown call, have %d", fs.chownCalls)
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// LinkHinter is an optional interface for a FileSystem that returns Ino
+// 0, telling the InoAllocator which paths are hard links of the same
+// file. Paths with the same key get the same inode number.
+type LinkHinter interface {
+	LinkKey(ctx *Context, path string) (key string, ok bool)
+}
+
+// InoAllocator assigns stable inode numbers to paths, for FileSystems
+// that have none and return Ino 0 from GetAttr. The bridge keeps it in
+// sync with Rename, Link, Unlink and Rmdir, and saves it in Dump. Its
+// state can also be persisted with MarshalBinary.
+//
+// A FileSystem should either always or never return Ino 0: allocated
+// numbers may collide with real ones.
+type InoAllocator struct {
+	mu    sync.Mutex
+	paths map[string]uint64
+	keys  map[string]uint64
+	next  uint64
+
+	// children indexes paths by directory, so that Rename and Remove
+	// visit a subtree only: it holds the names in each directory
+	// leading to a numbered path.
+	children map[string]map[string]struct{}
+	// links counts the paths of each number, and inoKeys the link
+	// key of it, dropped with the last path.
+	links   map[uint64]int
+	inoKeys map[uint64]string
+}
+
+// NewInoAllocator returns an empty allocator. Numbers start at 2, as 1
+// is the root.
+func NewInoAllocator() *InoAllocator {
+	a := &InoAllocator{}
+	a.reset(map[string]uint64{"": 1}, map[string]uint64{}, 2)
+	return a
+}
+
+func (a *InoAllocator) reset(paths map[string]uint64, keys map[string]uint64, next uint64) {
+	a.paths, a.keys, a.next = map[string]uint64{}, keys, next
+	a.children = map[string]map[string]struct{}{}
+	a.links = map[uint64]int{}
+	a.inoKeys = make(map[uint64]string, len(keys))
+	for key, ino := range keys {
+		a.inoKeys[ino] = key
+	}
+	for p, ino := range paths {
+		a.setLocked(p, ino)
+	}
+	for key, ino := range keys {
+		if a.links[ino] == 0 {
+			delete(a.keys, key)
+			delete(a.inoKeys, ino)
+		}
+	}
+}
+
+// Lookup returns the number of path, if it has one.
+func (a *InoAllocator) Lookup(path string) (uint64, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ino, ok := a.paths[path]
+	return ino, ok
+}
+
+// Assign returns the number of path, allocating one if needed. A
+// nonempty linkKey already known gives the number of its other links.
+func (a *InoAllocator) Assign(path string, linkKey string) uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if ino, ok := a.paths[path]; ok {
+		return ino
+	}
+	ino, ok := a.keys[linkKey]
+	if !ok {
+		ino = a.next
+		a.next++
+		if linkKey != "" {
+			a.keys[linkKey] = ino
+			a.inoKeys[ino] = linkKey
+		}
+	}
+	a.setLocked(path, ino)
+	return ino
+}
+
+// Link gives newPath the number of path, if it has one.
+func (a *InoAllocator) Link(path string, newPath string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if ino, ok := a.paths[path]; ok {
+		a.setLocked(newPath, ino)
+	}
+}
+
+// Rename moves the numbers of path and everything below it to newPath,
+// replacing what was there.
+func (a *InoAllocator) Rename(path string, newPath string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := underPath(newPath, path); ok {
+		// onto itself or into its own subtree, which no FileSystem
+		// allows.
+		return
+	}
+	a.removeLocked(newPath)
+	moved := a.subtreeLocked(path)
+	for _, p := range moved {
+		rest, _ := underPath(p, path)
+		a.setLocked(newPath+rest, a.paths[p])
+	}
+	for _, p := range moved {
+		a.deleteLocked(p)
+	}
+}
+
+// Remove forgets path and everything below it. The link key of a
+// number is forgotten with its last path.
+func (a *InoAllocator) Remove(path string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.removeLocked(path)
+}
+
+func (a *InoAllocator) removeLocked(path string) {
+	for _, p := range a.subtreeLocked(path) {
+		a.deleteLocked(p)
+	}
+}
+
+// subtreeLocked returns the numbered paths at or below path.
+func (a *InoAllocator) subtreeLocked(path string) []string {
+	var ps []string
+	var walk func(p string)
+	walk = func(p string) {
+		if _, ok := a.paths[p]; ok {
+			ps = append(ps, p)
+		}
+		for name := range a.children[p] {
+			walk(childPathOf(p, name))
+		}
+	}
+	walk(path)
+	return ps
+}
+
+func (a *InoAllocator) setLocked(path string, ino uint64) {
+	if old, ok := a.paths[path]; ok {
+		if old == ino {
+			return
+		}
+		a.unlinkLocked(old)
+	}
+	a.paths[path] = ino
+	a.links[ino]++
+
+	for path != "" {
+		dir, name := splitPath(path)
+		names := a.children[dir]
+		if names == nil {
+			names = map[string]struct{}{}
+			a.children[dir] = names
+		}
+		if _, ok := names[name]; ok {
+			return
+		}
+		names[name] = struct{}{}
+		path = dir
+	}
+}
+
+func (a *InoAllocator) deleteLocked(path string) {
+	ino, ok := a.paths[path]
+	if !ok {
+		return
+	}
+	delete(a.paths, path)
+	a.unlinkLocked(ino)
+
+	// drop the names leading nowhere any more.
+	for path != "" {
+		if _, ok := a.paths[path]; ok || len(a.children[path]) > 0 {
+			return
+		}
+		dir, name := splitPath(path)
+		delete(a.children[dir], name)
+		if len(a.children[dir]) == 0 {
+			delete(a.children, dir)
+		}
+		path = dir
+	}
+}
+
+func (a *InoAllocator) unlinkLocked(ino uint64) {
+	if a.links[ino]--; a.links[ino] > 0 {
+		return
+	}
+	delete(a.links, ino)
+	if key, ok := a.inoKeys[ino]; ok {
+		delete(a.keys, key)
+		delete(a.inoKeys, ino)
+	}
+}
+
+// splitPath splits path into its directory and last element.
+func splitPath(path string) (dir string, name string) {
+	if i := strings.LastIndexByte(path, '/'); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return "", path
+}
+
+// underPath reports whether p is dir or below it, returning the rest
+// of p.
+func underPath(p, dir string) (string, bool) {
+	if p == dir {
+		return "", true
+	}
+	if len(p) > len(dir) && strings.HasPrefix(p, dir) && p[len(dir)] == '/' {
+		return p[len(dir):], true
+	}
+	return "", false
+}
+
+type inoAllocatorState struct {
+	Paths map[string]uint64
+	Keys  map[string]uint64
+	Next  uint64
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (a *InoAllocator) MarshalBinary() ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&inoAllocatorState{a.paths, a.keys, a.next})
+	return buf.Bytes(), err
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. It fails on
+// numbers that the allocator could not have handed out: 0, 1 for
+// anything but the root, numbers not below Next, and a number shared
+// by two link keys.
+func (a *InoAllocator) UnmarshalBinary(data []byte) error {
+	var s inoAllocatorState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&s); err != nil {
+		return err
+	}
+	if s.Next < 2 {
+		return fmt.Errorf("ino table: next number %d is reserved", s.Next)
+	}
+	if s.Paths == nil {
+		s.Paths = map[string]uint64{}
+	}
+	if s.Keys == nil {
+		s.Keys = map[string]uint64{}
+	}
+	if ino, ok := s.Paths[""]; ok && ino != 1 {
+		return fmt.Errorf("ino table: root has number %d", ino)
+	}
+	s.Paths[""] = 1
+	for p, ino := range s.Paths {
+		if p != "" && (ino < 2 || ino >= s.Next) {
+			return fmt.Errorf("ino table: %q has number %d, want 2 to %d", p, ino, s.Next-1)
+		}
+	}
+	owners := make(map[uint64]string, len(s.Keys))
+	for key, ino := range s.Keys {
+		if ino < 2 || ino >= s.Next {
+			return fmt.Errorf("ino table: link key %q has number %d, want 2 to %d", key, ino, s.Next-1)
+		}
+		if other, ok := owners[ino]; ok {
+			return fmt.Errorf("ino table: link keys %q and %q share number %d", other, key, ino)
+		}
+		owners[ino] = key
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reset(s.Paths, s.Keys, s.Next)
+	return nil
+}
+
+// synthIno returns the number of path from Options.InoAllocator.
+func (b *rawBridge) synthIno(ctx *Context, path string) uint64 {
+	a := b.options.InoAllocator
+	if ino, ok := a.Lookup(path); ok {
+		return ino
+	}
+	var key string
+	if h, ok := b.fs.(LinkHinter); ok {
+		key, _ = h.LinkKey(ctx, path)
+	}
+	return a.Assign(path, key)
+}
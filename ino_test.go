@@ -0,0 +1,151 @@
+package pathfs
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestInoAllocator(t *testing.T) {
+	a := NewInoAllocator()
+	d := a.Assign("d", "")
+	f := a.Assign("d/f", "")
+	if d == f || d < 2 || f < 2 {
+		t.Fatalf("want distinct numbers above 1, have %d %d", d, f)
+	}
+	if ino := a.Assign("d/f", ""); ino != f {
+		t.Errorf("want stable number %d, have %d", f, ino)
+	}
+
+	// rename moves the subtree and replaces the target.
+	a.Assign("e", "")
+	a.Rename("d", "e")
+	if ino, _ := a.Lookup("e"); ino != d {
+		t.Errorf("want e = %d, have %d", d, ino)
+	}
+	if ino, _ := a.Lookup("e/f"); ino != f {
+		t.Errorf("want e/f = %d, have %d", f, ino)
+	}
+	if _, ok := a.Lookup("d/f"); ok {
+		t.Error("want d/f forgotten")
+	}
+
+	// hard links, by Link and by key.
+	a.Link("e/f", "g")
+	if ino, _ := a.Lookup("g"); ino != f {
+		t.Errorf("want g = %d, have %d", f, ino)
+	}
+	h := a.Assign("h", "k")
+	if ino := a.Assign("i", "k"); ino != h {
+		t.Errorf("want i = %d, have %d", h, ino)
+	}
+
+	a.Remove("e")
+	if _, ok := a.Lookup("e/f"); ok {
+		t.Error("want e/f removed")
+	}
+	if ino, _ := a.Lookup("g"); ino != f {
+		t.Error("want the other link kept")
+	}
+
+	data, err := a.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewInoAllocator()
+	if err := b.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if ino, _ := b.Lookup("g"); ino != f {
+		t.Errorf("want g = %d after reload, have %d", f, ino)
+	}
+	if ino := b.Assign("new", ""); ino <= h {
+		t.Errorf("want fresh number above %d, have %d", h, ino)
+	}
+}
+
+func TestInoAllocatorIndex(t *testing.T) {
+	a := NewInoAllocator()
+	d := a.Assign("d/e/f", "")
+	dd := a.Assign("dd/f", "")
+	k := a.Assign("d/k", "key")
+
+	a.Rename("d", "x")
+	if ino, _ := a.Lookup("x/e/f"); ino != d {
+		t.Errorf("want x/e/f = %d, have %d", d, ino)
+	}
+	if ino, _ := a.Lookup("dd/f"); ino != dd {
+		t.Errorf("want dd/f kept, have %d", ino)
+	}
+	if len(a.children["d"]) != 0 || len(a.children["x"]) != 2 {
+		t.Errorf("want the index moved, have %v", a.children)
+	}
+
+	// the key goes with the last path of its number.
+	if ino := a.Assign("l", "key"); ino != k {
+		t.Errorf("want l = %d by key, have %d", k, ino)
+	}
+	a.Remove("x")
+	if _, ok := a.keys["key"]; !ok {
+		t.Error("want the key kept by l")
+	}
+	a.Remove("l")
+	if _, ok := a.keys["key"]; ok {
+		t.Error("want the key forgotten with its last path")
+	}
+	if len(a.children) != 2 || len(a.links) != 2 {
+		t.Errorf("want only dd/f and the root left, have %v %v", a.children, a.links)
+	}
+}
+
+func TestInoAllocatorUnmarshalInvalid(t *testing.T) {
+	for _, s := range []inoAllocatorState{
+		{Next: 1},
+		{Paths: map[string]uint64{"a": 1}, Next: 3},
+		{Paths: map[string]uint64{"a": 3}, Next: 3},
+		{Paths: map[string]uint64{"": 2}, Next: 3},
+		{Keys: map[string]uint64{"k": 2, "l": 2}, Next: 3},
+	} {
+		var buf bytes.Buffer
+		gob.NewEncoder(&buf).Encode(&s)
+		if err := NewInoAllocator().UnmarshalBinary(buf.Bytes()); err == nil {
+			t.Errorf("want error for %+v", s)
+		}
+	}
+}
+
+type noInoFileSystem struct {
+	mockFileSystem
+}
+
+func (m *noInoFileSystem) Rename(ctx *Context, path string, newPath string) fuse.Status {
+	return fuse.OK
+}
+
+func TestBridgeInoAllocator(t *testing.T) {
+	fs := &noInoFileSystem{}
+	fs.getAttrFunc = func(path string) (fuse.Attr, fuse.Status) {
+		return fuse.Attr{Mode: fuse.S_IFREG | 0644}, fuse.OK
+	}
+	b := newMockBridge(&fs.mockFileSystem)
+	b.fs = fs
+	b.options.InoAllocator = NewInoAllocator()
+
+	var a, c fuse.EntryOut
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "a", &a)
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "c", &c)
+	if a.NodeId == c.NodeId || a.Ino == 0 {
+		t.Fatalf("want distinct inodes, have %d %d", a.NodeId, c.NodeId)
+	}
+
+	if code := b.Rename(nil, &fuse.RenameIn{InHeader: fuse.InHeader{NodeId: 1}, Newdir: 1}, "a", "b"); !code.Ok() {
+		t.Fatal(code)
+	}
+	var out fuse.EntryOut
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "b", &out)
+	if out.NodeId != a.NodeId {
+		t.Errorf("want the renamed file to keep inode %d, have %d", a.NodeId, out.NodeId)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"log"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
@@ -19,6 +20,11 @@ import (
 )
 
 type inode struct {
+	// pathEpoch is bumped when the parents of the inode change,
+	// invalidating the paths cached on it and below. Accessed
+	// atomically; kept first for alignment.
+	pathEpoch uint64
+
 	ino uint64
 
 	// Must be acquired before bridge.mu
@@ -36,6 +42,25 @@ type inode struct {
 	lookupCount uint32
 	parents     inodeParents
 	children    map[string]*inode
+
+	// generation is reported in fuse.EntryOut. It is bumped when the
+	// inode number is reused by a different file, see addChildIdent.
+	generation uint64
+
+	// fileType (S_IFMT bits) and backendGen identify the backend
+	// file; zero if unknown.
+	fileType   uint32
+	backendGen uint64
+
+	// path caches the *cachedPath of pathOf.
+	path atomic.Value
+}
+
+// nodeIdent identifies a backend file beyond its inode number. Zero
+// fields are unknown and never mismatch.
+type nodeIdent struct {
+	fileType uint32
+	gen      uint64
 }
 
 func newInode(ino uint64, isDir bool) *inode {
@@ -43,7 +68,7 @@ func newInode(ino uint64, isDir bool) *inode {
 		// fuse.pollHackInode = ^uint64(0)
 		log.Panic("using reserved ID for inode number")
 	}
-	n := &inode{ino: ino}
+	n := &inode{ino: ino, generation: 1}
 	if isDir {
 		n.children = make(map[string]*inode)
 	}
@@ -58,11 +83,11 @@ func (n *inode) isLive() bool {
 	return n.lookupCount > 0 || len(n.children) > 0
 }
 
-func (b *rawBridge) setEntryOut(n *inode, out *fuse.EntryOut) {
+func (b *rawBridge) setEntryOut(n *inode, path string, out *fuse.EntryOut) {
 	out.NodeId = n.ino
 	out.Ino = n.ino
-	out.Generation = 1
-	b.setAttrInner(&out.Attr)
+	out.Generation = n.generation
+	b.setAttrInner(path, &out.Attr)
 }
 
 func (b *rawBridge) setEntryOutTimeout(out *fuse.EntryOut) {
@@ -74,8 +99,8 @@ func (b *rawBridge) setEntryOutTimeout(out *fuse.EntryOut) {
 	}
 }
 
-func (b *rawBridge) setAttr(out *fuse.AttrOut) {
-	b.setAttrInner(&out.Attr)
+func (b *rawBridge) setAttr(path string, out *fuse.AttrOut) {
+	b.setAttrInner(path, &out.Attr)
 }
 
 func (b *rawBridge) setAttrTimeout(out *fuse.AttrOut) {
@@ -84,13 +109,17 @@ func (b *rawBridge) setAttrTimeout(out *fuse.AttrOut) {
 	}
 }
 
-func (b *rawBridge) setAttrInner(out *fuse.Attr) {
+func (b *rawBridge) setAttrInner(path string, out *fuse.Attr) {
 	if !b.options.NullPermissions && out.Mode&07777 == 0 {
 		out.Mode |= 0644
 		if out.Mode&syscall.S_IFDIR != 0 {
 			out.Mode |= 0111
 		}
 	}
+	if b.options.ModePolicy != nil {
+		b.options.ModePolicy.apply(path, out)
+	}
+	b.mapAttrIDs(out)
 	if b.options.UID != 0 && out.Uid == 0 {
 		out.Uid = b.options.UID
 	}
@@ -103,6 +132,18 @@ func (b *rawBridge) setAttrInner(out *fuse.Attr) {
 // addChild inserts a child into the tree. The ino will be used to
 // find an already-known node. If not found, create one via newInode.
 func (b *rawBridge) addChild(parent *inode, name string, ino uint64, isDir bool) *inode {
+	return b.addChildIdent(parent, name, ino, isDir, nodeIdent{})
+}
+
+// addChildIdent is addChild for a file of known identity. If the node
+// found for ino is of another type or generation, the backend has
+// reused the inode number: the node is replaced by a new one with a
+// bumped generation, which takes over its lookup count, as the kernel
+// keeps forgetting both under the same node ID. The children of a
+// replaced directory are dropped with it.
+//
+// It returns nil if ino is the parent's, which can't be its own child.
+func (b *rawBridge) addChildIdent(parent *inode, name string, ino uint64, isDir bool, id nodeIdent) *inode {
 	if name == "." || name == ".." {
 		log.Panicf("BUG: tried to add virtual entry %q to the actual tree", name)
 	}
@@ -122,10 +163,39 @@ func (b *rawBridge) addChild(parent *inode, name string, ino uint64, isDir bool)
 		child = old
 	}
 
-	if child == nil {
+	if child == parent {
+		b.mu.Unlock()
+		unlockNode2(parent, child)
+		b.logf("warning: inode %d of %q is its parent's", ino, name)
+		return nil
+	}
+
+	var stale *inode
+	if child != nil && child != b.root && child.mismatches(isDir, id) {
+		stale = child
+		child = newInode(ino, isDir)
+		child.mu.Lock()
+		child.generation = stale.generation + 1
+		child.lookupCount = stale.lookupCount
+		stale.lookupCount = 0
+		if parent.children[name] == stale {
+			stale.parents.delete(parentEntry{name, parent})
+			stale.pathChanged()
+		}
+		stale.revision++
+		b.logf("warning: inode %d reused for %q (dir %v, type %o, generation %d), was (dir %v, type %o, generation %d), bumping to generation %d",
+			ino, name, isDir, id.fileType, id.gen, stale.isDir(), stale.fileType, stale.backendGen, child.generation)
+		stale.mu.Unlock()
+	} else if child == nil {
 		child = newInode(ino, isDir)
 		child.mu.Lock()
 	}
+	if id.fileType != 0 {
+		child.fileType = id.fileType
+	}
+	if id.gen != 0 {
+		child.backendGen = id.gen
+	}
 
 	child.lookupCount++
 	child.revision++
@@ -136,16 +206,75 @@ func (b *rawBridge) addChild(parent *inode, name string, ino uint64, isDir bool)
 	}
 
 	parent.children[name] = child
-	child.parents.add(parentEntry{name, parent})
+	if pe := (parentEntry{name, parent}); child.parents.get() != pe {
+		// a new name, or an older one becoming the newest.
+		child.parents.add(pe)
+		child.pathChanged()
+	}
 	parent.revision++
 	child.revision++
 
 	b.mu.Unlock()
 	unlockNode2(parent, child)
 
+	if stale != nil {
+		// drop the stale node from the tree.
+		b.dropChildren(stale)
+		b.removeRef(stale, 0)
+	}
 	return child
 }
 
+// dropChildren unlinks all children of n, releasing those the kernel
+// does not know. The others are orphaned.
+func (b *rawBridge) dropChildren(n *inode) {
+retry:
+	for {
+		n.mu.Lock()
+		rev := n.revision
+		group := []*inode{n}
+		for _, c := range n.children {
+			group = append(group, c)
+		}
+		n.mu.Unlock()
+
+		lockNodes(group...)
+		if n.revision != rev {
+			unlockNodes(group...)
+			continue retry
+		}
+
+		children := make([]*inode, 0, len(n.children))
+		for name, c := range n.children {
+			delete(n.children, name)
+			c.parents.delete(parentEntry{name, n})
+			c.pathChanged()
+			c.revision++
+			children = append(children, c)
+		}
+		n.revision++
+
+		unlockNodes(group...)
+
+		for _, c := range children {
+			b.removeRef(c, 0)
+		}
+		return
+	}
+}
+
+// mismatches reports whether n is not the file described by isDir and
+// id. Call with n.mu held.
+func (n *inode) mismatches(isDir bool, id nodeIdent) bool {
+	if n.isDir() != isDir {
+		return true
+	}
+	if id.fileType != 0 && n.fileType != 0 && id.fileType != n.fileType {
+		return true
+	}
+	return id.gen != 0 && n.backendGen != 0 && id.gen != n.backendGen
+}
+
 // removeRef decreases references.
 func (b *rawBridge) removeRef(n *inode, nlookup uint32) (removed bool) {
 	n.mu.Lock()
@@ -162,7 +291,10 @@ func (b *rawBridge) removeRef(n *inode, nlookup uint32) (removed bool) {
 	}
 
 	b.mu.Lock()
-	delete(b.nodes, n.ino)
+	if b.nodes[n.ino] == n {
+		// n may have been replaced by a newer generation.
+		delete(b.nodes, n.ino)
+	}
 	b.mu.Unlock()
 
 	var group []*inode
@@ -194,6 +326,7 @@ retry:
 			pe.node.revision++
 		}
 		n.parents.clear()
+		n.pathChanged()
 		n.revision++
 
 		if n.lookupCount != 0 {
@@ -231,6 +364,7 @@ retry:
 
 		delete(parent.children, name)
 		child.parents.delete(parentEntry{name, parent})
+		child.pathChanged()
 		parent.revision++
 		child.revision++
 
@@ -269,6 +403,7 @@ retry:
 		if child != nil {
 			delete(parent.children, name)
 			child.parents.delete(parentEntry{name, parent})
+			child.pathChanged()
 			parent.revision++
 			child.revision++
 		}
@@ -276,6 +411,7 @@ retry:
 		if destChild != nil {
 			delete(newParent.children, newName)
 			destChild.parents.delete(parentEntry{newName, newParent})
+			destChild.pathChanged()
 			newParent.revision++
 			destChild.revision++
 		}
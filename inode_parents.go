@@ -73,6 +73,15 @@ func (p *inodeParents) all() []parentEntry {
 	return out
 }
 
+// newestFirst returns all known parents, the most recent first.
+func (p *inodeParents) newestFirst() []parentEntry {
+	parents := sortParents(p)
+	for i, j := 0, len(parents)-1; i < j; i, j = i+1, j-1 {
+		parents[i], parents[j] = parents[j], parents[i]
+	}
+	return parents
+}
+
 func (p *inodeParents) delete(n parentEntry) {
 	// We have zero parents, so we can't delete any.
 	if p.newest.node == nil {
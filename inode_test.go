@@ -2,7 +2,10 @@ package pathfs
 
 import (
 	"sync"
+	"syscall"
 	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 // failed if new inode isn't exactly the same with old inode
@@ -278,3 +281,106 @@ func TestMvChild(t *testing.T) {
 	}
 
 }
+
+func TestInodeReuse(t *testing.T) {
+	attrs := map[string]fuse.Attr{
+		"f": {Ino: 100, Mode: fuse.S_IFREG | 0644},
+	}
+	mock := &mockFileSystem{
+		getAttrFunc: func(path string) (fuse.Attr, fuse.Status) {
+			if a, ok := attrs[path]; ok {
+				return a, fuse.OK
+			}
+			return fuse.Attr{}, fuse.ENOENT
+		},
+	}
+	b := newMockBridge(mock)
+
+	var out fuse.EntryOut
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "f", &out)
+	if out.Generation != 1 {
+		t.Fatalf("want generation 1, have %d", out.Generation)
+	}
+	old := b.nodes[100]
+
+	// the backend removed f and reused its inode number for a directory.
+	delete(attrs, "f")
+	attrs["d"] = fuse.Attr{Ino: 100, Mode: fuse.S_IFDIR | 0755}
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "d", &out)
+	if out.NodeId != 100 || out.Generation != 2 {
+		t.Fatalf("want n100 generation 2, have n%d generation %d", out.NodeId, out.Generation)
+	}
+	n := b.nodes[100]
+	if n == old || !n.isDir() {
+		t.Fatal("want a new directory node")
+	}
+	// the kernel forgets both generations under the same node ID.
+	if n.lookupCount != 2 {
+		t.Errorf("want the lookups carried over, have %d", n.lookupCount)
+	}
+	if b.root.children["f"] != nil {
+		t.Error("want the stale node dropped from the tree")
+	}
+
+	// a symlink is not a regular file either.
+	attrs["l"] = fuse.Attr{Ino: 101, Mode: fuse.S_IFREG | 0644}
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "l", &out)
+	attrs["l"] = fuse.Attr{Ino: 101, Mode: fuse.S_IFLNK | 0777}
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "l", &out)
+	if out.Generation != 2 {
+		t.Errorf("want generation 2 after a type change, have %d", out.Generation)
+	}
+
+	b.Forget(100, 2)
+	if b.nodes[100] != nil {
+		t.Error("want n100 gone after forget")
+	}
+}
+
+func TestInodeReuseParent(t *testing.T) {
+	attrs := map[string]fuse.Attr{
+		"d":   {Ino: 100, Mode: fuse.S_IFDIR | 0755},
+		"d/f": {Ino: 101, Mode: fuse.S_IFREG | 0644},
+	}
+	mock := &mockFileSystem{
+		getAttrFunc: func(path string) (fuse.Attr, fuse.Status) {
+			if a, ok := attrs[path]; ok {
+				return a, fuse.OK
+			}
+			return fuse.Attr{}, fuse.ENOENT
+		},
+	}
+	b := newMockBridge(mock)
+
+	var out fuse.EntryOut
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "d", &out)
+	b.Lookup(nil, &fuse.InHeader{NodeId: 100}, "f", &out)
+	d := b.nodes[100]
+
+	// a child claiming the inode number of its parent, of another type
+	// or of the same.
+	attrs["d/x"] = fuse.Attr{Ino: 100, Mode: fuse.S_IFREG | 0644}
+	attrs["d/y"] = fuse.Attr{Ino: 100, Mode: fuse.S_IFDIR | 0755}
+	for _, name := range []string{"x", "y"} {
+		if code := b.Lookup(nil, &fuse.InHeader{NodeId: 100}, name, &out); code != fuse.Status(syscall.ESTALE) {
+			t.Errorf("%s: want ESTALE, have %v", name, code)
+		}
+		if d.children[name] != nil {
+			t.Errorf("%s: want no child added", name)
+		}
+	}
+
+	// the backend removed d and reused its inode number for a file:
+	// the stale directory leaves the tree with its children.
+	attrs["e"] = fuse.Attr{Ino: 100, Mode: fuse.S_IFREG | 0644}
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "e", &out)
+	if out.Generation != 2 {
+		t.Fatalf("want generation 2, have %d", out.Generation)
+	}
+	if b.root.children["d"] != nil || len(d.children) != 0 {
+		t.Error("want the stale directory dropped from the tree")
+	}
+	if _, code := b.pathOf(b.nodes[101]); code != fuse.Status(syscall.ESTALE) {
+		t.Errorf("want the child of the stale directory orphaned, have %v", code)
+	}
+}
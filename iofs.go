@@ -0,0 +1,306 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// readLinkFS is fs.ReadLinkFS, which is not in all Go versions.
+type readLinkFS interface {
+	ReadLink(name string) (string, error)
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+type ioFile struct {
+	mu   sync.Mutex
+	f    fs.File
+	name string
+	size int64
+	pos  int64 // for files that can't seek
+}
+
+type ioFileSystem struct {
+	readOnlyFileSystem
+	fsys fs.FS
+	inos *InoAllocator
+
+	mu     sync.Mutex
+	files  map[uint32]*ioFile
+	nextFh uint32
+}
+
+// NewIOFileSystem returns a read-only FileSystem serving fsys, such as
+// an embed.FS, a zip.Reader or an fstest.MapFS. fs.StatFS and
+// fs.ReadDirFS are used if implemented. Inode numbers are synthesized
+// by path. Files are read with io.ReaderAt, or else by seeking, or
+// else by reading them again from the start.
+func NewIOFileSystem(fsys fs.FS) FileSystem {
+	return &ioFileSystem{
+		fsys:   fsys,
+		inos:   NewInoAllocator(),
+		files:  make(map[uint32]*ioFile),
+		nextFh: 1,
+	}
+}
+
+// lstat is fs.Stat without following a final symlink, if fsys
+// supports symlinks.
+func (fsys *ioFileSystem) lstat(path string) (fs.FileInfo, error) {
+	if rl, ok := fsys.fsys.(readLinkFS); ok {
+		return rl.Lstat(ioName(path))
+	}
+	return fs.Stat(fsys.fsys, ioName(path))
+}
+
+// ioName turns a FileSystem path into an fs.FS name.
+func ioName(path string) string {
+	if path == "" {
+		return "."
+	}
+	return path
+}
+
+// ioStatus maps the errors of an fs.FS to a fuse.Status.
+func ioStatus(err error) fuse.Status {
+	var errno syscall.Errno
+	switch {
+	case err == nil:
+		return fuse.OK
+	case errors.As(err, &errno):
+		return fuse.Status(errno)
+	case errors.Is(err, fs.ErrNotExist):
+		return fuse.ENOENT
+	case errors.Is(err, fs.ErrPermission):
+		return fuse.EACCES
+	case errors.Is(err, fs.ErrExist):
+		return fuse.Status(syscall.EEXIST)
+	case errors.Is(err, fs.ErrInvalid):
+		return fuse.EINVAL
+	}
+	return fuse.EIO
+}
+
+// unixMode converts an fs.FileMode to a mode with S_IF* type bits.
+func unixMode(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	switch {
+	case m.IsDir():
+		mode |= syscall.S_IFDIR
+	case m&fs.ModeSymlink != 0:
+		mode |= syscall.S_IFLNK
+	case m&fs.ModeNamedPipe != 0:
+		mode |= syscall.S_IFIFO
+	case m&fs.ModeSocket != 0:
+		mode |= syscall.S_IFSOCK
+	case m&fs.ModeCharDevice != 0:
+		mode |= syscall.S_IFCHR
+	case m&fs.ModeDevice != 0:
+		mode |= syscall.S_IFBLK
+	default:
+		mode |= syscall.S_IFREG
+	}
+	if m&fs.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	return mode
+}
+
+func (fsys *ioFileSystem) fillAttr(path string, fi fs.FileInfo, out *fuse.Attr) {
+	*out = fuse.Attr{
+		Ino:   fsys.inos.Assign(path, ""),
+		Size:  uint64(fi.Size()),
+		Mode:  unixMode(fi.Mode()),
+		Nlink: 1,
+	}
+	if fi.IsDir() {
+		out.Nlink = 2
+	}
+	mtime := fi.ModTime()
+	out.SetTimes(&mtime, &mtime, &mtime)
+}
+
+func (fsys *ioFileSystem) file(uFh uint32) *ioFile {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	return fsys.files[uFh]
+}
+
+func (fsys *ioFileSystem) GetAttr(ctx *Context, path string, uFh uint32, out *fuse.Attr) fuse.Status {
+	var fi fs.FileInfo
+	var err error
+	if f := fsys.file(uFh); f != nil {
+		fi, err = f.f.Stat()
+	} else {
+		fi, err = fsys.lstat(path)
+	}
+	if err != nil {
+		return ioStatus(err)
+	}
+	fsys.fillAttr(path, fi, out)
+	return fuse.OK
+}
+
+func (fsys *ioFileSystem) Access(ctx *Context, path string, mask uint32) fuse.Status {
+	if mask&permWrite != 0 {
+		return fuse.EROFS
+	}
+	if _, err := fsys.lstat(path); err != nil {
+		return ioStatus(err)
+	}
+	return fuse.OK
+}
+
+func (fsys *ioFileSystem) Readlink(ctx *Context, path string) (string, fuse.Status) {
+	rl, ok := fsys.fsys.(readLinkFS)
+	if !ok {
+		return "", fuse.EINVAL
+	}
+	target, err := rl.ReadLink(ioName(path))
+	return target, ioStatus(err)
+}
+
+func (fsys *ioFileSystem) Lsdir(ctx *Context, path string) ([]fuse.DirEntry, fuse.Status) {
+	entries, err := fs.ReadDir(fsys.fsys, ioName(path))
+	if err != nil {
+		return nil, ioStatus(err)
+	}
+	stream := make([]fuse.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		stream = append(stream, fuse.DirEntry{
+			Name: e.Name(),
+			Mode: unixMode(e.Type()),
+			Ino:  fsys.inos.Assign(childPathOf(path, e.Name()), ""),
+		})
+	}
+	return stream, fuse.OK
+}
+
+func (fsys *ioFileSystem) Open(ctx *Context, path string, flags uint32) (uFh uint32, keepCache, forceDIO bool, code fuse.Status) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0 {
+		return 0, false, false, fuse.EROFS
+	}
+	f, err := fsys.fsys.Open(ioName(path))
+	if err != nil {
+		return 0, false, false, ioStatus(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, false, false, ioStatus(err)
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	uFh = fsys.nextFh
+	fsys.nextFh++
+	fsys.files[uFh] = &ioFile{f: f, name: ioName(path), size: fi.Size()}
+	// The content never changes.
+	return uFh, true, false, fuse.OK
+}
+
+func (fsys *ioFileSystem) Read(ctx *Context, path string, uFh uint32, dest []byte, off uint64) (fuse.ReadResult, fuse.Status) {
+	f := fsys.file(uFh)
+	if f == nil {
+		return nil, fuse.EBADF
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Some ReaderAts fail at offsets past the end.
+	if int64(off) >= f.size {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	if ra, ok := f.f.(io.ReaderAt); ok {
+		n, err := ra.ReadAt(dest, int64(off))
+		if err != nil && err != io.EOF {
+			return nil, ioStatus(err)
+		}
+		return fuse.ReadResultData(dest[:n]), fuse.OK
+	}
+
+	if code := fsys.seek(f, int64(off)); !code.Ok() {
+		return nil, code
+	}
+	n, err := io.ReadFull(f.f, dest)
+	f.pos += int64(n)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, ioStatus(err)
+	}
+	return fuse.ReadResultData(dest[:n]), fuse.OK
+}
+
+// seek moves f to off, reopening it and skipping data if it is not
+// an io.Seeker. Call with f.mu held.
+func (fsys *ioFileSystem) seek(f *ioFile, off int64) fuse.Status {
+	if off == f.pos {
+		return fuse.OK
+	}
+	if s, ok := f.f.(io.Seeker); ok {
+		if _, err := s.Seek(off, io.SeekStart); err != nil {
+			return ioStatus(err)
+		}
+		f.pos = off
+		return fuse.OK
+	}
+
+	if off < f.pos {
+		nf, err := fsys.fsys.Open(f.name)
+		if err != nil {
+			return ioStatus(err)
+		}
+		f.f.Close()
+		f.f, f.pos = nf, 0
+	}
+	n, err := io.CopyN(io.Discard, f.f, off-f.pos)
+	f.pos += n
+	if err != nil && err != io.EOF {
+		return ioStatus(err)
+	}
+	return fuse.OK
+}
+
+func (fsys *ioFileSystem) Flush(ctx *Context, path string, uFh uint32, lockOwner uint64) fuse.Status {
+	return fuse.OK
+}
+
+func (fsys *ioFileSystem) Fsync(ctx *Context, path string, uFh uint32, flags uint32) fuse.Status {
+	return fuse.OK
+}
+
+func (fsys *ioFileSystem) Release(ctx *Context, path string, uFh uint32) {
+	fsys.mu.Lock()
+	f := fsys.files[uFh]
+	delete(fsys.files, uFh)
+	fsys.mu.Unlock()
+	if f != nil {
+		f.f.Close()
+	}
+}
+
+func (fsys *ioFileSystem) GetXAttr(ctx *Context, path string, attr string) ([]byte, fuse.Status) {
+	return nil, fuse.ENOATTR
+}
+
+func (fsys *ioFileSystem) ListXAttr(ctx *Context, path string) ([]string, fuse.Status) {
+	return nil, fuse.OK
+}
+
+func (fsys *ioFileSystem) StatFs(ctx *Context, path string, out *fuse.StatfsOut) fuse.Status {
+	*out = fuse.StatfsOut{NameLen: 255, Bsize: 4096}
+	return fuse.OK
+}
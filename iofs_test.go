@@ -0,0 +1,152 @@
+package pathfs
+
+import (
+	"io/fs"
+	"syscall"
+	"testing"
+	"testing/fstest"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func newTestMapFS() fstest.MapFS {
+	return fstest.MapFS{
+		"a.txt":     {Data: []byte("hello world"), Mode: 0644},
+		"dir/b.txt": {Data: []byte("bbb"), Mode: 0600},
+		"link":      {Data: []byte("a.txt"), Mode: fs.ModeSymlink | 0777},
+	}
+}
+
+// streamFS hides io.ReaderAt and io.Seeker from the files of an fs.FS.
+type streamFS struct {
+	fs.FS
+}
+
+type streamFile struct {
+	fs.File
+}
+
+func (s streamFS) Open(name string) (fs.File, error) {
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return streamFile{f}, nil
+}
+
+func TestIOFileSystemAttr(t *testing.T) {
+	fsys := NewIOFileSystem(newTestMapFS())
+
+	var root, a, dir fuse.Attr
+	if code := fsys.GetAttr(nil, "", 0, &root); !code.Ok() || !root.IsDir() || root.Ino != 1 {
+		t.Errorf("root: %v %v", code, root)
+	}
+	if code := fsys.GetAttr(nil, "a.txt", 0, &a); !code.Ok() {
+		t.Fatal(code)
+	}
+	if !a.IsRegular() || a.Mode&07777 != 0644 || a.Size != 11 || a.Nlink != 1 || a.Ino < 2 {
+		t.Errorf("a.txt: %v", a)
+	}
+	fsys.GetAttr(nil, "dir", 0, &dir)
+	if !dir.IsDir() || dir.Ino == a.Ino {
+		t.Errorf("dir: %v", dir)
+	}
+
+	var again fuse.Attr
+	fsys.GetAttr(nil, "a.txt", 0, &again)
+	if again.Ino != a.Ino {
+		t.Errorf("ino changed: %d, %d", a.Ino, again.Ino)
+	}
+
+	if code := fsys.GetAttr(nil, "missing", 0, &a); code != fuse.ENOENT {
+		t.Errorf("want ENOENT, have %v", code)
+	}
+}
+
+func TestIOFileSystemLsdir(t *testing.T) {
+	fsys := NewIOFileSystem(newTestMapFS())
+
+	stream, code := fsys.Lsdir(nil, "")
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	modes := map[string]uint32{}
+	for _, e := range stream {
+		modes[e.Name] = e.Mode & syscall.S_IFMT
+	}
+	want := map[string]uint32{"a.txt": syscall.S_IFREG, "dir": syscall.S_IFDIR, "link": syscall.S_IFLNK}
+	if len(modes) != len(want) {
+		t.Fatalf("have %v", modes)
+	}
+	for name, mode := range want {
+		if modes[name] != mode {
+			t.Errorf("%s: want mode %o, have %o", name, mode, modes[name])
+		}
+	}
+
+	var a fuse.Attr
+	fsys.GetAttr(nil, "a.txt", 0, &a)
+	for _, e := range stream {
+		if e.Name == "a.txt" && e.Ino != a.Ino {
+			t.Errorf("want ino %d, have %d", a.Ino, e.Ino)
+		}
+	}
+}
+
+func TestIOFileSystemRead(t *testing.T) {
+	for name, fsys := range map[string]FileSystem{
+		"readerat": NewIOFileSystem(newTestMapFS()),
+		"stream":   NewIOFileSystem(streamFS{newTestMapFS()}),
+	} {
+		fh, _, _, code := fsys.Open(nil, "a.txt", syscall.O_RDONLY)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		for _, c := range []struct {
+			off  uint64
+			want string
+		}{{6, "world"}, {0, "hello"}, {5, " worl"}, {9, "ld"}, {20, ""}} {
+			res, code := fsys.Read(nil, "a.txt", fh, make([]byte, 5), c.off)
+			if !code.Ok() {
+				t.Fatalf("%s: %v", name, code)
+			}
+			data, _ := res.Bytes(nil)
+			if string(data) != c.want {
+				t.Errorf("%s: read at %d: want %q, have %q", name, c.off, c.want, data)
+			}
+		}
+		fsys.Release(nil, "a.txt", fh)
+	}
+}
+
+func TestIOFileSystemReadOnly(t *testing.T) {
+	fsys := NewIOFileSystem(newTestMapFS())
+
+	if _, _, _, code := fsys.Open(nil, "a.txt", syscall.O_RDWR); code != fuse.EROFS {
+		t.Errorf("open for write: want EROFS, have %v", code)
+	}
+	if code := fsys.Unlink(nil, "a.txt"); code != fuse.EROFS {
+		t.Errorf("unlink: want EROFS, have %v", code)
+	}
+	if code := fsys.Access(nil, "a.txt", permWrite); code != fuse.EROFS {
+		t.Errorf("access: want EROFS, have %v", code)
+	}
+	if target, code := fsys.Readlink(nil, "link"); !code.Ok() || target != "a.txt" {
+		t.Errorf("readlink: %q %v", target, code)
+	}
+}
+
+func TestIOFileSystemBridge(t *testing.T) {
+	raw := NewPathFS(NewIOFileSystem(newTestMapFS()), nil)
+
+	out := &fuse.EntryOut{}
+	if code := raw.Lookup(nil, &fuse.InHeader{NodeId: 1}, "dir", out); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := raw.Lookup(nil, &fuse.InHeader{NodeId: out.NodeId}, "b.txt", out); !code.Ok() {
+		t.Fatal(code)
+	}
+	if out.Size != 3 || out.Mode&07777 != 0600 {
+		t.Errorf("have %v", out.Attr)
+	}
+}
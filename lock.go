@@ -0,0 +1,224 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// releaseFlockUnlock is FUSE_RELEASE_FLOCK_UNLOCK, set in
+// fuse.ReleaseIn.ReleaseFlags when the released file holds a flock.
+const releaseFlockUnlock = 1 << 1
+
+// heldLock is a lock owned by a lock owner. The range is inclusive,
+// as in fuse.FileLock.
+type heldLock struct {
+	owner uint64
+	start uint64
+	end   uint64
+	typ   uint32
+	pid   uint32
+}
+
+func (l *heldLock) overlaps(start, end uint64) bool {
+	return l.start <= end && start <= l.end
+}
+
+// conflicts reports whether a lock of type typ requested by owner
+// cannot coexist with l.
+func (l *heldLock) conflicts(owner uint64, typ uint32) bool {
+	if l.owner == owner {
+		return false
+	}
+	return l.typ == syscall.F_WRLCK || typ == syscall.F_WRLCK
+}
+
+type inodeLocks struct {
+	posix []heldLock
+	flock []heldLock
+
+	// changed is closed and replaced whenever a lock is dropped,
+	// waking up the waiters of SetLkw.
+	changed chan struct{}
+}
+
+// lockManager implements POSIX byte range locks and BSD flock locks in
+// memory, keyed by inode and lock owner. It is used instead of the
+// FileSystem lock methods if Options.LocalLocks is set.
+type lockManager struct {
+	mu    sync.Mutex
+	nodes map[uint64]*inodeLocks
+}
+
+func newLockManager() *lockManager {
+	return &lockManager{
+		nodes: make(map[uint64]*inodeLocks),
+	}
+}
+
+// locksOf returns the locks of ino, creating them if asked to.
+// Call with mu held.
+func (m *lockManager) locksOf(ino uint64, create bool) *inodeLocks {
+	ls := m.nodes[ino]
+	if ls == nil && create {
+		ls = &inodeLocks{changed: make(chan struct{})}
+		m.nodes[ino] = ls
+	}
+	return ls
+}
+
+// gc drops the lock state of ino once empty. Call with mu held.
+func (m *lockManager) gc(ino uint64, ls *inodeLocks) {
+	if len(ls.posix) == 0 && len(ls.flock) == 0 {
+		delete(m.nodes, ino)
+	}
+}
+
+// conflict returns the first lock conflicting with the request, or nil.
+// Call with mu held.
+func (m *lockManager) conflict(ino uint64, owner uint64, lk *fuse.FileLock, flags uint32) *heldLock {
+	ls := m.locksOf(ino, false)
+	if ls == nil {
+		return nil
+	}
+	held, start, end := ls.posix, lk.Start, lk.End
+	if flags&fuse.FUSE_LK_FLOCK != 0 {
+		held, start, end = ls.flock, 0, ^uint64(0)
+	}
+	for i := range held {
+		if held[i].overlaps(start, end) && held[i].conflicts(owner, lk.Typ) {
+			return &held[i]
+		}
+	}
+	return nil
+}
+
+// GetLk implements F_GETLK: out describes a lock that would prevent
+// lk from being placed, or has type F_UNLCK.
+func (m *lockManager) GetLk(ino uint64, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) fuse.Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if c := m.conflict(ino, owner, lk, flags); c != nil {
+		*out = fuse.FileLock{Start: c.start, End: c.end, Typ: c.typ, Pid: c.pid}
+		return fuse.OK
+	}
+	*out = *lk
+	out.Typ = syscall.F_UNLCK
+	return fuse.OK
+}
+
+// SetLk implements F_SETLK and LOCK_NB flock.
+func (m *lockManager) SetLk(ino uint64, owner uint64, lk *fuse.FileLock, flags uint32) fuse.Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.setLocked(ino, owner, lk, flags)
+}
+
+// SetLkw implements F_SETLKW and blocking flock. It waits until the
+// lock can be placed or ctx is canceled, in which case EINTR is
+// returned.
+func (m *lockManager) SetLkw(ctx *Context, ino uint64, owner uint64, lk *fuse.FileLock, flags uint32) fuse.Status {
+	m.mu.Lock()
+	for {
+		code := m.setLocked(ino, owner, lk, flags)
+		if code != fuse.EAGAIN {
+			m.mu.Unlock()
+			return code
+		}
+		changed := m.locksOf(ino, true).changed
+		m.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fuse.EINTR
+		}
+		m.mu.Lock()
+	}
+}
+
+// Call with mu held.
+func (m *lockManager) setLocked(ino uint64, owner uint64, lk *fuse.FileLock, flags uint32) fuse.Status {
+	switch lk.Typ {
+	case syscall.F_RDLCK, syscall.F_WRLCK, syscall.F_UNLCK:
+	default:
+		return fuse.EINVAL
+	}
+	if lk.Typ != syscall.F_UNLCK && m.conflict(ino, owner, lk, flags) != nil {
+		return fuse.EAGAIN
+	}
+
+	ls := m.locksOf(ino, true)
+	if flags&fuse.FUSE_LK_FLOCK != 0 {
+		ls.flock = removeRange(ls.flock, owner, 0, ^uint64(0))
+		if lk.Typ != syscall.F_UNLCK {
+			ls.flock = append(ls.flock, heldLock{owner, 0, ^uint64(0), lk.Typ, lk.Pid})
+		}
+	} else {
+		// A new lock replaces whatever the owner held in its range.
+		ls.posix = removeRange(ls.posix, owner, lk.Start, lk.End)
+		if lk.Typ != syscall.F_UNLCK {
+			ls.posix = append(ls.posix, heldLock{owner, lk.Start, lk.End, lk.Typ, lk.Pid})
+		}
+	}
+
+	m.notify(ls)
+	m.gc(ino, ls)
+	return fuse.OK
+}
+
+// ReleaseOwner drops the POSIX locks (or the flock locks, if flock is
+// set) of owner on ino. It backs Flush and Release.
+func (m *lockManager) ReleaseOwner(ino uint64, owner uint64, flock bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ls := m.locksOf(ino, false)
+	if ls == nil {
+		return
+	}
+	if flock {
+		ls.flock = removeRange(ls.flock, owner, 0, ^uint64(0))
+	} else {
+		ls.posix = removeRange(ls.posix, owner, 0, ^uint64(0))
+	}
+	m.notify(ls)
+	m.gc(ino, ls)
+}
+
+// notify wakes up the waiters. Call with mu held.
+func (m *lockManager) notify(ls *inodeLocks) {
+	close(ls.changed)
+	ls.changed = make(chan struct{})
+}
+
+// removeRange drops the range [start, end] from the locks of owner,
+// splitting the locks that straddle it.
+func removeRange(held []heldLock, owner uint64, start, end uint64) []heldLock {
+	out := held[:0]
+	var tail []heldLock
+	for _, l := range held {
+		if l.owner != owner || !l.overlaps(start, end) {
+			out = append(out, l)
+			continue
+		}
+		if l.start < start {
+			head := l
+			head.end = start - 1
+			out = append(out, head)
+		}
+		if l.end > end {
+			rest := l
+			rest.start = end + 1
+			tail = append(tail, rest)
+		}
+	}
+	return append(out, tail...)
+}
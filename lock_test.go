@@ -0,0 +1,158 @@
+package pathfs
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+const lockEOF = uint64(1<<63 - 1)
+
+func TestLockConflicts(t *testing.T) {
+	m := newLockManager()
+
+	rd := &fuse.FileLock{Start: 0, End: 99, Typ: syscall.F_RDLCK, Pid: 1}
+	if code := m.SetLk(2, 1, rd, 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	// shared locks coexist.
+	if code := m.SetLk(2, 2, &fuse.FileLock{Start: 50, End: 149, Typ: syscall.F_RDLCK, Pid: 2}, 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	// an exclusive one doesn't.
+	wr := &fuse.FileLock{Start: 90, End: 199, Typ: syscall.F_WRLCK, Pid: 3}
+	if code := m.SetLk(2, 3, wr, 0); code != fuse.EAGAIN {
+		t.Errorf("want EAGAIN, have %v", code)
+	}
+	var out fuse.FileLock
+	m.GetLk(2, 3, wr, 0, &out)
+	if out.Typ != syscall.F_RDLCK || out.Pid != 1 {
+		t.Errorf("want the lock of pid 1, have %+v", out)
+	}
+	// other inodes are unaffected.
+	if code := m.SetLk(3, 3, wr, 0); !code.Ok() {
+		t.Errorf("want OK on another inode, have %v", code)
+	}
+	// past the shared locks there is no conflict.
+	m.GetLk(2, 3, &fuse.FileLock{Start: 150, End: lockEOF, Typ: syscall.F_WRLCK}, 0, &out)
+	if out.Typ != syscall.F_UNLCK {
+		t.Errorf("want F_UNLCK, have %+v", out)
+	}
+}
+
+func TestLockSplit(t *testing.T) {
+	m := newLockManager()
+
+	m.SetLk(2, 1, &fuse.FileLock{Start: 0, End: lockEOF, Typ: syscall.F_WRLCK}, 0)
+	// unlock a hole in the middle.
+	m.SetLk(2, 1, &fuse.FileLock{Start: 10, End: 19, Typ: syscall.F_UNLCK}, 0)
+
+	if code := m.SetLk(2, 2, &fuse.FileLock{Start: 10, End: 19, Typ: syscall.F_WRLCK}, 0); !code.Ok() {
+		t.Errorf("want the hole lockable, have %v", code)
+	}
+	for _, start := range []uint64{0, 20} {
+		if code := m.SetLk(2, 3, &fuse.FileLock{Start: start, End: start, Typ: syscall.F_RDLCK}, 0); code != fuse.EAGAIN {
+			t.Errorf("want byte %d still locked, have %v", start, code)
+		}
+	}
+
+	// downgrading replaces the owner's own lock.
+	m.SetLk(2, 1, &fuse.FileLock{Start: 0, End: 9, Typ: syscall.F_RDLCK}, 0)
+	if code := m.SetLk(2, 3, &fuse.FileLock{Start: 0, End: 9, Typ: syscall.F_RDLCK}, 0); !code.Ok() {
+		t.Errorf("want shared lock after downgrade, have %v", code)
+	}
+
+	m.ReleaseOwner(2, 1, false)
+	m.ReleaseOwner(2, 2, false)
+	m.ReleaseOwner(2, 3, false)
+	if len(m.nodes) != 0 {
+		t.Errorf("want lock state dropped, have %d inodes", len(m.nodes))
+	}
+}
+
+func TestFlock(t *testing.T) {
+	m := newLockManager()
+	ex := &fuse.FileLock{Typ: syscall.F_WRLCK}
+
+	if code := m.SetLk(2, 1, ex, fuse.FUSE_LK_FLOCK); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := m.SetLk(2, 2, ex, fuse.FUSE_LK_FLOCK); code != fuse.EAGAIN {
+		t.Errorf("want EAGAIN, have %v", code)
+	}
+	// flock and POSIX locks don't interact.
+	if code := m.SetLk(2, 2, &fuse.FileLock{Start: 0, End: lockEOF, Typ: syscall.F_WRLCK}, 0); !code.Ok() {
+		t.Errorf("want POSIX lock beside flock, have %v", code)
+	}
+	m.ReleaseOwner(2, 1, true)
+	if code := m.SetLk(2, 2, ex, fuse.FUSE_LK_FLOCK); !code.Ok() {
+		t.Errorf("want flock after release, have %v", code)
+	}
+}
+
+func TestSetLkw(t *testing.T) {
+	m := newLockManager()
+	wr := &fuse.FileLock{Start: 0, End: lockEOF, Typ: syscall.F_WRLCK}
+	m.SetLk(2, 1, wr, 0)
+
+	done := make(chan fuse.Status)
+	go func() {
+		done <- m.SetLkw(&Context{}, 2, 2, wr, 0)
+	}()
+	select {
+	case code := <-done:
+		t.Fatalf("SetLkw should block, returned %v", code)
+	case <-time.After(10 * time.Millisecond):
+	}
+	m.SetLk(2, 1, &fuse.FileLock{Start: 0, End: lockEOF, Typ: syscall.F_UNLCK}, 0)
+	if code := <-done; !code.Ok() {
+		t.Errorf("want OK after unlock, have %v", code)
+	}
+
+	cancel := make(chan struct{})
+	ctx := &Context{}
+	ctx.Cancel = cancel
+	go func() {
+		done <- m.SetLkw(ctx, 2, 3, wr, 0)
+	}()
+	close(cancel)
+	if code := <-done; code != fuse.EINTR {
+		t.Errorf("want EINTR after cancel, have %v", code)
+	}
+}
+
+func TestBridgeLocalLocks(t *testing.T) {
+	mock := &mockFileSystem{
+		getAttrFunc: func(path string) (fuse.Attr, fuse.Status) {
+			return fuse.Attr{Ino: 100, Mode: fuse.S_IFREG | 0644}, fuse.OK
+		},
+	}
+	b := newMockBridge(mock)
+	b.locks = newLockManager()
+
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "f", &fuse.EntryOut{})
+	openOut := &fuse.OpenOut{}
+	b.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 100}}, openOut)
+
+	lkIn := &fuse.LkIn{
+		InHeader: fuse.InHeader{NodeId: 100},
+		Fh:       openOut.Fh,
+		Owner:    7,
+		Lk:       fuse.FileLock{Start: 0, End: lockEOF, Typ: syscall.F_WRLCK},
+	}
+	if code := b.SetLk(nil, lkIn); !code.Ok() {
+		t.Fatal(code)
+	}
+	lkIn.Owner = 8
+	if code := b.SetLk(nil, lkIn); code != fuse.EAGAIN {
+		t.Errorf("want EAGAIN, have %v", code)
+	}
+
+	// closing the file of owner 7 drops its locks.
+	b.Flush(nil, &fuse.FlushIn{InHeader: fuse.InHeader{NodeId: 100}, Fh: openOut.Fh, LockOwner: 7})
+	if code := b.SetLk(nil, lkIn); !code.Ok() {
+		t.Errorf("want OK after flush, have %v", code)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// ModePolicy shapes the permission bits presented to the kernel, for
+// backends with no permission model of their own. It is applied after
+// the NullPermissions defaults.
+type ModePolicy struct {
+	// FileMask and DirMask are cleared from the permission bits of
+	// non-directories and directories, like the fmask and dmask
+	// mount options of vfat.
+	FileMask uint32
+	DirMask  uint32
+
+	// ForceFileMode and ForceDirMode are set in the permission bits
+	// of non-directories and directories, after the masks.
+	ForceFileMode uint32
+	ForceDirMode  uint32
+
+	// Umask is cleared from the modes of Create, Mkdir and Mknod
+	// before they reach the FileSystem, in addition to the umask of
+	// the calling process.
+	Umask uint32
+
+	// Overrides replace the permission bits of the paths they match,
+	// after the masks. The first match wins.
+	Overrides []ModeOverride
+}
+
+// ModeOverride sets the permission bits of the paths matching Pattern,
+// in the syntax of path.Match. Paths are relative to the root, without
+// a leading slash; a pattern without a slash matches base names too.
+type ModeOverride struct {
+	Pattern string
+	Mode    uint32
+
+	// DirOnly and FileOnly restrict the override to directories or
+	// non-directories.
+	DirOnly  bool
+	FileOnly bool
+}
+
+func (o *ModeOverride) match(p string, isDir bool) bool {
+	if (o.DirOnly && !isDir) || (o.FileOnly && isDir) {
+		return false
+	}
+	if ok, _ := path.Match(o.Pattern, p); ok {
+		return true
+	}
+	if !strings.Contains(o.Pattern, "/") {
+		ok, _ := path.Match(o.Pattern, path.Base(p))
+		return ok && p != ""
+	}
+	return false
+}
+
+// Validate checks that the modes are permission bits and that the
+// override patterns are well-formed.
+func (p *ModePolicy) Validate() error {
+	for _, m := range []uint32{p.FileMask, p.DirMask, p.ForceFileMode, p.ForceDirMode, p.Umask} {
+		if m&^07777 != 0 {
+			return fmt.Errorf("mode policy: %#o is not a permission mode", m)
+		}
+	}
+	for _, o := range p.Overrides {
+		if o.Mode&^07777 != 0 {
+			return fmt.Errorf("mode policy: override %q: %#o is not a permission mode", o.Pattern, o.Mode)
+		}
+		if _, err := path.Match(o.Pattern, ""); err != nil {
+			return fmt.Errorf("mode policy: override %q: %v", o.Pattern, err)
+		}
+	}
+	return nil
+}
+
+// apply rewrites the permission bits of the attr of path p.
+func (p *ModePolicy) apply(path string, out *fuse.Attr) {
+	isDir := out.IsDir()
+	perm := out.Mode & 07777
+	if isDir {
+		perm = perm&^p.DirMask | p.ForceDirMode
+	} else {
+		perm = perm&^p.FileMask | p.ForceFileMode
+	}
+	for i := range p.Overrides {
+		if p.Overrides[i].match(path, isDir) {
+			perm = p.Overrides[i].Mode
+			break
+		}
+	}
+	out.Mode = out.Mode&^07777 | perm&07777
+}
+
+// createMode applies the policy umask to the mode of a new entry.
+func (b *rawBridge) createMode(mode uint32) uint32 {
+	if b.options.ModePolicy == nil {
+		return mode
+	}
+	return mode &^ (b.options.ModePolicy.Umask & 0777)
+}
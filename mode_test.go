@@ -0,0 +1,88 @@
+package pathfs
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestModePolicy(t *testing.T) {
+	p := &ModePolicy{
+		FileMask:      0022,
+		DirMask:       0002,
+		ForceFileMode: 0400,
+		Overrides: []ModeOverride{
+			{Pattern: "bin/*", Mode: 0755, FileOnly: true},
+			{Pattern: "*.key", Mode: 0600},
+			{Pattern: "private", Mode: 0700, DirOnly: true},
+		},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		mode uint32
+		want uint32
+	}{
+		{"a", fuse.S_IFREG | 0666, fuse.S_IFREG | 0644},
+		{"a", fuse.S_IFREG | 0200, fuse.S_IFREG | 0600},
+		{"d", fuse.S_IFDIR | 0777, fuse.S_IFDIR | 0775},
+		{"bin/ls", fuse.S_IFREG | 0644, fuse.S_IFREG | 0755},
+		{"bin/sub", fuse.S_IFDIR | 0777, fuse.S_IFDIR | 0775},
+		{"etc/ssl/host.key", fuse.S_IFREG | 0644, fuse.S_IFREG | 0600},
+		{"x/private", fuse.S_IFDIR | 0755, fuse.S_IFDIR | 0700},
+		{"x/private", fuse.S_IFREG | 0644, fuse.S_IFREG | 0644},
+	}
+	for _, tt := range tests {
+		attr := fuse.Attr{Mode: tt.mode}
+		p.apply(tt.path, &attr)
+		if attr.Mode != tt.want {
+			t.Errorf("%s %o: want %o, have %o", tt.path, tt.mode, tt.want, attr.Mode)
+		}
+	}
+
+	if err := (&ModePolicy{Overrides: []ModeOverride{{Pattern: "["}}}).Validate(); err == nil {
+		t.Error("want bad pattern rejected")
+	}
+	if err := (&ModePolicy{ForceFileMode: fuse.S_IFREG | 0644}).Validate(); err == nil {
+		t.Error("want a file type in a mode rejected")
+	}
+	options := &Options{ModePolicy: &ModePolicy{Overrides: []ModeOverride{{Pattern: "["}}}}
+	if _, err := Mount(t.TempDir(), DefaultFileSystem(), options, nil); err == nil {
+		t.Error("want Mount to fail with an invalid mode policy")
+	}
+}
+
+type mkdirFileSystem struct {
+	mockFileSystem
+	mode uint32
+}
+
+func (m *mkdirFileSystem) Mkdir(ctx *Context, path string, mode uint32) fuse.Status {
+	m.mode = mode
+	return fuse.OK
+}
+
+func TestBridgeModePolicy(t *testing.T) {
+	fs := &mkdirFileSystem{}
+	fs.getAttrFunc = func(path string) (fuse.Attr, fuse.Status) {
+		return fuse.Attr{Ino: 100, Mode: fuse.S_IFDIR}, fuse.OK
+	}
+	b := newMockBridge(&fs.mockFileSystem)
+	b.fs = fs
+	b.options.ModePolicy = &ModePolicy{Umask: 0027, DirMask: 0022}
+
+	var out fuse.EntryOut
+	if code := b.Mkdir(nil, &fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: 1}, Mode: 0777}, "d", &out); !code.Ok() {
+		t.Fatal(code)
+	}
+	if fs.mode != 0750 {
+		t.Errorf("want mkdir mode 0750, have %o", fs.mode)
+	}
+	// the NullPermissions default comes first.
+	if out.Mode != fuse.S_IFDIR|0755 {
+		t.Errorf("want mode %o, have %o", fuse.S_IFDIR|0755, out.Mode)
+	}
+}
@@ -17,7 +17,8 @@ import (
 // Mount mounts the given PathFS on the directory, and starts serving
 // requests. This is a convenience wrapper around NewPathFS and
 // fuse.NewServer.  If nil is given as options, default settings are
-// applied, which are 1 second entry and attribute timeout.
+// applied, which are 1 second entry and attribute timeout. Invalid
+// options are returned as an error.
 func Mount(dir string, fs FileSystem, options *Options, mntOptions *fuse.MountOptions) (*fuse.Server, error) {
 	if options == nil {
 		oneSec := time.Second
@@ -26,6 +27,18 @@ func Mount(dir string, fs FileSystem, options *Options, mntOptions *fuse.MountOp
 			AttrTimeout:  &oneSec,
 		}
 	}
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	if options.LocalLocks {
+		var opts fuse.MountOptions
+		if mntOptions != nil {
+			opts = *mntOptions
+		}
+		opts.EnableLocks = true
+		mntOptions = &opts
+	}
 
 	rawFS := NewPathFS(fs, options)
 	server, err := fuse.NewServer(rawFS, dir, mntOptions)
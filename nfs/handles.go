@@ -0,0 +1,138 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nfs
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+)
+
+// fileHandle is the content of an nfs_fh3.
+type fileHandle struct {
+	ino uint64
+	gen uint64
+}
+
+const fileHandleSize = 16
+
+func (h fileHandle) bytes() []byte {
+	b := make([]byte, fileHandleSize)
+	binary.BigEndian.PutUint64(b, h.ino)
+	binary.BigEndian.PutUint64(b[8:], h.gen)
+	return b
+}
+
+func parseFileHandle(b []byte) (fileHandle, bool) {
+	if len(b) != fileHandleSize {
+		return fileHandle{}, false
+	}
+	return fileHandle{
+		ino: binary.BigEndian.Uint64(b),
+		gen: binary.BigEndian.Uint64(b[8:]),
+	}, true
+}
+
+// handleTable maps inode numbers to the paths they were seen at, the
+// most recent first, as the bridge's inodes remember their parents.
+type handleTable struct {
+	mu    sync.Mutex
+	inos  map[uint64][]string
+	paths map[string]uint64
+}
+
+func (t *handleTable) init() {
+	t.inos = make(map[uint64][]string)
+	t.paths = make(map[string]uint64)
+}
+
+// add records that ino was seen at path.
+func (t *handleTable) add(ino uint64, path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if old, ok := t.paths[path]; ok {
+		t.dropLocked(old, path)
+	}
+	t.inos[ino] = append([]string{path}, t.inos[ino]...)
+	t.paths[path] = ino
+}
+
+// lookup returns the paths of ino, the most recent first.
+func (t *handleTable) lookup(ino uint64) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.inos[ino]...)
+}
+
+// drop forgets that ino is at path.
+func (t *handleTable) drop(ino uint64, path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.paths[path] == ino {
+		t.dropLocked(ino, path)
+	}
+}
+
+func (t *handleTable) dropLocked(ino uint64, path string) {
+	delete(t.paths, path)
+	paths := t.inos[ino]
+	for i, p := range paths {
+		if p == path {
+			paths = append(paths[:i:i], paths[i+1:]...)
+			break
+		}
+	}
+	if len(paths) == 0 {
+		delete(t.inos, ino)
+	} else {
+		t.inos[ino] = paths
+	}
+}
+
+// remove forgets path and everything below it.
+func (t *handleTable) remove(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removeLocked(path)
+}
+
+func (t *handleTable) removeLocked(path string) {
+	for p, ino := range t.paths {
+		if _, ok := underPath(p, path); ok {
+			t.dropLocked(ino, p)
+		}
+	}
+}
+
+// rename moves path and everything below it to newPath, replacing what
+// was there.
+func (t *handleTable) rename(path, newPath string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removeLocked(newPath)
+	moved := map[string]uint64{}
+	for p, ino := range t.paths {
+		if rest, ok := underPath(p, path); ok {
+			moved[newPath+rest] = ino
+			t.dropLocked(ino, p)
+		}
+	}
+	for p, ino := range moved {
+		t.inos[ino] = append([]string{p}, t.inos[ino]...)
+		t.paths[p] = ino
+	}
+}
+
+// underPath reports whether p is dir or below it, returning the rest
+// of p.
+func underPath(p, dir string) (string, bool) {
+	if p == dir {
+		return "", true
+	}
+	if len(p) > len(dir) && strings.HasPrefix(p, dir) && p[len(dir)] == '/' {
+		return p[len(dir):], true
+	}
+	return "", false
+}
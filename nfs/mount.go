@@ -0,0 +1,94 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nfs
+
+import (
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+)
+
+// MOUNT version 3, RFC 1813 appendix I.
+const (
+	mountProcNull    = 0
+	mountProcMnt     = 1
+	mountProcDump    = 2
+	mountProcUmnt    = 3
+	mountProcUmntAll = 4
+	mountProcExport  = 5
+
+	mountPathLen = 1024
+)
+
+var mountProcs = []procedure{
+	mountProcNull:    func(s *Server, ctx *pathfs.Context, d *decoder, e *encoder) {},
+	mountProcMnt:     (*Server).mount,
+	mountProcDump:    (*Server).mountDump,
+	mountProcUmnt:    func(s *Server, ctx *pathfs.Context, d *decoder, e *encoder) { d.str(mountPathLen) },
+	mountProcUmntAll: func(s *Server, ctx *pathfs.Context, d *decoder, e *encoder) {},
+	mountProcExport:  (*Server).mountExport,
+}
+
+// exportPath returns the FileSystem path of a MOUNT dirpath.
+func (s *Server) exportPath(dirpath string) (string, bool) {
+	dirpath = "/" + strings.Trim(dirpath, "/")
+	if s.options.ExportPath == "/" {
+		return dirpath[1:], true
+	}
+	if dirpath == s.options.ExportPath {
+		return "", true
+	}
+	if strings.HasPrefix(dirpath, s.options.ExportPath+"/") {
+		return dirpath[len(s.options.ExportPath)+1:], true
+	}
+	return "", false
+}
+
+func (s *Server) mount(ctx *pathfs.Context, d *decoder, e *encoder) {
+	dirpath := d.str(mountPathLen)
+	if d.err != nil {
+		return
+	}
+
+	path, ok := s.exportPath(dirpath)
+	if !ok {
+		e.u32(uint32(nfs3ErrAcces))
+		return
+	}
+	for _, name := range strings.Split(path, "/") {
+		if name == "." || name == ".." {
+			e.u32(uint32(nfs3ErrAcces))
+			return
+		}
+	}
+	var attr fuse.Attr
+	if code := s.getAttr(ctx, path, &attr); !code.Ok() {
+		e.u32(uint32(statusOf(code)))
+		return
+	}
+	if !attr.IsDir() {
+		e.u32(uint32(nfs3ErrNotDir))
+		return
+	}
+
+	e.u32(uint32(nfs3OK))
+	e.opaque(s.handleOf(ctx, path, &attr))
+	e.u32(2) // auth_flavors
+	e.u32(authUnix)
+	e.u32(authNull)
+}
+
+// mountDump lists no mounts: the server does not track them.
+func (s *Server) mountDump(ctx *pathfs.Context, d *decoder, e *encoder) {
+	e.bool(false)
+}
+
+func (s *Server) mountExport(ctx *pathfs.Context, d *decoder, e *encoder) {
+	e.bool(true)
+	e.str(s.options.ExportPath)
+	e.bool(false) // groups
+	e.bool(false)
+}
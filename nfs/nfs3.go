@@ -0,0 +1,1157 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nfs
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+)
+
+// NFS version 3, RFC 1813.
+const (
+	nfsProcNull        = 0
+	nfsProcGetattr     = 1
+	nfsProcSetattr     = 2
+	nfsProcLookup      = 3
+	nfsProcAccess      = 4
+	nfsProcReadlink    = 5
+	nfsProcRead        = 6
+	nfsProcWrite       = 7
+	nfsProcCreate      = 8
+	nfsProcMkdir       = 9
+	nfsProcSymlink     = 10
+	nfsProcMknod       = 11
+	nfsProcRemove      = 12
+	nfsProcRmdir       = 13
+	nfsProcRename      = 14
+	nfsProcLink        = 15
+	nfsProcReaddir     = 16
+	nfsProcReaddirplus = 17
+	nfsProcFsstat      = 18
+	nfsProcFsinfo      = 19
+	nfsProcPathconf    = 20
+	nfsProcCommit      = 21
+
+	fhSize   = 64
+	nameSize = 255
+	pathSize = 4096
+)
+
+// ftype3 values.
+const (
+	nf3Reg  = 1
+	nf3Dir  = 2
+	nf3Blk  = 3
+	nf3Chr  = 4
+	nf3Lnk  = 5
+	nf3Sock = 6
+	nf3Fifo = 7
+)
+
+// ACCESS bits.
+const (
+	access3Read    = 0x01
+	access3Lookup  = 0x02
+	access3Modify  = 0x04
+	access3Extend  = 0x08
+	access3Delete  = 0x10
+	access3Execute = 0x20
+)
+
+// stable_how values.
+const (
+	unstable = 0
+	fileSync = 2
+)
+
+// createmode3 values.
+const (
+	createUnchecked = 0
+	createGuarded   = 1
+	createExclusive = 2
+)
+
+// time_how values.
+const (
+	dontChange      = 0
+	setToServerTime = 1
+	setToClientTime = 2
+)
+
+// fattr3Size is the encoded size of a fattr3.
+const fattr3Size = 84
+
+var nfsProcs = []procedure{
+	nfsProcNull:        func(s *Server, ctx *pathfs.Context, d *decoder, e *encoder) {},
+	nfsProcGetattr:     (*Server).getattr,
+	nfsProcSetattr:     (*Server).setattr,
+	nfsProcLookup:      (*Server).lookup,
+	nfsProcAccess:      (*Server).access,
+	nfsProcReadlink:    (*Server).readlink,
+	nfsProcRead:        (*Server).read,
+	nfsProcWrite:       (*Server).write,
+	nfsProcCreate:      (*Server).create,
+	nfsProcMkdir:       (*Server).mkdir,
+	nfsProcSymlink:     (*Server).symlink,
+	nfsProcMknod:       (*Server).mknod,
+	nfsProcRemove:      (*Server).remove,
+	nfsProcRmdir:       (*Server).rmdir,
+	nfsProcRename:      (*Server).rename,
+	nfsProcLink:        (*Server).link,
+	nfsProcReaddir:     (*Server).readdir,
+	nfsProcReaddirplus: (*Server).readdirplus,
+	nfsProcFsstat:      (*Server).fsstat,
+	nfsProcFsinfo:      (*Server).fsinfo,
+	nfsProcPathconf:    (*Server).pathconf,
+	nfsProcCommit:      (*Server).commit,
+}
+
+func fileType(mode uint32) uint32 {
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		return nf3Dir
+	case syscall.S_IFBLK:
+		return nf3Blk
+	case syscall.S_IFCHR:
+		return nf3Chr
+	case syscall.S_IFLNK:
+		return nf3Lnk
+	case syscall.S_IFSOCK:
+		return nf3Sock
+	case syscall.S_IFIFO:
+		return nf3Fifo
+	}
+	return nf3Reg
+}
+
+func (e *encoder) fattr(attr *fuse.Attr) {
+	e.u32(fileType(attr.Mode))
+	e.u32(attr.Mode & 07777)
+	e.u32(attr.Nlink)
+	e.u32(attr.Uid)
+	e.u32(attr.Gid)
+	e.u64(attr.Size)
+	e.u64(attr.Blocks * 512)
+	major, minor := pathfs.SplitDev(attr.Rdev)
+	e.u32(major)
+	e.u32(minor)
+	e.u64(0) // fsid
+	e.u64(attr.Ino)
+	e.u32(uint32(attr.Atime))
+	e.u32(attr.Atimensec)
+	e.u32(uint32(attr.Mtime))
+	e.u32(attr.Mtimensec)
+	e.u32(uint32(attr.Ctime))
+	e.u32(attr.Ctimensec)
+}
+
+// postOpAttr encodes attr, if any.
+func (e *encoder) postOpAttr(attr *fuse.Attr) {
+	e.bool(attr != nil)
+	if attr != nil {
+		e.fattr(attr)
+	}
+}
+
+// postOpAttr encodes the attr of path, if it can be had.
+func (s *Server) postOpAttr(ctx *pathfs.Context, e *encoder, path string, ok bool) {
+	var attr fuse.Attr
+	if ok && s.getAttr(ctx, path, &attr).Ok() {
+		e.postOpAttr(&attr)
+	} else {
+		e.postOpAttr(nil)
+	}
+}
+
+// wcc encodes the wcc_data of path. Pre-operation attributes are not
+// kept.
+func (s *Server) wcc(ctx *pathfs.Context, e *encoder, path string, ok bool) {
+	e.bool(false)
+	s.postOpAttr(ctx, e, path, ok)
+}
+
+// sattr is a decoded sattr3.
+type sattr struct {
+	mode, uid, gid *uint32
+	size           *uint64
+	atime, mtime   uint32
+	atimeV, mtimeV time.Time
+}
+
+func (d *decoder) optU32() *uint32 {
+	if !d.bool() {
+		return nil
+	}
+	v := d.u32()
+	return &v
+}
+
+func (d *decoder) nfstime() time.Time {
+	sec, nsec := d.u32(), d.u32()
+	return time.Unix(int64(sec), int64(nsec))
+}
+
+func (d *decoder) sattr() *sattr {
+	sa := &sattr{mode: d.optU32(), uid: d.optU32(), gid: d.optU32()}
+	if d.bool() {
+		size := d.u64()
+		sa.size = &size
+	}
+	if sa.atime = d.u32(); sa.atime == setToClientTime {
+		sa.atimeV = d.nfstime()
+	}
+	if sa.mtime = d.u32(); sa.mtime == setToClientTime {
+		sa.mtimeV = d.nfstime()
+	}
+	return sa
+}
+
+// setAttr applies the attributes of sa but its mode, if skipMode.
+func (s *Server) setAttr(ctx *pathfs.Context, path string, sa *sattr, skipMode bool) fuse.Status {
+	if sa.mode != nil && !skipMode {
+		if code := s.fs.Chmod(ctx, path, 0, *sa.mode&07777); !code.Ok() {
+			return code
+		}
+	}
+	if sa.uid != nil || sa.gid != nil {
+		uid, gid := ^uint32(0), ^uint32(0)
+		if sa.uid != nil {
+			uid = *sa.uid
+		}
+		if sa.gid != nil {
+			gid = *sa.gid
+		}
+		if code := s.fs.Chown(ctx, path, 0, uid, gid); !code.Ok() {
+			return code
+		}
+	}
+	if sa.size != nil {
+		if code := s.fs.Truncate(ctx, path, 0, *sa.size); !code.Ok() {
+			return code
+		}
+	}
+	if sa.atime != dontChange || sa.mtime != dontChange {
+		now := time.Now()
+		pick := func(how uint32, v time.Time) *time.Time {
+			switch how {
+			case setToServerTime:
+				return &now
+			case setToClientTime:
+				return &v
+			}
+			return nil
+		}
+		if code := s.fs.Utimens(ctx, path, 0, pick(sa.atime, sa.atimeV), pick(sa.mtime, sa.mtimeV)); !code.Ok() {
+			return code
+		}
+	}
+	return fuse.OK
+}
+
+// checkName checks a filename3 that is to be created or removed.
+func checkName(name string) nfsstat {
+	switch {
+	case name == "" || strings.ContainsRune(name, '/'):
+		return nfs3ErrInval
+	case name == "." || name == "..":
+		return nfs3ErrExist
+	case len(name) > nameSize:
+		return nfs3ErrNameTooLong
+	}
+	return nfs3OK
+}
+
+func childPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// parentPath returns the parent directory of path; the root is its own
+// parent.
+func parentPath(path string) string {
+	if i := strings.LastIndexByte(path, '/'); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// dirOp resolves the diropargs3 of a procedure that creates or removes
+// name in a directory. dirOK reports whether the directory resolved.
+func (s *Server) dirOp(ctx *pathfs.Context, fh []byte, name string) (dir, path string, dirOK bool, st nfsstat) {
+	var attr fuse.Attr
+	if dir, st = s.resolve(ctx, fh, &attr); st != nfs3OK {
+		return "", "", false, st
+	}
+	if !attr.IsDir() {
+		return dir, "", true, nfs3ErrNotDir
+	}
+	if st = checkName(name); st != nfs3OK {
+		return dir, "", true, st
+	}
+	return dir, childPath(dir, name), true, nfs3OK
+}
+
+func (s *Server) getattr(ctx *pathfs.Context, d *decoder, e *encoder) {
+	fh := d.opaque(fhSize)
+	if d.err != nil {
+		return
+	}
+	var attr fuse.Attr
+	if _, st := s.resolve(ctx, fh, &attr); st != nfs3OK {
+		e.u32(uint32(st))
+		return
+	}
+	e.u32(uint32(nfs3OK))
+	e.fattr(&attr)
+}
+
+func (s *Server) setattr(ctx *pathfs.Context, d *decoder, e *encoder) {
+	fh := d.opaque(fhSize)
+	sa := d.sattr()
+	check := d.bool()
+	var ctime time.Time
+	if check {
+		ctime = d.nfstime()
+	}
+	if d.err != nil {
+		return
+	}
+
+	var attr fuse.Attr
+	path, st := s.resolve(ctx, fh, &attr)
+	ok := st == nfs3OK
+	if ok && check &&
+		(uint32(attr.Ctime) != uint32(ctime.Unix()) || attr.Ctimensec != uint32(ctime.Nanosecond())) {
+		st = nfs3ErrNotSync
+	}
+	if st == nfs3OK {
+		st = statusOf(s.setAttr(ctx, path, sa, false))
+	}
+	e.u32(uint32(st))
+	s.wcc(ctx, e, path, ok)
+}
+
+func (s *Server) lookup(ctx *pathfs.Context, d *decoder, e *encoder) {
+	fh, name := d.opaque(fhSize), d.str(pathSize)
+	if d.err != nil {
+		return
+	}
+
+	var dirAttr fuse.Attr
+	dir, st := s.resolve(ctx, fh, &dirAttr)
+	if st != nfs3OK {
+		e.u32(uint32(st))
+		e.postOpAttr(nil)
+		return
+	}
+	var path string
+	switch {
+	case !dirAttr.IsDir():
+		st = nfs3ErrNotDir
+	case name == ".":
+		path = dir
+	case name == "..":
+		path = parentPath(dir)
+	case name == "" || strings.ContainsRune(name, '/'):
+		st = nfs3ErrNoEnt
+	case len(name) > nameSize:
+		st = nfs3ErrNameTooLong
+	default:
+		path = childPath(dir, name)
+	}
+	var attr fuse.Attr
+	if st == nfs3OK {
+		st = statusOf(s.getAttr(ctx, path, &attr))
+	}
+	if st != nfs3OK {
+		e.u32(uint32(st))
+		e.postOpAttr(&dirAttr)
+		return
+	}
+
+	e.u32(uint32(nfs3OK))
+	e.opaque(s.handleOf(ctx, path, &attr))
+	e.postOpAttr(&attr)
+	e.postOpAttr(&dirAttr)
+}
+
+// permits reports whether the mode bits of attr give caller the rwx
+// bits of mask, for FileSystems that do not implement Access.
+func permits(caller *fuse.Caller, attr *fuse.Attr, mask uint32) bool {
+	if caller.Uid == 0 {
+		return mask&1 == 0 || attr.IsDir() || attr.Mode&0111 != 0
+	}
+	perm := attr.Mode
+	switch {
+	case caller.Uid == attr.Uid:
+		perm >>= 6
+	case caller.Gid == attr.Gid:
+		perm >>= 3
+	}
+	return perm&mask&7 == mask
+}
+
+func (s *Server) access(ctx *pathfs.Context, d *decoder, e *encoder) {
+	fh, want := d.opaque(fhSize), d.u32()
+	if d.err != nil {
+		return
+	}
+
+	var attr fuse.Attr
+	path, st := s.resolve(ctx, fh, &attr)
+	if st != nfs3OK {
+		e.u32(uint32(st))
+		e.postOpAttr(nil)
+		return
+	}
+	var granted uint32
+	for _, m := range []struct{ bits, mask uint32 }{
+		{access3Read, 4},
+		{access3Modify | access3Extend | access3Delete, 2},
+		{access3Lookup | access3Execute, 1},
+	} {
+		if want&m.bits == 0 {
+			continue
+		}
+		code := s.fs.Access(ctx, path, m.mask)
+		if code == fuse.ENOSYS {
+			if permits(&ctx.Caller, &attr, m.mask) {
+				code = fuse.OK
+			}
+		}
+		if code.Ok() {
+			granted |= want & m.bits
+		}
+	}
+
+	e.u32(uint32(nfs3OK))
+	e.postOpAttr(&attr)
+	e.u32(granted)
+}
+
+func (s *Server) readlink(ctx *pathfs.Context, d *decoder, e *encoder) {
+	fh := d.opaque(fhSize)
+	if d.err != nil {
+		return
+	}
+
+	var attr fuse.Attr
+	path, st := s.resolve(ctx, fh, &attr)
+	if st != nfs3OK {
+		e.u32(uint32(st))
+		e.postOpAttr(nil)
+		return
+	}
+	if attr.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		e.u32(uint32(nfs3ErrInval))
+		e.postOpAttr(&attr)
+		return
+	}
+	target, code := s.fs.Readlink(ctx, path)
+	if !code.Ok() {
+		e.u32(uint32(statusOf(code)))
+		e.postOpAttr(&attr)
+		return
+	}
+	e.u32(uint32(nfs3OK))
+	e.postOpAttr(&attr)
+	e.str(target)
+}
+
+// openFile is a file opened for a single READ, WRITE or COMMIT: NFS
+// has no open.
+type openFile struct {
+	ctx  *pathfs.Context
+	path string
+	file *pathfs.File
+}
+
+func (s *Server) open(ctx *pathfs.Context, path string, flags uint32) (*openFile, fuse.Status) {
+	ctx.Opener = &ctx.Caller.Owner
+	file, _, _, code := pathfs.OpenFile(ctx, s.fs, path, flags)
+	if !code.Ok() {
+		return nil, code
+	}
+	return &openFile{ctx: ctx, path: path, file: file}, fuse.OK
+}
+
+func (f *openFile) read(buf []byte, off uint64) ([]byte, fuse.Status) {
+	res, code := f.file.Read(f.ctx, f.path, buf, off)
+	if !code.Ok() {
+		return nil, code
+	}
+	defer res.Done()
+	return res.Bytes(buf)
+}
+
+func (f *openFile) write(data []byte, off uint64) (uint32, fuse.Status) {
+	return f.file.Write(f.ctx, f.path, data, off)
+}
+
+// fsync syncs the file; a FileSystem without Fsync is always in sync.
+func (f *openFile) fsync() fuse.Status {
+	if code := f.file.Fsync(f.ctx, f.path, 0); code != fuse.ENOSYS {
+		return code
+	}
+	return fuse.OK
+}
+
+func (f *openFile) close() fuse.Status {
+	return f.file.Close(f.ctx, f.path)
+}
+
+func (s *Server) read(ctx *pathfs.Context, d *decoder, e *encoder) {
+	fh, off, count := d.opaque(fhSize), d.u64(), d.u32()
+	if d.err != nil {
+		return
+	}
+	if count > s.options.MaxIOSize {
+		count = s.options.MaxIOSize
+	}
+
+	var attr fuse.Attr
+	path, st := s.resolve(ctx, fh, &attr)
+	ok := st == nfs3OK
+	if ok && attr.IsDir() {
+		st = nfs3ErrIsDir
+	}
+	var data []byte
+	if st == nfs3OK {
+		f, code := s.open(ctx, path, syscall.O_RDONLY)
+		if code.Ok() {
+			data, code = f.read(make([]byte, count), off)
+			f.close()
+		}
+		st = statusOf(code)
+	}
+	if st != nfs3OK {
+		e.u32(uint32(st))
+		s.postOpAttr(ctx, e, path, ok)
+		return
+	}
+
+	s.getAttr(ctx, path, &attr)
+	e.u32(uint32(nfs3OK))
+	e.postOpAttr(&attr)
+	e.u32(uint32(len(data)))
+	e.bool(uint32(len(data)) < count || off+uint64(len(data)) >= attr.Size)
+	e.opaque(data)
+}
+
+func (s *Server) write(ctx *pathfs.Context, d *decoder, e *encoder) {
+	fh, off, count, stable := d.opaque(fhSize), d.u64(), d.u32(), d.u32()
+	data := d.opaque(s.options.MaxIOSize)
+	if d.err != nil {
+		return
+	}
+	if uint32(len(data)) > count {
+		data = data[:count]
+	}
+
+	var attr fuse.Attr
+	path, st := s.resolve(ctx, fh, &attr)
+	ok := st == nfs3OK
+	if ok && attr.IsDir() {
+		st = nfs3ErrIsDir
+	}
+	var written uint32
+	if st == nfs3OK {
+		f, code := s.open(ctx, path, syscall.O_WRONLY)
+		if code.Ok() {
+			written, code = f.write(data, off)
+			if code.Ok() && stable != unstable {
+				code = f.fsync()
+			}
+			if fcode := f.close(); code.Ok() {
+				code = fcode
+			}
+		}
+		st = statusOf(code)
+	}
+	e.u32(uint32(st))
+	s.wcc(ctx, e, path, ok)
+	if st != nfs3OK {
+		return
+	}
+	e.u32(written)
+	if stable != unstable {
+		stable = fileSync
+	}
+	e.u32(stable)
+	e.fixed(s.verf[:])
+}
+
+func (s *Server) commit(ctx *pathfs.Context, d *decoder, e *encoder) {
+	fh := d.opaque(fhSize)
+	d.u64() // offset
+	d.u32() // count
+	if d.err != nil {
+		return
+	}
+
+	var attr fuse.Attr
+	path, st := s.resolve(ctx, fh, &attr)
+	ok := st == nfs3OK
+	if ok && !attr.IsDir() {
+		f, code := s.open(ctx, path, syscall.O_RDONLY)
+		if code.Ok() {
+			code = f.fsync()
+			f.close()
+		}
+		st = statusOf(code)
+	}
+	e.u32(uint32(st))
+	s.wcc(ctx, e, path, ok)
+	if st == nfs3OK {
+		e.fixed(s.verf[:])
+	}
+}
+
+// created encodes the reply of a procedure that created path in dir.
+func (s *Server) created(ctx *pathfs.Context, e *encoder, dir, path string, dirOK bool, st nfsstat) {
+	var attr fuse.Attr
+	if st == nfs3OK {
+		st = statusOf(s.getAttr(ctx, path, &attr))
+	}
+	e.u32(uint32(st))
+	if st == nfs3OK {
+		e.bool(true)
+		e.opaque(s.handleOf(ctx, path, &attr))
+		e.postOpAttr(&attr)
+	}
+	s.wcc(ctx, e, dir, dirOK)
+}
+
+// exclusiveTimes stores the verifier of an EXCLUSIVE create, as Linux
+// does, in the times of the file.
+func exclusiveTimes(verf []byte) (atime, mtime time.Time) {
+	a := uint32(verf[0])<<24 | uint32(verf[1])<<16 | uint32(verf[2])<<8 | uint32(verf[3])
+	m := uint32(verf[4])<<24 | uint32(verf[5])<<16 | uint32(verf[6])<<8 | uint32(verf[7])
+	return time.Unix(int64(a), 0), time.Unix(int64(m), 0)
+}
+
+func (s *Server) create(ctx *pathfs.Context, d *decoder, e *encoder) {
+	fh, name, how := d.opaque(fhSize), d.str(pathSize), d.u32()
+	var sa *sattr
+	var verf []byte
+	switch how {
+	case createUnchecked, createGuarded:
+		sa = d.sattr()
+	case createExclusive:
+		verf = d.take(8)
+	default:
+		d.err = errShort
+	}
+	if d.err != nil {
+		return
+	}
+
+	dir, path, dirOK, st := s.dirOp(ctx, fh, name)
+	if st != nfs3OK {
+		s.created(ctx, e, dir, path, dirOK, st)
+		return
+	}
+	mode := uint32(0644)
+	if sa != nil && sa.mode != nil {
+		mode = *sa.mode & 07777
+	}
+	flags := uint32(syscall.O_CREAT | syscall.O_WRONLY)
+	if how != createUnchecked {
+		flags |= syscall.O_EXCL
+	}
+
+	ctx.Opener = &ctx.Caller.Owner
+	f, _, code := pathfs.CreateFile(ctx, s.fs, path, flags, mode|syscall.S_IFREG)
+	if code.Ok() {
+		f.Close(ctx, path)
+	}
+
+	if how == createExclusive {
+		atime, mtime := exclusiveTimes(verf)
+		if code.Ok() {
+			code = s.fs.Utimens(ctx, path, 0, &atime, &mtime)
+		} else if code == fuse.Status(syscall.EEXIST) {
+			// A retransmission finds its own verifier.
+			var attr fuse.Attr
+			if s.fs.GetAttr(ctx, path, 0, &attr).Ok() &&
+				attr.Atime == uint64(atime.Unix()) && attr.Mtime == uint64(mtime.Unix()) {
+				code = fuse.OK
+			}
+		}
+	} else if code.Ok() {
+		code = s.setAttr(ctx, path, sa, true)
+	}
+	s.created(ctx, e, dir, path, dirOK, statusOf(code))
+}
+
+func (s *Server) mkdir(ctx *pathfs.Context, d *decoder, e *encoder) {
+	fh, name := d.opaque(fhSize), d.str(pathSize)
+	sa := d.sattr()
+	if d.err != nil {
+		return
+	}
+
+	dir, path, dirOK, st := s.dirOp(ctx, fh, name)
+	if st == nfs3OK {
+		mode := uint32(0755)
+		if sa.mode != nil {
+			mode = *sa.mode & 07777
+		}
+		code := s.fs.Mkdir(ctx, path, mode)
+		if code.Ok() {
+			code = s.setAttr(ctx, path, sa, true)
+		}
+		st = statusOf(code)
+	}
+	s.created(ctx, e, dir, path, dirOK, st)
+}
+
+func (s *Server) symlink(ctx *pathfs.Context, d *decoder, e *encoder) {
+	fh, name := d.opaque(fhSize), d.str(pathSize)
+	d.sattr()
+	target := d.str(pathSize)
+	if d.err != nil {
+		return
+	}
+
+	dir, path, dirOK, st := s.dirOp(ctx, fh, name)
+	if st == nfs3OK {
+		st = statusOf(s.fs.Symlink(ctx, path, target))
+	}
+	s.created(ctx, e, dir, path, dirOK, st)
+}
+
+func (s *Server) mknod(ctx *pathfs.Context, d *decoder, e *encoder) {
+	fh, name, typ := d.opaque(fhSize), d.str(pathSize), d.u32()
+	var sa *sattr
+	var dev uint32
+	var ifmt uint32
+	switch typ {
+	case nf3Chr, nf3Blk:
+		sa = d.sattr()
+		dev = pathfs.MakeDev(d.u32(), d.u32())
+		ifmt = syscall.S_IFCHR
+		if typ == nf3Blk {
+			ifmt = syscall.S_IFBLK
+		}
+	case nf3Sock:
+		sa = d.sattr()
+		ifmt = syscall.S_IFSOCK
+	case nf3Fifo:
+		sa = d.sattr()
+		ifmt = syscall.S_IFIFO
+	}
+	if d.err != nil {
+		return
+	}
+
+	dir, path, dirOK, st := s.dirOp(ctx, fh, name)
+	if st == nfs3OK && sa == nil {
+		st = nfs3ErrBadType
+	}
+	if st == nfs3OK {
+		mode := uint32(0644)
+		if sa.mode != nil {
+			mode = *sa.mode & 07777
+		}
+		code := s.fs.Mknod(ctx, path, ifmt|mode, dev)
+		if code.Ok() {
+			code = s.setAttr(ctx, path, sa, true)
+		}
+		st = statusOf(code)
+	}
+	s.created(ctx, e, dir, path, dirOK, st)
+}
+
+// removed updates the handles and inode numbers of a removed path.
+func (s *Server) removed(path string) {
+	s.options.InoAllocator.Remove(path)
+	s.handles.remove(path)
+}
+
+func (s *Server) remove(ctx *pathfs.Context, d *decoder, e *encoder) {
+	s.unlink(ctx, d, e, s.fs.Unlink)
+}
+
+func (s *Server) rmdir(ctx *pathfs.Context, d *decoder, e *encoder) {
+	s.unlink(ctx, d, e, s.fs.Rmdir)
+}
+
+func (s *Server) unlink(ctx *pathfs.Context, d *decoder, e *encoder,
+	op func(ctx *pathfs.Context, path string) fuse.Status) {
+	fh, name := d.opaque(fhSize), d.str(pathSize)
+	if d.err != nil {
+		return
+	}
+
+	dir, path, dirOK, st := s.dirOp(ctx, fh, name)
+	if st == nfs3OK {
+		if st = statusOf(op(ctx, path)); st == nfs3OK {
+			s.removed(path)
+		}
+	}
+	e.u32(uint32(st))
+	s.wcc(ctx, e, dir, dirOK)
+}
+
+func (s *Server) rename(ctx *pathfs.Context, d *decoder, e *encoder) {
+	fh, name := d.opaque(fhSize), d.str(pathSize)
+	toFh, toName := d.opaque(fhSize), d.str(pathSize)
+	if d.err != nil {
+		return
+	}
+
+	dir, path, dirOK, st := s.dirOp(ctx, fh, name)
+	var toDir, toPath string
+	var toDirOK bool
+	if st == nfs3OK {
+		toDir, toPath, toDirOK, st = s.dirOp(ctx, toFh, toName)
+	}
+	if st == nfs3OK {
+		st = statusOf(s.fs.Rename(ctx, path, toPath))
+	}
+	if st == nfs3OK && path != toPath {
+		s.options.InoAllocator.Rename(path, toPath)
+		s.handles.rename(path, toPath)
+	}
+	e.u32(uint32(st))
+	s.wcc(ctx, e, dir, dirOK)
+	s.wcc(ctx, e, toDir, toDirOK)
+}
+
+func (s *Server) link(ctx *pathfs.Context, d *decoder, e *encoder) {
+	fh := d.opaque(fhSize)
+	dirFh, name := d.opaque(fhSize), d.str(pathSize)
+	if d.err != nil {
+		return
+	}
+
+	var attr fuse.Attr
+	path, st := s.resolve(ctx, fh, &attr)
+	ok := st == nfs3OK
+	var dir, newPath string
+	var dirOK bool
+	if ok {
+		dir, newPath, dirOK, st = s.dirOp(ctx, dirFh, name)
+	}
+	if st == nfs3OK {
+		st = statusOf(s.fs.Link(ctx, path, newPath))
+	}
+	if st == nfs3OK {
+		s.options.InoAllocator.Link(path, newPath)
+		s.handles.add(attr.Ino, newPath)
+	}
+	e.u32(uint32(st))
+	s.postOpAttr(ctx, e, path, ok)
+	s.wcc(ctx, e, dir, dirOK)
+}
+
+// dirEntry is an entry of a READDIR listing.
+type dirEntry struct {
+	name   string
+	mode   uint32
+	ino    uint64
+	cookie uint64
+}
+
+// nameCookie returns the cookie of the entry name. Cookies are hashes
+// of names, so that a listing resumes at the same place however the
+// directory changes between READDIRs. 1 and 2 are "." and "..".
+func nameCookie(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	c := h.Sum64() >> 1
+	if c < 3 {
+		c += 3
+	}
+	return c
+}
+
+// listDir returns the entries of dir, whose attr is attr, in cookie
+// order.
+func (s *Server) listDir(ctx *pathfs.Context, dir string, attr *fuse.Attr) ([]dirEntry, fuse.Status) {
+	stream, code := s.fs.Lsdir(ctx, dir)
+	if !code.Ok() {
+		return nil, code
+	}
+
+	parentIno := attr.Ino
+	if dir != "" {
+		var parent fuse.Attr
+		if s.getAttr(ctx, parentPath(dir), &parent).Ok() {
+			parentIno = parent.Ino
+		}
+	}
+	entries := make([]dirEntry, 0, len(stream)+2)
+	entries = append(entries,
+		dirEntry{name: ".", mode: syscall.S_IFDIR, ino: attr.Ino, cookie: 1},
+		dirEntry{name: "..", mode: syscall.S_IFDIR, ino: parentIno, cookie: 2})
+	for _, de := range stream {
+		if de.Name == "." || de.Name == ".." {
+			continue
+		}
+		ino := de.Ino
+		if ino == 0 {
+			ino = s.synthIno(ctx, childPath(dir, de.Name))
+		}
+		entries = append(entries, dirEntry{name: de.Name, mode: de.Mode, ino: ino, cookie: nameCookie(de.Name)})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].cookie != entries[j].cookie {
+			return entries[i].cookie < entries[j].cookie
+		}
+		return entries[i].name < entries[j].name
+	})
+	return entries, fuse.OK
+}
+
+// after returns the entries after cookie.
+func after(entries []dirEntry, cookie uint64) []dirEntry {
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].cookie > cookie })
+	return entries[i:]
+}
+
+// xdrLen is the encoded size of a string of n bytes.
+func xdrLen(n int) int {
+	return 4 + (n+3)&^3
+}
+
+func (s *Server) readdir(ctx *pathfs.Context, d *decoder, e *encoder) {
+	fh, cookie := d.opaque(fhSize), d.u64()
+	d.take(8) // cookieverf
+	count := d.u32()
+	if d.err != nil {
+		return
+	}
+
+	var attr fuse.Attr
+	dir, st := s.resolve(ctx, fh, &attr)
+	ok := st == nfs3OK
+	if ok && !attr.IsDir() {
+		st = nfs3ErrNotDir
+	}
+	var entries []dirEntry
+	if st == nfs3OK {
+		var code fuse.Status
+		entries, code = s.listDir(ctx, dir, &attr)
+		st = statusOf(code)
+	}
+	if st != nfs3OK {
+		e.u32(uint32(st))
+		s.postOpAttr(ctx, e, dir, ok)
+		return
+	}
+
+	mark := len(e.buf)
+	e.u32(uint32(nfs3OK))
+	e.postOpAttr(&attr)
+	e.fixed(make([]byte, 8)) // cookieverf
+	// The reply so far, and the end of the list.
+	size := len(e.buf) + 8
+	entries = after(entries, cookie)
+	n := 0
+	for _, de := range entries {
+		size += 4 + 8 + xdrLen(len(de.name)) + 8
+		if size > int(count) {
+			break
+		}
+		e.bool(true)
+		e.u64(de.ino)
+		e.str(de.name)
+		e.u64(de.cookie)
+		n++
+	}
+	if n == 0 && len(entries) > 0 {
+		e.buf = e.buf[:mark]
+		e.u32(uint32(nfs3ErrTooSmall))
+		e.postOpAttr(&attr)
+		return
+	}
+	e.bool(false)
+	e.bool(n == len(entries))
+}
+
+func (s *Server) readdirplus(ctx *pathfs.Context, d *decoder, e *encoder) {
+	fh, cookie := d.opaque(fhSize), d.u64()
+	d.take(8) // cookieverf
+	dircount, maxcount := d.u32(), d.u32()
+	if d.err != nil {
+		return
+	}
+
+	var attr fuse.Attr
+	dir, st := s.resolve(ctx, fh, &attr)
+	ok := st == nfs3OK
+	if ok && !attr.IsDir() {
+		st = nfs3ErrNotDir
+	}
+	var entries []dirEntry
+	if st == nfs3OK {
+		var code fuse.Status
+		entries, code = s.listDir(ctx, dir, &attr)
+		st = statusOf(code)
+	}
+	if st != nfs3OK {
+		e.u32(uint32(st))
+		s.postOpAttr(ctx, e, dir, ok)
+		return
+	}
+
+	mark := len(e.buf)
+	e.u32(uint32(nfs3OK))
+	e.postOpAttr(&attr)
+	e.fixed(make([]byte, 8)) // cookieverf
+	size, dsize := len(e.buf)+8, 0
+	entries = after(entries, cookie)
+	n := 0
+	for _, de := range entries {
+		dsize += 8 + xdrLen(len(de.name)) + 8
+		size += 4 + 8 + xdrLen(len(de.name)) + 8 + 4 + fattr3Size + 4 + xdrLen(fileHandleSize)
+		if dsize > int(dircount) || size > int(maxcount) {
+			break
+		}
+
+		var path string
+		switch de.name {
+		case ".":
+			path = dir
+		case "..":
+			path = parentPath(dir)
+		default:
+			path = childPath(dir, de.name)
+		}
+		var child fuse.Attr
+		ok := s.getAttr(ctx, path, &child).Ok()
+		if ok {
+			de.ino = child.Ino
+		}
+		e.bool(true)
+		e.u64(de.ino)
+		e.str(de.name)
+		e.u64(de.cookie)
+		if ok {
+			e.postOpAttr(&child)
+			e.bool(true)
+			e.opaque(s.handleOf(ctx, path, &child))
+		} else {
+			e.postOpAttr(nil)
+			e.bool(false)
+		}
+		n++
+	}
+	if n == 0 && len(entries) > 0 {
+		e.buf = e.buf[:mark]
+		e.u32(uint32(nfs3ErrTooSmall))
+		e.postOpAttr(&attr)
+		return
+	}
+	e.bool(false)
+	e.bool(n == len(entries))
+}
+
+func (s *Server) fsstat(ctx *pathfs.Context, d *decoder, e *encoder) {
+	fh := d.opaque(fhSize)
+	if d.err != nil {
+		return
+	}
+
+	var attr fuse.Attr
+	path, st := s.resolve(ctx, fh, &attr)
+	ok := st == nfs3OK
+	var out fuse.StatfsOut
+	if ok {
+		st = statusOf(s.fs.StatFs(ctx, path, &out))
+	}
+	if st != nfs3OK {
+		e.u32(uint32(st))
+		s.postOpAttr(ctx, e, path, ok)
+		return
+	}
+
+	bsize := uint64(out.Frsize)
+	if bsize == 0 {
+		bsize = uint64(out.Bsize)
+	}
+	e.u32(uint32(nfs3OK))
+	e.postOpAttr(&attr)
+	e.u64(out.Blocks * bsize)
+	e.u64(out.Bfree * bsize)
+	e.u64(out.Bavail * bsize)
+	e.u64(out.Files)
+	e.u64(out.Ffree)
+	e.u64(out.Ffree)
+	e.u32(0) // invarsec
+}
+
+func (s *Server) fsinfo(ctx *pathfs.Context, d *decoder, e *encoder) {
+	fh := d.opaque(fhSize)
+	if d.err != nil {
+		return
+	}
+
+	var attr fuse.Attr
+	if _, st := s.resolve(ctx, fh, &attr); st != nfs3OK {
+		e.u32(uint32(st))
+		e.postOpAttr(nil)
+		return
+	}
+
+	const (
+		fsf3Link        = 0x01
+		fsf3Symlink     = 0x02
+		fsf3Homogeneous = 0x08
+		fsf3CanSetTime  = 0x10
+	)
+	e.u32(uint32(nfs3OK))
+	e.postOpAttr(&attr)
+	e.u32(s.options.MaxIOSize) // rtmax
+	e.u32(s.options.MaxIOSize) // rtpref
+	e.u32(4096)                // rtmult
+	e.u32(s.options.MaxIOSize) // wtmax
+	e.u32(s.options.MaxIOSize) // wtpref
+	e.u32(4096)                // wtmult
+	e.u32(64 << 10)            // dtpref
+	e.u64(1<<63 - 1)           // maxfilesize
+	e.u32(0)                   // time_delta
+	e.u32(1)
+	e.u32(fsf3Link | fsf3Symlink | fsf3Homogeneous | fsf3CanSetTime)
+}
+
+func (s *Server) pathconf(ctx *pathfs.Context, d *decoder, e *encoder) {
+	fh := d.opaque(fhSize)
+	if d.err != nil {
+		return
+	}
+
+	var attr fuse.Attr
+	path, st := s.resolve(ctx, fh, &attr)
+	if st != nfs3OK {
+		e.u32(uint32(st))
+		e.postOpAttr(nil)
+		return
+	}
+	nameMax := uint32(nameSize)
+	var out fuse.StatfsOut
+	if s.fs.StatFs(ctx, path, &out).Ok() && out.NameLen != 0 && out.NameLen < nameMax {
+		nameMax = out.NameLen
+	}
+
+	e.u32(uint32(nfs3OK))
+	e.postOpAttr(&attr)
+	e.u32(1<<31 - 1) // linkmax
+	e.u32(nameMax)
+	e.bool(true)  // no_trunc
+	e.bool(true)  // chown_restricted
+	e.bool(false) // case_insensitive
+	e.bool(true)  // case_preserving
+}
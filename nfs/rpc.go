@@ -0,0 +1,227 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+)
+
+// ONC RPC, RFC 5531.
+const (
+	rpcCall  = 0
+	rpcReply = 1
+
+	msgAccepted = 0
+	msgDenied   = 1
+
+	acceptSuccess      = 0
+	acceptProgUnavail  = 1
+	acceptProgMismatch = 2
+	acceptProcUnavail  = 3
+	acceptGarbageArgs  = 4
+
+	rejectRPCMismatch = 0
+	rejectAuthError   = 1
+
+	authNull = 0
+	authUnix = 1
+
+	authTooWeak = 5
+
+	lastFragment = 0x80000000
+)
+
+// Programs served.
+const (
+	progNFS   = 100003
+	progMount = 100005
+
+	versNFS   = 3
+	versMount = 3
+)
+
+// nobody is the uid and gid of AUTH_NULL calls.
+const nobody = 65534
+
+// call is a decoded RPC call header.
+type call struct {
+	xid    uint32
+	prog   uint32
+	vers   uint32
+	proc   uint32
+	caller fuse.Caller
+}
+
+type conn struct {
+	srv *Server
+	rw  io.ReadWriteCloser
+
+	wmu sync.Mutex
+
+	// closed is the Cancel of every request; it is closed when the
+	// connection ends.
+	closed  chan struct{}
+	running sync.WaitGroup
+}
+
+func (c *conn) serve() error {
+	for {
+		rec, err := c.readRecord()
+		if err != nil {
+			return err
+		}
+		c.running.Add(1)
+		go func() {
+			defer c.running.Done()
+			if reply := c.handle(rec); reply != nil {
+				c.writeRecord(reply)
+			}
+		}()
+	}
+}
+
+// readRecord reads the fragments of a record.
+func (c *conn) readRecord() ([]byte, error) {
+	var rec []byte
+	var hdr [4]byte
+	for {
+		if _, err := io.ReadFull(c.rw, hdr[:]); err != nil {
+			if err == io.ErrUnexpectedEOF || (err == io.EOF && rec != nil) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		h := binary.BigEndian.Uint32(hdr[:])
+		n := h &^ lastFragment
+		if uint64(len(rec))+uint64(n) > uint64(c.srv.maxRecord()) {
+			return nil, fmt.Errorf("nfs: record too long")
+		}
+		frag := make([]byte, n)
+		if _, err := io.ReadFull(c.rw, frag); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		rec = append(rec, frag...)
+		if h&lastFragment != 0 {
+			return rec, nil
+		}
+	}
+}
+
+func (c *conn) writeRecord(rec []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], lastFragment|uint32(len(rec)))
+	if _, err := c.rw.Write(append(hdr[:], rec...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// handle runs a call and returns its reply, or nil if rec is not a
+// call.
+func (c *conn) handle(rec []byte) []byte {
+	d := &decoder{buf: rec}
+	xid, mtype := d.u32(), d.u32()
+	if d.err != nil || mtype != rpcCall {
+		c.srv.logf("nfs: dropping a malformed message")
+		return nil
+	}
+	rpcvers := d.u32()
+	cl := call{xid: xid, prog: d.u32(), vers: d.u32(), proc: d.u32()}
+	flavor, cred := d.u32(), d.opaque(400)
+	d.u32()
+	d.opaque(400) // verf
+	if d.err != nil {
+		return acceptedReply(xid, acceptGarbageArgs).buf
+	}
+
+	if rpcvers != 2 {
+		e := &encoder{}
+		e.u32(xid)
+		e.u32(rpcReply)
+		e.u32(msgDenied)
+		e.u32(rejectRPCMismatch)
+		e.u32(2)
+		e.u32(2)
+		return e.buf
+	}
+	switch flavor {
+	case authNull:
+		cl.caller.Uid, cl.caller.Gid = nobody, nobody
+	case authUnix:
+		cd := &decoder{buf: cred}
+		cd.u32()    // stamp
+		cd.str(255) // machinename
+		cl.caller.Uid = cd.u32()
+		cl.caller.Gid = cd.u32()
+		if cd.err != nil {
+			return acceptedReply(xid, acceptGarbageArgs).buf
+		}
+	default:
+		e := &encoder{}
+		e.u32(xid)
+		e.u32(rpcReply)
+		e.u32(msgDenied)
+		e.u32(rejectAuthError)
+		e.u32(authTooWeak)
+		return e.buf
+	}
+
+	var procs []procedure
+	var vers uint32
+	switch cl.prog {
+	case progNFS:
+		procs, vers = nfsProcs, versNFS
+	case progMount:
+		procs, vers = mountProcs, versMount
+	default:
+		return acceptedReply(xid, acceptProgUnavail).buf
+	}
+	if cl.vers != vers {
+		e := acceptedReply(xid, acceptProgMismatch)
+		e.u32(vers)
+		e.u32(vers)
+		return e.buf
+	}
+	if cl.proc >= uint32(len(procs)) || procs[cl.proc] == nil {
+		return acceptedReply(xid, acceptProcUnavail).buf
+	}
+
+	ctx := &pathfs.Context{}
+	ctx.Caller = cl.caller
+	ctx.Cancel = c.closed
+	e := acceptedReply(xid, acceptSuccess)
+	procs[cl.proc](c.srv, ctx, d, e)
+	if d.err != nil {
+		c.srv.logf("nfs: program %d procedure %d: %v", cl.prog, cl.proc, d.err)
+		return acceptedReply(xid, acceptGarbageArgs).buf
+	}
+	return e.buf
+}
+
+// procedure decodes its arguments from d and encodes its results to
+// e. It must check d.err before acting: a decoding error discards e.
+type procedure func(s *Server, ctx *pathfs.Context, d *decoder, e *encoder)
+
+func acceptedReply(xid uint32, stat uint32) *encoder {
+	e := &encoder{buf: make([]byte, 0, 128)}
+	e.u32(xid)
+	e.u32(rpcReply)
+	e.u32(msgAccepted)
+	e.u32(authNull) // verf
+	e.u32(0)
+	e.u32(stat)
+	return e
+}
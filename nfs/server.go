@@ -0,0 +1,193 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nfs serves a pathfs.FileSystem over NFSv3, with the MOUNT
+// protocol on the same port, for clients that cannot use FUSE.
+//
+// File handles hold the inode number of a file, as the FUSE bridge
+// reports it: the Ino of GetAttr, or one from the InoAllocator when
+// that is 0, along with the Generation of a Generationer. The server
+// maps them back to the paths it has seen them at, and follows renames
+// made through it. A handle that no longer resolves is stale, as is
+// every handle of a previous Server unless its FileSystem has real
+// inode numbers and the client looks them up again.
+//
+// There is no portmapper; clients are given the port, as in
+//
+//	mount -t nfs -o vers=3,proto=tcp,port=N,mountport=N,nolock host:/ dir
+//
+// Only AUTH_NULL and AUTH_UNIX are accepted, and the caller's uid and
+// gid are passed to the FileSystem as is.
+package nfs
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+)
+
+// DefaultMaxIOSize is the largest READ and WRITE offered to clients
+// when Options.MaxIOSize is not set.
+const DefaultMaxIOSize = 1 << 20
+
+// Options sets options for a Server.
+type Options struct {
+	// ExportPath is the MOUNT path of the FileSystem's root. Paths
+	// below it mount subdirectories. The default is "/".
+	ExportPath string
+
+	// MaxIOSize bounds the size of READ and WRITE requests.
+	MaxIOSize uint32
+
+	// InoAllocator numbers the files of a FileSystem that returns
+	// Ino 0. If unset, a new one is used; set it to share or persist
+	// the numbers, and with them the file handles.
+	InoAllocator *pathfs.InoAllocator
+
+	// Logger is a sink for diagnostic messages, such as malformed
+	// requests. If unset, no messages are printed.
+	Logger *log.Logger
+}
+
+// Server serves a FileSystem to any number of NFS connections.
+type Server struct {
+	fs      pathfs.FileSystem
+	options Options
+
+	handles handleTable
+
+	// verf is the write verifier. It changes with every Server, which
+	// tells clients to resend their uncommitted writes.
+	verf [8]byte
+}
+
+// NewServer returns a Server for fs. options may be nil.
+func NewServer(fs pathfs.FileSystem, options *Options) *Server {
+	s := &Server{fs: fs}
+	if options != nil {
+		s.options = *options
+	}
+	s.options.ExportPath = "/" + strings.Trim(s.options.ExportPath, "/")
+	if s.options.MaxIOSize == 0 {
+		s.options.MaxIOSize = DefaultMaxIOSize
+	}
+	if s.options.MaxIOSize < 4096 {
+		s.options.MaxIOSize = 4096
+	}
+	if s.options.InoAllocator == nil {
+		s.options.InoAllocator = pathfs.NewInoAllocator()
+	}
+	s.handles.init()
+	binary.BigEndian.PutUint64(s.verf[:], uint64(time.Now().UnixNano()))
+	return s
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.options.Logger != nil {
+		s.options.Logger.Printf(format, args...)
+	}
+}
+
+// maxRecord bounds the size of a call: a WRITE of MaxIOSize, and its
+// header.
+func (s *Server) maxRecord() uint32 {
+	return s.options.MaxIOSize + 4096
+}
+
+// Serve serves the connections accepted from l, each in its own
+// goroutine, until Accept fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := s.ServeConn(c); err != nil {
+				s.logf("nfs: %v: %v", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn serves a single connection until it is closed or a record
+// is malformed. It closes rw, and returns nil at EOF.
+func (s *Server) ServeConn(rw io.ReadWriteCloser) error {
+	c := &conn{srv: s, rw: rw, closed: make(chan struct{})}
+	err := c.serve()
+	close(c.closed)
+	rw.Close()
+	c.running.Wait()
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// synthIno returns the allocated number of path, as the bridge does.
+func (s *Server) synthIno(ctx *pathfs.Context, path string) uint64 {
+	var key string
+	if h, ok := s.fs.(pathfs.LinkHinter); ok {
+		key, _ = h.LinkKey(ctx, path)
+	}
+	return s.options.InoAllocator.Assign(path, key)
+}
+
+// getAttr returns the attr of path, with its inode number filled in.
+func (s *Server) getAttr(ctx *pathfs.Context, path string, out *fuse.Attr) fuse.Status {
+	if code := s.fs.GetAttr(ctx, path, 0, out); !code.Ok() {
+		return code
+	}
+	if out.Ino == 0 {
+		out.Ino = s.synthIno(ctx, path)
+	}
+	return fuse.OK
+}
+
+// handleOf returns the file handle of path, whose attr is attr, and
+// remembers where it was seen.
+func (s *Server) handleOf(ctx *pathfs.Context, path string, attr *fuse.Attr) []byte {
+	h := fileHandle{ino: attr.Ino}
+	if g, ok := s.fs.(pathfs.Generationer); ok {
+		h.gen, _ = g.Generation(ctx, path)
+	}
+	s.handles.add(h.ino, path)
+	return h.bytes()
+}
+
+// resolve returns the path and attr of the file handle b.
+func (s *Server) resolve(ctx *pathfs.Context, b []byte, attr *fuse.Attr) (string, nfsstat) {
+	h, ok := parseFileHandle(b)
+	if !ok {
+		return "", nfs3ErrBadHandle
+	}
+	for _, path := range s.handles.lookup(h.ino) {
+		code := s.getAttr(ctx, path, attr)
+		if code == fuse.ENOENT {
+			s.handles.drop(h.ino, path)
+			continue
+		}
+		if !code.Ok() {
+			return "", statusOf(code)
+		}
+		if attr.Ino != h.ino {
+			s.handles.drop(h.ino, path)
+			continue
+		}
+		if g, ok := s.fs.(pathfs.Generationer); ok {
+			if gen, _ := g.Generation(ctx, path); gen != h.gen {
+				s.handles.drop(h.ino, path)
+				continue
+			}
+		}
+		return path, nfs3OK
+	}
+	return "", nfs3ErrStale
+}
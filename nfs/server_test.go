@@ -0,0 +1,334 @@
+package nfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/someonegg/pathfs"
+)
+
+// testClient makes ONC RPC calls to a Server, one at a time.
+type testClient struct {
+	t   *testing.T
+	c   net.Conn
+	xid uint32
+}
+
+func newTestClient(t *testing.T, fs pathfs.FileSystem) *testClient {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewServer(fs, nil).Serve(l)
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		l.Close()
+	})
+	return &testClient{t: t, c: c}
+}
+
+// rpc makes a call with AUTH_UNIX and returns its accept_stat and
+// results.
+func (c *testClient) rpc(prog, vers, proc uint32, fill func(e *encoder)) (uint32, *decoder) {
+	c.t.Helper()
+	c.xid++
+	e := &encoder{}
+	e.u32(c.xid)
+	e.u32(rpcCall)
+	e.u32(2)
+	e.u32(prog)
+	e.u32(vers)
+	e.u32(proc)
+	cred := &encoder{}
+	cred.u32(0)
+	cred.str("test")
+	cred.u32(uint32(os.Getuid()))
+	cred.u32(uint32(os.Getgid()))
+	cred.u32(0)
+	e.u32(authUnix)
+	e.opaque(cred.buf)
+	e.u32(authNull)
+	e.opaque(nil)
+	fill(e)
+
+	// Send the call in two fragments.
+	half := len(e.buf) / 2
+	msg := make([]byte, 4, len(e.buf)+8)
+	binary.BigEndian.PutUint32(msg, uint32(half))
+	msg = append(msg, e.buf[:half]...)
+	msg = append(msg, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(msg[len(msg)-4:], lastFragment|uint32(len(e.buf)-half))
+	msg = append(msg, e.buf[half:]...)
+	if _, err := c.c.Write(msg); err != nil {
+		c.t.Fatal(err)
+	}
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.c, hdr[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	rec := make([]byte, binary.BigEndian.Uint32(hdr[:])&^lastFragment)
+	if _, err := io.ReadFull(c.c, rec); err != nil {
+		c.t.Fatal(err)
+	}
+	d := &decoder{buf: rec}
+	if xid, mtype, stat := d.u32(), d.u32(), d.u32(); xid != c.xid || mtype != rpcReply || stat != msgAccepted {
+		c.t.Fatalf("reply %d %d %d", xid, mtype, stat)
+	}
+	d.u32()
+	d.opaque(400)
+	return d.u32(), d
+}
+
+// nfs makes an NFS call and returns its nfsstat3 and the rest of the
+// results.
+func (c *testClient) nfs(proc uint32, fill func(e *encoder)) (nfsstat, *decoder) {
+	c.t.Helper()
+	stat, d := c.rpc(progNFS, versNFS, proc, fill)
+	if stat != acceptSuccess {
+		c.t.Fatalf("procedure %d: accept_stat %d", proc, stat)
+	}
+	return nfsstat(d.u32()), d
+}
+
+func (c *testClient) mount(path string) []byte {
+	c.t.Helper()
+	stat, d := c.rpc(progMount, versMount, mountProcMnt, func(e *encoder) { e.str(path) })
+	if stat != acceptSuccess {
+		c.t.Fatalf("MNT: accept_stat %d", stat)
+	}
+	if st := d.u32(); st != 0 {
+		c.t.Fatalf("MNT: %d", st)
+	}
+	return d.opaque(fhSize)
+}
+
+// skipPostOpAttr skips a post_op_attr.
+func skipPostOpAttr(d *decoder) {
+	if d.bool() {
+		d.take(fattr3Size)
+	}
+}
+
+// noSattr encodes a sattr3 that sets nothing but perhaps the mode.
+func noSattr(e *encoder, mode uint32) {
+	e.bool(mode != 0)
+	if mode != 0 {
+		e.u32(mode)
+	}
+	e.bool(false)
+	e.bool(false)
+	e.bool(false)
+	e.u32(dontChange)
+	e.u32(dontChange)
+}
+
+// create creates name in dir and returns its handle.
+func (c *testClient) create(dir []byte, name string) []byte {
+	c.t.Helper()
+	st, d := c.nfs(nfsProcCreate, func(e *encoder) {
+		e.opaque(dir)
+		e.str(name)
+		e.u32(createGuarded)
+		noSattr(e, 0644)
+	})
+	if st != nfs3OK {
+		c.t.Fatalf("CREATE %s: %d", name, st)
+	}
+	d.bool()
+	return d.opaque(fhSize)
+}
+
+func (c *testClient) lookup(dir []byte, name string) ([]byte, nfsstat) {
+	c.t.Helper()
+	st, d := c.nfs(nfsProcLookup, func(e *encoder) {
+		e.opaque(dir)
+		e.str(name)
+	})
+	if st != nfs3OK {
+		return nil, st
+	}
+	return d.opaque(fhSize), st
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestClient(t, pathfs.NewTestFileSystem(dir))
+	root := c.mount("/")
+
+	if stat, d := c.rpc(progMount, versMount, mountProcMnt, func(e *encoder) { e.str("/missing") }); stat != acceptSuccess || d.u32() != uint32(nfs3ErrNoEnt) {
+		t.Fatal("MNT of a missing path succeeded")
+	}
+	if stat, _ := c.rpc(1, 1, 0, func(e *encoder) {}); stat != acceptProgUnavail {
+		t.Fatalf("unknown program: %d", stat)
+	}
+
+	// Write and read a file.
+	f := c.create(root, "f")
+	data := []byte("hello, nfs")
+	st, d := c.nfs(nfsProcWrite, func(e *encoder) {
+		e.opaque(f)
+		e.u64(0)
+		e.u32(uint32(len(data)))
+		e.u32(fileSync)
+		e.opaque(data)
+	})
+	if st != nfs3OK {
+		t.Fatalf("WRITE: %d", st)
+	}
+	d.bool()
+	skipPostOpAttr(d)
+	if n := d.u32(); n != uint32(len(data)) {
+		t.Fatalf("WRITE: %d", n)
+	}
+	st, d = c.nfs(nfsProcRead, func(e *encoder) {
+		e.opaque(f)
+		e.u64(7)
+		e.u32(100)
+	})
+	if st != nfs3OK {
+		t.Fatalf("READ: %d", st)
+	}
+	skipPostOpAttr(d)
+	d.u32()
+	if eof, got := d.bool(), d.opaque(100); !eof || string(got) != "nfs" {
+		t.Fatalf("READ: %q %v", got, eof)
+	}
+	if got, _ := c.lookup(root, "f"); !bytes.Equal(got, f) {
+		t.Fatalf("LOOKUP: handle %x, want %x", got, f)
+	}
+
+	// A handle follows its file across RENAME.
+	st, d = c.nfs(nfsProcMkdir, func(e *encoder) {
+		e.opaque(root)
+		e.str("d")
+		noSattr(e, 0755)
+	})
+	if st != nfs3OK {
+		t.Fatalf("MKDIR: %d", st)
+	}
+	d.bool()
+	sub := d.opaque(fhSize)
+	if st, _ := c.nfs(nfsProcRename, func(e *encoder) {
+		e.opaque(root)
+		e.str("f")
+		e.opaque(sub)
+		e.str("g")
+	}); st != nfs3OK {
+		t.Fatalf("RENAME: %d", st)
+	}
+	st, d = c.nfs(nfsProcGetattr, func(e *encoder) { e.opaque(f) })
+	if st != nfs3OK {
+		t.Fatalf("GETATTR after RENAME: %d", st)
+	}
+	if typ, _, _, _, _, size := d.u32(), d.u32(), d.u32(), d.u32(), d.u32(), d.u64(); typ != nf3Reg || size != uint64(len(data)) {
+		t.Fatalf("GETATTR: type %d size %d", typ, size)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d", "g")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A removed file's handle is stale.
+	if st, _ := c.nfs(nfsProcRemove, func(e *encoder) {
+		e.opaque(sub)
+		e.str("g")
+	}); st != nfs3OK {
+		t.Fatalf("REMOVE: %d", st)
+	}
+	if st, _ := c.nfs(nfsProcGetattr, func(e *encoder) { e.opaque(f) }); st != nfs3ErrStale {
+		t.Fatalf("GETATTR after REMOVE: %d", st)
+	}
+	if st, _ := c.nfs(nfsProcGetattr, func(e *encoder) { e.opaque([]byte("bad")) }); st != nfs3ErrBadHandle {
+		t.Fatalf("GETATTR of a bad handle: %d", st)
+	}
+}
+
+// readdirplus reads a page of dir from cookie, returning the names
+// and the cookie of the last.
+func (c *testClient) readdirplus(dir []byte, cookie uint64) ([]string, uint64, bool) {
+	c.t.Helper()
+	st, d := c.nfs(nfsProcReaddirplus, func(e *encoder) {
+		e.opaque(dir)
+		e.u64(cookie)
+		e.fixed(make([]byte, 8))
+		e.u32(4096)
+		e.u32(600)
+	})
+	if st != nfs3OK {
+		c.t.Fatalf("READDIRPLUS: %d", st)
+	}
+	skipPostOpAttr(d)
+	d.take(8)
+	var names []string
+	for d.bool() {
+		d.u64()
+		names = append(names, d.str(nameSize))
+		cookie = d.u64()
+		skipPostOpAttr(d)
+		if d.bool() {
+			d.opaque(fhSize)
+		}
+	}
+	return names, cookie, d.bool()
+}
+
+func TestServerReaddirCookies(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestClient(t, pathfs.NewTestFileSystem(dir))
+	root := c.mount("/")
+
+	want := map[string]bool{".": true, "..": true}
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("f%02d", i)
+		c.create(root, name)
+		want[name] = true
+	}
+
+	// Entries added and removed between pages do not disturb the
+	// others.
+	seen := map[string]bool{}
+	var cookie uint64
+	for pages := 0; ; pages++ {
+		names, next, eof := c.readdirplus(root, cookie)
+		for _, name := range names {
+			if seen[name] {
+				t.Fatalf("%q listed twice", name)
+			}
+			seen[name] = true
+		}
+		if eof {
+			if pages == 0 {
+				t.Fatal("listing fit in one page")
+			}
+			break
+		}
+		if len(names) == 0 {
+			t.Fatal("empty page before eof")
+		}
+		c.create(root, fmt.Sprintf("new%02d", pages))
+		if last := names[len(names)-1]; pages == 0 && last != "." && last != ".." {
+			if st, _ := c.nfs(nfsProcRemove, func(e *encoder) {
+				e.opaque(root)
+				e.str(last)
+			}); st != nfs3OK {
+				t.Fatalf("REMOVE: %d", st)
+			}
+		}
+		cookie = next
+	}
+	for name := range want {
+		if !seen[name] {
+			t.Errorf("%q not listed", name)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nfs
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// nfsstat is an nfsstat3.
+type nfsstat uint32
+
+const (
+	nfs3OK             nfsstat = 0
+	nfs3ErrPerm        nfsstat = 1
+	nfs3ErrNoEnt       nfsstat = 2
+	nfs3ErrIO          nfsstat = 5
+	nfs3ErrNXIO        nfsstat = 6
+	nfs3ErrAcces       nfsstat = 13
+	nfs3ErrExist       nfsstat = 17
+	nfs3ErrXDev        nfsstat = 18
+	nfs3ErrNoDev       nfsstat = 19
+	nfs3ErrNotDir      nfsstat = 20
+	nfs3ErrIsDir       nfsstat = 21
+	nfs3ErrInval       nfsstat = 22
+	nfs3ErrFBig        nfsstat = 27
+	nfs3ErrNoSpc       nfsstat = 28
+	nfs3ErrROFS        nfsstat = 30
+	nfs3ErrMLink       nfsstat = 31
+	nfs3ErrNameTooLong nfsstat = 63
+	nfs3ErrNotEmpty    nfsstat = 66
+	nfs3ErrDQuot       nfsstat = 69
+	nfs3ErrStale       nfsstat = 70
+	nfs3ErrBadHandle   nfsstat = 10001
+	nfs3ErrNotSync     nfsstat = 10002
+	nfs3ErrBadCookie   nfsstat = 10003
+	nfs3ErrNotSupp     nfsstat = 10004
+	nfs3ErrTooSmall    nfsstat = 10005
+	nfs3ErrServerFault nfsstat = 10006
+	nfs3ErrBadType     nfsstat = 10007
+	nfs3ErrJukebox     nfsstat = 10008
+)
+
+// statuses maps the errnos of the host to nfsstat3.
+var statuses = map[syscall.Errno]nfsstat{
+	syscall.EPERM:        nfs3ErrPerm,
+	syscall.ENOENT:       nfs3ErrNoEnt,
+	syscall.EIO:          nfs3ErrIO,
+	syscall.ENXIO:        nfs3ErrNXIO,
+	syscall.EACCES:       nfs3ErrAcces,
+	syscall.EEXIST:       nfs3ErrExist,
+	syscall.EXDEV:        nfs3ErrXDev,
+	syscall.ENODEV:       nfs3ErrNoDev,
+	syscall.ENOTDIR:      nfs3ErrNotDir,
+	syscall.EISDIR:       nfs3ErrIsDir,
+	syscall.EINVAL:       nfs3ErrInval,
+	syscall.EFBIG:        nfs3ErrFBig,
+	syscall.ENOSPC:       nfs3ErrNoSpc,
+	syscall.EROFS:        nfs3ErrROFS,
+	syscall.EMLINK:       nfs3ErrMLink,
+	syscall.ENAMETOOLONG: nfs3ErrNameTooLong,
+	syscall.ENOTEMPTY:    nfs3ErrNotEmpty,
+	syscall.EDQUOT:       nfs3ErrDQuot,
+	syscall.ESTALE:       nfs3ErrStale,
+	syscall.ENOSYS:       nfs3ErrNotSupp,
+	syscall.EOPNOTSUPP:   nfs3ErrNotSupp,
+	syscall.EAGAIN:       nfs3ErrJukebox,
+}
+
+// statusOf converts a status to nfsstat3, EIO if it has no equivalent.
+func statusOf(code fuse.Status) nfsstat {
+	if code.Ok() {
+		return nfs3OK
+	}
+	if st, ok := statuses[syscall.Errno(code)]; ok {
+		return st
+	}
+	return nfs3ErrIO
+}
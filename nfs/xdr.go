@@ -0,0 +1,108 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nfs
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errShort = errors.New("nfs: message too short")
+
+// decoder reads XDR. The first failure is kept in err; later reads
+// return zero values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) take(n uint32) []byte {
+	if d.err != nil {
+		return nil
+	}
+	// XDR pads to four bytes.
+	padded := (uint64(n) + 3) &^ 3
+	if uint64(len(d.buf)) < padded {
+		d.err = errShort
+		return nil
+	}
+	b := d.buf[:n:n]
+	d.buf = d.buf[padded:]
+	return b
+}
+
+func (d *decoder) u32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) u64() uint64 {
+	if b := d.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) bool() bool {
+	return d.u32() != 0
+}
+
+// opaque reads variable-length opaque data of at most max bytes.
+func (d *decoder) opaque(max uint32) []byte {
+	n := d.u32()
+	if n > max && d.err == nil {
+		d.err = errors.New("nfs: opaque data too long")
+	}
+	return d.take(n)
+}
+
+func (d *decoder) str(max uint32) string {
+	return string(d.opaque(max))
+}
+
+// encoder writes XDR.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) u32(v uint32) {
+	e.buf = append(e.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *encoder) u64(v uint64) {
+	e.u32(uint32(v >> 32))
+	e.u32(uint32(v))
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.u32(1)
+	} else {
+		e.u32(0)
+	}
+}
+
+// fixed writes fixed-length opaque data.
+func (e *encoder) fixed(b []byte) {
+	e.buf = append(e.buf, b...)
+	for len(e.buf)%4 != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *encoder) opaque(b []byte) {
+	e.u32(uint32(len(b)))
+	e.fixed(b)
+}
+
+func (e *encoder) str(s string) {
+	e.u32(uint32(len(s)))
+	e.buf = append(e.buf, s...)
+	for len(e.buf)%4 != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
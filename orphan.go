@@ -0,0 +1,81 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+// OrphanPather is an optional interface for a FileSystem that keeps
+// unlinked files reachable while they are open, the way NFS clients
+// rename them to .nfsXXXX. After Unlink or Rename removed the last
+// name of a file with open handles, the bridge asks for the path the
+// file is reachable at, and uses it for these handles from then on.
+//
+// Without it, open handles keep the path they were opened with, and
+// operations on the orphaned inode without a handle fail with ESTALE.
+type OrphanPather interface {
+	OrphanPath(ctx *Context, path string) (hidden string, ok bool)
+}
+
+// child returns the child name of parent, or nil.
+func (b *rawBridge) child(parent *inode, name string) *inode {
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+	return parent.children[name]
+}
+
+// isOrphan reports whether n has no name left.
+func (b *rawBridge) isOrphan(n *inode) bool {
+	if n == b.root {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.parents.count() == 0
+}
+
+// orphaned is called once the name path of n is gone.
+func (b *rawBridge) orphaned(ctx *Context, n *inode, path string) {
+	if n == nil || !b.isOrphan(n) {
+		return
+	}
+	op, ok := b.fs.(OrphanPather)
+	if !ok || !b.hasOpenFiles(n.ino) {
+		return
+	}
+	hidden, ok := op.OrphanPath(ctx, path)
+	if !ok {
+		return
+	}
+	b.setFilePaths(n.ino, hidden)
+}
+
+// hasOpenFiles reports whether some file entry refers to ino.
+func (b *rawBridge) hasOpenFiles(ino uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.hasOpenFilesLocked(ino)
+}
+
+func (b *rawBridge) hasOpenFilesLocked(ino uint64) bool {
+	for _, f := range b.files[1:] {
+		if f.ino == ino {
+			return true
+		}
+	}
+	return false
+}
+
+// setFilePaths sets the path of the file entries of ino.
+func (b *rawBridge) setFilePaths(ino uint64, path string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.setFilePathsLocked(ino, path)
+}
+
+func (b *rawBridge) setFilePathsLocked(ino uint64, path string) {
+	for _, f := range b.files[1:] {
+		if f.ino == ino {
+			f.path = path
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package pathfs
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// unlinkFileSystem serves a single file "f" and records the paths
+// passed to Read.
+type unlinkFileSystem struct {
+	mockFileSystem
+	readPaths []string
+}
+
+func (u *unlinkFileSystem) Unlink(ctx *Context, path string) fuse.Status {
+	return fuse.OK
+}
+
+func (u *unlinkFileSystem) Read(ctx *Context, path string, uFh uint32, dest []byte, off uint64) (fuse.ReadResult, fuse.Status) {
+	u.readPaths = append(u.readPaths, path)
+	return fuse.ReadResultData(nil), fuse.OK
+}
+
+type hidingFileSystem struct {
+	unlinkFileSystem
+}
+
+func (h *hidingFileSystem) OrphanPath(ctx *Context, path string) (string, bool) {
+	return ".nfs0001", true
+}
+
+func newUnlinkBridge(fs FileSystem, mock *mockFileSystem) (*rawBridge, uint64) {
+	mock.getAttrFunc = func(path string) (fuse.Attr, fuse.Status) {
+		return fuse.Attr{Ino: 100, Mode: fuse.S_IFREG | 0644}, fuse.OK
+	}
+	b := newMockBridge(mock)
+	b.fs = fs
+
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "f", &fuse.EntryOut{})
+	openOut := &fuse.OpenOut{}
+	b.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 100}}, openOut)
+	return b, openOut.Fh
+}
+
+func TestOrphanKeepsFilePath(t *testing.T) {
+	fs := &unlinkFileSystem{}
+	b, fh := newUnlinkBridge(fs, &fs.mockFileSystem)
+
+	if code := b.Unlink(nil, &fuse.InHeader{NodeId: 1}, "f"); !code.Ok() {
+		t.Fatal(code)
+	}
+
+	readIn := &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: 100}, Fh: fh, Size: 1}
+	if _, code := b.Read(nil, readIn, make([]byte, 1)); !code.Ok() {
+		t.Fatal(code)
+	}
+	if len(fs.readPaths) != 1 || fs.readPaths[0] != "f" {
+		t.Errorf("want read of f, have %v", fs.readPaths)
+	}
+
+	// without a handle, the orphan has no path.
+	if code := b.Access(nil, &fuse.AccessIn{InHeader: fuse.InHeader{NodeId: 100}}); code != fuse.Status(syscall.ESTALE) {
+		t.Errorf("want ESTALE, have %v", code)
+	}
+}
+
+func TestOrphanPather(t *testing.T) {
+	fs := &hidingFileSystem{}
+	b, fh := newUnlinkBridge(fs, &fs.mockFileSystem)
+
+	b.Unlink(nil, &fuse.InHeader{NodeId: 1}, "f")
+
+	readIn := &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: 100}, Fh: fh, Size: 1}
+	b.Read(nil, readIn, make([]byte, 1))
+	if len(fs.readPaths) != 1 || fs.readPaths[0] != ".nfs0001" {
+		t.Errorf("want read of the hidden path, have %v", fs.readPaths)
+	}
+}
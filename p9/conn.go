@@ -0,0 +1,362 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package p9
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+)
+
+// fid is the state of a fid. path is guarded by conn.mu, the rest by
+// mu.
+type fid struct {
+	path string
+	uid  uint32
+	gid  uint32
+
+	mu    sync.Mutex
+	open  bool
+	isDir bool
+	file  *pathfs.File
+
+	// dirents is the listing of an open directory, taken at offset 0.
+	dirents []fuse.DirEntry
+
+	// xattr is set for the fids of Txattrwalk and Txattrcreate.
+	xattr *xattrState
+}
+
+// uFh returns the uFh of the open file of f, for the FileSystem
+// methods that take one. f.mu must be held.
+func (f *fid) uFh() uint32 {
+	if f.file == nil {
+		return 0
+	}
+	return f.file.UFh()
+}
+
+type xattrState struct {
+	name  string
+	data  []byte
+	write bool
+	size  uint64
+	flags uint32
+}
+
+// request is an outstanding request, for Tflush.
+type request struct {
+	cancel chan struct{}
+	done   chan struct{}
+}
+
+// abort cancels r, once.
+func (r *request) abort() {
+	select {
+	case <-r.cancel:
+	default:
+		close(r.cancel)
+	}
+}
+
+type conn struct {
+	srv *Server
+	rw  io.ReadWriteCloser
+
+	wmu sync.Mutex
+
+	// msize is only changed by Tversion, when no request is running.
+	msize uint32
+
+	mu      sync.Mutex
+	fids    map[uint32]*fid
+	pending map[uint16]*request
+	running sync.WaitGroup
+}
+
+func newConn(srv *Server, rw io.ReadWriteCloser) *conn {
+	return &conn{
+		srv:     srv,
+		rw:      rw,
+		msize:   srv.options.MaxMessageSize,
+		fids:    make(map[uint32]*fid),
+		pending: make(map[uint16]*request),
+	}
+}
+
+func (c *conn) serve() error {
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(c.rw, size[:]); err != nil {
+			return err
+		}
+		n := binary.LittleEndian.Uint32(size[:])
+		if n < headerSize || n > c.msize {
+			return fmt.Errorf("p9: bad message size %d", n)
+		}
+		msg := make([]byte, n-4)
+		if _, err := io.ReadFull(c.rw, msg); err != nil {
+			return err
+		}
+		typ, tag := msg[0], binary.LittleEndian.Uint16(msg[1:])
+		d := &decoder{buf: msg[3:]}
+
+		switch typ {
+		case msgTversion:
+			// Tversion aborts everything else.
+			c.abortAll()
+			c.running.Wait()
+			if err := c.write(c.version(tag, d)); err != nil {
+				return err
+			}
+		case msgTflush:
+			c.flush(tag, d)
+		default:
+			c.start(typ, tag, d)
+		}
+	}
+}
+
+// start runs a request in its own goroutine.
+func (c *conn) start(typ uint8, tag uint16, d *decoder) {
+	r := &request{cancel: make(chan struct{}), done: make(chan struct{})}
+	c.mu.Lock()
+	if _, ok := c.pending[tag]; ok {
+		c.mu.Unlock()
+		c.srv.logf("p9: tag %d is in use", tag)
+		c.write(lerror(tag, fuse.EINVAL))
+		return
+	}
+	c.pending[tag] = r
+	c.mu.Unlock()
+
+	c.running.Add(1)
+	go func() {
+		defer c.running.Done()
+		reply := c.handle(typ, tag, d, r.cancel)
+		if d.err != nil {
+			c.srv.logf("p9: message %d: %v", typ, d.err)
+			reply = lerror(tag, fuse.EINVAL)
+		}
+		// The tag is retired as the reply is sent, since the client may
+		// reuse it once it sees the reply. The reply must also come
+		// before the Rflush of a flush of it.
+		c.mu.Lock()
+		c.write(reply)
+		delete(c.pending, tag)
+		c.mu.Unlock()
+		close(r.done)
+	}()
+}
+
+// flush cancels the request oldtag and answers once it is done.
+func (c *conn) flush(tag uint16, d *decoder) {
+	oldtag := d.u16()
+	c.mu.Lock()
+	r := c.pending[oldtag]
+	c.mu.Unlock()
+	reply := newEncoder(msgRflush, tag).bytes()
+	if r == nil {
+		c.write(reply)
+		return
+	}
+
+	r.abort()
+	go func() {
+		<-r.done
+		c.write(reply)
+	}()
+}
+
+// abortAll cancels the outstanding requests.
+func (c *conn) abortAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range c.pending {
+		r.abort()
+	}
+}
+
+func (c *conn) write(msg []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.rw.Write(msg)
+	return err
+}
+
+// shutdown waits for the running requests and releases all fids.
+func (c *conn) shutdown() {
+	c.running.Wait()
+	c.mu.Lock()
+	fids := c.fids
+	c.fids = make(map[uint32]*fid)
+	c.mu.Unlock()
+	for _, f := range fids {
+		c.release(f, nil)
+	}
+}
+
+func (c *conn) version(tag uint16, d *decoder) []byte {
+	msize, version := d.u32(), d.str()
+	if d.err != nil {
+		return lerror(tag, fuse.EINVAL)
+	}
+	c.shutdown()
+
+	if msize > c.srv.options.MaxMessageSize {
+		msize = c.srv.options.MaxMessageSize
+	}
+	if msize < 512 {
+		msize = 512
+	}
+	c.msize = msize
+	if version != Version {
+		version = "unknown"
+	}
+
+	e := newEncoder(msgRversion, tag)
+	e.u32(msize)
+	e.str(version)
+	return e.bytes()
+}
+
+// fid returns fid n, or nil.
+func (c *conn) fid(n uint32) *fid {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fids[n]
+}
+
+// pathOf returns the current path of f.
+func (c *conn) pathOf(f *fid) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return f.path
+}
+
+// addFid binds n to f. n may only be in use by old, the fid it is
+// derived from.
+func (c *conn) addFid(n uint32, f *fid, old *fid) fuse.Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cur, ok := c.fids[n]; ok && cur != old {
+		return fuse.EBADF
+	}
+	c.fids[n] = f
+	return fuse.OK
+}
+
+// removeFid unbinds n and returns its fid.
+func (c *conn) removeFid(n uint32) *fid {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.fids[n]
+	delete(c.fids, n)
+	return f
+}
+
+// renameFids moves the fids at or below path to newPath.
+func (c *conn) renameFids(path, newPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range c.fids {
+		if f.path == path {
+			f.path = newPath
+		} else if strings.HasPrefix(f.path, path+"/") {
+			f.path = newPath + f.path[len(path):]
+		}
+	}
+}
+
+// context returns the Context of a request of the attach of f, which
+// runs as the attaching user and its primary group.
+func (c *conn) context(f *fid, cancel <-chan struct{}) *pathfs.Context {
+	ctx := &pathfs.Context{}
+	ctx.Caller = fuse.Caller{Owner: fuse.Owner{Uid: f.uid, Gid: f.gid}}
+	ctx.Cancel = cancel
+	return ctx
+}
+
+// primaryGid returns the group of the user uid in the user database,
+// or the overflow gid if there is none: Tattach carries no gid.
+func primaryGid(uid uint32) uint32 {
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return 65534
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return 65534
+	}
+	return uint32(gid)
+}
+
+// qid returns the qid of path, with a synthesized inode number if
+// the FileSystem has none.
+func (c *conn) qid(path string, mode uint32, ino uint64) qid {
+	if ino == 0 {
+		ino = c.srv.inos.Assign(path, "")
+	}
+	return qidOf(mode, ino)
+}
+
+// childPath returns the path of name in dir, rejecting names that
+// are not a single element.
+func childPath(dir, name string) (string, fuse.Status) {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return "", fuse.EINVAL
+	}
+	if dir == "" {
+		return name, fuse.OK
+	}
+	return dir + "/" + name, fuse.OK
+}
+
+// parentPath returns the parent directory of path; the root is its own
+// parent.
+func parentPath(path string) string {
+	if i := strings.LastIndexByte(path, '/'); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// release closes the open file or commits the xattr of f, returning
+// the status of the commit or of Flush.
+func (c *conn) release(f *fid, cancel <-chan struct{}) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ctx := c.context(f, cancel)
+	path := c.pathOf(f)
+	code := fuse.OK
+	if x := f.xattr; x != nil && x.write {
+		if uint64(len(x.data)) != x.size {
+			code = fuse.EINVAL
+		} else if x.size == 0 && x.flags&xattrReplace != 0 {
+			code = c.srv.fs.RemoveXAttr(ctx, path, x.name)
+		} else {
+			code = c.srv.fs.SetXAttr(ctx, path, x.name, x.data, x.flags)
+		}
+	}
+	f.xattr = nil
+
+	if f.file != nil {
+		ctx.Opener = &ctx.Caller.Owner
+		code = f.file.Close(ctx, path)
+	}
+	f.open, f.file, f.dirents = false, nil, nil
+	return code
+}
+
+// xattrReplace is the XATTR_REPLACE flag of setxattr(2).
+const xattrReplace = 0x2
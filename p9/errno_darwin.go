@@ -0,0 +1,73 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package p9
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// linuxErrnos maps the darwin errnos that differ from Linux. Those
+// below 35 are the same.
+var linuxErrnos = map[syscall.Errno]uint32{
+	syscall.EAGAIN:       11,
+	syscall.EDEADLK:      35,
+	syscall.ENAMETOOLONG: 36,
+	syscall.ENOLCK:       37,
+	syscall.ENOSYS:       38,
+	syscall.ENOTEMPTY:    39,
+	syscall.ELOOP:        40,
+	syscall.ENOATTR:      61,
+	syscall.EOVERFLOW:    75,
+	syscall.ENOTSUP:      95,
+	syscall.EOPNOTSUPP:   95,
+	syscall.ETIMEDOUT:    110,
+	syscall.ESTALE:       116,
+	syscall.EDQUOT:       122,
+}
+
+// linuxErrno converts a status to the Linux errno of Rlerror.
+func linuxErrno(code fuse.Status) uint32 {
+	if e, ok := linuxErrnos[syscall.Errno(code)]; ok {
+		return e
+	}
+	if code < 35 {
+		return uint32(code)
+	}
+	return 5 // EIO
+}
+
+// linuxOpenFlags are the open flags of 9P2000.L, which are those of
+// Linux, and their darwin values.
+var linuxOpenFlags = []struct{ linux, host uint32 }{
+	{00000100, syscall.O_CREAT},
+	{00000200, syscall.O_EXCL},
+	{00000400, syscall.O_NOCTTY},
+	{00001000, syscall.O_TRUNC},
+	{00002000, syscall.O_APPEND},
+	{00004000, syscall.O_NONBLOCK},
+	{00200000, syscall.O_DIRECTORY},
+	{00400000, syscall.O_NOFOLLOW},
+	{02000000, syscall.O_CLOEXEC},
+	{04010000, syscall.O_SYNC},
+}
+
+// hostOpenFlags converts the Linux open flags of Tlopen and Tlcreate.
+func hostOpenFlags(flags uint32) uint32 {
+	host := flags & syscall.O_ACCMODE
+	for _, f := range linuxOpenFlags {
+		if flags&f.linux == f.linux {
+			host |= f.host
+		}
+	}
+	return host
+}
+
+// blksize returns the st_blksize of Rgetattr; fuse.Attr has none on
+// darwin.
+func blksize(attr *fuse.Attr) uint64 {
+	return 4096
+}
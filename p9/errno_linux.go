@@ -0,0 +1,22 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package p9
+
+import "github.com/hanwen/go-fuse/v2/fuse"
+
+// linuxErrno converts a status to the Linux errno of Rlerror.
+func linuxErrno(code fuse.Status) uint32 {
+	return uint32(code)
+}
+
+// hostOpenFlags converts the Linux open flags of Tlopen and Tlcreate.
+func hostOpenFlags(flags uint32) uint32 {
+	return flags
+}
+
+// blksize returns the st_blksize of Rgetattr.
+func blksize(attr *fuse.Attr) uint64 {
+	return uint64(attr.Blksize)
+}
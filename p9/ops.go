@@ -0,0 +1,984 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package p9
+
+import (
+	"hash/fnv"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+)
+
+// handle runs a request other than Tversion and Tflush, returning the
+// reply.
+func (c *conn) handle(typ uint8, tag uint16, d *decoder, cancel <-chan struct{}) []byte {
+	var e *encoder
+	var code fuse.Status
+	switch typ {
+	case msgTattach:
+		e, code = c.attach(tag, d, cancel)
+	case msgTwalk:
+		e, code = c.walk(tag, d, cancel)
+	case msgTclunk:
+		e, code = c.clunk(tag, d, cancel)
+	case msgTremove:
+		e, code = c.remove(tag, d, cancel)
+	case msgTstatfs:
+		e, code = c.statfs(tag, d, cancel)
+	case msgTlopen:
+		e, code = c.lopen(tag, d, cancel)
+	case msgTlcreate:
+		e, code = c.lcreate(tag, d, cancel)
+	case msgTread:
+		e, code = c.read(tag, d, cancel)
+	case msgTwrite:
+		e, code = c.writeFile(tag, d, cancel)
+	case msgTfsync:
+		e, code = c.fsync(tag, d, cancel)
+	case msgTgetattr:
+		e, code = c.getattr(tag, d, cancel)
+	case msgTsetattr:
+		e, code = c.setattr(tag, d, cancel)
+	case msgTreaddir:
+		e, code = c.readdir(tag, d, cancel)
+	case msgTreadlink:
+		e, code = c.readlink(tag, d, cancel)
+	case msgTsymlink:
+		e, code = c.symlink(tag, d, cancel)
+	case msgTmknod:
+		e, code = c.mknod(tag, d, cancel)
+	case msgTmkdir:
+		e, code = c.mkdir(tag, d, cancel)
+	case msgTlink:
+		e, code = c.link(tag, d, cancel)
+	case msgTrename:
+		e, code = c.rename(tag, d, cancel)
+	case msgTrenameat:
+		e, code = c.renameat(tag, d, cancel)
+	case msgTunlinkat:
+		e, code = c.unlinkat(tag, d, cancel)
+	case msgTxattrwalk:
+		e, code = c.xattrwalk(tag, d, cancel)
+	case msgTxattrcreate:
+		e, code = c.xattrcreate(tag, d, cancel)
+	case msgTlock:
+		e, code = c.lock(tag, d, cancel)
+	case msgTgetlock:
+		e, code = c.getlock(tag, d, cancel)
+	default:
+		// Tauth, and the 9P2000 messages that .L replaces.
+		code = fuse.Status(syscall.EOPNOTSUPP)
+	}
+	if !code.Ok() {
+		return lerror(tag, code)
+	}
+	return e.bytes()
+}
+
+// fidOf returns the fid read from d.
+func (c *conn) fidOf(d *decoder) (*fid, fuse.Status) {
+	n := d.u32()
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if f := c.fid(n); f != nil {
+		return f, fuse.OK
+	}
+	return nil, fuse.EBADF
+}
+
+// getAttr returns the attr of f, using its open file if any.
+func (c *conn) getAttr(ctx *pathfs.Context, f *fid, path string, out *fuse.Attr) fuse.Status {
+	f.mu.Lock()
+	file := f.file
+	f.mu.Unlock()
+	if file != nil {
+		return file.GetAttr(ctx, path, out)
+	}
+	return c.srv.fs.GetAttr(ctx, path, 0, out)
+}
+
+// entryQid returns the qid of a new entry.
+func (c *conn) entryQid(ctx *pathfs.Context, path string) (qid, fuse.Status) {
+	var attr fuse.Attr
+	if code := c.srv.fs.GetAttr(ctx, path, 0, &attr); !code.Ok() {
+		return qid{}, code
+	}
+	return c.qid(path, attr.Mode, attr.Ino), fuse.OK
+}
+
+func (c *conn) attach(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	n, _, _, _, uid := d.u32(), d.u32(), d.str(), d.str(), d.u32()
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if uid == noUID {
+		uid = 65534
+	}
+
+	f := &fid{uid: uid, gid: primaryGid(uid)}
+	ctx := c.context(f, cancel)
+	var attr fuse.Attr
+	if code := c.srv.fs.GetAttr(ctx, "", 0, &attr); !code.Ok() {
+		return nil, code
+	}
+	if code := c.addFid(n, f, nil); !code.Ok() {
+		return nil, code
+	}
+
+	e := newEncoder(msgRattach, tag)
+	e.qid(c.qid("", attr.Mode, attr.Ino))
+	return e, fuse.OK
+}
+
+func (c *conn) walk(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	f, code := c.fidOf(d)
+	newN, nwname := d.u32(), d.u16()
+	if nwname > maxWalkElements {
+		return nil, fuse.EINVAL
+	}
+	names := make([]string, nwname)
+	for i := range names {
+		names[i] = d.str()
+	}
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+
+	ctx := c.context(f, cancel)
+	path := c.pathOf(f)
+	var qids []qid
+	for i, name := range names {
+		var next string
+		if name == ".." {
+			next = parentPath(path)
+		} else if next, code = childPath(path, name); !code.Ok() {
+			return nil, code
+		}
+		var attr fuse.Attr
+		if code := c.srv.fs.GetAttr(ctx, next, 0, &attr); !code.Ok() {
+			if i == 0 {
+				return nil, code
+			}
+			break
+		}
+		path = next
+		qids = append(qids, c.qid(path, attr.Mode, attr.Ino))
+	}
+
+	if len(qids) == len(names) {
+		if code := c.addFid(newN, &fid{path: path, uid: f.uid, gid: f.gid}, f); !code.Ok() {
+			return nil, code
+		}
+	}
+	e := newEncoder(msgRwalk, tag)
+	e.u16(uint16(len(qids)))
+	for _, q := range qids {
+		e.qid(q)
+	}
+	return e, fuse.OK
+}
+
+func (c *conn) clunk(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	n := d.u32()
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	f := c.removeFid(n)
+	if f == nil {
+		return nil, fuse.EBADF
+	}
+	if code := c.release(f, cancel); !code.Ok() {
+		return nil, code
+	}
+	return newEncoder(msgRclunk, tag), fuse.OK
+}
+
+func (c *conn) remove(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	n := d.u32()
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	// The fid is clunked even if the remove fails.
+	f := c.removeFid(n)
+	if f == nil {
+		return nil, fuse.EBADF
+	}
+	c.release(f, cancel)
+
+	ctx := c.context(f, cancel)
+	path := c.pathOf(f)
+	if path == "" {
+		return nil, fuse.EBUSY
+	}
+	var attr fuse.Attr
+	code := c.srv.fs.GetAttr(ctx, path, 0, &attr)
+	if code.Ok() {
+		if attr.IsDir() {
+			code = c.srv.fs.Rmdir(ctx, path)
+		} else {
+			code = c.srv.fs.Unlink(ctx, path)
+		}
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+	c.srv.inos.Remove(path)
+	return newEncoder(msgRremove, tag), fuse.OK
+}
+
+func (c *conn) statfs(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	f, code := c.fidOf(d)
+	if !code.Ok() {
+		return nil, code
+	}
+	var out fuse.StatfsOut
+	if code := c.srv.fs.StatFs(c.context(f, cancel), c.pathOf(f), &out); !code.Ok() {
+		return nil, code
+	}
+
+	e := newEncoder(msgRstatfs, tag)
+	e.u32(statfsMagic)
+	e.u32(out.Bsize)
+	e.u64(out.Blocks)
+	e.u64(out.Bfree)
+	e.u64(out.Bavail)
+	e.u64(out.Files)
+	e.u64(out.Ffree)
+	e.u64(0) // fsid
+	e.u32(out.NameLen)
+	return e, fuse.OK
+}
+
+func (c *conn) iounit() uint32 {
+	return c.msize - ioHeaderSize
+}
+
+func (c *conn) lopen(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	f, code := c.fidOf(d)
+	flags := hostOpenFlags(d.u32())
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.open || f.xattr != nil {
+		return nil, fuse.EBADF
+	}
+	ctx := c.context(f, cancel)
+	path := c.pathOf(f)
+	var attr fuse.Attr
+	if code := c.srv.fs.GetAttr(ctx, path, 0, &attr); !code.Ok() {
+		return nil, code
+	}
+
+	if attr.IsDir() {
+		f.isDir = true
+	} else {
+		ctx.Opener = &ctx.Caller.Owner
+		flags &^= syscall.O_CREAT | syscall.O_EXCL
+		if f.file, _, _, code = pathfs.OpenFile(ctx, c.srv.fs, path, flags); !code.Ok() {
+			return nil, code
+		}
+	}
+	f.open = true
+
+	e := newEncoder(msgRlopen, tag)
+	e.qid(c.qid(path, attr.Mode, attr.Ino))
+	e.u32(c.iounit())
+	return e, fuse.OK
+}
+
+func (c *conn) lcreate(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	f, code := c.fidOf(d)
+	name, flags, mode, gid := d.str(), hostOpenFlags(d.u32()), d.u32(), d.u32()
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.open || f.xattr != nil {
+		return nil, fuse.EBADF
+	}
+	path, code := childPath(c.pathOf(f), name)
+	if !code.Ok() {
+		return nil, code
+	}
+	ctx := c.context(f, cancel)
+	ctx.Gid = gid
+	ctx.Opener = &ctx.Caller.Owner
+	mode = mode&07777 | syscall.S_IFREG
+	if f.file, _, code = pathfs.CreateFile(ctx, c.srv.fs, path, flags|syscall.O_CREAT, mode); !code.Ok() {
+		return nil, code
+	}
+	f.open = true
+
+	// The fid now stands for the new file.
+	c.mu.Lock()
+	f.path = path
+	c.mu.Unlock()
+
+	var attr fuse.Attr
+	if code := f.file.GetAttr(ctx, path, &attr); !code.Ok() {
+		return nil, code
+	}
+
+	e := newEncoder(msgRlcreate, tag)
+	e.qid(c.qid(path, attr.Mode, attr.Ino))
+	e.u32(c.iounit())
+	return e, fuse.OK
+}
+
+func (c *conn) read(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	f, code := c.fidOf(d)
+	off, count := d.u64(), d.u32()
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+	if count > c.iounit() {
+		count = c.iounit()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e := newEncoder(msgRread, tag)
+	if x := f.xattr; x != nil && !x.write {
+		var data []byte
+		if off < uint64(len(x.data)) {
+			data = x.data[off:]
+		}
+		if uint32(len(data)) > count {
+			data = data[:count]
+		}
+		e.data(data)
+		return e, fuse.OK
+	}
+	if !f.open || f.isDir {
+		return nil, fuse.EBADF
+	}
+
+	ctx := c.context(f, cancel)
+	ctx.Opener = &ctx.Caller.Owner
+	buf := make([]byte, count)
+	res, code := f.file.Read(ctx, c.pathOf(f), buf, off)
+	if !code.Ok() {
+		return nil, code
+	}
+	data, code := res.Bytes(buf)
+	res.Done()
+	if !code.Ok() {
+		return nil, code
+	}
+	e.data(data)
+	return e, fuse.OK
+}
+
+func (c *conn) writeFile(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	f, code := c.fidOf(d)
+	off, count := d.u64(), d.u32()
+	data := d.data(count)
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e := newEncoder(msgRwrite, tag)
+	if x := f.xattr; x != nil && x.write {
+		if off != uint64(len(x.data)) || off+uint64(count) > x.size {
+			return nil, fuse.EINVAL
+		}
+		x.data = append(x.data, data...)
+		e.u32(count)
+		return e, fuse.OK
+	}
+	if !f.open || f.isDir {
+		return nil, fuse.EBADF
+	}
+
+	ctx := c.context(f, cancel)
+	ctx.Opener = &ctx.Caller.Owner
+	written, code := f.file.Write(ctx, c.pathOf(f), data, off)
+	if !code.Ok() {
+		return nil, code
+	}
+	e.u32(written)
+	return e, fuse.OK
+}
+
+func (c *conn) fsync(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	f, code := c.fidOf(d)
+	if !code.Ok() {
+		return nil, code
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.open {
+		return nil, fuse.EBADF
+	}
+	if !f.isDir {
+		ctx := c.context(f, cancel)
+		ctx.Opener = &ctx.Caller.Owner
+		if code := f.file.Fsync(ctx, c.pathOf(f), 0); !code.Ok() && code != fuse.ENOSYS {
+			return nil, code
+		}
+	}
+	return newEncoder(msgRfsync, tag), fuse.OK
+}
+
+func (c *conn) getattr(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	f, code := c.fidOf(d)
+	d.u64() // request_mask; all basic fields are returned.
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+
+	path := c.pathOf(f)
+	var attr fuse.Attr
+	if code := c.getAttr(c.context(f, cancel), f, path, &attr); !code.Ok() {
+		return nil, code
+	}
+
+	e := newEncoder(msgRgetattr, tag)
+	e.u64(getattrBasic)
+	e.qid(c.qid(path, attr.Mode, attr.Ino))
+	e.u32(attr.Mode)
+	e.u32(attr.Uid)
+	e.u32(attr.Gid)
+	e.u64(uint64(attr.Nlink))
+	e.u64(uint64(attr.Rdev))
+	e.u64(attr.Size)
+	e.u64(blksize(&attr))
+	e.u64(attr.Blocks)
+	e.u64(attr.Atime)
+	e.u64(uint64(attr.Atimensec))
+	e.u64(attr.Mtime)
+	e.u64(uint64(attr.Mtimensec))
+	e.u64(attr.Ctime)
+	e.u64(uint64(attr.Ctimensec))
+	e.u64(0) // btime
+	e.u64(0)
+	e.u64(0) // gen
+	e.u64(0) // data_version
+	return e, fuse.OK
+}
+
+func (c *conn) setattr(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	f, code := c.fidOf(d)
+	valid, mode, uid, gid, size := d.u32(), d.u32(), d.u32(), d.u32(), d.u64()
+	atimeSec, atimeNsec, mtimeSec, mtimeNsec := d.u64(), d.u64(), d.u64(), d.u64()
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+
+	f.mu.Lock()
+	file, uFh := f.file, f.uFh()
+	f.mu.Unlock()
+	ctx := c.context(f, cancel)
+	ctx.Opener = &ctx.Caller.Owner
+	path := c.pathOf(f)
+
+	code = fuse.OK
+	if valid&setattrMode != 0 {
+		code = c.srv.fs.Chmod(ctx, path, uFh, mode&07777)
+	}
+	if code.Ok() && valid&(setattrUID|setattrGID) != 0 {
+		if valid&setattrUID == 0 {
+			uid = ^uint32(0)
+		}
+		if valid&setattrGID == 0 {
+			gid = ^uint32(0)
+		}
+		code = c.srv.fs.Chown(ctx, path, uFh, uid, gid)
+	}
+	if code.Ok() && valid&setattrSize != 0 {
+		if file != nil {
+			code = file.Truncate(ctx, path, size)
+		} else {
+			code = c.srv.fs.Truncate(ctx, path, uFh, size)
+		}
+	}
+	if code.Ok() && valid&(setattrAtime|setattrMtime) != 0 {
+		now := time.Now()
+		var a, m *time.Time
+		if valid&setattrAtime != 0 {
+			a = &now
+			if valid&setattrAtimeSet != 0 {
+				t := time.Unix(int64(atimeSec), int64(atimeNsec))
+				a = &t
+			}
+		}
+		if valid&setattrMtime != 0 {
+			m = &now
+			if valid&setattrMtimeSet != 0 {
+				t := time.Unix(int64(mtimeSec), int64(mtimeNsec))
+				m = &t
+			}
+		}
+		code = c.srv.fs.Utimens(ctx, path, uFh, a, m)
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+	return newEncoder(msgRsetattr, tag), fuse.OK
+}
+
+// direntType is the d_type of a mode.
+func direntType(mode uint32) uint8 {
+	return uint8((mode & syscall.S_IFMT) >> 12)
+}
+
+func (c *conn) readdir(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	f, code := c.fidOf(d)
+	off, count := d.u64(), d.u32()
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+	if count > c.iounit() {
+		count = c.iounit()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.open || !f.isDir {
+		return nil, fuse.EBADF
+	}
+	path := c.pathOf(f)
+	if off == 0 || f.dirents == nil {
+		stream, code := c.srv.fs.Lsdir(c.context(f, cancel), path)
+		if !code.Ok() {
+			return nil, code
+		}
+		f.dirents = append(f.dirents[:0],
+			fuse.DirEntry{Name: ".", Mode: syscall.S_IFDIR},
+			fuse.DirEntry{Name: "..", Mode: syscall.S_IFDIR})
+		for _, e := range stream {
+			if e.Name != "." && e.Name != ".." {
+				f.dirents = append(f.dirents, e)
+			}
+		}
+	}
+
+	// Offsets are indexes in the listing, plus one.
+	var entries encoder
+	for i := off; i < uint64(len(f.dirents)); i++ {
+		de := f.dirents[i]
+		if 13+8+1+2+len(de.Name) > int(count)-len(entries.buf) {
+			break
+		}
+		var q qid
+		switch de.Name {
+		case ".":
+			q = c.qid(path, syscall.S_IFDIR, 0)
+		case "..":
+			q = c.qid(parentPath(path), syscall.S_IFDIR, 0)
+		default:
+			child, _ := childPath(path, de.Name)
+			q = c.qid(child, de.Mode, de.Ino)
+		}
+		entries.qid(q)
+		entries.u64(i + 1)
+		entries.u8(direntType(de.Mode))
+		entries.str(de.Name)
+	}
+
+	e := newEncoder(msgRreaddir, tag)
+	e.data(entries.buf)
+	return e, fuse.OK
+}
+
+func (c *conn) readlink(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	f, code := c.fidOf(d)
+	if !code.Ok() {
+		return nil, code
+	}
+	target, code := c.srv.fs.Readlink(c.context(f, cancel), c.pathOf(f))
+	if !code.Ok() {
+		return nil, code
+	}
+	e := newEncoder(msgRreadlink, tag)
+	e.str(target)
+	return e, fuse.OK
+}
+
+// create runs a Tsymlink, Tmknod or Tmkdir in the directory dfid.
+func (c *conn) create(typ uint8, tag uint16, dir *fid, name string, gid uint32, cancel <-chan struct{},
+	op func(ctx *pathfs.Context, path string) fuse.Status) (*encoder, fuse.Status) {
+	path, code := childPath(c.pathOf(dir), name)
+	if !code.Ok() {
+		return nil, code
+	}
+	ctx := c.context(dir, cancel)
+	ctx.Gid = gid
+	if code := op(ctx, path); !code.Ok() {
+		return nil, code
+	}
+	q, code := c.entryQid(ctx, path)
+	if !code.Ok() {
+		return nil, code
+	}
+	e := newEncoder(typ, tag)
+	e.qid(q)
+	return e, fuse.OK
+}
+
+func (c *conn) symlink(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	f, code := c.fidOf(d)
+	name, target, gid := d.str(), d.str(), d.u32()
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+	return c.create(msgRsymlink, tag, f, name, gid, cancel, func(ctx *pathfs.Context, path string) fuse.Status {
+		return c.srv.fs.Symlink(ctx, path, target)
+	})
+}
+
+func (c *conn) mknod(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	f, code := c.fidOf(d)
+	name, mode, major, minor, gid := d.str(), d.u32(), d.u32(), d.u32(), d.u32()
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+	// The encoding of Linux dev_t.
+	dev := minor&0xff | (major&0xfff)<<8 | (minor&^0xff)<<12
+	return c.create(msgRmknod, tag, f, name, gid, cancel, func(ctx *pathfs.Context, path string) fuse.Status {
+		return c.srv.fs.Mknod(ctx, path, mode, dev)
+	})
+}
+
+func (c *conn) mkdir(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	f, code := c.fidOf(d)
+	name, mode, gid := d.str(), d.u32(), d.u32()
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+	return c.create(msgRmkdir, tag, f, name, gid, cancel, func(ctx *pathfs.Context, path string) fuse.Status {
+		return c.srv.fs.Mkdir(ctx, path, mode&07777)
+	})
+}
+
+func (c *conn) link(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	dir, code := c.fidOf(d)
+	f, fcode := c.fidOf(d)
+	name := d.str()
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+	if !fcode.Ok() {
+		return nil, fcode
+	}
+
+	path := c.pathOf(f)
+	newPath, code := childPath(c.pathOf(dir), name)
+	if !code.Ok() {
+		return nil, code
+	}
+	if code := c.srv.fs.Link(c.context(dir, cancel), path, newPath); !code.Ok() {
+		return nil, code
+	}
+	c.srv.inos.Link(path, newPath)
+	return newEncoder(msgRlink, tag), fuse.OK
+}
+
+// renamePath renames path to newPath, and the fids with it.
+func (c *conn) renamePath(ctx *pathfs.Context, path, newPath string) fuse.Status {
+	if path == "" {
+		return fuse.EBUSY
+	}
+	if code := c.srv.fs.Rename(ctx, path, newPath); !code.Ok() {
+		return code
+	}
+	c.srv.inos.Rename(path, newPath)
+	c.renameFids(path, newPath)
+	return fuse.OK
+}
+
+func (c *conn) rename(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	f, code := c.fidOf(d)
+	dir, dcode := c.fidOf(d)
+	name := d.str()
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+	if !dcode.Ok() {
+		return nil, dcode
+	}
+
+	newPath, code := childPath(c.pathOf(dir), name)
+	if !code.Ok() {
+		return nil, code
+	}
+	if code := c.renamePath(c.context(f, cancel), c.pathOf(f), newPath); !code.Ok() {
+		return nil, code
+	}
+	return newEncoder(msgRrename, tag), fuse.OK
+}
+
+func (c *conn) renameat(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	dir, code := c.fidOf(d)
+	name := d.str()
+	newDir, ncode := c.fidOf(d)
+	newName := d.str()
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+	if !ncode.Ok() {
+		return nil, ncode
+	}
+
+	path, code := childPath(c.pathOf(dir), name)
+	if !code.Ok() {
+		return nil, code
+	}
+	newPath, code := childPath(c.pathOf(newDir), newName)
+	if !code.Ok() {
+		return nil, code
+	}
+	if code := c.renamePath(c.context(dir, cancel), path, newPath); !code.Ok() {
+		return nil, code
+	}
+	return newEncoder(msgRrenameat, tag), fuse.OK
+}
+
+func (c *conn) unlinkat(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	dir, code := c.fidOf(d)
+	name, flags := d.str(), d.u32()
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+
+	path, code := childPath(c.pathOf(dir), name)
+	if !code.Ok() {
+		return nil, code
+	}
+	ctx := c.context(dir, cancel)
+	if flags&atRemoveDir != 0 {
+		code = c.srv.fs.Rmdir(ctx, path)
+	} else {
+		code = c.srv.fs.Unlink(ctx, path)
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+	c.srv.inos.Remove(path)
+	return newEncoder(msgRunlinkat, tag), fuse.OK
+}
+
+func (c *conn) xattrwalk(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	f, code := c.fidOf(d)
+	newN, name := d.u32(), d.str()
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+
+	ctx := c.context(f, cancel)
+	path := c.pathOf(f)
+	var data []byte
+	if name == "" {
+		attrs, code := c.srv.fs.ListXAttr(ctx, path)
+		if !code.Ok() {
+			return nil, code
+		}
+		for _, a := range attrs {
+			data = append(data, a...)
+			data = append(data, 0)
+		}
+	} else if data, code = c.srv.fs.GetXAttr(ctx, path, name); !code.Ok() {
+		return nil, code
+	}
+
+	x := &fid{path: path, uid: f.uid, gid: f.gid, xattr: &xattrState{name: name, data: data}}
+	if code := c.addFid(newN, x, f); !code.Ok() {
+		return nil, code
+	}
+	e := newEncoder(msgRxattrwalk, tag)
+	e.u64(uint64(len(data)))
+	return e, fuse.OK
+}
+
+func (c *conn) xattrcreate(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	f, code := c.fidOf(d)
+	name, size, flags := d.str(), d.u64(), d.u32()
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+	if size > uint64(c.msize)*64 {
+		return nil, fuse.Status(syscall.E2BIG)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.open || f.xattr != nil {
+		return nil, fuse.EBADF
+	}
+	// The value is written to the fid and set at Tclunk.
+	f.xattr = &xattrState{name: name, write: true, size: size, flags: flags}
+	return newEncoder(msgRxattrcreate, tag), fuse.OK
+}
+
+// lockOwner derives a lock owner from the client id and pid of a lock
+// request.
+func lockOwner(clientID string, pid uint32) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(clientID))
+	return h.Sum64() ^ uint64(pid)
+}
+
+// fileLock converts the range and type of a lock request.
+func fileLock(typ uint8, start, length uint64, pid uint32) fuse.FileLock {
+	lk := fuse.FileLock{Start: start, End: 1<<63 - 1, Pid: pid}
+	if length != 0 {
+		lk.End = start + length - 1
+	}
+	switch typ {
+	case lockTypeRead:
+		lk.Typ = syscall.F_RDLCK
+	case lockTypeWrite:
+		lk.Typ = syscall.F_WRLCK
+	default:
+		lk.Typ = syscall.F_UNLCK
+	}
+	return lk
+}
+
+func (c *conn) lock(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	f, code := c.fidOf(d)
+	typ, flags, start, length, pid, clientID := d.u8(), d.u32(), d.u64(), d.u64(), d.u32(), d.str()
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+
+	f.mu.Lock()
+	uFh, open := f.uFh(), f.open
+	f.mu.Unlock()
+	if !open {
+		return nil, fuse.EBADF
+	}
+	ctx := c.context(f, cancel)
+	ctx.Opener = &ctx.Caller.Owner
+	lk := fileLock(typ, start, length, pid)
+	owner := lockOwner(clientID, pid)
+	if flags&lockFlagBlock != 0 {
+		code = c.srv.fs.SetLkw(ctx, c.pathOf(f), uFh, owner, &lk, 0)
+	} else {
+		code = c.srv.fs.SetLk(ctx, c.pathOf(f), uFh, owner, &lk, 0)
+	}
+
+	e := newEncoder(msgRlock, tag)
+	switch code {
+	case fuse.OK:
+		e.u8(lockSuccess)
+	case fuse.EAGAIN:
+		e.u8(lockBlocked)
+	case fuse.ENOSYS:
+		return nil, code
+	default:
+		e.u8(lockError)
+	}
+	return e, fuse.OK
+}
+
+func (c *conn) getlock(tag uint16, d *decoder, cancel <-chan struct{}) (*encoder, fuse.Status) {
+	f, code := c.fidOf(d)
+	typ, start, length, pid, clientID := d.u8(), d.u64(), d.u64(), d.u32(), d.str()
+	if d.err != nil {
+		return nil, fuse.EINVAL
+	}
+	if !code.Ok() {
+		return nil, code
+	}
+
+	f.mu.Lock()
+	uFh, open := f.uFh(), f.open
+	f.mu.Unlock()
+	if !open {
+		return nil, fuse.EBADF
+	}
+	ctx := c.context(f, cancel)
+	ctx.Opener = &ctx.Caller.Owner
+	lk := fileLock(typ, start, length, pid)
+	var out fuse.FileLock
+	if code := c.srv.fs.GetLk(ctx, c.pathOf(f), uFh, lockOwner(clientID, pid), &lk, 0, &out); !code.Ok() {
+		return nil, code
+	}
+
+	e := newEncoder(msgRgetlock, tag)
+	switch out.Typ {
+	case syscall.F_RDLCK:
+		e.u8(lockTypeRead)
+	case syscall.F_WRLCK:
+		e.u8(lockTypeWrite)
+	default:
+		e.u8(lockTypeUnlock)
+	}
+	e.u64(out.Start)
+	if out.End == 1<<63-1 {
+		e.u64(0)
+	} else {
+		e.u64(out.End - out.Start + 1)
+	}
+	e.u32(out.Pid)
+	e.str(clientID)
+	return e, fuse.OK
+}
@@ -0,0 +1,270 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package p9
+
+import (
+	"encoding/binary"
+	"errors"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Message types of 9P2000.L, and of 9P2000 where .L reuses them.
+const (
+	msgTlerror      = 6
+	msgRlerror      = 7
+	msgTstatfs      = 8
+	msgRstatfs      = 9
+	msgTlopen       = 12
+	msgRlopen       = 13
+	msgTlcreate     = 14
+	msgRlcreate     = 15
+	msgTsymlink     = 16
+	msgRsymlink     = 17
+	msgTmknod       = 18
+	msgRmknod       = 19
+	msgTrename      = 20
+	msgRrename      = 21
+	msgTreadlink    = 22
+	msgRreadlink    = 23
+	msgTgetattr     = 24
+	msgRgetattr     = 25
+	msgTsetattr     = 26
+	msgRsetattr     = 27
+	msgTxattrwalk   = 30
+	msgRxattrwalk   = 31
+	msgTxattrcreate = 32
+	msgRxattrcreate = 33
+	msgTreaddir     = 40
+	msgRreaddir     = 41
+	msgTfsync       = 50
+	msgRfsync       = 51
+	msgTlock        = 52
+	msgRlock        = 53
+	msgTgetlock     = 54
+	msgRgetlock     = 55
+	msgTlink        = 70
+	msgRlink        = 71
+	msgTmkdir       = 72
+	msgRmkdir       = 73
+	msgTrenameat    = 74
+	msgRrenameat    = 75
+	msgTunlinkat    = 76
+	msgRunlinkat    = 77
+	msgTversion     = 100
+	msgRversion     = 101
+	msgTauth        = 102
+	msgRauth        = 103
+	msgTattach      = 104
+	msgRattach      = 105
+	msgTflush       = 108
+	msgRflush       = 109
+	msgTwalk        = 110
+	msgRwalk        = 111
+	msgTread        = 116
+	msgRread        = 117
+	msgTwrite       = 118
+	msgRwrite       = 119
+	msgTclunk       = 120
+	msgRclunk       = 121
+	msgTremove      = 122
+	msgRremove      = 123
+)
+
+const (
+	// Version is the only protocol version served.
+	Version = "9P2000.L"
+
+	noTag = 0xffff
+	noFid = 0xffffffff
+
+	// noUID is the n_uname of an attach without a numeric uid.
+	noUID = 0xffffffff
+
+	// headerSize is the size of size[4] type[1] tag[2].
+	headerSize = 7
+
+	// ioHeaderSize is the overhead of Rread and Twrite, the
+	// P9_IOHDRSZ of Linux.
+	ioHeaderSize = 24
+
+	// maxWalkElements is the most names of a Twalk.
+	maxWalkElements = 16
+)
+
+// Qid types.
+const (
+	qtDir     = 0x80
+	qtSymlink = 0x02
+	qtFile    = 0x00
+)
+
+// Getattr and Setattr masks.
+const (
+	getattrBasic = 0x000007ff
+
+	setattrMode     = 0x00000001
+	setattrUID      = 0x00000002
+	setattrGID      = 0x00000004
+	setattrSize     = 0x00000008
+	setattrAtime    = 0x00000010
+	setattrMtime    = 0x00000020
+	setattrAtimeSet = 0x00000080
+	setattrMtimeSet = 0x00000100
+)
+
+// Tlock types, flags and statuses.
+const (
+	lockTypeRead   = 0
+	lockTypeWrite  = 1
+	lockTypeUnlock = 2
+
+	lockFlagBlock = 1
+
+	lockSuccess = 0
+	lockBlocked = 1
+	lockError   = 2
+)
+
+// Tunlinkat flags.
+const atRemoveDir = 0x200
+
+// statfsMagic is the f_type of v9fs.
+const statfsMagic = 0x01021997
+
+// qid identifies a file on the server.
+type qid struct {
+	Type    uint8
+	Version uint32
+	Path    uint64
+}
+
+// qidOf returns the qid of a file with the attr mode and inode number.
+func qidOf(mode uint32, ino uint64) qid {
+	q := qid{Type: qtFile, Path: ino}
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		q.Type = qtDir
+	case syscall.S_IFLNK:
+		q.Type = qtSymlink
+	}
+	return q
+}
+
+var errShort = errors.New("p9: message too short")
+
+// decoder reads the fields of a message. The first failure is kept in
+// err; later reads return zero values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = errShort
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8 {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) u16() uint16 {
+	if b := d.take(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) u32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) u64() uint64 {
+	if b := d.take(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) str() string {
+	n := d.u16()
+	return string(d.take(int(n)))
+}
+
+func (d *decoder) data(n uint32) []byte {
+	return d.take(int(n))
+}
+
+// encoder builds a message, leaving room for the header.
+type encoder struct {
+	buf []byte
+}
+
+func newEncoder(typ uint8, tag uint16) *encoder {
+	e := &encoder{buf: make([]byte, headerSize, 64)}
+	e.buf[4] = typ
+	binary.LittleEndian.PutUint16(e.buf[5:], tag)
+	return e
+}
+
+func (e *encoder) u8(v uint8) { e.buf = append(e.buf, v) }
+
+func (e *encoder) u16(v uint16) {
+	e.buf = append(e.buf, byte(v), byte(v>>8))
+}
+
+func (e *encoder) u32(v uint32) {
+	e.buf = append(e.buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (e *encoder) u64(v uint64) {
+	e.u32(uint32(v))
+	e.u32(uint32(v >> 32))
+}
+
+func (e *encoder) str(s string) {
+	e.u16(uint16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) qid(q qid) {
+	e.u8(q.Type)
+	e.u32(q.Version)
+	e.u64(q.Path)
+}
+
+func (e *encoder) data(b []byte) {
+	e.u32(uint32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// bytes finishes the message.
+func (e *encoder) bytes() []byte {
+	binary.LittleEndian.PutUint32(e.buf, uint32(len(e.buf)))
+	return e.buf
+}
+
+// lerror returns an Rlerror for code.
+func lerror(tag uint16, code fuse.Status) []byte {
+	e := newEncoder(msgRlerror, tag)
+	e.u32(linuxErrno(code))
+	return e.bytes()
+}
@@ -0,0 +1,99 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package p9 serves a pathfs.FileSystem over 9P2000.L, the dialect of
+// the Linux v9fs client, QEMU and gVisor.
+//
+// A connection maps each fid to a path and, once opened, to the uFh or
+// pathfs.FileHandle of the FileSystem, much like the FUSE bridge maps
+// inodes. Fids are renamed along with Trename and Trenameat on the
+// same connection. Requests run as the n_uname of Tattach, with the
+// primary group of that user. Authentication is not supported.
+package p9
+
+import (
+	"io"
+	"log"
+	"net"
+
+	"github.com/someonegg/pathfs"
+)
+
+// DefaultMaxMessageSize is the msize offered to clients when
+// Options.MaxMessageSize is not set.
+const DefaultMaxMessageSize = 1 << 20
+
+// Options sets options for a Server.
+type Options struct {
+	// MaxMessageSize bounds the msize negotiated by Tversion.
+	MaxMessageSize uint32
+
+	// Logger is a sink for diagnostic messages, such as malformed
+	// requests. If unset, no messages are printed.
+	Logger *log.Logger
+}
+
+// Server serves a FileSystem to any number of 9P connections.
+type Server struct {
+	fs      pathfs.FileSystem
+	options Options
+
+	// inos synthesizes qid paths for the FileSystem's Ino 0.
+	inos *pathfs.InoAllocator
+}
+
+// NewServer returns a Server for fs. options may be nil.
+func NewServer(fs pathfs.FileSystem, options *Options) *Server {
+	s := &Server{
+		fs:   fs,
+		inos: pathfs.NewInoAllocator(),
+	}
+	if options != nil {
+		s.options = *options
+	}
+	if s.options.MaxMessageSize == 0 {
+		s.options.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if s.options.MaxMessageSize < 4096 {
+		s.options.MaxMessageSize = 4096
+	}
+	return s
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.options.Logger != nil {
+		s.options.Logger.Printf(format, args...)
+	}
+}
+
+// Serve serves the connections accepted from l, each in its own
+// goroutine, until Accept fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := s.ServeConn(c); err != nil {
+				s.logf("p9: %v: %v", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn serves a single connection, such as a socket or the pipe
+// of a virtio transport, until it is closed or a message is malformed.
+// It closes rw, releases the open files of the connection, and returns
+// nil at EOF.
+func (s *Server) ServeConn(rw io.ReadWriteCloser) error {
+	c := newConn(s, rw)
+	err := c.serve()
+	rw.Close()
+	c.shutdown()
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
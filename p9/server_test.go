@@ -0,0 +1,452 @@
+package p9
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+)
+
+// testClient speaks 9P2000.L to a Server, one request at a time.
+type testClient struct {
+	t  *testing.T
+	rw net.Conn
+}
+
+func newTestClient(t *testing.T, fs pathfs.FileSystem) *testClient {
+	sock := filepath.Join(t.TempDir(), "9p.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewServer(fs, nil).Serve(l)
+	client, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		l.Close()
+	})
+
+	c := &testClient{t: t, rw: client}
+	d, errno := c.rpc(msgTversion, func(e *encoder) {
+		e.u32(8192)
+		e.str(Version)
+	})
+	if errno != 0 {
+		t.Fatalf("Tversion: %v", errno)
+	}
+	if msize, version := d.u32(), d.str(); msize != 8192 || version != Version {
+		t.Fatalf("Rversion: %d %q", msize, version)
+	}
+	return c
+}
+
+// rpc sends a request and returns the decoder of its reply, or the
+// errno of an Rlerror.
+func (c *testClient) rpc(typ uint8, fill func(e *encoder)) (*decoder, syscall.Errno) {
+	e := newEncoder(typ, 1)
+	if typ == msgTversion {
+		e = newEncoder(typ, noTag)
+	}
+	fill(e)
+	if _, err := c.rw.Write(e.bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+
+	rtyp, d := c.reply()
+	switch rtyp {
+	case msgRlerror:
+		return nil, syscall.Errno(d.u32())
+	case typ + 1:
+		return d, 0
+	}
+	c.t.Fatalf("reply %d to message %d", rtyp, typ)
+	return nil, 0
+}
+
+// reply reads a reply, returning its type and the decoder of its body.
+func (c *testClient) reply() (uint8, *decoder) {
+	var size [4]byte
+	if _, err := io.ReadFull(c.rw, size[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	msg := make([]byte, binary.LittleEndian.Uint32(size[:])-4)
+	if _, err := io.ReadFull(c.rw, msg); err != nil {
+		c.t.Fatal(err)
+	}
+	return msg[0], &decoder{buf: msg[3:]}
+}
+
+// must is rpc for requests that must succeed.
+func (c *testClient) must(typ uint8, fill func(e *encoder)) *decoder {
+	c.t.Helper()
+	d, errno := c.rpc(typ, fill)
+	if errno != 0 {
+		c.t.Fatalf("message %d: %v", typ, errno)
+	}
+	return d
+}
+
+func (c *testClient) walk(fid, newfid uint32, names ...string) (int, syscall.Errno) {
+	d, errno := c.rpc(msgTwalk, func(e *encoder) {
+		e.u32(fid)
+		e.u32(newfid)
+		e.u16(uint16(len(names)))
+		for _, name := range names {
+			e.str(name)
+		}
+	})
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(d.u16()), 0
+}
+
+func (c *testClient) clunk(fid uint32) {
+	c.t.Helper()
+	c.must(msgTclunk, func(e *encoder) { e.u32(fid) })
+}
+
+func (c *testClient) readdir(fid uint32) []string {
+	c.t.Helper()
+	var names []string
+	var off uint64
+	for {
+		d := c.must(msgTreaddir, func(e *encoder) {
+			e.u32(fid)
+			e.u64(off)
+			e.u32(64)
+		})
+		entries := &decoder{buf: d.data(d.u32())}
+		if len(entries.buf) == 0 {
+			return names
+		}
+		for len(entries.buf) > 0 {
+			entries.take(13)
+			off = entries.u64()
+			entries.u8()
+			names = append(names, entries.str())
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, pathfs.NewTestFileSystem(dir))
+
+	d := c.must(msgTattach, func(e *encoder) {
+		e.u32(0)
+		e.u32(noFid)
+		e.str("")
+		e.str("")
+		e.u32(uint32(os.Getuid()))
+	})
+	if typ := d.u8(); typ != qtDir {
+		t.Fatalf("root qid type %d", typ)
+	}
+
+	if _, errno := c.walk(0, 1, "missing"); errno != syscall.ENOENT {
+		t.Fatalf("walk missing: %v", errno)
+	}
+	if n, errno := c.walk(0, 1, "sub", "missing"); errno != 0 || n != 1 {
+		t.Fatalf("partial walk: %d %v", n, errno)
+	}
+	if n, errno := c.walk(0, 1, "sub", ".."); errno != 0 || n != 2 {
+		t.Fatalf("walk: %d %v", n, errno)
+	}
+	c.clunk(1)
+
+	// Create and write sub/f.
+	if _, errno := c.walk(0, 1, "sub"); errno != 0 {
+		t.Fatal(errno)
+	}
+	c.must(msgTlcreate, func(e *encoder) {
+		e.u32(1)
+		e.str("f")
+		e.u32(syscall.O_RDWR)
+		e.u32(0644)
+		e.u32(uint32(os.Getgid()))
+	})
+	data := []byte("hello, 9p")
+	d = c.must(msgTwrite, func(e *encoder) {
+		e.u32(1)
+		e.u64(0)
+		e.data(data)
+	})
+	if n := d.u32(); n != uint32(len(data)) {
+		t.Fatalf("wrote %d", n)
+	}
+	d = c.must(msgTread, func(e *encoder) {
+		e.u32(1)
+		e.u64(7)
+		e.u32(100)
+	})
+	if got := string(d.data(d.u32())); got != "9p" {
+		t.Fatalf("read %q", got)
+	}
+	c.clunk(1)
+
+	// Stat it.
+	if _, errno := c.walk(0, 1, "sub", "f"); errno != 0 {
+		t.Fatal(errno)
+	}
+	d = c.must(msgTgetattr, func(e *encoder) {
+		e.u32(1)
+		e.u64(getattrBasic)
+	})
+	d.u64()
+	d.take(13)
+	if mode := d.u32(); mode != syscall.S_IFREG|0644 {
+		t.Fatalf("mode %o", mode)
+	}
+	d.take(4 + 4 + 8 + 8)
+	if size := d.u64(); size != uint64(len(data)) {
+		t.Fatalf("size %d", size)
+	}
+
+	// Rename it; fid 1 follows.
+	if _, errno := c.walk(0, 2, "sub"); errno != 0 {
+		t.Fatal(errno)
+	}
+	c.must(msgTrenameat, func(e *encoder) {
+		e.u32(2)
+		e.str("f")
+		e.u32(0)
+		e.str("g")
+	})
+	c.must(msgTlopen, func(e *encoder) {
+		e.u32(1)
+		e.u32(syscall.O_RDONLY)
+	})
+	d = c.must(msgTread, func(e *encoder) {
+		e.u32(1)
+		e.u64(0)
+		e.u32(100)
+	})
+	if got := string(d.data(d.u32())); got != string(data) {
+		t.Fatalf("read %q", got)
+	}
+	c.clunk(1)
+	if _, err := os.Stat(filepath.Join(dir, "g")); err != nil {
+		t.Fatal(err)
+	}
+
+	// List sub, across several Treaddirs.
+	for _, name := range []string{"a", "b", "c"} {
+		c.must(msgTmkdir, func(e *encoder) {
+			e.u32(2)
+			e.str(name)
+			e.u32(0755)
+			e.u32(uint32(os.Getgid()))
+		})
+	}
+	c.must(msgTlopen, func(e *encoder) {
+		e.u32(2)
+		e.u32(syscall.O_RDONLY)
+	})
+	got := map[string]bool{}
+	for _, name := range c.readdir(2) {
+		got[name] = true
+	}
+	for _, name := range []string{".", "..", "a", "b", "c"} {
+		if !got[name] {
+			t.Errorf("readdir: missing %q in %v", name, got)
+		}
+	}
+	if len(got) != 5 {
+		t.Errorf("readdir: %v", got)
+	}
+
+	c.must(msgTunlinkat, func(e *encoder) {
+		e.u32(2)
+		e.str("a")
+		e.u32(atRemoveDir)
+	})
+	if _, err := os.Stat(filepath.Join(dir, "sub", "a")); !os.IsNotExist(err) {
+		t.Fatalf("unlinkat: %v", err)
+	}
+	c.clunk(2)
+
+	if _, errno := c.rpc(msgTclunk, func(e *encoder) { e.u32(2) }); errno != syscall.EBADF {
+		t.Fatalf("clunk twice: %v", errno)
+	}
+}
+
+func TestServerXAttr(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, pathfs.NewTestFileSystem(dir))
+	c.must(msgTattach, func(e *encoder) {
+		e.u32(0)
+		e.u32(noFid)
+		e.str("")
+		e.str("")
+		e.u32(uint32(os.Getuid()))
+	})
+
+	value := []byte("v")
+	if _, errno := c.walk(0, 1, "f"); errno != 0 {
+		t.Fatal(errno)
+	}
+	c.must(msgTxattrcreate, func(e *encoder) {
+		e.u32(1)
+		e.str("user.k")
+		e.u64(uint64(len(value)))
+		e.u32(0)
+	})
+	c.must(msgTwrite, func(e *encoder) {
+		e.u32(1)
+		e.u64(0)
+		e.data(value)
+	})
+	c.clunk(1)
+
+	if _, errno := c.walk(0, 1, "f"); errno != 0 {
+		t.Fatal(errno)
+	}
+	d := c.must(msgTxattrwalk, func(e *encoder) {
+		e.u32(1)
+		e.u32(2)
+		e.str("")
+	})
+	if size := d.u64(); size != uint64(len("user.k\x00")) {
+		t.Fatalf("list size %d", size)
+	}
+	c.clunk(2)
+
+	c.must(msgTxattrwalk, func(e *encoder) {
+		e.u32(1)
+		e.u32(2)
+		e.str("user.k")
+	})
+	d = c.must(msgTread, func(e *encoder) {
+		e.u32(2)
+		e.u64(0)
+		e.u32(100)
+	})
+	if got := string(d.data(d.u32())); got != string(value) {
+		t.Fatalf("xattr %q", got)
+	}
+}
+
+// blockingFS blocks GetAttr of "slow" until the request is canceled,
+// and records the gid of the callers.
+type blockingFS struct {
+	pathfs.FileSystem
+
+	mu   sync.Mutex
+	gids []uint32
+}
+
+func (b *blockingFS) GetAttr(ctx *pathfs.Context, path string, uFh uint32, out *fuse.Attr) fuse.Status {
+	b.mu.Lock()
+	b.gids = append(b.gids, ctx.Gid)
+	b.mu.Unlock()
+	if path == "slow" {
+		<-ctx.Cancel
+		return fuse.EINTR
+	}
+	return b.FileSystem.GetAttr(ctx, path, uFh, out)
+}
+
+func TestServerVersionAborts(t *testing.T) {
+	fs := &blockingFS{FileSystem: pathfs.NewTestFileSystem(t.TempDir())}
+	c := newTestClient(t, fs)
+
+	// Tattach has no gid: the user's primary group is used.
+	want := uint32(65534)
+	if u, err := user.LookupId("1"); err == nil {
+		gid, _ := strconv.Atoi(u.Gid)
+		want = uint32(gid)
+	}
+	c.must(msgTattach, func(e *encoder) {
+		e.u32(0)
+		e.u32(noFid)
+		e.str("")
+		e.str("")
+		e.u32(1)
+	})
+	fs.mu.Lock()
+	if len(fs.gids) != 1 || fs.gids[0] != want {
+		t.Errorf("want gid %d, have %v", want, fs.gids)
+	}
+	fs.mu.Unlock()
+
+	// a request stuck in the FileSystem doesn't hold up Tversion.
+	e := newEncoder(msgTwalk, 1)
+	e.u32(0)
+	e.u32(1)
+	e.u16(1)
+	e.str("slow")
+	if _, err := c.rw.Write(e.bytes()); err != nil {
+		t.Fatal(err)
+	}
+	e = newEncoder(msgTversion, noTag)
+	e.u32(8192)
+	e.str(Version)
+	if _, err := c.rw.Write(e.bytes()); err != nil {
+		t.Fatal(err)
+	}
+	c.rw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if typ, d := c.reply(); typ != msgRlerror || syscall.Errno(d.u32()) != syscall.EINTR {
+		t.Errorf("want the walk interrupted, have reply %d", typ)
+	}
+	if typ, _ := c.reply(); typ != msgRversion {
+		t.Errorf("want Rversion, have reply %d", typ)
+	}
+}
+
+// flushFailFS fails Flush.
+type flushFailFS struct {
+	pathfs.FileSystem
+}
+
+func (f *flushFailFS) Flush(ctx *pathfs.Context, path string, uFh uint32, lockOwner uint64) fuse.Status {
+	return fuse.EIO
+}
+
+func TestServerClunkFlush(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, &flushFailFS{FileSystem: pathfs.NewTestFileSystem(dir)})
+	c.must(msgTattach, func(e *encoder) {
+		e.u32(0)
+		e.u32(noFid)
+		e.str("")
+		e.str("")
+		e.u32(uint32(os.Getuid()))
+	})
+	if _, errno := c.walk(0, 1, "f"); errno != 0 {
+		t.Fatal(errno)
+	}
+	c.must(msgTlopen, func(e *encoder) {
+		e.u32(1)
+		e.u32(syscall.O_RDONLY)
+	})
+	if _, errno := c.rpc(msgTclunk, func(e *encoder) { e.u32(1) }); errno != syscall.EIO {
+		t.Errorf("want the EIO of Flush, have %v", errno)
+	}
+	// the fid is gone all the same.
+	if _, errno := c.rpc(msgTclunk, func(e *encoder) { e.u32(1) }); errno != syscall.EBADF {
+		t.Errorf("want EBADF, have %v", errno)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Access masks, as in access(2).
+const (
+	permExec  = 1
+	permWrite = 2
+	permRead  = 4
+)
+
+// supplementaryGroups returns the supplementary groups of a process.
+var supplementaryGroups = groupsOf
+
+// checkPerm enforces Options.DefaultPermissions: it fails with EACCES
+// unless the caller has the mask permissions on n.
+func (b *rawBridge) checkPerm(ctx *Context, n *inode, mask uint32) fuse.Status {
+	if !b.options.DefaultPermissions {
+		return fuse.OK
+	}
+
+	var attr fuse.Attr
+	if code := b.permAttr(ctx, n, &attr); !code.Ok() {
+		return code
+	}
+	if !hasPermission(&ctx.kernel, &attr, mask) {
+		return fuse.EACCES
+	}
+	return fuse.OK
+}
+
+// checkSticky enforces the restricted deletion flag: in a sticky
+// directory, only the owner of the entry or of the directory may
+// remove or rename it.
+func (b *rawBridge) checkSticky(ctx *Context, parent *inode, name string) fuse.Status {
+	if !b.options.DefaultPermissions || ctx.kernel.Uid == 0 {
+		return fuse.OK
+	}
+
+	var dir fuse.Attr
+	if code := b.permAttr(ctx, parent, &dir); !code.Ok() {
+		return code
+	}
+	if dir.Mode&syscall.S_ISVTX == 0 || dir.Uid == ctx.kernel.Uid {
+		return fuse.OK
+	}
+
+	var attr fuse.Attr
+	path, code := b.entryPath(parent, name)
+	if !code.Ok() {
+		return code
+	}
+	code = b.fs.GetAttr(ctx, path, 0, &attr)
+	if !code.Ok() {
+		return code
+	}
+	b.setAttrInner(path, &attr)
+	if attr.Uid != ctx.kernel.Uid {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+// checkSetAttr applies the ownership rules of chmod, chown, truncate
+// and utimes.
+func (b *rawBridge) checkSetAttr(ctx *Context, n *inode, input *fuse.SetAttrIn) fuse.Status {
+	if !b.options.DefaultPermissions || ctx.kernel.Uid == 0 {
+		return fuse.OK
+	}
+
+	var attr fuse.Attr
+	if code := b.permAttr(ctx, n, &attr); !code.Ok() {
+		return code
+	}
+	owner := attr.Uid == ctx.kernel.Uid
+
+	if _, ok := input.GetMode(); ok && !owner {
+		return fuse.EPERM
+	}
+	if uid, ok := input.GetUID(); ok && uid != attr.Uid {
+		return fuse.EPERM
+	}
+	if gid, ok := input.GetGID(); ok && gid != attr.Gid {
+		if !owner || !inGroup(&ctx.kernel, gid) {
+			return fuse.EPERM
+		}
+	}
+
+	_, hasFh := input.GetFh()
+	if _, ok := input.GetSize(); ok && !hasFh && !hasPermission(&ctx.kernel, &attr, permWrite) {
+		return fuse.EACCES
+	}
+
+	const setNow = fuse.FATTR_ATIME_NOW | fuse.FATTR_MTIME_NOW
+	if times := input.Valid & (fuse.FATTR_ATIME | fuse.FATTR_MTIME); times != 0 && !owner {
+		// Only setting the current time is allowed to writers.
+		if input.Valid&setNow == 0 {
+			return fuse.EPERM
+		}
+		if !hasPermission(&ctx.kernel, &attr, permWrite) {
+			return fuse.EACCES
+		}
+	}
+	return fuse.OK
+}
+
+func (b *rawBridge) permAttr(ctx *Context, n *inode, out *fuse.Attr) fuse.Status {
+	return b.tryPaths(ctx, n, func(path string) fuse.Status {
+		code := b.fs.GetAttr(ctx, path, 0, out)
+		if !code.Ok() {
+			return code
+		}
+		b.setAttrInner(path, out)
+		return fuse.OK
+	})
+}
+
+// openMask returns the permissions required by open flags.
+func openMask(flags uint32) uint32 {
+	var mask uint32
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		mask = permRead
+	case syscall.O_WRONLY:
+		mask = permWrite
+	case syscall.O_RDWR:
+		mask = permRead | permWrite
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		mask |= permWrite
+	}
+	return mask
+}
+
+// hasPermission checks the mode bits of attr against caller, as the
+// kernel does for default_permissions.
+func hasPermission(caller *fuse.Caller, attr *fuse.Attr, mask uint32) bool {
+	if caller.Uid == 0 {
+		// root needs at least one exec bit to execute files.
+		if mask&permExec == 0 || attr.IsDir() {
+			return true
+		}
+		return attr.Mode&0111 != 0
+	}
+
+	var perm uint32
+	switch {
+	case caller.Uid == attr.Uid:
+		perm = attr.Mode >> 6
+	case inGroup(caller, attr.Gid):
+		perm = attr.Mode >> 3
+	default:
+		perm = attr.Mode
+	}
+	return perm&mask&7 == mask
+}
+
+func inGroup(caller *fuse.Caller, gid uint32) bool {
+	if caller.Gid == gid {
+		return true
+	}
+	for _, g := range supplementaryGroups(caller.Pid) {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRename checks the permissions of rename(2): write and search
+// on both directories, the sticky bit on both entries, and write on a
+// directory moved to another parent, as its ".." changes.
+func (b *rawBridge) checkRename(ctx *Context, parent *inode, name string, newParent *inode, newName string) fuse.Status {
+	if !b.options.DefaultPermissions {
+		return fuse.OK
+	}
+
+	for _, dir := range []*inode{parent, newParent} {
+		if code := b.checkPerm(ctx, dir, permWrite|permExec); !code.Ok() {
+			return code
+		}
+	}
+	if code := b.checkSticky(ctx, parent, name); !code.Ok() {
+		return code
+	}
+	if code := b.checkSticky(ctx, newParent, newName); !code.Ok() && code != fuse.ENOENT {
+		return code
+	}
+
+	if parent == newParent {
+		return fuse.OK
+	}
+	parent.mu.Lock()
+	child := parent.children[name]
+	parent.mu.Unlock()
+	if child != nil && child.isDir() {
+		return b.checkPerm(ctx, child, permWrite)
+	}
+	return fuse.OK
+}
@@ -0,0 +1,11 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+// groupsOf returns nil: there is no portable way to read the groups
+// of another process, only the primary group is checked.
+func groupsOf(pid uint32) []uint32 {
+	return nil
+}
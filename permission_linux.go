@@ -0,0 +1,41 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// groupsOf reads the supplementary groups of pid from /proc.
+func groupsOf(pid uint32) []uint32 {
+	if pid == 0 {
+		return nil
+	}
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		var groups []uint32
+		for _, field := range strings.Fields(line[len("Groups:"):]) {
+			if g, err := strconv.ParseUint(field, 10, 32); err == nil {
+				groups = append(groups, uint32(g))
+			}
+		}
+		return groups
+	}
+	return nil
+}
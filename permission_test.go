@@ -0,0 +1,113 @@
+package pathfs
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestHasPermission(t *testing.T) {
+	defer func(f func(uint32) []uint32) { supplementaryGroups = f }(supplementaryGroups)
+	supplementaryGroups = func(pid uint32) []uint32 {
+		if pid == 42 {
+			return []uint32{200}
+		}
+		return nil
+	}
+
+	file := &fuse.Attr{Mode: fuse.S_IFREG | 0640, Owner: fuse.Owner{Uid: 100, Gid: 200}}
+	tests := []struct {
+		caller fuse.Caller
+		mask   uint32
+		want   bool
+	}{
+		{fuse.Caller{Owner: fuse.Owner{Uid: 100}}, permRead | permWrite, true},
+		{fuse.Caller{Owner: fuse.Owner{Uid: 100}}, permExec, false},
+		{fuse.Caller{Owner: fuse.Owner{Uid: 101, Gid: 200}}, permRead, true},
+		{fuse.Caller{Owner: fuse.Owner{Uid: 101, Gid: 200}}, permWrite, false},
+		{fuse.Caller{Owner: fuse.Owner{Uid: 101, Gid: 201}, Pid: 42}, permRead, true},
+		{fuse.Caller{Owner: fuse.Owner{Uid: 101, Gid: 201}}, permRead, false},
+		{fuse.Caller{}, permRead | permWrite, true},
+		{fuse.Caller{}, permExec, false},
+	}
+	for i, tt := range tests {
+		if have := hasPermission(&tt.caller, file, tt.mask); have != tt.want {
+			t.Errorf("%d: caller %+v mask %o: want %v, have %v", i, tt.caller, tt.mask, tt.want, have)
+		}
+	}
+}
+
+func newPermBridge(attrs map[string]fuse.Attr) *rawBridge {
+	mock := &mockFileSystem{
+		getAttrFunc: func(path string) (fuse.Attr, fuse.Status) {
+			if a, ok := attrs[path]; ok {
+				return a, fuse.OK
+			}
+			return fuse.Attr{}, fuse.ENOENT
+		},
+	}
+	b := newMockBridge(mock)
+	b.options.DefaultPermissions = true
+	return b
+}
+
+func TestDefaultPermissions(t *testing.T) {
+	b := newPermBridge(map[string]fuse.Attr{
+		"":        {Ino: 1, Mode: fuse.S_IFDIR | 0755},
+		"priv":    {Ino: 2, Mode: fuse.S_IFDIR | 0700, Owner: fuse.Owner{Uid: 100}},
+		"priv/f":  {Ino: 3, Mode: fuse.S_IFREG | 0644, Owner: fuse.Owner{Uid: 100}},
+		"tmp":     {Ino: 4, Mode: fuse.S_IFDIR | 0777 | syscall.S_ISVTX},
+		"tmp/f":   {Ino: 5, Mode: fuse.S_IFREG | 0666, Owner: fuse.Owner{Uid: 100}},
+		"ro":      {Ino: 6, Mode: fuse.S_IFREG | 0444, Owner: fuse.Owner{Uid: 100}},
+		"private": {Ino: 7, Mode: fuse.S_IFREG | 0600, Owner: fuse.Owner{Uid: 100}},
+	})
+	owner := fuse.Caller{Owner: fuse.Owner{Uid: 100, Gid: 100}}
+	other := fuse.Caller{Owner: fuse.Owner{Uid: 101, Gid: 101}}
+
+	for _, name := range []string{"priv", "tmp", "ro", "private"} {
+		if code := b.Lookup(nil, &fuse.InHeader{NodeId: 1, Caller: owner}, name, &fuse.EntryOut{}); !code.Ok() {
+			t.Fatalf("lookup %s: %v", name, code)
+		}
+	}
+
+	// search permission on the parent.
+	if code := b.Lookup(nil, &fuse.InHeader{NodeId: 2, Caller: other}, "f", &fuse.EntryOut{}); code != fuse.EACCES {
+		t.Errorf("lookup in 0700 dir: want EACCES, have %v", code)
+	}
+	if code := b.Lookup(nil, &fuse.InHeader{NodeId: 2, Caller: owner}, "f", &fuse.EntryOut{}); !code.Ok() {
+		t.Errorf("lookup by owner: want OK, have %v", code)
+	}
+
+	// open modes.
+	if code := b.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 6, Caller: owner}, Flags: syscall.O_WRONLY}, &fuse.OpenOut{}); code != fuse.EACCES {
+		t.Errorf("write open of 0444 file: want EACCES, have %v", code)
+	}
+	if code := b.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 7, Caller: other}}, &fuse.OpenOut{}); code != fuse.EACCES {
+		t.Errorf("read open of 0600 file by other: want EACCES, have %v", code)
+	}
+	if code := b.Access(nil, &fuse.AccessIn{InHeader: fuse.InHeader{NodeId: 6, Caller: other}, Mask: permRead}); !code.Ok() {
+		t.Errorf("access R on 0444 file: want OK, have %v", code)
+	}
+
+	// write permission on the parent.
+	if code := b.Mkdir(nil, &fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: 1, Caller: other}}, "d", &fuse.EntryOut{}); code != fuse.EACCES {
+		t.Errorf("mkdir in 0755 dir by other: want EACCES, have %v", code)
+	}
+
+	// sticky directory.
+	b.Lookup(nil, &fuse.InHeader{NodeId: 4, Caller: owner}, "f", &fuse.EntryOut{})
+	if code := b.Unlink(nil, &fuse.InHeader{NodeId: 4, Caller: other}, "f"); code != fuse.EPERM {
+		t.Errorf("unlink in sticky dir by other: want EPERM, have %v", code)
+	}
+
+	// chmod needs ownership.
+	setIn := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+		InHeader: fuse.InHeader{NodeId: 7, Caller: other},
+		Valid:    fuse.FATTR_MODE,
+		Mode:     0777,
+	}}
+	if code := b.SetAttr(nil, setIn, &fuse.AttrOut{}); code != fuse.EPERM {
+		t.Errorf("chmod by other: want EPERM, have %v", code)
+	}
+}
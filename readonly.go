@@ -0,0 +1,82 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// readOnlyFileSystem is a FileSystem whose tree can't be changed: the
+// methods that would change it fail with EROFS. It is embedded by
+// read-only FileSystems.
+type readOnlyFileSystem struct {
+	defaultFileSystem
+}
+
+func (fs readOnlyFileSystem) Mknod(ctx *Context, path string, mode uint32, dev uint32) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs readOnlyFileSystem) Mkdir(ctx *Context, path string, mode uint32) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs readOnlyFileSystem) Unlink(ctx *Context, path string) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs readOnlyFileSystem) Rmdir(ctx *Context, path string) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs readOnlyFileSystem) Rename(ctx *Context, path string, newPath string) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs readOnlyFileSystem) Link(ctx *Context, path string, newPath string) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs readOnlyFileSystem) Symlink(ctx *Context, path string, target string) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs readOnlyFileSystem) SetXAttr(ctx *Context, path string, attr string, data []byte, flags uint32) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs readOnlyFileSystem) RemoveXAttr(ctx *Context, path string, attr string) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs readOnlyFileSystem) Create(ctx *Context, path string, flags uint32, mode uint32) (uFh uint32, forceDIO bool, code fuse.Status) {
+	return 0, false, fuse.EROFS
+}
+
+func (fs readOnlyFileSystem) Write(ctx *Context, path string, uFh uint32, data []byte, off uint64) (written uint32, code fuse.Status) {
+	return 0, fuse.EROFS
+}
+
+func (fs readOnlyFileSystem) Fallocate(ctx *Context, path string, uFh uint32, off uint64, size uint64, mode uint32) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs readOnlyFileSystem) Chmod(ctx *Context, path string, uFh uint32, mode uint32) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs readOnlyFileSystem) Chown(ctx *Context, path string, uFh uint32, uid uint32, gid uint32) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs readOnlyFileSystem) Truncate(ctx *Context, path string, uFh uint32, size uint64) fuse.Status {
+	return fuse.EROFS
+}
+
+func (fs readOnlyFileSystem) Utimens(ctx *Context, path string, uFh uint32, atime *time.Time, mtime *time.Time) fuse.Status {
+	return fuse.EROFS
+}
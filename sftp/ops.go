@@ -0,0 +1,503 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sftp
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+)
+
+// fsPath returns the FileSystem path of an SFTP path.
+func fsPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// maxSymlinks bounds the symlinks STAT follows.
+const maxSymlinks = 40
+
+// follow gets the attrs of p, following symlinks, and returns the
+// path they lead to.
+func (ss *session) follow(ctx *pathfs.Context, p string, out *fuse.Attr) (string, fuse.Status) {
+	for i := 0; i < maxSymlinks; i++ {
+		if code := ss.srv.fs.GetAttr(ctx, p, 0, out); !code.Ok() {
+			return "", code
+		}
+		if out.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+			return p, fuse.OK
+		}
+		target, code := ss.srv.fs.Readlink(ctx, p)
+		if !code.Ok() {
+			return "", code
+		}
+		if !path.IsAbs(target) {
+			target = path.Join("/"+path.Dir(p), target)
+		}
+		p = fsPath(target)
+	}
+	return "", fuse.Status(syscall.ELOOP)
+}
+
+func attrsPacket(id uint32, attr *fuse.Attr) *encoder {
+	e := newPacket(fxpAttrs, id)
+	e.attrs(attr)
+	return e
+}
+
+// lookupHandle returns the handle of a request, nil if it is unknown.
+func (ss *session) lookupHandle(d *decoder) *handle {
+	return ss.handles[d.str()]
+}
+
+func badHandle(id uint32) *encoder {
+	return statusPacket(id, fxFailure, "invalid handle")
+}
+
+func (ss *session) open(ctx *pathfs.Context, id uint32, d *decoder) *encoder {
+	p, pflags, a := fsPath(d.str()), d.u32(), d.attrs()
+	if d.err != nil {
+		return nil
+	}
+	var flags uint32
+	switch {
+	case pflags&fxfRead != 0 && pflags&fxfWrite != 0:
+		flags = syscall.O_RDWR
+	case pflags&fxfWrite != 0:
+		flags = syscall.O_WRONLY
+	default:
+		flags = syscall.O_RDONLY
+	}
+	if pflags&fxfTrunc != 0 {
+		flags |= syscall.O_TRUNC
+	}
+	if pflags&fxfAppend != 0 {
+		flags |= syscall.O_APPEND
+	}
+
+	var attr fuse.Attr
+	code := ss.srv.fs.GetAttr(ctx, p, 0, &attr)
+	var f *openFile
+	switch {
+	case code == fuse.ENOENT && pflags&fxfCreat != 0:
+		mode := uint32(0644)
+		if a.flags&attrPermissions != 0 {
+			mode = a.permissions & 07777
+		}
+		if pflags&fxfExcl != 0 {
+			flags |= syscall.O_EXCL
+		}
+		f, code = ss.createFile(ctx, p, flags, mode)
+	case code.Ok() && pflags&fxfCreat != 0 && pflags&fxfExcl != 0:
+		code = fuse.Status(syscall.EEXIST)
+	case code.Ok():
+		f, code = ss.openFile(ctx, p, flags)
+	}
+	if !code.Ok() {
+		return status(id, code)
+	}
+	return ss.addHandle(id, &handle{path: p, file: f, append: pflags&fxfAppend != 0})
+}
+
+func (ss *session) close(ctx *pathfs.Context, id uint32, d *decoder) *encoder {
+	key := d.str()
+	if d.err != nil {
+		return nil
+	}
+	h, ok := ss.handles[key]
+	if !ok {
+		return badHandle(id)
+	}
+	delete(ss.handles, key)
+	if h.file != nil {
+		return status(id, h.file.close(ctx))
+	}
+	return status(id, fuse.OK)
+}
+
+func (ss *session) read(ctx *pathfs.Context, id uint32, d *decoder) *encoder {
+	h, off, n := ss.lookupHandle(d), d.u64(), d.u32()
+	if d.err != nil {
+		return nil
+	}
+	if h == nil || h.file == nil {
+		return badHandle(id)
+	}
+	// Leave room for the header of DATA.
+	if max := ss.srv.options.MaxPacketSize - 13; n > max {
+		n = max
+	}
+	data, code := h.file.read(ctx, make([]byte, n), off)
+	if !code.Ok() {
+		return status(id, code)
+	}
+	if len(data) == 0 {
+		return statusPacket(id, fxEOF, "EOF")
+	}
+	e := newPacket(fxpData, id)
+	e.bytes(data)
+	return e
+}
+
+func (ss *session) write(ctx *pathfs.Context, id uint32, d *decoder) *encoder {
+	h, off, data := ss.lookupHandle(d), d.u64(), d.bytes()
+	if d.err != nil {
+		return nil
+	}
+	if h == nil || h.file == nil {
+		return badHandle(id)
+	}
+	if h.append {
+		var attr fuse.Attr
+		if code := h.file.getAttr(ctx, &attr); !code.Ok() {
+			return status(id, code)
+		}
+		off = attr.Size
+	}
+	for len(data) > 0 {
+		n, code := h.file.write(ctx, data, off)
+		if !code.Ok() {
+			return status(id, code)
+		}
+		if n == 0 {
+			return statusPacket(id, fxFailure, "short write")
+		}
+		data = data[n:]
+		off += uint64(n)
+	}
+	return status(id, fuse.OK)
+}
+
+func (ss *session) lstat(ctx *pathfs.Context, id uint32, d *decoder) *encoder {
+	p := fsPath(d.str())
+	if d.err != nil {
+		return nil
+	}
+	var attr fuse.Attr
+	if code := ss.srv.fs.GetAttr(ctx, p, 0, &attr); !code.Ok() {
+		return status(id, code)
+	}
+	return attrsPacket(id, &attr)
+}
+
+func (ss *session) stat(ctx *pathfs.Context, id uint32, d *decoder) *encoder {
+	p := fsPath(d.str())
+	if d.err != nil {
+		return nil
+	}
+	var attr fuse.Attr
+	if _, code := ss.follow(ctx, p, &attr); !code.Ok() {
+		return status(id, code)
+	}
+	return attrsPacket(id, &attr)
+}
+
+func (ss *session) fstat(ctx *pathfs.Context, id uint32, d *decoder) *encoder {
+	h := ss.lookupHandle(d)
+	if d.err != nil {
+		return nil
+	}
+	if h == nil {
+		return badHandle(id)
+	}
+	var attr fuse.Attr
+	var code fuse.Status
+	if h.file != nil {
+		code = h.file.getAttr(ctx, &attr)
+	} else {
+		code = ss.srv.fs.GetAttr(ctx, h.path, 0, &attr)
+	}
+	if !code.Ok() {
+		return status(id, code)
+	}
+	return attrsPacket(id, &attr)
+}
+
+// setAttrs applies the attrs of SETSTAT and FSETSTAT.
+func (ss *session) setAttrs(ctx *pathfs.Context, p string, f *openFile, a *attrs) fuse.Status {
+	var uFh uint32
+	if f != nil {
+		uFh = f.file.UFh()
+	}
+	if a.flags&attrSize != 0 {
+		var code fuse.Status
+		if f != nil {
+			code = f.file.Truncate(ctx, p, a.size)
+		} else {
+			code = ss.srv.fs.Truncate(ctx, p, uFh, a.size)
+		}
+		if !code.Ok() {
+			return code
+		}
+	}
+	if a.flags&attrUIDGID != 0 {
+		if code := ss.srv.fs.Chown(ctx, p, uFh, a.uid, a.gid); !code.Ok() {
+			return code
+		}
+	}
+	if a.flags&attrPermissions != 0 {
+		if code := ss.srv.fs.Chmod(ctx, p, uFh, a.permissions&07777); !code.Ok() {
+			return code
+		}
+	}
+	if a.flags&attrACModTime != 0 {
+		atime, mtime := time.Unix(int64(a.atime), 0), time.Unix(int64(a.mtime), 0)
+		if code := ss.srv.fs.Utimens(ctx, p, uFh, &atime, &mtime); !code.Ok() {
+			return code
+		}
+	}
+	return fuse.OK
+}
+
+func (ss *session) setstat(ctx *pathfs.Context, id uint32, d *decoder) *encoder {
+	p, a := fsPath(d.str()), d.attrs()
+	if d.err != nil {
+		return nil
+	}
+	return status(id, ss.setAttrs(ctx, p, nil, &a))
+}
+
+func (ss *session) fsetstat(ctx *pathfs.Context, id uint32, d *decoder) *encoder {
+	h, a := ss.lookupHandle(d), d.attrs()
+	if d.err != nil {
+		return nil
+	}
+	if h == nil {
+		return badHandle(id)
+	}
+	return status(id, ss.setAttrs(ctx, h.path, h.file, &a))
+}
+
+func (ss *session) opendir(ctx *pathfs.Context, id uint32, d *decoder) *encoder {
+	p := fsPath(d.str())
+	if d.err != nil {
+		return nil
+	}
+	var attr fuse.Attr
+	dir, code := ss.follow(ctx, p, &attr)
+	if !code.Ok() {
+		return status(id, code)
+	}
+	if !attr.IsDir() {
+		return status(id, fuse.Status(syscall.ENOTDIR))
+	}
+	entries, code := ss.srv.fs.Lsdir(ctx, dir)
+	if !code.Ok() {
+		return status(id, code)
+	}
+	return ss.addHandle(id, &handle{path: dir, dirents: entries})
+}
+
+// readdirBatch bounds the names of a READDIR reply.
+const readdirBatch = 128
+
+func (ss *session) readdir(ctx *pathfs.Context, id uint32, d *decoder) *encoder {
+	h := ss.lookupHandle(d)
+	if d.err != nil {
+		return nil
+	}
+	if h == nil || h.file != nil {
+		return badHandle(id)
+	}
+	if h.pos >= len(h.dirents) {
+		return statusPacket(id, fxEOF, "EOF")
+	}
+
+	e := newPacket(fxpName, id)
+	countAt := len(e.buf)
+	e.u32(0)
+	var count uint32
+	for ; h.pos < len(h.dirents) && count < readdirBatch; h.pos++ {
+		de := h.dirents[h.pos]
+		var p string
+		switch de.Name {
+		case ".":
+			p = h.path
+		case "..":
+			p = fsPath(path.Dir("/" + h.path))
+		default:
+			p = path.Join(h.path, de.Name)
+		}
+		var attr fuse.Attr
+		if !ss.srv.fs.GetAttr(ctx, p, 0, &attr).Ok() {
+			attr = fuse.Attr{Mode: de.Mode}
+		}
+		mark := len(e.buf)
+		e.str(de.Name)
+		e.str(longname(de.Name, &attr))
+		e.attrs(&attr)
+		if uint32(len(e.buf)) > ss.srv.options.MaxPacketSize && count > 0 {
+			e.buf = e.buf[:mark]
+			break
+		}
+		count++
+	}
+	e.buf[countAt] = byte(count >> 24)
+	e.buf[countAt+1] = byte(count >> 16)
+	e.buf[countAt+2] = byte(count >> 8)
+	e.buf[countAt+3] = byte(count)
+	return e
+}
+
+// longname formats an entry as "ls -l" does, which some clients parse.
+func longname(name string, attr *fuse.Attr) string {
+	mtime := time.Unix(int64(attr.Mtime), 0)
+	layout := "Jan _2 15:04"
+	if time.Since(mtime) > 180*24*time.Hour {
+		layout = "Jan _2  2006"
+	}
+	nlink := attr.Nlink
+	if nlink == 0 {
+		nlink = 1
+	}
+	return fmt.Sprintf("%s %4d %-8d %-8d %8d %s %s",
+		modeString(attr.Mode), nlink, attr.Uid, attr.Gid, attr.Size, mtime.Format(layout), name)
+}
+
+func modeString(mode uint32) string {
+	b := []byte("?rwxrwxrwx")
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		b[0] = '-'
+	case syscall.S_IFDIR:
+		b[0] = 'd'
+	case syscall.S_IFLNK:
+		b[0] = 'l'
+	case syscall.S_IFCHR:
+		b[0] = 'c'
+	case syscall.S_IFBLK:
+		b[0] = 'b'
+	case syscall.S_IFIFO:
+		b[0] = 'p'
+	case syscall.S_IFSOCK:
+		b[0] = 's'
+	}
+	for i := 0; i < 9; i++ {
+		if mode&(1<<uint(8-i)) == 0 {
+			b[i+1] = '-'
+		}
+	}
+	if mode&syscall.S_ISUID != 0 {
+		b[3] = "Ss"[mode>>6&1]
+	}
+	if mode&syscall.S_ISGID != 0 {
+		b[6] = "Ss"[mode>>3&1]
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		b[9] = "Tt"[mode&1]
+	}
+	return string(b)
+}
+
+func (ss *session) remove(ctx *pathfs.Context, id uint32, d *decoder) *encoder {
+	p := fsPath(d.str())
+	if d.err != nil {
+		return nil
+	}
+	return status(id, ss.srv.fs.Unlink(ctx, p))
+}
+
+func (ss *session) mkdir(ctx *pathfs.Context, id uint32, d *decoder) *encoder {
+	p, a := fsPath(d.str()), d.attrs()
+	if d.err != nil {
+		return nil
+	}
+	mode := uint32(0755)
+	if a.flags&attrPermissions != 0 {
+		mode = a.permissions & 07777
+	}
+	return status(id, ss.srv.fs.Mkdir(ctx, p, mode))
+}
+
+func (ss *session) rmdir(ctx *pathfs.Context, id uint32, d *decoder) *encoder {
+	p := fsPath(d.str())
+	if d.err != nil {
+		return nil
+	}
+	return status(id, ss.srv.fs.Rmdir(ctx, p))
+}
+
+// namePacket returns a NAME reply of a single name without attrs.
+func namePacket(id uint32, name string) *encoder {
+	e := newPacket(fxpName, id)
+	e.u32(1)
+	e.str(name)
+	e.str(name)
+	e.u32(0)
+	return e
+}
+
+func (ss *session) realpath(ctx *pathfs.Context, id uint32, d *decoder) *encoder {
+	p := fsPath(d.str())
+	if d.err != nil {
+		return nil
+	}
+	return namePacket(id, "/"+p)
+}
+
+func (ss *session) rename(ctx *pathfs.Context, id uint32, d *decoder) *encoder {
+	oldPath, newPath := fsPath(d.str()), fsPath(d.str())
+	if d.err != nil {
+		return nil
+	}
+	// Unlike posix-rename, RENAME does not replace newPath.
+	var attr fuse.Attr
+	if code := ss.srv.fs.GetAttr(ctx, newPath, 0, &attr); code != fuse.ENOENT {
+		if code.Ok() {
+			code = fuse.Status(syscall.EEXIST)
+		}
+		return status(id, code)
+	}
+	return status(id, ss.srv.fs.Rename(ctx, oldPath, newPath))
+}
+
+func (ss *session) readlink(ctx *pathfs.Context, id uint32, d *decoder) *encoder {
+	p := fsPath(d.str())
+	if d.err != nil {
+		return nil
+	}
+	target, code := ss.srv.fs.Readlink(ctx, p)
+	if !code.Ok() {
+		return status(id, code)
+	}
+	return namePacket(id, target)
+}
+
+func (ss *session) symlink(ctx *pathfs.Context, id uint32, d *decoder) *encoder {
+	target, p := d.str(), fsPath(d.str())
+	if d.err != nil {
+		return nil
+	}
+	return status(id, ss.srv.fs.Symlink(ctx, p, target))
+}
+
+func (ss *session) extended(ctx *pathfs.Context, id uint32, d *decoder) *encoder {
+	name := d.str()
+	switch name {
+	case "posix-rename@openssh.com":
+		oldPath, newPath := fsPath(d.str()), fsPath(d.str())
+		if d.err != nil {
+			return nil
+		}
+		return status(id, ss.srv.fs.Rename(ctx, oldPath, newPath))
+	case "fsync@openssh.com":
+		h := ss.lookupHandle(d)
+		if d.err != nil {
+			return nil
+		}
+		if h == nil || h.file == nil {
+			return badHandle(id)
+		}
+		return status(id, h.file.fsync(ctx))
+	}
+	if d.err != nil {
+		return nil
+	}
+	return statusPacket(id, fxOpUnsupported, "unsupported extension "+name)
+}
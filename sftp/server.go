@@ -0,0 +1,84 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sftp serves a pathfs.FileSystem over SFTP version 3, the
+// dialect of OpenSSH.
+//
+// The Server does not speak SSH itself: an SSH server authenticates
+// the user and, on a "subsystem" request for "sftp", passes the
+// channel to ServeConn along with the Caller the user maps to, as in
+//
+//	go srv.ServeConn(channel, fuse.Caller{Owner: fuse.Owner{Uid: uid, Gid: gid}})
+//
+// The root of the FileSystem is "/", and relative paths are resolved
+// against it. SYMLINK takes its arguments in the order of OpenSSH,
+// target first. The posix-rename@openssh.com and fsync@openssh.com
+// extensions are supported.
+package sftp
+
+import (
+	"io"
+	"log"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+)
+
+// DefaultMaxPacketSize is the bound of packets when
+// Options.MaxPacketSize is not set, that of OpenSSH.
+const DefaultMaxPacketSize = 256 << 10
+
+// Options sets options for a Server.
+type Options struct {
+	// MaxPacketSize bounds the packets received and sent. READ
+	// replies are shortened to fit.
+	MaxPacketSize uint32
+
+	// Logger is a sink for diagnostic messages, such as malformed
+	// requests. If unset, no messages are printed.
+	Logger *log.Logger
+}
+
+// Server serves a FileSystem to any number of SFTP sessions.
+type Server struct {
+	fs      pathfs.FileSystem
+	options Options
+}
+
+// NewServer returns a Server for fs. options may be nil.
+func NewServer(fs pathfs.FileSystem, options *Options) *Server {
+	s := &Server{fs: fs}
+	if options != nil {
+		s.options = *options
+	}
+	if s.options.MaxPacketSize == 0 {
+		s.options.MaxPacketSize = DefaultMaxPacketSize
+	}
+	if s.options.MaxPacketSize < 34000 {
+		// The least every implementation must support.
+		s.options.MaxPacketSize = 34000
+	}
+	return s
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.options.Logger != nil {
+		s.options.Logger.Printf(format, args...)
+	}
+}
+
+// ServeConn serves a single session, such as an SSH channel, making
+// every request as caller. It returns when rw is closed or a packet is
+// malformed, after closing rw and the files left open by the client,
+// and returns nil at EOF.
+func (s *Server) ServeConn(rw io.ReadWriteCloser, caller fuse.Caller) error {
+	ss := newSession(s, rw, caller)
+	err := ss.serve()
+	rw.Close()
+	ss.shutdown()
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,379 @@
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+	"golang.org/x/crypto/ssh"
+)
+
+// callerFS records the callers of Mkdir.
+type callerFS struct {
+	pathfs.FileSystem
+
+	mu      sync.Mutex
+	callers []fuse.Caller
+}
+
+func (fs *callerFS) Mkdir(ctx *pathfs.Context, path string, mode uint32) fuse.Status {
+	fs.mu.Lock()
+	fs.callers = append(fs.callers, ctx.Caller)
+	fs.mu.Unlock()
+	return fs.FileSystem.Mkdir(ctx, path, mode)
+}
+
+// startSSH serves the sftp subsystem of srv over SSH on a loopback
+// port, mapping the user "partner" to uid and gid, and returns a
+// connected client.
+func startSSH(t *testing.T, srv *Server, uid, gid uint32) *ssh.Client {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() != "partner" || string(pass) != "secret" {
+				return nil, io.EOF
+			}
+			return &ssh.Permissions{Extensions: map[string]string{
+				"uid": strconv.Itoa(int(uid)),
+				"gid": strconv.Itoa(int(gid)),
+			}}, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(srv, nc, config)
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            "partner",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.FixedHostKey(signer.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func serveSSH(srv *Server, nc net.Conn, config *ssh.ServerConfig) {
+	conn, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+	uid, _ := strconv.Atoi(conn.Permissions.Extensions["uid"])
+	gid, _ := strconv.Atoi(conn.Permissions.Extensions["gid"])
+	caller := fuse.Caller{Owner: fuse.Owner{Uid: uint32(uid), Gid: uint32(gid)}}
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		ch, reqs, err := nch.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range reqs {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						srv.ServeConn(ch, caller)
+					}()
+				}
+			}
+		}()
+	}
+}
+
+// testClient makes SFTP requests, one at a time.
+type testClient struct {
+	t  *testing.T
+	w  io.WriteCloser
+	r  io.Reader
+	id uint32
+}
+
+func newTestClient(t *testing.T, client *ssh.Client) *testClient {
+	s, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := s.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RequestSubsystem("sftp"); err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{t: t, w: w, r: r}
+	e := newPacket(fxpInit, 3)
+	c.send(e)
+	if typ, d := c.recv(); typ != fxpVersion || d.u32() != 3 {
+		t.Fatalf("INIT: reply %d", typ)
+	}
+	return c
+}
+
+func (c *testClient) send(e *encoder) {
+	c.t.Helper()
+	if _, err := c.w.Write(e.packet()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) recv() (uint8, *decoder) {
+	c.t.Helper()
+	var size [4]byte
+	if _, err := io.ReadFull(c.r, size[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	pkt := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(c.r, pkt); err != nil {
+		c.t.Fatal(err)
+	}
+	d := &decoder{buf: pkt}
+	return d.u8(), d
+}
+
+// call sends a request filled by fill and returns the type of the
+// reply and its body after the id.
+func (c *testClient) call(typ uint8, fill func(e *encoder)) (uint8, *decoder) {
+	c.t.Helper()
+	c.id++
+	e := newPacket(typ, c.id)
+	fill(e)
+	c.send(e)
+	rtyp, d := c.recv()
+	if id := d.u32(); id != c.id {
+		c.t.Fatalf("reply to %d for %d", id, c.id)
+	}
+	return rtyp, d
+}
+
+// status makes a request that replies with STATUS, and returns its
+// code.
+func (c *testClient) status(typ uint8, fill func(e *encoder)) uint32 {
+	c.t.Helper()
+	rtyp, d := c.call(typ, fill)
+	if rtyp != fxpStatus {
+		c.t.Fatalf("request %d: reply %d", typ, rtyp)
+	}
+	return d.u32()
+}
+
+func (c *testClient) handle(typ uint8, fill func(e *encoder)) string {
+	c.t.Helper()
+	rtyp, d := c.call(typ, fill)
+	if rtyp != fxpHandle {
+		c.t.Fatalf("request %d: reply %d %d", typ, rtyp, d.u32())
+	}
+	return d.str()
+}
+
+func (c *testClient) open(p string, pflags uint32) string {
+	c.t.Helper()
+	return c.handle(fxpOpen, func(e *encoder) {
+		e.str(p)
+		e.u32(pflags)
+		e.u32(0)
+	})
+}
+
+func (c *testClient) readdir(p string) map[string]uint32 {
+	c.t.Helper()
+	h := c.handle(fxpOpendir, func(e *encoder) { e.str(p) })
+	names := map[string]uint32{}
+	for {
+		typ, d := c.call(fxpReaddir, func(e *encoder) { e.str(h) })
+		if typ == fxpStatus {
+			if code := d.u32(); code != fxEOF {
+				c.t.Fatalf("READDIR: %d", code)
+			}
+			break
+		}
+		for n := d.u32(); n > 0; n-- {
+			name := d.str()
+			d.str()
+			names[name] = d.attrs().permissions
+		}
+	}
+	if code := c.status(fxpClose, func(e *encoder) { e.str(h) }); code != fxOK {
+		c.t.Fatalf("CLOSE: %d", code)
+	}
+	return names
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	fs := &callerFS{FileSystem: pathfs.NewTestFileSystem(dir)}
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	c := newTestClient(t, startSSH(t, NewServer(fs, nil), uid, gid))
+
+	ok := func(what string, code uint32) {
+		t.Helper()
+		if code != fxOK {
+			t.Fatalf("%s: %d", what, code)
+		}
+	}
+
+	// MKDIR is made as the user of the session.
+	ok("MKDIR", c.status(fxpMkdir, func(e *encoder) {
+		e.str("/in")
+		e.u32(attrPermissions)
+		e.u32(0750)
+	}))
+	if len(fs.callers) != 1 || fs.callers[0].Uid != uid || fs.callers[0].Gid != gid {
+		t.Fatalf("callers %v", fs.callers)
+	}
+
+	// Upload and download a file.
+	h := c.open("in/data.csv", fxfWrite|fxfCreat|fxfTrunc)
+	ok("WRITE", c.status(fxpWrite, func(e *encoder) {
+		e.str(h)
+		e.u64(0)
+		e.bytes([]byte("a,b\n1,2\n"))
+	}))
+	ok("CLOSE", c.status(fxpClose, func(e *encoder) { e.str(h) }))
+	if data, err := os.ReadFile(filepath.Join(dir, "in", "data.csv")); err != nil || string(data) != "a,b\n1,2\n" {
+		t.Fatalf("uploaded %q %v", data, err)
+	}
+	if code := c.status(fxpOpen, func(e *encoder) {
+		e.str("in/data.csv")
+		e.u32(fxfWrite | fxfCreat | fxfExcl)
+		e.u32(0)
+	}); code != fxFailure {
+		t.Fatalf("exclusive OPEN of an existing file: %d", code)
+	}
+
+	h = c.open("/in/data.csv", fxfRead)
+	typ, d := c.call(fxpRead, func(e *encoder) {
+		e.str(h)
+		e.u64(4)
+		e.u32(100)
+	})
+	if got := d.str(); typ != fxpData || got != "1,2\n" {
+		t.Fatalf("READ: %d %q", typ, got)
+	}
+	if code := c.status(fxpRead, func(e *encoder) {
+		e.str(h)
+		e.u64(8)
+		e.u32(100)
+	}); code != fxEOF {
+		t.Fatalf("READ at the end: %d", code)
+	}
+	typ, d = c.call(fxpFstat, func(e *encoder) { e.str(h) })
+	if a := d.attrs(); typ != fxpAttrs || a.size != 8 {
+		t.Fatalf("FSTAT: %d %d", typ, a.size)
+	}
+	ok("CLOSE", c.status(fxpClose, func(e *encoder) { e.str(h) }))
+	if code := c.status(fxpClose, func(e *encoder) { e.str(h) }); code != fxFailure {
+		t.Fatalf("second CLOSE: %d", code)
+	}
+
+	// SETSTAT.
+	ok("SETSTAT", c.status(fxpSetstat, func(e *encoder) {
+		e.str("in/data.csv")
+		e.u32(attrSize | attrPermissions | attrACModTime)
+		e.u64(3)
+		e.u32(0600)
+		e.u32(1000000000)
+		e.u32(1000000000)
+	}))
+	fi, err := os.Stat(filepath.Join(dir, "in", "data.csv"))
+	if err != nil || fi.Size() != 3 || fi.Mode().Perm() != 0600 || fi.ModTime().Unix() != 1000000000 {
+		t.Fatalf("after SETSTAT: %v %v", fi, err)
+	}
+
+	// Symlinks; STAT follows them, LSTAT does not.
+	ok("SYMLINK", c.status(fxpSymlink, func(e *encoder) {
+		e.str("in/data.csv")
+		e.str("link")
+	}))
+	typ, d = c.call(fxpReadlink, func(e *encoder) { e.str("link") })
+	if d.u32(); typ != fxpName || d.str() != "in/data.csv" {
+		t.Fatalf("READLINK: %d", typ)
+	}
+	typ, d = c.call(fxpStat, func(e *encoder) { e.str("/link") })
+	if a := d.attrs(); typ != fxpAttrs || a.size != 3 {
+		t.Fatalf("STAT: %d %d", typ, a.size)
+	}
+	typ, d = c.call(fxpLstat, func(e *encoder) { e.str("/link") })
+	if a := d.attrs(); typ != fxpAttrs || a.permissions&syscall.S_IFMT != syscall.S_IFLNK {
+		t.Fatalf("LSTAT: %d %o", typ, a.permissions)
+	}
+
+	names := c.readdir("/in")
+	if len(names) == 0 || names["data.csv"]&0777 != 0600 {
+		t.Fatalf("READDIR: %v", names)
+	}
+
+	// RENAME does not replace; posix-rename does.
+	h = c.open("other", fxfWrite|fxfCreat)
+	ok("CLOSE", c.status(fxpClose, func(e *encoder) { e.str(h) }))
+	if code := c.status(fxpRename, func(e *encoder) {
+		e.str("other")
+		e.str("in/data.csv")
+	}); code != fxFailure {
+		t.Fatalf("RENAME over a file: %d", code)
+	}
+	ok("posix-rename", c.status(fxpExtended, func(e *encoder) {
+		e.str("posix-rename@openssh.com")
+		e.str("other")
+		e.str("in/data.csv")
+	}))
+	ok("RENAME", c.status(fxpRename, func(e *encoder) {
+		e.str("in/data.csv")
+		e.str("out.csv")
+	}))
+
+	typ, d = c.call(fxpRealpath, func(e *encoder) { e.str("in/../.") })
+	if d.u32(); typ != fxpName || d.str() != "/" {
+		t.Fatalf("REALPATH: %d", typ)
+	}
+
+	ok("REMOVE", c.status(fxpRemove, func(e *encoder) { e.str("out.csv") }))
+	if code := c.status(fxpRemove, func(e *encoder) { e.str("out.csv") }); code != fxNoSuchFile {
+		t.Fatalf("REMOVE of a missing file: %d", code)
+	}
+	ok("RMDIR", c.status(fxpRmdir, func(e *encoder) { e.str("in") }))
+	if code := c.status(fxpExtended, func(e *encoder) { e.str("nope@example.com") }); code != fxOpUnsupported {
+		t.Fatalf("unknown extension: %d", code)
+	}
+}
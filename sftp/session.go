@@ -0,0 +1,258 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sftp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+)
+
+// handle is the state of an SFTP handle, an open file or directory.
+type handle struct {
+	path string
+
+	// file is nil for directories.
+	file   *openFile
+	append bool
+
+	// dirents is the listing of an open directory, and pos the next
+	// entry of READDIR.
+	dirents []fuse.DirEntry
+	pos     int
+}
+
+// session is an SFTP session. Requests are run one at a time, in the
+// order they arrive, which keeps the requests on a handle in order as
+// the protocol requires.
+type session struct {
+	srv    *Server
+	rw     io.ReadWriteCloser
+	caller fuse.Caller
+
+	// closed is the Cancel of every request; it is closed when the
+	// client goes away.
+	closed chan struct{}
+	done   chan struct{}
+
+	handles map[string]*handle
+	next    uint64
+}
+
+func newSession(srv *Server, rw io.ReadWriteCloser, caller fuse.Caller) *session {
+	return &session{
+		srv:     srv,
+		rw:      rw,
+		caller:  caller,
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+		handles: make(map[string]*handle),
+	}
+}
+
+func (ss *session) serve() error {
+	packets := make(chan []byte)
+	var rerr error
+	go func() {
+		defer close(packets)
+		defer close(ss.closed)
+		for {
+			pkt, err := ss.readPacket()
+			if err != nil {
+				rerr = err
+				return
+			}
+			select {
+			case packets <- pkt:
+			case <-ss.done:
+				return
+			}
+		}
+	}()
+	defer close(ss.done)
+	for pkt := range packets {
+		reply, err := ss.handle(pkt)
+		if err != nil {
+			return err
+		}
+		if _, err := ss.rw.Write(reply); err != nil {
+			return err
+		}
+	}
+	return rerr
+}
+
+func (ss *session) readPacket() ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(ss.rw, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n == 0 || n > ss.srv.options.MaxPacketSize {
+		return nil, fmt.Errorf("sftp: packet of %d bytes", n)
+	}
+	pkt := make([]byte, n)
+	if _, err := io.ReadFull(ss.rw, pkt); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// shutdown releases the handles left open.
+func (ss *session) shutdown() {
+	ctx := &pathfs.Context{}
+	ctx.Caller = ss.caller
+	for key, h := range ss.handles {
+		if h.file != nil {
+			h.file.close(ctx)
+		}
+		delete(ss.handles, key)
+	}
+}
+
+// request is an operation. It decodes its arguments from d and returns
+// its reply. It must check d.err before acting, and return nil if it is
+// set.
+type request func(ss *session, ctx *pathfs.Context, id uint32, d *decoder) *encoder
+
+var requests = map[uint8]request{
+	fxpOpen:     (*session).open,
+	fxpClose:    (*session).close,
+	fxpRead:     (*session).read,
+	fxpWrite:    (*session).write,
+	fxpLstat:    (*session).lstat,
+	fxpFstat:    (*session).fstat,
+	fxpSetstat:  (*session).setstat,
+	fxpFsetstat: (*session).fsetstat,
+	fxpOpendir:  (*session).opendir,
+	fxpReaddir:  (*session).readdir,
+	fxpRemove:   (*session).remove,
+	fxpMkdir:    (*session).mkdir,
+	fxpRmdir:    (*session).rmdir,
+	fxpRealpath: (*session).realpath,
+	fxpStat:     (*session).stat,
+	fxpRename:   (*session).rename,
+	fxpReadlink: (*session).readlink,
+	fxpSymlink:  (*session).symlink,
+	fxpExtended: (*session).extended,
+}
+
+// handle runs a packet and returns its reply.
+func (ss *session) handle(pkt []byte) ([]byte, error) {
+	d := &decoder{buf: pkt}
+	typ := d.u8()
+	if typ == fxpInit {
+		if v := d.u32(); v < 3 {
+			return nil, fmt.Errorf("sftp: version %d is not supported", v)
+		}
+		e := newPacket(fxpVersion, 3)
+		e.str("posix-rename@openssh.com")
+		e.str("1")
+		e.str("fsync@openssh.com")
+		e.str("1")
+		return e.packet(), nil
+	}
+	id := d.u32()
+	if d.err != nil {
+		return nil, d.err
+	}
+	req, ok := requests[typ]
+	if !ok {
+		return statusPacket(id, fxOpUnsupported, "unsupported request").packet(), nil
+	}
+
+	ctx := &pathfs.Context{}
+	ctx.Caller = ss.caller
+	ctx.Cancel = ss.closed
+	e := req(ss, ctx, id, d)
+	if d.err != nil {
+		ss.srv.logf("sftp: request %d: %v", typ, d.err)
+		return statusPacket(id, fxBadMessage, d.err.Error()).packet(), nil
+	}
+	return e.packet(), nil
+}
+
+func statusPacket(id uint32, code uint32, msg string) *encoder {
+	e := newPacket(fxpStatus, id)
+	e.u32(code)
+	e.str(msg)
+	e.str("")
+	return e
+}
+
+// status returns the STATUS reply of a FileSystem status.
+func status(id uint32, code fuse.Status) *encoder {
+	if code.Ok() {
+		return statusPacket(id, fxOK, "")
+	}
+	return statusPacket(id, statusOf(code), syscall.Errno(code).Error())
+}
+
+// addHandle adds h and returns the HANDLE reply.
+func (ss *session) addHandle(id uint32, h *handle) *encoder {
+	ss.next++
+	key := strconv.FormatUint(ss.next, 10)
+	ss.handles[key] = h
+	e := newPacket(fxpHandle, id)
+	e.str(key)
+	return e
+}
+
+// openFile is an open file of a session.
+type openFile struct {
+	path string
+	file *pathfs.File
+}
+
+func (ss *session) openFile(ctx *pathfs.Context, p string, flags uint32) (*openFile, fuse.Status) {
+	ctx.Opener = &ctx.Caller.Owner
+	file, _, _, code := pathfs.OpenFile(ctx, ss.srv.fs, p, flags)
+	if !code.Ok() {
+		return nil, code
+	}
+	return &openFile{path: p, file: file}, fuse.OK
+}
+
+func (ss *session) createFile(ctx *pathfs.Context, p string, flags uint32, mode uint32) (*openFile, fuse.Status) {
+	ctx.Opener = &ctx.Caller.Owner
+	file, _, code := pathfs.CreateFile(ctx, ss.srv.fs, p, flags|syscall.O_CREAT, mode|syscall.S_IFREG)
+	if !code.Ok() {
+		return nil, code
+	}
+	return &openFile{path: p, file: file}, fuse.OK
+}
+
+func (f *openFile) read(ctx *pathfs.Context, buf []byte, off uint64) ([]byte, fuse.Status) {
+	res, code := f.file.Read(ctx, f.path, buf, off)
+	if !code.Ok() {
+		return nil, code
+	}
+	defer res.Done()
+	return res.Bytes(buf)
+}
+
+func (f *openFile) write(ctx *pathfs.Context, data []byte, off uint64) (uint32, fuse.Status) {
+	return f.file.Write(ctx, f.path, data, off)
+}
+
+func (f *openFile) getAttr(ctx *pathfs.Context, out *fuse.Attr) fuse.Status {
+	return f.file.GetAttr(ctx, f.path, out)
+}
+
+func (f *openFile) fsync(ctx *pathfs.Context) fuse.Status {
+	return f.file.Fsync(ctx, f.path, 0)
+}
+
+func (f *openFile) close(ctx *pathfs.Context) fuse.Status {
+	return f.file.Close(ctx, f.path)
+}
@@ -0,0 +1,226 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Packet types of SFTP version 3, draft-ietf-secsh-filexfer-02.
+const (
+	fxpInit          = 1
+	fxpVersion       = 2
+	fxpOpen          = 3
+	fxpClose         = 4
+	fxpRead          = 5
+	fxpWrite         = 6
+	fxpLstat         = 7
+	fxpFstat         = 8
+	fxpSetstat       = 9
+	fxpFsetstat      = 10
+	fxpOpendir       = 11
+	fxpReaddir       = 12
+	fxpRemove        = 13
+	fxpMkdir         = 14
+	fxpRmdir         = 15
+	fxpRealpath      = 16
+	fxpStat          = 17
+	fxpRename        = 18
+	fxpReadlink      = 19
+	fxpSymlink       = 20
+	fxpStatus        = 101
+	fxpHandle        = 102
+	fxpData          = 103
+	fxpName          = 104
+	fxpAttrs         = 105
+	fxpExtended      = 200
+	fxpExtendedReply = 201
+)
+
+// Status codes.
+const (
+	fxOK               = 0
+	fxEOF              = 1
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxFailure          = 4
+	fxBadMessage       = 5
+	fxOpUnsupported    = 8
+)
+
+// Attribute flags.
+const (
+	attrSize        = 0x00000001
+	attrUIDGID      = 0x00000002
+	attrPermissions = 0x00000004
+	attrACModTime   = 0x00000008
+	attrExtended    = 0x80000000
+)
+
+// Open flags.
+const (
+	fxfRead   = 0x00000001
+	fxfWrite  = 0x00000002
+	fxfAppend = 0x00000004
+	fxfCreat  = 0x00000008
+	fxfTrunc  = 0x00000010
+	fxfExcl   = 0x00000020
+)
+
+var errShort = errors.New("sftp: packet too short")
+
+// decoder reads the SSH wire encoding. The first failure is kept in
+// err; later reads return zero values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) take(n uint32) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if uint64(len(d.buf)) < uint64(n) {
+		d.err = errShort
+		return nil
+	}
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8 {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) u32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) u64() uint64 {
+	if b := d.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) bytes() []byte {
+	return d.take(d.u32())
+}
+
+func (d *decoder) str() string {
+	return string(d.bytes())
+}
+
+// attrs is a decoded ATTRS.
+type attrs struct {
+	flags        uint32
+	size         uint64
+	uid, gid     uint32
+	permissions  uint32
+	atime, mtime uint32
+}
+
+func (d *decoder) attrs() attrs {
+	var a attrs
+	a.flags = d.u32()
+	if a.flags&attrSize != 0 {
+		a.size = d.u64()
+	}
+	if a.flags&attrUIDGID != 0 {
+		a.uid, a.gid = d.u32(), d.u32()
+	}
+	if a.flags&attrPermissions != 0 {
+		a.permissions = d.u32()
+	}
+	if a.flags&attrACModTime != 0 {
+		a.atime, a.mtime = d.u32(), d.u32()
+	}
+	if a.flags&attrExtended != 0 {
+		for n := d.u32(); n > 0 && d.err == nil; n-- {
+			d.str()
+			d.str()
+		}
+	}
+	return a
+}
+
+// encoder writes the SSH wire encoding of a packet. The first four
+// bytes are reserved for its length.
+type encoder struct {
+	buf []byte
+}
+
+func newPacket(typ uint8, id uint32) *encoder {
+	e := &encoder{buf: make([]byte, 4, 128)}
+	e.u8(typ)
+	e.u32(id)
+	return e
+}
+
+// packet returns the packet, with its length filled in.
+func (e *encoder) packet() []byte {
+	binary.BigEndian.PutUint32(e.buf, uint32(len(e.buf)-4))
+	return e.buf
+}
+
+func (e *encoder) u8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) u32(v uint32) {
+	e.buf = append(e.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *encoder) u64(v uint64) {
+	e.u32(uint32(v >> 32))
+	e.u32(uint32(v))
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.u32(uint32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) str(s string) {
+	e.u32(uint32(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// attrs writes the ATTRS of attr.
+func (e *encoder) attrs(attr *fuse.Attr) {
+	e.u32(attrSize | attrUIDGID | attrPermissions | attrACModTime)
+	e.u64(attr.Size)
+	e.u32(attr.Uid)
+	e.u32(attr.Gid)
+	e.u32(attr.Mode)
+	e.u32(uint32(attr.Atime))
+	e.u32(uint32(attr.Mtime))
+}
+
+// statusOf converts a status to an SFTP status code.
+func statusOf(code fuse.Status) uint32 {
+	switch syscall.Errno(code) {
+	case 0:
+		return fxOK
+	case syscall.ENOENT:
+		return fxNoSuchFile
+	case syscall.EACCES, syscall.EPERM:
+		return fxPermissionDenied
+	case syscall.ENOSYS, syscall.EOPNOTSUPP:
+		return fxOpUnsupported
+	}
+	return fxFailure
+}
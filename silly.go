@@ -0,0 +1,117 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"fmt"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// sillyPrefix starts the hidden names of Options.SillyRename.
+const sillyPrefix = ".pathfs_hidden"
+
+// sillyName returns a hidden name for n in parent.
+func (b *rawBridge) sillyName(parent *inode, n *inode) (string, fuse.Status) {
+	b.mu.Lock()
+	b.sillyCount++
+	count := b.sillyCount
+	b.mu.Unlock()
+
+	return b.entryPath(parent, fmt.Sprintf("%s%016x%08x", sillyPrefix, n.ino, count))
+}
+
+// needsSilly reports whether removing the name path of n would drop
+// the last name of an open file.
+func (b *rawBridge) needsSilly(n *inode) bool {
+	if !b.options.SillyRename || n == nil || n.isDir() {
+		return false
+	}
+	n.mu.Lock()
+	last := n.parents.count() == 1
+	n.mu.Unlock()
+	return last && b.hasOpenFiles(n.ino)
+}
+
+// sillyRename renames the file n at path in parent to a hidden name
+// instead of removing it, and points its open files there. The file
+// is removed by the last Release.
+func (b *rawBridge) sillyRename(ctx *Context, parent *inode, n *inode, path string) fuse.Status {
+	hidden, code := b.hideFile(ctx, parent, n, path)
+	if !code.Ok() {
+		return code
+	}
+	b.hidden(ctx, n, path, hidden)
+	return fuse.OK
+}
+
+// hideFile renames the file n at path in parent to a hidden name in
+// the FileSystem only, returning the name. Follow it with hidden, or
+// undo it.
+func (b *rawBridge) hideFile(ctx *Context, parent *inode, n *inode, path string) (string, fuse.Status) {
+	hidden, code := b.sillyName(parent, n)
+	if !code.Ok() {
+		return "", code
+	}
+	if code := b.fs.Rename(ctx, path, hidden); !code.Ok() {
+		return "", code
+	}
+	return hidden, fuse.OK
+}
+
+// hidden records that the file n at path was hidden by hideFile.
+// If the last file of n was released meanwhile, nothing will release
+// the hidden file, so it is removed right away.
+func (b *rawBridge) hidden(ctx *Context, n *inode, path string, hidden string) {
+	a := b.options.InoAllocator
+	if a != nil {
+		a.Rename(path, hidden)
+	}
+
+	b.mu.Lock()
+	open := b.hasOpenFilesLocked(n.ino)
+	if open {
+		b.setFilePathsLocked(n.ino, hidden)
+		if b.sillies == nil {
+			b.sillies = make(map[uint64]string)
+		}
+		b.sillies[n.ino] = hidden
+	}
+	b.mu.Unlock()
+	if open {
+		return
+	}
+
+	if code := b.fs.Unlink(ctx, hidden); !code.Ok() {
+		b.logf("warning: removing silly-renamed %q: %v", hidden, code)
+	}
+	if a != nil {
+		a.Remove(hidden)
+	}
+}
+
+// releaseSilly removes the hidden file of ino once its last file is
+// released.
+func (b *rawBridge) releaseSilly(ctx *Context, ino uint64) {
+	b.mu.Lock()
+	hidden, ok := b.sillies[ino]
+	if ok && b.hasOpenFilesLocked(ino) {
+		ok = false
+	}
+	if ok {
+		delete(b.sillies, ino)
+	}
+	b.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if code := b.fs.Unlink(ctx, hidden); !code.Ok() {
+		b.logf("warning: removing silly-renamed %q: %v", hidden, code)
+	}
+	if a := b.options.InoAllocator; a != nil {
+		a.Remove(hidden)
+	}
+}
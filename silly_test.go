@@ -0,0 +1,140 @@
+package pathfs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type sillyFileSystem struct {
+	unlinkFileSystem
+	ops []string
+	// failRename fails the renames of this path.
+	failRename string
+	// renamed is called after each rename.
+	renamed func(path string, newPath string)
+}
+
+func (s *sillyFileSystem) Unlink(ctx *Context, path string) fuse.Status {
+	s.ops = append(s.ops, "unlink "+path)
+	return fuse.OK
+}
+
+func (s *sillyFileSystem) Rename(ctx *Context, path string, newPath string) fuse.Status {
+	s.ops = append(s.ops, "rename "+path+" "+newPath)
+	if path == s.failRename {
+		return fuse.EIO
+	}
+	if s.renamed != nil {
+		s.renamed(path, newPath)
+	}
+	return fuse.OK
+}
+
+func TestSillyRename(t *testing.T) {
+	fs := &sillyFileSystem{}
+	b, fh := newUnlinkBridge(fs, &fs.mockFileSystem)
+	b.options.SillyRename = true
+
+	if code := b.Unlink(nil, &fuse.InHeader{NodeId: 1}, "f"); !code.Ok() {
+		t.Fatal(code)
+	}
+	if len(fs.ops) != 1 || !strings.HasPrefix(fs.ops[0], "rename f "+sillyPrefix) {
+		t.Fatalf("want a rename to a hidden name, have %v", fs.ops)
+	}
+	hidden := strings.Fields(fs.ops[0])[2]
+
+	readIn := &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: 100}, Fh: fh, Size: 1}
+	b.Read(nil, readIn, make([]byte, 1))
+	if len(fs.readPaths) != 1 || fs.readPaths[0] != hidden {
+		t.Errorf("want read of %s, have %v", hidden, fs.readPaths)
+	}
+
+	b.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: 100}, Fh: fh})
+	if len(fs.ops) != 2 || fs.ops[1] != "unlink "+hidden {
+		t.Errorf("want the hidden file removed at release, have %v", fs.ops)
+	}
+	if len(b.sillies) != 0 {
+		t.Errorf("want no silly-renamed files left, have %v", b.sillies)
+	}
+}
+
+func TestSillyRenameOver(t *testing.T) {
+	fs := &sillyFileSystem{}
+	b, fh := newUnlinkBridge(fs, &fs.mockFileSystem)
+	b.options.SillyRename = true
+
+	// closed files are removed as usual.
+	fs.getAttrFunc = func(path string) (fuse.Attr, fuse.Status) {
+		return fuse.Attr{Ino: 101, Mode: fuse.S_IFREG | 0644}, fuse.OK
+	}
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "g", &fuse.EntryOut{})
+	b.Unlink(nil, &fuse.InHeader{NodeId: 1}, "g")
+	if len(fs.ops) != 1 || fs.ops[0] != "unlink g" {
+		t.Fatalf("want a plain unlink, have %v", fs.ops)
+	}
+
+	fs.getAttrFunc = func(path string) (fuse.Attr, fuse.Status) {
+		return fuse.Attr{Ino: 102, Mode: fuse.S_IFREG | 0644}, fuse.OK
+	}
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "new", &fuse.EntryOut{})
+	fs.ops = nil
+	if code := b.Rename(nil, &fuse.RenameIn{InHeader: fuse.InHeader{NodeId: 1}, Newdir: 1}, "new", "f"); !code.Ok() {
+		t.Fatal(code)
+	}
+	if len(fs.ops) != 2 || !strings.HasPrefix(fs.ops[0], "rename f "+sillyPrefix) || fs.ops[1] != "rename new f" {
+		t.Errorf("want the open target hidden first, have %v", fs.ops)
+	}
+	b.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: 100}, Fh: fh})
+	if len(fs.ops) != 3 || !strings.HasPrefix(fs.ops[2], "unlink "+sillyPrefix) {
+		t.Errorf("want the hidden file removed at release, have %v", fs.ops)
+	}
+}
+
+func TestSillyRenameOverFails(t *testing.T) {
+	fs := &sillyFileSystem{failRename: "new"}
+	b, fh := newUnlinkBridge(fs, &fs.mockFileSystem)
+	b.options.SillyRename = true
+	f := b.child(b.root, "f")
+
+	fs.getAttrFunc = func(path string) (fuse.Attr, fuse.Status) {
+		return fuse.Attr{Ino: 102, Mode: fuse.S_IFREG | 0644}, fuse.OK
+	}
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "new", &fuse.EntryOut{})
+	if code := b.Rename(nil, &fuse.RenameIn{InHeader: fuse.InHeader{NodeId: 1}, Newdir: 1}, "new", "f"); code != fuse.EIO {
+		t.Fatalf("want EIO, have %v", code)
+	}
+	if len(fs.ops) != 3 || fs.ops[2] != "rename "+strings.Fields(fs.ops[0])[2]+" f" {
+		t.Errorf("want the open target put back, have %v", fs.ops)
+	}
+	if b.child(b.root, "f") != f || len(b.sillies) != 0 || b.files[fh].path != "f" {
+		t.Errorf("want the target kept in the tree, have sillies %v, path %q", b.sillies, b.files[fh].path)
+	}
+}
+
+func TestSillyRenameOverReleased(t *testing.T) {
+	fs := &sillyFileSystem{}
+	b, fh := newUnlinkBridge(fs, &fs.mockFileSystem)
+	b.options.SillyRename = true
+
+	// the target is released between hiding it and recording it.
+	fs.renamed = func(path string, newPath string) {
+		if strings.HasPrefix(newPath, sillyPrefix) {
+			b.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: 100}, Fh: fh})
+		}
+	}
+	fs.getAttrFunc = func(path string) (fuse.Attr, fuse.Status) {
+		return fuse.Attr{Ino: 102, Mode: fuse.S_IFREG | 0644}, fuse.OK
+	}
+	b.Lookup(nil, &fuse.InHeader{NodeId: 1}, "new", &fuse.EntryOut{})
+	if code := b.Rename(nil, &fuse.RenameIn{InHeader: fuse.InHeader{NodeId: 1}, Newdir: 1}, "new", "f"); !code.Ok() {
+		t.Fatal(code)
+	}
+	if len(fs.ops) != 3 || fs.ops[2] != "unlink "+strings.Fields(fs.ops[0])[2] {
+		t.Errorf("want the hidden file removed, have %v", fs.ops)
+	}
+	if len(b.sillies) != 0 {
+		t.Errorf("want no silly-renamed files left, have %v", b.sillies)
+	}
+}
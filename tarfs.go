@@ -0,0 +1,130 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// NewTarFileSystem returns a read-only FileSystem serving the tar
+// archive in r, of size bytes. The archive is scanned once to index
+// its members and where the content of each starts, so a Read is a
+// ReadAt of r. Inode numbers follow the order of the members, and hard
+// links share theirs. The content of sparse members is kept in memory.
+func NewTarFileSystem(r io.ReaderAt, size int64) (FileSystem, error) {
+	fsys, err := newTarFileSystem(r, size, nil)
+	if err != nil {
+		return nil, err
+	}
+	return fsys, nil
+}
+
+// NewTarGzFileSystem returns a read-only FileSystem serving the
+// gzipped tar archive read from r, as NewTarFileSystem does. As gzip
+// can't be read at random, the archive is first decompressed to an
+// unlinked file in dir, or os.TempDir if dir is empty. The FileSystem
+// is an io.Closer that closes the file.
+func NewTarGzFileSystem(r io.Reader, dir string) (FileSystem, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	f, err := os.CreateTemp(dir, "pathfs-tar-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	size, err := io.Copy(f, zr)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	fsys, err := newTarFileSystem(f, size, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return fsys, nil
+}
+
+// isSparse reports whether the content of a member is not stored as
+// one run.
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+func newTarFileSystem(r io.ReaderAt, size int64, closer io.Closer) (*archiveFileSystem, error) {
+	sr := io.NewSectionReader(r, 0, size)
+	tr := tar.NewReader(sr)
+	x := newArchiveIndex()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		p, ok := archivePath(hdr.Name)
+		if !ok {
+			continue
+		}
+		e := &archiveEntry{}
+		e.attr.Mode = uint32(hdr.Mode) & 07777
+		e.attr.Uid = uint32(hdr.Uid)
+		e.attr.Gid = uint32(hdr.Gid)
+		setArchiveTimes(&e.attr, hdr.ModTime, hdr.AccessTime, hdr.ChangeTime)
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeGNUSparse:
+			e.attr.Mode |= syscall.S_IFREG
+			e.attr.Size = uint64(hdr.Size)
+			if isSparse(hdr) {
+				if e.data, err = io.ReadAll(tr); err != nil {
+					return nil, err
+				}
+				e.attr.Size = uint64(len(e.data))
+			} else if e.off, err = sr.Seek(0, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+		case tar.TypeDir:
+			e.attr.Mode |= syscall.S_IFDIR
+		case tar.TypeSymlink:
+			e.attr.Mode |= syscall.S_IFLNK
+			e.target = hdr.Linkname
+			e.attr.Size = uint64(len(hdr.Linkname))
+		case tar.TypeLink:
+			if target, ok := archivePath(hdr.Linkname); ok {
+				x.link(p, target)
+			}
+			continue
+		case tar.TypeChar:
+			e.attr.Mode |= syscall.S_IFCHR
+			e.attr.Rdev = MakeDev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		case tar.TypeBlock:
+			e.attr.Mode |= syscall.S_IFBLK
+			e.attr.Rdev = MakeDev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		case tar.TypeFifo:
+			e.attr.Mode |= syscall.S_IFIFO
+		default:
+			continue
+		}
+		x.add(p, e)
+	}
+	return x.fileSystem(r, closer), nil
+}
@@ -1,18 +1,30 @@
 package pathfs
 
 import (
+	"encoding/json"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 )
 
+type testFile struct {
+	fd    int
+	path  string
+	flags uint32
+}
+
 type testFileSystem struct {
 	defaultFileSystem
 	root string
 
+	mu     sync.Mutex
+	files  map[uint32]*testFile
+	nextFh uint32
+
 	xattrs map[string]map[string][]byte
 }
 
@@ -32,6 +44,8 @@ func NewTestFileSystem(root string) FileSystem {
 
 	return &testFileSystem{
 		root:   root,
+		files:  make(map[uint32]*testFile),
+		nextFh: 1,
 		xattrs: make(map[string]map[string][]byte),
 	}
 }
@@ -40,6 +54,25 @@ func (fs *testFileSystem) absPath(relPath string) string {
 	return filepath.Join(fs.root, relPath)
 }
 
+// addFile maps an open fd to a uFh that stays valid across Dump/Restore.
+func (fs *testFileSystem) addFile(fd int, path string, flags uint32) uint32 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	uFh := fs.nextFh
+	fs.nextFh++
+	fs.files[uFh] = &testFile{fd, path, flags}
+	return uFh
+}
+
+func (fs *testFileSystem) fd(uFh uint32) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if f := fs.files[uFh]; f != nil {
+		return f.fd
+	}
+	return -1
+}
+
 func (fs *testFileSystem) GetAttr(ctx *Context, path string, uFh uint32, out *fuse.Attr) fuse.Status {
 	st := syscall.Stat_t{}
 	err := syscall.Lstat(fs.absPath(path), &st)
@@ -72,7 +105,34 @@ func (fs *testFileSystem) Rmdir(ctx *Context, path string) (code fuse.Status) {
 }
 
 func (fs *testFileSystem) Rename(ctx *Context, path string, newPath string) fuse.Status {
-	return fuse.ToStatus(syscall.Rename(fs.absPath(path), fs.absPath(newPath)))
+	if err := syscall.Rename(fs.absPath(path), fs.absPath(newPath)); err != nil {
+		return fuse.ToStatus(err)
+	}
+
+	// the extended attributes go with the files.
+	moved := make(map[string]map[string][]byte)
+	for p, m := range fs.xattrs {
+		if _, ok := underPath(p, newPath); ok {
+			delete(fs.xattrs, p)
+		}
+		if rest, ok := underPath(p, path); ok {
+			moved[newPath+rest] = m
+			delete(fs.xattrs, p)
+		}
+	}
+	for p, m := range moved {
+		fs.xattrs[p] = m
+	}
+
+	// so do the open files, to reopen them at RestoreState.
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, f := range fs.files {
+		if rest, ok := underPath(f.path, path); ok {
+			f.path = newPath + rest
+		}
+	}
+	return fuse.OK
 }
 
 func (fs *testFileSystem) Link(ctx *Context, path string, newPath string) fuse.Status {
@@ -96,7 +156,7 @@ func (fs *testFileSystem) Create(ctx *Context, path string, flags uint32, mode u
 		code = fuse.ToStatus(err)
 		return
 	}
-	uFh = uint32(fd)
+	uFh = fs.addFile(fd, path, flags)
 	return
 }
 
@@ -108,7 +168,7 @@ func (fs *testFileSystem) Open(ctx *Context, path string, flags uint32) (uFh uin
 		code = fuse.ToStatus(err)
 		return
 	}
-	uFh = uint32(fd)
+	uFh = fs.addFile(fd, path, flags)
 	return
 }
 
@@ -124,7 +184,7 @@ func (fs *testFileSystem) Read(ctx *Context, path string, uFh uint32, dest []byt
 			return nil, fuse.ToStatus(err)
 		}
 	} else {
-		fd = int(uFh)
+		fd = fs.fd(uFh)
 	}
 
 	sz, err = syscall.Pread(fd, dest, int64(off))
@@ -144,7 +204,7 @@ func (fs *testFileSystem) Write(ctx *Context, path string, uFh uint32, data []by
 			return 0, fuse.ToStatus(err)
 		}
 	} else {
-		fd = int(uFh)
+		fd = fs.fd(uFh)
 	}
 
 	sz, err = syscall.Pwrite(fd, data, int64(off))
@@ -154,22 +214,26 @@ func (fs *testFileSystem) Write(ctx *Context, path string, uFh uint32, data []by
 
 func (fs *testFileSystem) Fsync(ctx *Context, path string, uFh uint32, flags uint32) fuse.Status {
 	if uFh != 0 {
-		return fuse.ToStatus(syscall.Fsync(int(uFh)))
+		return fuse.ToStatus(syscall.Fsync(fs.fd(uFh)))
 	} else {
 		return fuse.OK
 	}
 }
 
 func (fs *testFileSystem) Release(ctx *Context, path string, uFh uint32) {
-	if uFh != 0 {
-		syscall.Close(int(uFh))
+	fs.mu.Lock()
+	f := fs.files[uFh]
+	delete(fs.files, uFh)
+	fs.mu.Unlock()
+	if f != nil {
+		syscall.Close(f.fd)
 	}
 }
 
 func (fs *testFileSystem) Chmod(ctx *Context, path string, uFh uint32, mode uint32) fuse.Status {
 	var err error
 	if uFh != 0 {
-		err = syscall.Fchmod(int(uFh), mode)
+		err = syscall.Fchmod(fs.fd(uFh), mode)
 	} else {
 		err = syscall.Chmod(fs.absPath(path), mode)
 	}
@@ -184,7 +248,7 @@ func (fs *testFileSystem) Chown(ctx *Context, path string, uFh uint32, uid uint3
 func (fs *testFileSystem) Truncate(ctx *Context, path string, uFh uint32, size uint64) fuse.Status {
 	var err error
 	if uFh != 0 {
-		err = syscall.Ftruncate(int(uFh), int64(size))
+		err = syscall.Ftruncate(fs.fd(uFh), int64(size))
 	} else {
 		err = os.Truncate(fs.absPath(path), int64(size))
 	}
@@ -236,7 +300,7 @@ func (fs *testFileSystem) StatFs(ctx *Context, path string, out *fuse.StatfsOut)
 func (fs *testFileSystem) Utimens(ctx *Context, path string, uFh uint32, atime *time.Time, mtime *time.Time) fuse.Status {
 	var err error
 	if uFh != 0 {
-		err = fUtimes(int(uFh), atime, mtime)
+		err = fUtimes(fs.fd(uFh), atime, mtime)
 	} else {
 		err = utimes(fs.absPath(path), atime, mtime)
 	}
@@ -290,3 +354,60 @@ func (fs *testFileSystem) RemoveXAttr(ctx *Context, path string, attr string) fu
 	}
 	return fuse.OK
 }
+
+type testFileState struct {
+	Path  string
+	Flags uint32
+}
+
+type testFileSystemState struct {
+	Files  map[uint32]testFileState
+	NextFh uint32
+	XAttrs map[string]map[string][]byte
+}
+
+func (fs *testFileSystem) DumpState() ([]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	state := testFileSystemState{
+		Files:  make(map[uint32]testFileState, len(fs.files)),
+		NextFh: fs.nextFh,
+		XAttrs: fs.xattrs,
+	}
+	for uFh, f := range fs.files {
+		state.Files[uFh] = testFileState{f.path, f.flags}
+	}
+	return json.Marshal(&state)
+}
+
+// RestoreState reopens the files of the dumped handle table under
+// their old uFh values.
+func (fs *testFileSystem) RestoreState(data []byte) error {
+	var state testFileSystemState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	files := make(map[uint32]*testFile, len(state.Files))
+	for uFh, f := range state.Files {
+		flags := f.Flags &^ (syscall.O_CREAT | syscall.O_EXCL | syscall.O_TRUNC)
+		fd, err := syscall.Open(fs.absPath(f.Path), int(flags), 0)
+		if err != nil {
+			for _, f := range files {
+				syscall.Close(f.fd)
+			}
+			return err
+		}
+		files[uFh] = &testFile{fd, f.Path, f.Flags}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.files = files
+	fs.nextFh = state.NextFh
+	if state.XAttrs != nil {
+		fs.xattrs = state.XAttrs
+	}
+	return nil
+}
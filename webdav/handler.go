@@ -0,0 +1,666 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package webdav serves a pathfs.FileSystem over WebDAV (RFC 4918),
+// for browsers and office tools.
+//
+// The Handler is self-contained and implements class 1 and 2: GET,
+// PUT, DELETE, MKCOL, COPY, MOVE, PROPFIND, PROPPATCH, LOCK and
+// UNLOCK. Collections map to directories. Dead properties are stored
+// as extended attributes named "user.webdav." followed by the
+// property's name in Clark notation, {namespace}local, and hold the
+// property's inner XML. Locks are kept in memory.
+package webdav
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+)
+
+// Options sets options for a Handler.
+type Options struct {
+	// Prefix is the URL path the FileSystem is served at, such as
+	// "/dav". It is stripped from request paths.
+	Prefix string
+
+	// Caller is the caller of the FileSystem requests.
+	Caller fuse.Caller
+
+	// Logger is a sink for diagnostic messages, such as failed
+	// requests. If unset, no messages are printed.
+	Logger *log.Logger
+}
+
+// Handler serves a FileSystem over WebDAV.
+type Handler struct {
+	// tempCount numbers the temporary names of COPY and MOVE.
+	// Accessed atomically; kept first for alignment.
+	tempCount uint64
+	// tempID tells the temporary names of this Handler from those
+	// left behind by others.
+	tempID string
+
+	fs      pathfs.FileSystem
+	options Options
+	locks   lockTable
+}
+
+// NewHandler returns a Handler for fs. options may be nil.
+func NewHandler(fs pathfs.FileSystem, options *Options) *Handler {
+	h := &Handler{fs: fs}
+	if options != nil {
+		h.options = *options
+	}
+	h.options.Prefix = strings.TrimRight(h.options.Prefix, "/")
+	h.locks.init()
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err == nil {
+		h.tempID = fmt.Sprintf("%x", id)
+	} else {
+		h.tempID = fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return h
+}
+
+func (h *Handler) logf(format string, args ...interface{}) {
+	if h.options.Logger != nil {
+		h.options.Logger.Printf(format, args...)
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, ok := h.fsPath(r.URL.Path)
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	ctx := &pathfs.Context{}
+	ctx.Caller = h.options.Caller
+	ctx.Cancel = r.Context().Done()
+
+	var status int
+	var err error
+	switch r.Method {
+	case "OPTIONS":
+		status, err = h.handleOptions(ctx, w, r, p)
+	case "GET", "HEAD":
+		status, err = h.handleGet(ctx, w, r, p)
+	case "PUT":
+		status, err = h.handlePut(ctx, w, r, p)
+	case "DELETE":
+		status, err = h.handleDelete(ctx, w, r, p)
+	case "MKCOL":
+		status, err = h.handleMkcol(ctx, w, r, p)
+	case "COPY", "MOVE":
+		status, err = h.handleCopyMove(ctx, w, r, p)
+	case "PROPFIND":
+		status, err = h.handlePropfind(ctx, w, r, p)
+	case "PROPPATCH":
+		status, err = h.handleProppatch(ctx, w, r, p)
+	case "LOCK":
+		status, err = h.handleLock(ctx, w, r, p)
+	case "UNLOCK":
+		status, err = h.handleUnlock(ctx, w, r, p)
+	default:
+		status = http.StatusMethodNotAllowed
+	}
+	if err != nil {
+		h.logf("webdav: %s %s: %v", r.Method, r.URL.Path, err)
+	}
+	if status != 0 {
+		w.WriteHeader(status)
+		if status >= 400 {
+			fmt.Fprintln(w, http.StatusText(status))
+		}
+	}
+}
+
+// fsPath returns the FileSystem path of a URL path.
+func (h *Handler) fsPath(urlPath string) (string, bool) {
+	if !strings.HasPrefix(urlPath, h.options.Prefix) {
+		return "", false
+	}
+	rest := urlPath[len(h.options.Prefix):]
+	if rest != "" && rest[0] != '/' {
+		return "", false
+	}
+	return strings.TrimPrefix(path.Clean("/"+rest), "/"), true
+}
+
+// href returns the URL path of p, with a trailing slash for
+// collections.
+func (h *Handler) href(p string, dir bool) string {
+	u := h.options.Prefix + "/" + (&url.URL{Path: p}).EscapedPath()
+	if dir && p != "" {
+		u += "/"
+	}
+	return u
+}
+
+func parentPath(p string) string {
+	if i := strings.LastIndexByte(p, '/'); i >= 0 {
+		return p[:i]
+	}
+	return ""
+}
+
+func childPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// httpStatus converts a status to an HTTP status.
+func httpStatus(code fuse.Status) int {
+	switch syscall.Errno(code) {
+	case 0:
+		return http.StatusOK
+	case syscall.ENOENT:
+		return http.StatusNotFound
+	case syscall.EACCES, syscall.EPERM, syscall.EROFS:
+		return http.StatusForbidden
+	case syscall.EEXIST, syscall.EISDIR:
+		return http.StatusMethodNotAllowed
+	case syscall.ENOTDIR, syscall.ENOTEMPTY:
+		return http.StatusConflict
+	case syscall.ENOSPC, syscall.EDQUOT:
+		return http.StatusInsufficientStorage
+	case syscall.ENOSYS, syscall.EOPNOTSUPP:
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
+
+func statusError(code fuse.Status) error {
+	return syscall.Errno(code)
+}
+
+// etag returns the ETag of a file with attr.
+func etag(attr *fuse.Attr) string {
+	return fmt.Sprintf(`"%x%x"`, attr.Mtime*1e9+uint64(attr.Mtimensec), attr.Size)
+}
+
+func modTime(attr *fuse.Attr) time.Time {
+	return time.Unix(int64(attr.Mtime), int64(attr.Mtimensec))
+}
+
+func (h *Handler) handleOptions(ctx *pathfs.Context, w http.ResponseWriter, r *http.Request, p string) (int, error) {
+	allow := "OPTIONS, LOCK, PUT, MKCOL"
+	var attr fuse.Attr
+	if code := h.fs.GetAttr(ctx, p, 0, &attr); code.Ok() {
+		if attr.IsDir() {
+			allow = "OPTIONS, LOCK, GET, HEAD, DELETE, PROPPATCH, COPY, MOVE, UNLOCK, PROPFIND"
+		} else {
+			allow = "OPTIONS, LOCK, GET, HEAD, DELETE, PROPPATCH, COPY, MOVE, UNLOCK, PROPFIND, PUT"
+		}
+	}
+	w.Header().Set("Allow", allow)
+	w.Header().Set("DAV", "1, 2")
+	w.Header().Set("MS-Author-Via", "DAV")
+	return http.StatusOK, nil
+}
+
+// fileReader reads an open file, for http.ServeContent.
+type fileReader struct {
+	f    *openFile
+	off  int64
+	size int64
+}
+
+func (fr *fileReader) Read(b []byte) (int, error) {
+	if fr.off >= fr.size {
+		return 0, io.EOF
+	}
+	data, code := fr.f.read(b, uint64(fr.off))
+	if !code.Ok() {
+		return 0, statusError(code)
+	}
+	if len(data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, data)
+	fr.off += int64(n)
+	return n, nil
+}
+
+func (fr *fileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += fr.off
+	case io.SeekEnd:
+		offset += fr.size
+	}
+	if offset < 0 {
+		return 0, syscall.EINVAL
+	}
+	fr.off = offset
+	return offset, nil
+}
+
+func (h *Handler) handleGet(ctx *pathfs.Context, w http.ResponseWriter, r *http.Request, p string) (int, error) {
+	var attr fuse.Attr
+	if code := h.fs.GetAttr(ctx, p, 0, &attr); !code.Ok() {
+		return httpStatus(code), nil
+	}
+	if attr.IsDir() {
+		return h.listing(ctx, w, r, p)
+	}
+
+	f, code := h.open(ctx, p, syscall.O_RDONLY)
+	if !code.Ok() {
+		return httpStatus(code), statusError(code)
+	}
+	defer f.close()
+	w.Header().Set("ETag", etag(&attr))
+	if ct := mime.TypeByExtension(path.Ext(p)); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	http.ServeContent(w, r, path.Base(p), modTime(&attr), &fileReader{f: f, size: int64(attr.Size)})
+	return 0, nil
+}
+
+// listing writes an HTML index of a collection, for browsers.
+func (h *Handler) listing(ctx *pathfs.Context, w http.ResponseWriter, r *http.Request, p string) (int, error) {
+	entries, code := h.fs.Lsdir(ctx, p)
+	if !code.Ok() {
+		return httpStatus(code), statusError(code)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == "HEAD" {
+		return http.StatusOK, nil
+	}
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<ul>\n")
+	for _, e := range entries {
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+		dir := e.Mode&syscall.S_IFMT == syscall.S_IFDIR
+		name := e.Name
+		if dir {
+			name += "/"
+		}
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a></li>\n",
+			escapeXML(h.href(childPath(p, e.Name), dir)), escapeXML(name))
+	}
+	fmt.Fprintf(w, "</ul>\n")
+	return 0, nil
+}
+
+// copyBufSize is the size of the reads and writes of PUT and COPY.
+const copyBufSize = 128 << 10
+
+func (h *Handler) handlePut(ctx *pathfs.Context, w http.ResponseWriter, r *http.Request, p string) (int, error) {
+	if p == "" {
+		return http.StatusMethodNotAllowed, nil
+	}
+	if status := h.checkLocks(r, p, false); status != 0 {
+		return status, nil
+	}
+	var attr fuse.Attr
+	code := h.fs.GetAttr(ctx, p, 0, &attr)
+	created := code == fuse.ENOENT
+	if code.Ok() && attr.IsDir() {
+		return http.StatusMethodNotAllowed, nil
+	}
+	if !code.Ok() && !created {
+		return httpStatus(code), statusError(code)
+	}
+
+	var f *openFile
+	if created {
+		f, code = h.create(ctx, p, syscall.O_WRONLY|syscall.O_TRUNC, 0644)
+		if code == fuse.ENOENT || code == fuse.Status(syscall.ENOTDIR) {
+			return http.StatusConflict, nil
+		}
+	} else {
+		f, code = h.open(ctx, p, syscall.O_WRONLY|syscall.O_TRUNC)
+	}
+	if !code.Ok() {
+		return httpStatus(code), statusError(code)
+	}
+	_, err := f.readFrom(r.Body)
+	if code := f.close(); err == nil && !code.Ok() {
+		err = statusError(code)
+	}
+	if err != nil {
+		if errno, ok := err.(syscall.Errno); ok {
+			return httpStatus(fuse.Status(errno)), err
+		}
+		return http.StatusInternalServerError, err
+	}
+
+	if h.fs.GetAttr(ctx, p, 0, &attr).Ok() {
+		w.Header().Set("ETag", etag(&attr))
+	}
+	if created {
+		return http.StatusCreated, nil
+	}
+	return http.StatusNoContent, nil
+}
+
+// removeAll removes p and everything below it.
+func (h *Handler) removeAll(ctx *pathfs.Context, p string) fuse.Status {
+	var attr fuse.Attr
+	if code := h.fs.GetAttr(ctx, p, 0, &attr); !code.Ok() {
+		return code
+	}
+	if !attr.IsDir() {
+		return h.fs.Unlink(ctx, p)
+	}
+	entries, code := h.fs.Lsdir(ctx, p)
+	if !code.Ok() {
+		return code
+	}
+	for _, e := range entries {
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+		if code := h.removeAll(ctx, childPath(p, e.Name)); !code.Ok() {
+			return code
+		}
+	}
+	return h.fs.Rmdir(ctx, p)
+}
+
+func (h *Handler) handleDelete(ctx *pathfs.Context, w http.ResponseWriter, r *http.Request, p string) (int, error) {
+	if p == "" {
+		return http.StatusForbidden, nil
+	}
+	if status := h.checkLocks(r, p, true); status != 0 {
+		return status, nil
+	}
+	if code := h.removeAll(ctx, p); !code.Ok() {
+		return httpStatus(code), statusError(code)
+	}
+	h.locks.remove(p)
+	return http.StatusNoContent, nil
+}
+
+func (h *Handler) handleMkcol(ctx *pathfs.Context, w http.ResponseWriter, r *http.Request, p string) (int, error) {
+	if r.ContentLength > 0 {
+		return http.StatusUnsupportedMediaType, nil
+	}
+	if status := h.checkLocks(r, p, false); status != 0 {
+		return status, nil
+	}
+	code := h.fs.Mkdir(ctx, p, 0755)
+	switch {
+	case code == fuse.ENOENT || code == fuse.Status(syscall.ENOTDIR):
+		return http.StatusConflict, nil
+	case !code.Ok():
+		return httpStatus(code), nil
+	}
+	return http.StatusCreated, nil
+}
+
+// destination returns the FileSystem path of the Destination header.
+func (h *Handler) destination(r *http.Request) (string, int) {
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || u.Path == "" {
+		return "", http.StatusBadRequest
+	}
+	if u.Host != "" && u.Host != r.Host {
+		return "", http.StatusBadGateway
+	}
+	p, ok := h.fsPath(u.Path)
+	if !ok {
+		return "", http.StatusBadGateway
+	}
+	return p, 0
+}
+
+func (h *Handler) handleCopyMove(ctx *pathfs.Context, w http.ResponseWriter, r *http.Request, p string) (int, error) {
+	dst, status := h.destination(r)
+	if status != 0 {
+		return status, nil
+	}
+	move := r.Method == "MOVE"
+	if p == dst || strings.HasPrefix(dst+"/", p+"/") || p == "" || dst == "" {
+		return http.StatusForbidden, nil
+	}
+	depthInfinity := true
+	switch r.Header.Get("Depth") {
+	case "", "infinity":
+	case "0":
+		if move {
+			return http.StatusBadRequest, nil
+		}
+		depthInfinity = false
+	default:
+		return http.StatusBadRequest, nil
+	}
+	if move {
+		if status := h.checkLocks(r, p, true); status != 0 {
+			return status, nil
+		}
+	}
+	if status := h.checkLocks(r, dst, true); status != 0 {
+		return status, nil
+	}
+
+	var attr fuse.Attr
+	if code := h.fs.GetAttr(ctx, p, 0, &attr); !code.Ok() {
+		return httpStatus(code), nil
+	}
+	var parent fuse.Attr
+	if code := h.fs.GetAttr(ctx, parentPath(dst), 0, &parent); !code.Ok() || !parent.IsDir() {
+		return http.StatusConflict, nil
+	}
+	var old fuse.Attr
+	exists := h.fs.GetAttr(ctx, dst, 0, &old).Ok()
+	if exists && r.Header.Get("Overwrite") == "F" {
+		return http.StatusPreconditionFailed, nil
+	}
+
+	// the destination is replaced by a rename, so that it survives a
+	// failed request.
+	src, code := p, fuse.OK
+	if !move {
+		src = h.tempName(ctx, dst, "copy")
+		code = h.copyTree(ctx, p, src, depthInfinity)
+	}
+	if code.Ok() {
+		code = h.replace(ctx, src, dst, attr.IsDir(), exists && old.IsDir(), exists)
+	}
+	if !code.Ok() {
+		if !move {
+			if code := h.removeAll(ctx, src); !code.Ok() && code != fuse.ENOENT {
+				h.logf("webdav: removing the copy %q: %v", src, code)
+			}
+		}
+		return httpStatus(code), statusError(code)
+	}
+	if move {
+		h.locks.remove(p)
+	}
+	if exists {
+		h.locks.remove(dst)
+		return http.StatusNoContent, nil
+	}
+	return http.StatusCreated, nil
+}
+
+// tempName returns an unused hidden name next to p. The names are
+// unique to the Handler, and any name that exists is skipped.
+func (h *Handler) tempName(ctx *pathfs.Context, p string, kind string) string {
+	var attr fuse.Attr
+	for {
+		n := atomic.AddUint64(&h.tempCount, 1)
+		name := childPath(parentPath(p), fmt.Sprintf(".webdav-%s-%s-%d-%s", kind, h.tempID, n, path.Base(p)))
+		if !h.fs.GetAttr(ctx, name, 0, &attr).Ok() {
+			return name
+		}
+	}
+}
+
+// replace renames src to dst. A file replaces a file atomically; a
+// directory on either side is moved aside first, removed once the
+// rename is done, and put back if it fails.
+func (h *Handler) replace(ctx *pathfs.Context, src, dst string, srcDir, dstDir, exists bool) fuse.Status {
+	if !exists || !srcDir && !dstDir {
+		return h.fs.Rename(ctx, src, dst)
+	}
+	aside := h.tempName(ctx, dst, "old")
+	if code := h.fs.Rename(ctx, dst, aside); !code.Ok() {
+		return code
+	}
+	if code := h.fs.Rename(ctx, src, dst); !code.Ok() {
+		if code := h.fs.Rename(ctx, aside, dst); !code.Ok() {
+			h.logf("webdav: restoring %q from %q: %v", dst, aside, code)
+		}
+		return code
+	}
+	if code := h.removeAll(ctx, aside); !code.Ok() {
+		h.logf("webdav: removing replaced %q: %v", aside, code)
+	}
+	return fuse.OK
+}
+
+// copyTree copies src to dst, and what is below it if recursive.
+func (h *Handler) copyTree(ctx *pathfs.Context, src, dst string, recursive bool) fuse.Status {
+	var attr fuse.Attr
+	if code := h.fs.GetAttr(ctx, src, 0, &attr); !code.Ok() {
+		return code
+	}
+	var code fuse.Status
+	switch attr.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		code = h.fs.Mkdir(ctx, dst, attr.Mode&07777)
+	case syscall.S_IFLNK:
+		var target string
+		if target, code = h.fs.Readlink(ctx, src); code.Ok() {
+			code = h.fs.Symlink(ctx, dst, target)
+		}
+	default:
+		code = h.copyFile(ctx, src, dst, attr.Mode&07777)
+	}
+	if !code.Ok() {
+		return code
+	}
+	if code := h.copyProps(ctx, src, dst); !code.Ok() {
+		return code
+	}
+	if !attr.IsDir() || !recursive {
+		return fuse.OK
+	}
+
+	entries, code := h.fs.Lsdir(ctx, src)
+	if !code.Ok() {
+		return code
+	}
+	for _, e := range entries {
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+		if code := h.copyTree(ctx, childPath(src, e.Name), childPath(dst, e.Name), true); !code.Ok() {
+			return code
+		}
+	}
+	return fuse.OK
+}
+
+func (h *Handler) copyFile(ctx *pathfs.Context, src, dst string, mode uint32) fuse.Status {
+	in, code := h.open(ctx, src, syscall.O_RDONLY)
+	if !code.Ok() {
+		return code
+	}
+	defer in.close()
+	out, code := h.create(ctx, dst, syscall.O_WRONLY|syscall.O_EXCL, mode)
+	if !code.Ok() {
+		return code
+	}
+	_, err := out.readFrom(&fileReader{f: in, size: 1<<63 - 1})
+	if code := out.close(); err == nil && !code.Ok() {
+		err = statusError(code)
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		return fuse.Status(errno)
+	}
+	if err != nil {
+		return fuse.EIO
+	}
+	return fuse.OK
+}
+
+// openFile is a file open for a single request.
+type openFile struct {
+	ctx  *pathfs.Context
+	path string
+	file *pathfs.File
+}
+
+func (h *Handler) open(ctx *pathfs.Context, p string, flags uint32) (*openFile, fuse.Status) {
+	ctx.Opener = &ctx.Caller.Owner
+	file, _, _, code := pathfs.OpenFile(ctx, h.fs, p, flags)
+	if !code.Ok() {
+		return nil, code
+	}
+	return &openFile{ctx: ctx, path: p, file: file}, fuse.OK
+}
+
+func (h *Handler) create(ctx *pathfs.Context, p string, flags uint32, mode uint32) (*openFile, fuse.Status) {
+	ctx.Opener = &ctx.Caller.Owner
+	file, _, code := pathfs.CreateFile(ctx, h.fs, p, flags|syscall.O_CREAT, mode|syscall.S_IFREG)
+	if !code.Ok() {
+		return nil, code
+	}
+	return &openFile{ctx: ctx, path: p, file: file}, fuse.OK
+}
+
+func (f *openFile) read(buf []byte, off uint64) ([]byte, fuse.Status) {
+	res, code := f.file.Read(f.ctx, f.path, buf, off)
+	if !code.Ok() {
+		return nil, code
+	}
+	defer res.Done()
+	return res.Bytes(buf)
+}
+
+func (f *openFile) write(data []byte, off uint64) (uint32, fuse.Status) {
+	return f.file.Write(f.ctx, f.path, data, off)
+}
+
+// readFrom writes all of r to the file from offset 0.
+func (f *openFile) readFrom(r io.Reader) (int64, error) {
+	buf := make([]byte, copyBufSize)
+	var off int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		for done := 0; done < n; {
+			written, code := f.write(buf[done:n], uint64(off))
+			if !code.Ok() {
+				return off, statusError(code)
+			}
+			if written == 0 {
+				return off, io.ErrShortWrite
+			}
+			done += int(written)
+			off += int64(written)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return off, nil
+		}
+		if err != nil {
+			return off, err
+		}
+	}
+}
+
+func (f *openFile) close() fuse.Status {
+	return f.file.Close(f.ctx, f.path)
+}
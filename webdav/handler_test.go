@@ -0,0 +1,225 @@
+package webdav
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+)
+
+type testClient struct {
+	t   *testing.T
+	srv *httptest.Server
+}
+
+func newTestClient(t *testing.T, dir string) *testClient {
+	srv := httptest.NewServer(NewHandler(pathfs.NewTestFileSystem(dir), &Options{Prefix: "/dav/"}))
+	t.Cleanup(srv.Close)
+	return &testClient{t: t, srv: srv}
+}
+
+// do makes a request and returns its status and body.
+func (c *testClient) do(method, p, body string, header ...string) (int, string, http.Header) {
+	c.t.Helper()
+	req, err := http.NewRequest(method, c.srv.URL+"/dav/"+p, strings.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp.StatusCode, string(data), resp.Header
+}
+
+func (c *testClient) expect(want int, method, p, body string, header ...string) string {
+	c.t.Helper()
+	status, data, _ := c.do(method, p, body, header...)
+	if status != want {
+		c.t.Fatalf("%s %s: %d, want %d: %s", method, p, status, want, data)
+	}
+	return data
+}
+
+func TestHandler(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestClient(t, dir)
+
+	c.expect(http.StatusCreated, "MKCOL", "d", "")
+	c.expect(http.StatusMethodNotAllowed, "MKCOL", "d", "")
+	c.expect(http.StatusConflict, "MKCOL", "x/y", "")
+	c.expect(http.StatusCreated, "PUT", "d/f.txt", "hello, webdav")
+	c.expect(http.StatusNoContent, "PUT", "d/f.txt", "hello, dav")
+	if got := c.expect(http.StatusOK, "GET", "d/f.txt", ""); got != "hello, dav" {
+		t.Fatalf("GET: %q", got)
+	}
+	if got := c.expect(http.StatusPartialContent, "GET", "d/f.txt", "", "Range", "bytes=7-"); got != "dav" {
+		t.Fatalf("GET range: %q", got)
+	}
+	c.expect(http.StatusNotFound, "GET", "missing", "")
+
+	ms := c.expect(http.StatusMultiStatus, "PROPFIND", "", "", "Depth", "1")
+	for _, want := range []string{"<D:href>/dav/d/</D:href>", "<D:collection/>"} {
+		if !strings.Contains(ms, want) {
+			t.Fatalf("PROPFIND: no %s in %s", want, ms)
+		}
+	}
+	if strings.Contains(ms, "f.txt") {
+		t.Fatalf("PROPFIND depth 1 listed a grandchild: %s", ms)
+	}
+	ms = c.expect(http.StatusMultiStatus, "PROPFIND", "d/f.txt", `<?xml version="1.0"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:getcontentlength/><D:nothing/></D:prop></D:propfind>`, "Depth", "0")
+	if !strings.Contains(ms, "<D:getcontentlength>10</D:getcontentlength>") || !strings.Contains(ms, "404 Not Found") {
+		t.Fatalf("PROPFIND prop: %s", ms)
+	}
+
+	// Dead properties are kept and copied.
+	c.expect(http.StatusMultiStatus, "PROPPATCH", "d/f.txt", `<?xml version="1.0"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:z"><D:set><D:prop><Z:color>red &amp; blue</Z:color></D:prop></D:set></D:propertyupdate>`)
+	ms = c.expect(http.StatusMultiStatus, "PROPPATCH", "d/f.txt", `<?xml version="1.0"?>
+<D:propertyupdate xmlns:D="DAV:"><D:set><D:prop><D:getetag>x</D:getetag></D:prop></D:set></D:propertyupdate>`)
+	if !strings.Contains(ms, "403 Forbidden") {
+		t.Fatalf("PROPPATCH of a live property: %s", ms)
+	}
+	c.expect(http.StatusCreated, "COPY", "d", "", "Destination", c.srv.URL+"/dav/e")
+	c.expect(http.StatusPreconditionFailed, "COPY", "d", "", "Destination", "/dav/e", "Overwrite", "F")
+	ms = c.expect(http.StatusMultiStatus, "PROPFIND", "e/f.txt", `<?xml version="1.0"?>
+<D:propfind xmlns:D="DAV:"><D:prop><color xmlns="urn:z"/></D:prop></D:propfind>`, "Depth", "0")
+	if !strings.Contains(ms, `<color xmlns="urn:z">red &amp; blue</color>`) {
+		t.Fatalf("PROPFIND of a dead property: %s", ms)
+	}
+
+	c.expect(http.StatusCreated, "MOVE", "e/f.txt", "", "Destination", "/dav/g.txt")
+	c.expect(http.StatusNoContent, "MOVE", "d/f.txt", "", "Destination", "/dav/g.txt")
+	if data, err := os.ReadFile(filepath.Join(dir, "g.txt")); err != nil || string(data) != "hello, dav" {
+		t.Fatalf("after MOVE: %q %v", data, err)
+	}
+	c.expect(http.StatusNoContent, "DELETE", "e", "")
+	c.expect(http.StatusNotFound, "DELETE", "e", "")
+	if _, err := os.Stat(filepath.Join(dir, "e")); !os.IsNotExist(err) {
+		t.Fatal("e survived DELETE")
+	}
+}
+
+func TestHandlerLock(t *testing.T) {
+	c := newTestClient(t, t.TempDir())
+	c.expect(http.StatusCreated, "MKCOL", "d", "")
+
+	lockinfo := `<?xml version="1.0"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype><D:owner>me</D:owner></D:lockinfo>`
+	status, body, header := c.do("LOCK", "d", lockinfo, "Timeout", "Second-60")
+	token := header.Get("Lock-Token")
+	if status != http.StatusOK || token == "" || !strings.Contains(body, "<D:owner>me</D:owner>") {
+		t.Fatalf("LOCK: %d %q %s", status, token, body)
+	}
+	c.expect(http.StatusLocked, "LOCK", "d/f", lockinfo)
+	c.expect(http.StatusLocked, "PUT", "d/f", "x")
+	c.expect(http.StatusLocked, "DELETE", "d", "")
+	c.expect(http.StatusCreated, "PUT", "d/f", "x", "If", "("+token+")")
+	c.expect(http.StatusOK, "LOCK", "d", "", "If", "("+token+")")
+	ms := c.expect(http.StatusMultiStatus, "PROPFIND", "d/f", `<?xml version="1.0"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:lockdiscovery/></D:prop></D:propfind>`, "Depth", "0")
+	if !strings.Contains(ms, token[1:len(token)-1]) {
+		t.Fatalf("lockdiscovery: %s", ms)
+	}
+
+	c.expect(http.StatusConflict, "UNLOCK", "", "", "Lock-Token", "<urn:uuid:nope>")
+	c.expect(http.StatusNoContent, "UNLOCK", "d/f", "", "Lock-Token", token)
+	c.expect(http.StatusNoContent, "PUT", "d/f", "y")
+
+	// Locking a missing resource creates it.
+	status, _, header = c.do("LOCK", "new", lockinfo, "Depth", "0")
+	if status != http.StatusCreated {
+		t.Fatalf("LOCK of a missing resource: %d", status)
+	}
+	c.expect(http.StatusOK, "GET", "new", "")
+	c.expect(http.StatusNoContent, "UNLOCK", "new", "", "Lock-Token", header.Get("Lock-Token"))
+}
+
+// failingRenameFS fails the renames of the paths fail reports.
+type failingRenameFS struct {
+	pathfs.FileSystem
+	fail func(path, newPath string) bool
+}
+
+func (f *failingRenameFS) Rename(ctx *pathfs.Context, path string, newPath string) fuse.Status {
+	if f.fail(path, newPath) {
+		return fuse.EIO
+	}
+	return f.FileSystem.Rename(ctx, path, newPath)
+}
+
+func TestHandlerFailedCopyMove(t *testing.T) {
+	dir := t.TempDir()
+	fs := &failingRenameFS{FileSystem: pathfs.NewTestFileSystem(dir)}
+	srv := httptest.NewServer(NewHandler(fs, &Options{Prefix: "/dav/"}))
+	t.Cleanup(srv.Close)
+	c := &testClient{t: t, srv: srv}
+
+	c.expect(http.StatusCreated, "PUT", "a", "new")
+	c.expect(http.StatusCreated, "PUT", "b", "old")
+	c.expect(http.StatusCreated, "MKCOL", "d", "")
+	c.expect(http.StatusCreated, "PUT", "d/f", "old")
+
+	fs.fail = func(path, newPath string) bool { return path == "a" }
+	c.expect(http.StatusInternalServerError, "MOVE", "a", "", "Destination", "/dav/b")
+	c.expect(http.StatusInternalServerError, "MOVE", "a", "", "Destination", "/dav/d")
+	fs.fail = func(path, newPath string) bool { return strings.HasPrefix(path, ".webdav-copy-") }
+	c.expect(http.StatusInternalServerError, "COPY", "a", "", "Destination", "/dav/b")
+	c.expect(http.StatusInternalServerError, "COPY", "a", "", "Destination", "/dav/d")
+
+	if data, err := os.ReadFile(filepath.Join(dir, "b")); err != nil || string(data) != "old" {
+		t.Errorf("b after failed MOVE and COPY: %q %v", data, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "d", "f")); err != nil || string(data) != "old" {
+		t.Errorf("d/f after failed MOVE and COPY: %q %v", data, err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Errorf("want a, b and d left, have %v", entries)
+	}
+
+	// and succeed over a directory.
+	fs.fail = func(path, newPath string) bool { return false }
+	c.expect(http.StatusNoContent, "COPY", "a", "", "Destination", "/dav/d")
+	if data, err := os.ReadFile(filepath.Join(dir, "d")); err != nil || string(data) != "new" {
+		t.Errorf("d after COPY: %q %v", data, err)
+	}
+	c.expect(http.StatusNoContent, "MOVE", "a", "", "Destination", "/dav/b")
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("want b and d left, have %v", entries)
+	}
+}
+
+func TestHandlerTempNames(t *testing.T) {
+	dir := t.TempDir()
+	h := NewHandler(pathfs.NewTestFileSystem(dir), nil)
+	other := NewHandler(pathfs.NewTestFileSystem(dir), nil)
+	if h.tempID == other.tempID {
+		t.Errorf("want distinct temporary names, have %q twice", h.tempID)
+	}
+
+	// a leftover of an earlier Handler is skipped.
+	h.tempID = "x"
+	if err := os.WriteFile(filepath.Join(dir, ".webdav-copy-x-1-f"), []byte("left"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := &pathfs.Context{}
+	if name := h.tempName(ctx, "f", "copy"); name != ".webdav-copy-x-2-f" {
+		t.Errorf("want the leftover skipped, have %q", name)
+	}
+}
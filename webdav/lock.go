@@ -0,0 +1,325 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdav
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+)
+
+const (
+	defaultLockTimeout = time.Hour
+	maxLockTimeout     = 24 * time.Hour
+)
+
+// lock is a write lock.
+type lock struct {
+	token   string
+	root    string
+	depth0  bool
+	shared  bool
+	owner   string // XML
+	timeout time.Duration
+	expires time.Time
+}
+
+// covers reports whether l applies to p.
+func (l *lock) covers(p string) bool {
+	if l.depth0 {
+		return p == l.root
+	}
+	return within(p, l.root)
+}
+
+// within reports whether p is root or below it.
+func within(p, root string) bool {
+	return root == "" || p == root || strings.HasPrefix(p, root+"/")
+}
+
+// lockTable is the locks of a Handler, by token.
+type lockTable struct {
+	mu    sync.Mutex
+	locks map[string]*lock
+}
+
+func (t *lockTable) init() {
+	t.locks = make(map[string]*lock)
+}
+
+// purge drops expired locks. t.mu must be held.
+func (t *lockTable) purge() {
+	now := time.Now()
+	for token, l := range t.locks {
+		if now.After(l.expires) {
+			delete(t.locks, token)
+		}
+	}
+}
+
+// covering returns the locks that apply to p.
+func (t *lockTable) covering(p string) []*lock {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.purge()
+	var ls []*lock
+	for _, l := range t.locks {
+		if l.covers(p) {
+			c := *l
+			ls = append(ls, &c)
+		}
+	}
+	return ls
+}
+
+// check reports whether p, and what is below it if recursive, may be
+// modified by a request that submitted tokens.
+func (t *lockTable) check(p string, recursive bool, tokens map[string]bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.purge()
+	for _, l := range t.locks {
+		if (l.covers(p) || recursive && within(l.root, p)) && !tokens[l.token] {
+			return false
+		}
+	}
+	return true
+}
+
+// create adds a lock, unless it conflicts with another.
+func (t *lockTable) create(l *lock) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.purge()
+	for _, o := range t.locks {
+		overlap := o.covers(l.root) || !l.depth0 && within(o.root, l.root)
+		if overlap && !(l.shared && o.shared) {
+			return false
+		}
+	}
+	l.expires = time.Now().Add(l.timeout)
+	t.locks[l.token] = l
+	return true
+}
+
+// refresh renews the lock on p with one of tokens.
+func (t *lockTable) refresh(p string, tokens map[string]bool, timeout time.Duration) *lock {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.purge()
+	for token := range tokens {
+		if l, ok := t.locks[token]; ok && l.covers(p) {
+			l.timeout = timeout
+			l.expires = time.Now().Add(timeout)
+			c := *l
+			return &c
+		}
+	}
+	return nil
+}
+
+// unlock drops the lock with token, if it applies to p.
+func (t *lockTable) unlock(token, p string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.purge()
+	l, ok := t.locks[token]
+	if !ok || !l.covers(p) {
+		return false
+	}
+	delete(t.locks, token)
+	return true
+}
+
+// remove drops the locks on p and below it, which is gone.
+func (t *lockTable) remove(p string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for token, l := range t.locks {
+		if within(l.root, p) {
+			delete(t.locks, token)
+		}
+	}
+}
+
+func newLockToken() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:]), nil
+}
+
+// ifTokens returns the state tokens in the If header of r. Resource
+// tags are returned too, but match no lock.
+func ifTokens(r *http.Request) map[string]bool {
+	tokens := map[string]bool{}
+	s := r.Header.Get("If")
+	for {
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			return tokens
+		}
+		j := strings.IndexByte(s[i:], '>')
+		if j < 0 {
+			return tokens
+		}
+		tokens[s[i+1:i+j]] = true
+		s = s[i+j+1:]
+	}
+}
+
+// checkLocks returns 423 if a lock the request did not submit applies
+// to p, or to what is below it if recursive, and 0 otherwise.
+func (h *Handler) checkLocks(r *http.Request, p string, recursive bool) int {
+	if !h.locks.check(p, recursive, ifTokens(r)) {
+		return http.StatusLocked
+	}
+	return 0
+}
+
+// parseTimeout parses a Timeout header.
+func parseTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultLockTimeout, nil
+	}
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if t == "Infinite" {
+			return maxLockTimeout, nil
+		}
+		if !strings.HasPrefix(t, "Second-") {
+			continue
+		}
+		n, err := strconv.ParseUint(t[len("Second-"):], 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("webdav: bad timeout %q", s)
+		}
+		if d := time.Duration(n) * time.Second; d < maxLockTimeout {
+			return d, nil
+		}
+		return maxLockTimeout, nil
+	}
+	return defaultLockTimeout, nil
+}
+
+type lockInfo struct {
+	XMLName   xml.Name  `xml:"DAV: lockinfo"`
+	Exclusive *struct{} `xml:"DAV: lockscope>exclusive"`
+	Shared    *struct{} `xml:"DAV: lockscope>shared"`
+	Write     *struct{} `xml:"DAV: locktype>write"`
+	Owner     struct {
+		Inner string `xml:",innerxml"`
+	} `xml:"DAV: owner"`
+}
+
+func (h *Handler) writeActiveLock(w io.Writer, l *lock) {
+	scope, depth := "exclusive", "infinity"
+	if l.shared {
+		scope = "shared"
+	}
+	if l.depth0 {
+		depth = "0"
+	}
+	fmt.Fprintf(w, "<D:activelock><D:locktype><D:write/></D:locktype><D:lockscope><D:%s/></D:lockscope><D:depth>%s</D:depth>", scope, depth)
+	if l.owner != "" {
+		fmt.Fprintf(w, "<D:owner>%s</D:owner>", l.owner)
+	}
+	fmt.Fprintf(w, "<D:timeout>Second-%d</D:timeout><D:locktoken><D:href>%s</D:href></D:locktoken><D:lockroot><D:href>%s</D:href></D:lockroot></D:activelock>",
+		int64(l.timeout/time.Second), escapeXML(l.token), escapeXML(h.href(l.root, false)))
+}
+
+func (h *Handler) handleLock(ctx *pathfs.Context, w http.ResponseWriter, r *http.Request, p string) (int, error) {
+	timeout, err := parseTimeout(r.Header.Get("Timeout"))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	var l *lock
+	status := http.StatusOK
+	if len(bytes.TrimSpace(body)) == 0 {
+		if l = h.locks.refresh(p, ifTokens(r), timeout); l == nil {
+			return http.StatusPreconditionFailed, nil
+		}
+	} else {
+		var li lockInfo
+		if err := xml.Unmarshal(body, &li); err != nil {
+			return http.StatusBadRequest, err
+		}
+		if li.Write == nil || (li.Exclusive == nil) == (li.Shared == nil) {
+			return http.StatusBadRequest, nil
+		}
+		l = &lock{root: p, shared: li.Shared != nil, owner: li.Owner.Inner, timeout: timeout}
+		switch r.Header.Get("Depth") {
+		case "", "infinity":
+		case "0":
+			l.depth0 = true
+		default:
+			return http.StatusBadRequest, nil
+		}
+		if l.token, err = newLockToken(); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if !h.locks.create(l) {
+			return http.StatusLocked, nil
+		}
+
+		// Locking an unmapped URL creates an empty resource.
+		var attr fuse.Attr
+		code := h.fs.GetAttr(ctx, p, 0, &attr)
+		if code == fuse.ENOENT {
+			var f *openFile
+			if f, code = h.create(ctx, p, syscall.O_WRONLY, 0644); code.Ok() {
+				code = f.close()
+				status = http.StatusCreated
+			} else if code == fuse.ENOENT || code == fuse.Status(syscall.ENOTDIR) {
+				h.locks.unlock(l.token, p)
+				return http.StatusConflict, nil
+			}
+		}
+		if !code.Ok() {
+			h.locks.unlock(l.token, p)
+			return httpStatus(code), statusError(code)
+		}
+		w.Header().Set("Lock-Token", "<"+l.token+">")
+	}
+
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n" + `<D:prop xmlns:D="DAV:"><D:lockdiscovery>`)
+	h.writeActiveLock(&b, l)
+	b.WriteString("</D:lockdiscovery></D:prop>\n")
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b.Bytes())
+	return 0, nil
+}
+
+func (h *Handler) handleUnlock(ctx *pathfs.Context, w http.ResponseWriter, r *http.Request, p string) (int, error) {
+	token := strings.TrimSpace(r.Header.Get("Lock-Token"))
+	if len(token) < 2 || token[0] != '<' || token[len(token)-1] != '>' {
+		return http.StatusBadRequest, nil
+	}
+	if !h.locks.unlock(token[1:len(token)-1], p) {
+		return http.StatusConflict, nil
+	}
+	return http.StatusNoContent, nil
+}
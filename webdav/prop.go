@@ -0,0 +1,440 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/someonegg/pathfs"
+)
+
+const davNS = "DAV:"
+
+// xattrPrefix is the prefix of the xattrs that hold dead properties.
+const xattrPrefix = "user.webdav."
+
+// liveProps are the properties computed from attrs, in the order of
+// an allprop.
+var liveProps = []string{
+	"resourcetype",
+	"displayname",
+	"getcontentlength",
+	"getcontenttype",
+	"getetag",
+	"getlastmodified",
+	"creationdate",
+	"supportedlock",
+	"lockdiscovery",
+}
+
+func isLiveProp(name xml.Name) bool {
+	if name.Space != davNS {
+		return false
+	}
+	for _, p := range liveProps {
+		if p == name.Local {
+			return true
+		}
+	}
+	return false
+}
+
+// xattrName returns the xattr of a dead property.
+func xattrName(name xml.Name) string {
+	return xattrPrefix + "{" + name.Space + "}" + name.Local
+}
+
+// propName parses the name of a dead property from its xattr.
+func propName(attr string) (xml.Name, bool) {
+	if !strings.HasPrefix(attr, xattrPrefix+"{") {
+		return xml.Name{}, false
+	}
+	rest := attr[len(xattrPrefix)+1:]
+	i := strings.IndexByte(rest, '}')
+	if i < 0 || i == len(rest)-1 {
+		return xml.Name{}, false
+	}
+	return xml.Name{Space: rest[:i], Local: rest[i+1:]}, true
+}
+
+func escapeXML(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// prop is a property of a PROPFIND response.
+type prop struct {
+	name  xml.Name
+	inner string // XML
+}
+
+// writeProp writes a property element, declaring its namespace.
+func writeProp(w io.Writer, p prop) {
+	open, closing := "D:"+p.name.Local, "D:"+p.name.Local
+	if p.name.Space != davNS {
+		open = fmt.Sprintf(`%s xmlns="%s"`, p.name.Local, escapeXML(p.name.Space))
+		closing = p.name.Local
+	}
+	if p.inner == "" {
+		fmt.Fprintf(w, "<%s/>", open)
+	} else {
+		fmt.Fprintf(w, "<%s>%s</%s>", open, p.inner, closing)
+	}
+}
+
+// liveProp returns the inner XML of a live property of p, if it has
+// one.
+func (h *Handler) liveProp(p string, attr *fuse.Attr, name string) (string, bool) {
+	dir := attr.IsDir()
+	switch name {
+	case "resourcetype":
+		if dir {
+			return "<D:collection/>", true
+		}
+		return "", true
+	case "displayname":
+		if p == "" {
+			return "", false
+		}
+		return escapeXML(path.Base(p)), true
+	case "getcontentlength":
+		if dir {
+			return "", false
+		}
+		return fmt.Sprint(attr.Size), true
+	case "getcontenttype":
+		if dir {
+			return "", false
+		}
+		ct := mime.TypeByExtension(path.Ext(p))
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		return escapeXML(ct), true
+	case "getetag":
+		if dir {
+			return "", false
+		}
+		return escapeXML(etag(attr)), true
+	case "getlastmodified":
+		return modTime(attr).UTC().Format(http.TimeFormat), true
+	case "creationdate":
+		return time.Unix(int64(attr.Ctime), int64(attr.Ctimensec)).UTC().Format(time.RFC3339), true
+	case "supportedlock":
+		return "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>" +
+			"<D:lockentry><D:lockscope><D:shared/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>", true
+	case "lockdiscovery":
+		var b strings.Builder
+		for _, l := range h.locks.covering(p) {
+			h.writeActiveLock(&b, l)
+		}
+		return b.String(), true
+	}
+	return "", false
+}
+
+// deadProps returns the names of the dead properties of p.
+func (h *Handler) deadProps(ctx *pathfs.Context, p string) []xml.Name {
+	attrs, code := h.fs.ListXAttr(ctx, p)
+	if !code.Ok() {
+		return nil
+	}
+	var names []xml.Name
+	for _, a := range attrs {
+		if name, ok := propName(a); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return xattrName(names[i]) < xattrName(names[j])
+	})
+	return names
+}
+
+// propNames is the list of names in a DAV:prop element.
+type propNames []xml.Name
+
+func (pn *propNames) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			*pn = append(*pn, t.Name)
+			if err := d.Skip(); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+type propfind struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	AllProp  *struct{} `xml:"DAV: allprop"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     propNames `xml:"DAV: prop"`
+}
+
+func (h *Handler) handlePropfind(ctx *pathfs.Context, w http.ResponseWriter, r *http.Request, p string) (int, error) {
+	var pf propfind
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		pf.AllProp = &struct{}{}
+	} else if err := xml.Unmarshal(body, &pf); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	depth := r.Header.Get("Depth")
+	if depth != "0" && depth != "1" && depth != "infinity" && depth != "" {
+		return http.StatusBadRequest, nil
+	}
+	var attr fuse.Attr
+	if code := h.fs.GetAttr(ctx, p, 0, &attr); !code.Ok() {
+		return httpStatus(code), nil
+	}
+
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n" + `<D:multistatus xmlns:D="DAV:">`)
+	var walk func(p string, attr *fuse.Attr, level int)
+	walk = func(p string, attr *fuse.Attr, level int) {
+		h.writePropfindResponse(ctx, &b, &pf, p, attr)
+		if !attr.IsDir() || depth == "0" || depth == "1" && level == 1 {
+			return
+		}
+		entries, code := h.fs.Lsdir(ctx, p)
+		if !code.Ok() {
+			return
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+		for _, e := range entries {
+			if e.Name == "." || e.Name == ".." {
+				continue
+			}
+			child := childPath(p, e.Name)
+			var cattr fuse.Attr
+			if h.fs.GetAttr(ctx, child, 0, &cattr).Ok() {
+				walk(child, &cattr, level+1)
+			}
+		}
+	}
+	walk(p, &attr, 0)
+	b.WriteString("</D:multistatus>\n")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write(b.Bytes())
+	return 0, nil
+}
+
+func (h *Handler) writePropfindResponse(ctx *pathfs.Context, b *bytes.Buffer, pf *propfind, p string, attr *fuse.Attr) {
+	var found, missing []prop
+	switch {
+	case pf.PropName != nil:
+		for _, name := range liveProps {
+			if _, ok := h.liveProp(p, attr, name); ok {
+				found = append(found, prop{name: xml.Name{Space: davNS, Local: name}})
+			}
+		}
+		for _, name := range h.deadProps(ctx, p) {
+			found = append(found, prop{name: name})
+		}
+	case pf.AllProp != nil:
+		for _, name := range liveProps {
+			if inner, ok := h.liveProp(p, attr, name); ok {
+				found = append(found, prop{name: xml.Name{Space: davNS, Local: name}, inner: inner})
+			}
+		}
+		for _, name := range h.deadProps(ctx, p) {
+			if data, code := h.fs.GetXAttr(ctx, p, xattrName(name)); code.Ok() {
+				found = append(found, prop{name: name, inner: string(data)})
+			}
+		}
+	default:
+		for _, name := range pf.Prop {
+			if isLiveProp(name) {
+				if inner, ok := h.liveProp(p, attr, name.Local); ok {
+					found = append(found, prop{name: name, inner: inner})
+					continue
+				}
+			} else if data, code := h.fs.GetXAttr(ctx, p, xattrName(name)); code.Ok() {
+				found = append(found, prop{name: name, inner: string(data)})
+				continue
+			}
+			missing = append(missing, prop{name: name})
+		}
+	}
+
+	fmt.Fprintf(b, "<D:response><D:href>%s</D:href>", escapeXML(h.href(p, attr.IsDir())))
+	writePropstat(b, found, http.StatusOK)
+	writePropstat(b, missing, http.StatusNotFound)
+	b.WriteString("</D:response>")
+}
+
+func writePropstat(b *bytes.Buffer, props []prop, status int) {
+	if len(props) == 0 {
+		return
+	}
+	b.WriteString("<D:propstat><D:prop>")
+	for _, p := range props {
+		writeProp(b, p)
+	}
+	fmt.Fprintf(b, "</D:prop><D:status>HTTP/1.1 %d %s</D:status></D:propstat>", status, http.StatusText(status))
+}
+
+// propUpdate is a set or remove of a PROPPATCH.
+type propUpdate struct {
+	remove bool
+	name   xml.Name
+	inner  []byte
+}
+
+// parsePropertyUpdate parses a DAV:propertyupdate, keeping the order
+// of its instructions.
+func parsePropertyUpdate(r io.Reader) ([]propUpdate, error) {
+	d := xml.NewDecoder(r)
+	var updates []propUpdate
+	var remove, inProp bool
+	depth := 0
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			if depth != 0 || updates == nil {
+				return nil, fmt.Errorf("webdav: bad propertyupdate")
+			}
+			return updates, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			switch {
+			case depth == 0 && t.Name == xml.Name{Space: davNS, Local: "propertyupdate"}:
+			case depth == 1 && t.Name.Space == davNS && (t.Name.Local == "set" || t.Name.Local == "remove"):
+				remove = t.Name.Local == "remove"
+			case depth == 2 && t.Name == xml.Name{Space: davNS, Local: "prop"}:
+				inProp = true
+			case depth == 3 && inProp:
+				var v struct {
+					Inner []byte `xml:",innerxml"`
+				}
+				if err := d.DecodeElement(&v, &t); err != nil {
+					return nil, err
+				}
+				updates = append(updates, propUpdate{remove: remove, name: t.Name, inner: v.Inner})
+				continue
+			default:
+				return nil, fmt.Errorf("webdav: unexpected %s in propertyupdate", t.Name.Local)
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+			if depth == 2 {
+				inProp = false
+			}
+		}
+	}
+}
+
+func (h *Handler) handleProppatch(ctx *pathfs.Context, w http.ResponseWriter, r *http.Request, p string) (int, error) {
+	if status := h.checkLocks(r, p, false); status != 0 {
+		return status, nil
+	}
+	var attr fuse.Attr
+	if code := h.fs.GetAttr(ctx, p, 0, &attr); !code.Ok() {
+		return httpStatus(code), nil
+	}
+	updates, err := parsePropertyUpdate(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	// Live properties are protected; then nothing is done.
+	statuses := make([]int, len(updates))
+	failed := false
+	for i, u := range updates {
+		if isLiveProp(u.name) {
+			statuses[i] = http.StatusForbidden
+			failed = true
+		}
+	}
+	for i, u := range updates {
+		switch {
+		case failed:
+			if statuses[i] == 0 {
+				statuses[i] = http.StatusFailedDependency
+			}
+			continue
+		case u.remove:
+			code := h.fs.RemoveXAttr(ctx, p, xattrName(u.name))
+			if code == fuse.ENOATTR {
+				code = fuse.OK
+			}
+			statuses[i] = httpStatus(code)
+		default:
+			statuses[i] = httpStatus(h.fs.SetXAttr(ctx, p, xattrName(u.name), u.inner, 0))
+		}
+		if statuses[i] != http.StatusOK {
+			failed = true
+		}
+	}
+
+	byStatus := map[int][]prop{}
+	var order []int
+	for i, u := range updates {
+		if byStatus[statuses[i]] == nil {
+			order = append(order, statuses[i])
+		}
+		byStatus[statuses[i]] = append(byStatus[statuses[i]], prop{name: u.name})
+	}
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n" + `<D:multistatus xmlns:D="DAV:">`)
+	fmt.Fprintf(&b, "<D:response><D:href>%s</D:href>", escapeXML(h.href(p, attr.IsDir())))
+	for _, status := range order {
+		writePropstat(&b, byStatus[status], status)
+	}
+	b.WriteString("</D:response></D:multistatus>\n")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write(b.Bytes())
+	return 0, nil
+}
+
+// copyProps copies the dead properties of src to dst.
+func (h *Handler) copyProps(ctx *pathfs.Context, src, dst string) fuse.Status {
+	for _, name := range h.deadProps(ctx, src) {
+		data, code := h.fs.GetXAttr(ctx, src, xattrName(name))
+		if code == fuse.ENOATTR {
+			continue
+		}
+		if code.Ok() {
+			code = h.fs.SetXAttr(ctx, dst, xattrName(name), data, 0)
+		}
+		if !code.Ok() && code != fuse.Status(syscall.ENOTSUP) {
+			return code
+		}
+	}
+	return fuse.OK
+}
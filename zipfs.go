@@ -0,0 +1,64 @@
+// Copyright 2022 someonegg. All rights reserscoreed.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathfs
+
+import (
+	"archive/zip"
+	"io"
+	"io/fs"
+)
+
+// maxArchiveSymlink bounds the targets of symlinks read from an
+// archive's content.
+const maxArchiveSymlink = 4096
+
+// NewZipFileSystem returns a read-only FileSystem serving the zip
+// archive in r, of size bytes, indexed once from its central
+// directory. Inode numbers follow the order of the members. Stored
+// members are read at their offsets in r; compressed ones are
+// decompressed from their start by each open file, which a backward
+// Read restarts.
+func NewZipFileSystem(r io.ReaderAt, size int64) (FileSystem, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	x := newArchiveIndex()
+	for _, f := range zr.File {
+		p, ok := archivePath(f.Name)
+		if !ok {
+			continue
+		}
+		fi := f.FileInfo()
+		e := &archiveEntry{}
+		e.attr.Mode = unixMode(fi.Mode())
+		setArchiveTimes(&e.attr, f.Modified, f.Modified, f.Modified)
+		switch {
+		case fi.Mode()&fs.ModeSymlink != 0:
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			target, err := io.ReadAll(io.LimitReader(rc, maxArchiveSymlink))
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			e.target = string(target)
+			e.attr.Size = uint64(len(target))
+		case fi.Mode().IsRegular():
+			e.attr.Size = f.UncompressedSize64
+			if f.Method == zip.Store {
+				if e.off, err = f.DataOffset(); err != nil {
+					return nil, err
+				}
+			} else {
+				e.open = f.Open
+			}
+		}
+		x.add(p, e)
+	}
+	return x.fileSystem(r, nil), nil
+}